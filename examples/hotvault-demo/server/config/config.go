@@ -2,19 +2,34 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 )
 
 type Config struct {
-	Server       ServerConfig
-	Database     DatabaseConfig
-	JWT          JWTConfig
-	Ethereum     EthereumConfig
-	PdptoolPath  string
-	ServiceName  string
-	ServiceURL   string
-	RecordKeeper string
+	Server            ServerConfig
+	Database          DatabaseConfig
+	JWT               JWTConfig
+	Ethereum          EthereumConfig
+	PdptoolPath       string
+	PDPClient         string
+	ServiceSecretPath string
+	ServiceSecret     ServiceSecretConfig
+	AdminToken        string
+	ServiceName       string
+	ServiceURL        string
+	RecordKeeper      string
+	ProviderPolicy    string
+	ReplicationFactor int
+	DedupAcrossUsers  bool
+	Uploads           UploadConfig
+	Aggregation       AggregationConfig
+	Segments          SegmentConfig
+	Encryption        EncryptionConfig
+	Quota             QuotaConfig
+	Webhooks          WebhookConfig
+	RootReconcile     RootReconcileConfig
 }
 
 type ServerConfig struct {
@@ -36,6 +51,101 @@ type JWTConfig struct {
 	Expiration time.Duration
 }
 
+// ServiceSecretConfig controls the encrypted keystore holding the PDP
+// service key. The keystore is protected by Passphrase when set, otherwise
+// by a random key kept in KeyFile, outside the keystore's directory.
+// ExportPlaintext writes the active key to a plaintext pdpservice.json for
+// pdptool, which cannot read the keystore.
+type ServiceSecretConfig struct {
+	StorePath       string
+	Passphrase      string
+	KeyFile         string
+	ExportPlaintext bool
+}
+
+// UploadConfig controls the upload job queue. Payloads of queued uploads
+// are kept under Dir until their job finishes. Workers bounds the jobs
+// processed at once; the stage limits bound how many of those run a stage
+// concurrently. New uploads are rejected once QueueLimit jobs are waiting.
+// Chunks of chunked upload sessions are kept under ChunkDir so sessions can
+// be resumed after a restart. Roots of concurrent uploads to a proof set are
+// added in one call once AddRootsBatchSize are waiting or AddRootsBatchWindow
+// after the first.
+type UploadConfig struct {
+	Dir                 string
+	ChunkDir            string
+	Workers             int
+	MaxAttempts         int
+	QueueLimit          int
+	PrepareConcurrency  int
+	TransferConcurrency int
+	AddRootsConcurrency int
+	AddRootsBatchSize   int
+	AddRootsBatchWindow time.Duration
+	// AllowUnverifiedChunks accepts chunked uploads without a SHA-256 of
+	// the file and its chunks, for clients that cannot compute them.
+	AllowUnverifiedChunks bool
+}
+
+// AggregationConfig controls packing of small files into one piece. Files
+// smaller than Threshold wait to be packed with other files of the same
+// user; an aggregate is stored once it holds MaxFiles files or MaxSize
+// bytes, or Window after its oldest file arrived. A zero Threshold disables
+// aggregation.
+type AggregationConfig struct {
+	Threshold int64
+	MaxSize   int64
+	MaxFiles  int
+	Window    time.Duration
+}
+
+// SegmentConfig controls splitting of large files. Files larger than
+// Threshold are split into segments of Size bytes, each stored as a piece
+// of its own. A zero Threshold disables segmentation.
+type SegmentConfig struct {
+	Threshold int64
+	Size      int64
+}
+
+// EncryptionConfig controls encryption of uploads before they are sent to
+// a provider. Each file is encrypted with a data key of its own, wrapped by
+// a key of its owner, which in turn is wrapped by MasterKey, a hex-encoded
+// 32-byte key. Enabled is the default for users without an override.
+type EncryptionConfig struct {
+	Enabled   bool
+	MasterKey string
+}
+
+// QuotaConfig is the default storage quota of a user, counting every
+// replica of every stored piece. Zero means unlimited.
+type QuotaConfig struct {
+	Bytes  int64
+	Pieces int64
+}
+
+// WebhookConfig controls delivery of webhook events. Workers deliver
+// events concurrently, each attempt bounded by Timeout. A failed delivery
+// is retried up to MaxAttempts attempts in all, waiting Backoff after the
+// first failure and twice as long after each further one. Webhooks may
+// only target private and loopback addresses when AllowPrivate is set.
+type WebhookConfig struct {
+	Workers      int
+	MaxAttempts  int
+	Backoff      time.Duration
+	Timeout      time.Duration
+	AllowPrivate bool
+}
+
+// RootReconcileConfig controls the lookup of root IDs that were not
+// confirmed when a piece was stored. Every Interval the roots of the proof
+// sets holding such pieces are fetched and matched by CID. A piece whose
+// root has not appeared MissingAfter after it was stored is flagged as
+// missing.
+type RootReconcileConfig struct {
+	Interval     time.Duration
+	MissingAfter time.Duration
+}
+
 type EthereumConfig struct {
 	RPCURL          string
 	ChainID         int64
@@ -54,6 +164,42 @@ func LoadConfig() *Config {
 		chainID = 1
 	}
 
+	pdpClient := os.Getenv("PDP_CLIENT")
+	if pdpClient == "" {
+		pdpClient = "pdptool"
+	}
+
+	providerPolicy := os.Getenv("STORAGE_PROVIDER_POLICY")
+	if providerPolicy == "" {
+		providerPolicy = "default"
+	}
+
+	replicationFactor, err := strconv.Atoi(os.Getenv("REPLICATION_FACTOR"))
+	if err != nil || replicationFactor < 1 {
+		replicationFactor = 1
+	}
+
+	dedupAcrossUsers, _ := strconv.ParseBool(os.Getenv("DEDUP_ACROSS_USERS"))
+	encryptUploads, _ := strconv.ParseBool(os.Getenv("ENCRYPT_UPLOADS"))
+	webhookAllowPrivate, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE_URLS"))
+	exportSecret, _ := strconv.ParseBool(os.Getenv("PDP_SECRET_EXPORT_PLAINTEXT"))
+	allowUnverifiedChunks, _ := strconv.ParseBool(os.Getenv("ALLOW_UNVERIFIED_CHUNKS"))
+
+	uploadDir := os.Getenv("UPLOAD_DIR")
+	if uploadDir == "" {
+		uploadDir = filepath.Join(os.TempDir(), "hotvault-uploads")
+	}
+
+	segmentSize := envInt64("SEGMENT_SIZE", 1<<30)
+	if segmentSize == 0 {
+		segmentSize = 1 << 30
+	}
+
+	chunkDir := os.Getenv("CHUNKED_UPLOAD_DIR")
+	if chunkDir == "" {
+		chunkDir = filepath.Join(uploadDir, "chunked")
+	}
+
 	return &Config{
 		Server: ServerConfig{
 			Port: os.Getenv("PORT"),
@@ -76,9 +222,93 @@ func LoadConfig() *Config {
 			ChainID:         chainID,
 			ContractAddress: os.Getenv("CONTRACT_ADDRESS"),
 		},
-		PdptoolPath:  os.Getenv("PDPTOOL_PATH"),
-		ServiceName:  os.Getenv("SERVICE_NAME"),
-		ServiceURL:   os.Getenv("SERVICE_URL"),
-		RecordKeeper: os.Getenv("RECORD_KEEPER"),
+		PdptoolPath:       os.Getenv("PDPTOOL_PATH"),
+		PDPClient:         pdpClient,
+		ServiceSecretPath: os.Getenv("PDP_SERVICE_SECRET_PATH"),
+		ServiceSecret: ServiceSecretConfig{
+			StorePath:       os.Getenv("PDP_SECRET_STORE_PATH"),
+			Passphrase:      os.Getenv("PDP_SECRET_PASSPHRASE"),
+			KeyFile:         os.Getenv("PDP_SECRET_KEYFILE"),
+			ExportPlaintext: exportSecret,
+		},
+		AdminToken:        os.Getenv("ADMIN_API_TOKEN"),
+		ServiceName:       os.Getenv("SERVICE_NAME"),
+		ServiceURL:        os.Getenv("SERVICE_URL"),
+		RecordKeeper:      os.Getenv("RECORD_KEEPER"),
+		ProviderPolicy:    providerPolicy,
+		ReplicationFactor: replicationFactor,
+		DedupAcrossUsers:  dedupAcrossUsers,
+		Uploads: UploadConfig{
+			Dir:                   uploadDir,
+			ChunkDir:              chunkDir,
+			Workers:               envInt("UPLOAD_WORKERS", 4),
+			MaxAttempts:           envInt("UPLOAD_JOB_MAX_ATTEMPTS", 3),
+			QueueLimit:            envInt("UPLOAD_QUEUE_LIMIT", 100),
+			PrepareConcurrency:    envInt("UPLOAD_PREPARE_CONCURRENCY", 2),
+			TransferConcurrency:   envInt("UPLOAD_TRANSFER_CONCURRENCY", 2),
+			AddRootsConcurrency:   envInt("UPLOAD_ADD_ROOTS_CONCURRENCY", 4),
+			AddRootsBatchSize:     envInt("UPLOAD_ADD_ROOTS_BATCH_SIZE", 10),
+			AddRootsBatchWindow:   envDuration("UPLOAD_ADD_ROOTS_BATCH_WINDOW", 10*time.Second),
+			AllowUnverifiedChunks: allowUnverifiedChunks,
+		},
+		Aggregation: AggregationConfig{
+			Threshold: envInt64("AGGREGATE_THRESHOLD", 0),
+			MaxSize:   envInt64("AGGREGATE_MAX_SIZE", 64<<20),
+			MaxFiles:  envInt("AGGREGATE_MAX_FILES", 100),
+			Window:    envDuration("AGGREGATE_WINDOW", 30*time.Second),
+		},
+		Segments: SegmentConfig{
+			Threshold: envInt64("SEGMENT_THRESHOLD", 0),
+			Size:      segmentSize,
+		},
+		Encryption: EncryptionConfig{
+			Enabled:   encryptUploads,
+			MasterKey: os.Getenv("ENCRYPTION_MASTER_KEY"),
+		},
+		Quota: QuotaConfig{
+			Bytes:  envInt64("DEFAULT_QUOTA_BYTES", 0),
+			Pieces: envInt64("DEFAULT_QUOTA_PIECES", 0),
+		},
+		Webhooks: WebhookConfig{
+			Workers:      envInt("WEBHOOK_WORKERS", 2),
+			MaxAttempts:  envInt("WEBHOOK_MAX_ATTEMPTS", 8),
+			Backoff:      envDuration("WEBHOOK_BACKOFF", 30*time.Second),
+			Timeout:      envDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+			AllowPrivate: webhookAllowPrivate,
+		},
+		RootReconcile: RootReconcileConfig{
+			Interval:     envDuration("ROOT_RECONCILE_INTERVAL", 5*time.Minute),
+			MissingAfter: envDuration("ROOT_MISSING_AFTER", 24*time.Hour),
+		},
+	}
+}
+
+// envInt reads a positive integer from the environment, returning def when
+// the variable is unset or invalid.
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 1 {
+		return def
+	}
+	return value
+}
+
+// envInt64 reads a non-negative 64-bit integer from the environment,
+// returning def when the variable is unset or invalid.
+func envInt64(name string, def int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+// envDuration reads a positive duration such as "10s" from the environment,
+// returning def when the variable is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return def
 	}
+	return value
 }
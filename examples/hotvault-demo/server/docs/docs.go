@@ -800,12 +800,6 @@ const docTemplate = `{
                 },
                 "rootId": {
                     "type": "string"
-                },
-                "serviceName": {
-                    "type": "string"
-                },
-                "serviceUrl": {
-                    "type": "string"
                 }
             }
         },
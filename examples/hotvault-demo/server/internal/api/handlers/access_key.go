@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	accessKeyIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	secretKeyAlphabet   = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+type CreateAccessKeyRequest struct {
+	Description string `json:"description"`
+}
+
+// CreateAccessKeyResponse is the only response carrying the secret key.
+type CreateAccessKeyResponse struct {
+	models.AccessKey
+	SecretAccessKey string `json:"secretAccessKey"`
+}
+
+// randomString returns n characters drawn uniformly from alphabet.
+func randomString(alphabet string, n int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	out := make([]byte, n)
+	for i := range out {
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		out[i] = alphabet[index.Int64()]
+	}
+	return string(out), nil
+}
+
+// CreateAccessKey creates an S3 access key for the authenticated user
+// @Summary Create S3 access key
+// @Description Create an access key pair for the S3 gateway at /s3. The secret key is only returned in this response.
+// @Tags s3
+// @Accept json
+// @Produce json
+// @Param request body CreateAccessKeyRequest false "Key description"
+// @Success 201 {object} CreateAccessKeyResponse
+// @Router /api/v1/access-keys [post]
+func CreateAccessKey(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	var request CreateAccessKeyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	key, err := newAccessKey(userID.(uint), request.Description)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Failed to create access key")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create access key",
+		})
+		return
+	}
+
+	log.WithField("userID", key.UserID).WithField("accessKeyId", key.AccessKeyID).Info("Created S3 access key")
+	c.JSON(http.StatusCreated, CreateAccessKeyResponse{AccessKey: *key, SecretAccessKey: key.SecretAccessKey})
+}
+
+// newAccessKey generates and saves an access key pair for a user.
+func newAccessKey(userID uint, description string) (*models.AccessKey, error) {
+	suffix, err := randomString(accessKeyIDAlphabet, 18)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(secretKeyAlphabet, 40)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &models.AccessKey{
+		UserID:          userID,
+		AccessKeyID:     "HV" + suffix,
+		SecretAccessKey: secret,
+		Description:     description,
+	}
+	if err := db.Create(key).Error; err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListAccessKeys lists the S3 access keys of the authenticated user
+// @Summary List S3 access keys
+// @Tags s3
+// @Produce json
+// @Success 200 {array} models.AccessKey
+// @Router /api/v1/access-keys [get]
+func ListAccessKeys(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	var keys []models.AccessKey
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch access keys",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// DeleteAccessKey revokes an S3 access key
+// @Summary Delete S3 access key
+// @Tags s3
+// @Produce json
+// @Param id path string true "Access key ID"
+// @Success 200 {object} map[string]string
+// @Router /api/v1/access-keys/{id} [delete]
+func DeleteAccessKey(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	var key models.AccessKey
+	if err := db.Where("access_key_id = ? AND user_id = ?", c.Param("id"), userID).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Access key not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch access key",
+		})
+		return
+	}
+
+	if err := db.Delete(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete access key",
+		})
+		return
+	}
+
+	log.WithField("userID", key.UserID).WithField("accessKeyId", key.AccessKeyID).Info("Deleted S3 access key")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Access key deleted",
+	})
+}
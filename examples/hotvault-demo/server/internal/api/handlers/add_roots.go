@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
+)
+
+const (
+	addRootsMaxRetries     = 100
+	addRootsAttemptTimeout = 60 * time.Second
+	addRootsBackoff        = 10 * time.Second
+
+	rootPollInterval        = 10 * time.Second
+	rootPollMaxAttempts     = 100
+	rootPollMaxConsecErrors = 10
+)
+
+// rootRequest is a root waiting in a batch to be added to a proof set.
+type rootRequest struct {
+	ctx  context.Context
+	root pdp.Root
+	// cid is the root CID the proof set lists the root under.
+	cid    string
+	report func(progress UploadProgress)
+	done   chan rootResult
+	// added is closed once the root has been added to the proof set.
+	added chan struct{}
+}
+
+type rootResult struct {
+	rootID string
+	err    error
+}
+
+// rootBatch collects the roots added to one proof set in one add-roots
+// call.
+type rootBatch struct {
+	proofSet *models.ProofSet
+	client   pdp.PDPClient
+	requests []*rootRequest
+	timer    *time.Timer
+}
+
+// rootBatcher aggregates the roots of concurrent uploads per proof set.
+// A batch is submitted once UPLOAD_ADD_ROOTS_BATCH_SIZE roots are waiting
+// or UPLOAD_ADD_ROOTS_BATCH_WINDOW after its first root, costing one transaction for
+// all of them. The root ID found for each root is handed back to the
+// upload that queued it.
+type rootBatcher struct {
+	mu      sync.Mutex
+	batches map[uint]*rootBatch
+}
+
+var addRootsBatcher = &rootBatcher{batches: make(map[uint]*rootBatch)}
+
+// addRoot queues a root for proofSet and waits until it has been added and
+// its root ID is known, or ctx is done. The root ID is empty when the root
+// was added but its ID is not known, because it did not show up in the
+// proof set in time or ctx ended after it was added; the root reconciler
+// looks it up later.
+func (b *rootBatcher) addRoot(ctx context.Context, client pdp.PDPClient, proofSet *models.ProofSet, root pdp.Root, cid string, report func(UploadProgress)) (string, error) {
+	request := &rootRequest{
+		ctx:    ctx,
+		root:   root,
+		cid:    cid,
+		report: report,
+		done:   make(chan rootResult, 1),
+		added:  make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	batch := b.batches[proofSet.ID]
+	if batch == nil {
+		batch = &rootBatch{proofSet: proofSet, client: client}
+		b.batches[proofSet.ID] = batch
+		batch.timer = time.AfterFunc(cfg.Uploads.AddRootsBatchWindow, func() {
+			b.flush(proofSet.ID, batch)
+		})
+	}
+	batch.requests = append(batch.requests, request)
+	queued := len(batch.requests)
+	full := queued >= cfg.Uploads.AddRootsBatchSize
+	if full {
+		delete(b.batches, proofSet.ID)
+		batch.timer.Stop()
+	}
+	b.mu.Unlock()
+
+	if full {
+		go b.submit(batch)
+	} else {
+		report(UploadProgress{
+			Status:   "adding_root",
+			Progress: 95,
+			Message:  fmt.Sprintf("Waiting to add root with other uploads (%d queued)...", queued),
+		})
+	}
+
+	select {
+	case result := <-request.done:
+		return result.rootID, result.err
+	case <-ctx.Done():
+		select {
+		case <-request.added:
+			// The root is in the proof set, so it is recorded as
+			// unconfirmed rather than lost.
+			return "", nil
+		default:
+			return "", ctx.Err()
+		}
+	}
+}
+
+// flush submits a batch when its window ends, unless it was already
+// submitted for being full.
+func (b *rootBatcher) flush(proofSetID uint, batch *rootBatch) {
+	b.mu.Lock()
+	if b.batches[proofSetID] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.batches, proofSetID)
+	b.mu.Unlock()
+
+	b.submit(batch)
+}
+
+// submit adds the roots of a batch in one add-roots call and delivers each
+// root's ID to the upload waiting for it.
+func (b *rootBatcher) submit(batch *rootBatch) {
+	var requests []*rootRequest
+	for _, request := range batch.requests {
+		if request.ctx.Err() == nil {
+			requests = append(requests, request)
+		}
+	}
+	if len(requests) == 0 {
+		return
+	}
+
+	// Uploads of the same content share one root.
+	var roots []pdp.Root
+	seen := make(map[string]bool)
+	for _, request := range requests {
+		if key := request.root.String(); !seen[key] {
+			seen[key] = true
+			roots = append(roots, request.root)
+		}
+	}
+
+	waiting := make([]context.Context, len(requests))
+	for i, request := range requests {
+		waiting[i] = request.ctx
+	}
+	ctx, cancel := batchContext(waiting)
+	defer cancel()
+
+	proofSetID := batch.proofSet.ProofSetID
+	log.WithField("proofSetID", proofSetID).
+		WithField("roots", len(roots)).
+		WithField("uploads", len(requests)).
+		Info("Submitting batched add-roots")
+
+	if err := addRootsWithRetry(ctx, batch.client, proofSetID, roots, requests); err != nil {
+		for _, request := range requests {
+			request.done <- rootResult{err: err}
+		}
+		return
+	}
+	for _, request := range requests {
+		close(request.added)
+	}
+
+	pollRootIDs(ctx, batch.client, batch.proofSet, requests)
+}
+
+// batchContext returns a context that is cancelled once every upload in a
+// batch has given up, that is once all of waiting are done.
+func batchContext(waiting []context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for _, upload := range waiting {
+			select {
+			case <-upload.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+func reportBatch(requests []*rootRequest, progress UploadProgress) {
+	for _, request := range requests {
+		request.report(progress)
+	}
+}
+
+// addRootsWithRetry calls add-roots until the service accepts the roots.
+// Every failure is retried, as the service commonly rejects roots until
+// their upload has been registered or the proof set is initialised.
+func addRootsWithRetry(ctx context.Context, client pdp.PDPClient, proofSetID string, roots []pdp.Root, requests []*rootRequest) error {
+	rootStrings := make([]string, len(roots))
+	for i, root := range roots {
+		rootStrings[i] = root.String()
+	}
+
+	reportBatch(requests, UploadProgress{
+		Status:   "adding_root",
+		Progress: 95,
+		Message:  fmt.Sprintf("Adding %d root(s) to proof set %s...", len(roots), proofSetID),
+	})
+
+	for attempt := 1; attempt <= addRootsMaxRetries; attempt++ {
+		log.WithField("roots", strings.Join(rootStrings, ",")).
+			WithField("attempt", attempt).
+			WithField("maxRetries", addRootsMaxRetries).
+			Info("Executing add-roots command")
+
+		if err := addRootsLimiter.acquire(ctx, nil); err != nil {
+			return err
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, addRootsAttemptTimeout)
+		err := client.AddRoots(attemptCtx, proofSetID, roots)
+		cancel()
+		addRootsLimiter.release()
+
+		if err == nil {
+			log.WithField("proofSetID", proofSetID).
+				WithField("roots", len(roots)).
+				WithField("attempt", attempt).
+				Info("add-roots command completed successfully")
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		message := fmt.Sprintf("add-roots failed, retrying %d/%d...", attempt+1, addRootsMaxRetries)
+		if errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+			log.WithField("attempt", attempt).
+				WithField("maxRetries", addRootsMaxRetries).
+				Error("Command execution timed out after 60 seconds")
+			message = fmt.Sprintf("Command timed out. Retrying %d/%d...", attempt+1, addRootsMaxRetries)
+		} else {
+			log.WithField("error", err.Error()).
+				WithField("attempt", attempt).
+				WithField("maxRetries", addRootsMaxRetries).
+				Error("pdptool add-roots command failed")
+		}
+
+		if attempt == addRootsMaxRetries {
+			return fmt.Errorf("service did not accept the roots after %d attempts: %w", addRootsMaxRetries, err)
+		}
+		reportBatch(requests, UploadProgress{
+			Status:   "adding_root",
+			Progress: 95,
+			Message:  message,
+		})
+
+		retryDelay := addRootsBackoff + time.Duration(rand.Int63n(int64(addRootsBackoff/2)))
+		log.WithField("retryDelay", retryDelay.String()).Info("Waiting before retry")
+		if err := sleepContext(ctx, retryDelay); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("service did not accept the roots after %d attempts", addRootsMaxRetries)
+}
+
+// pollRootIDs polls the proof set until the root ID of every request is
+// known, delivering each as soon as it is found. The roots are in the proof
+// set already, so a root whose ID is not found by the end of polling is
+// delivered without one, to be saved as unconfirmed and left to the root
+// reconciler.
+func pollRootIDs(ctx context.Context, client pdp.PDPClient, proofSet *models.ProofSet, requests []*rootRequest) {
+	reportBatch(requests, UploadProgress{
+		Status:   "finalizing",
+		Progress: 96,
+		Message:  "Confirming Root ID assignment...",
+	})
+
+	proofSetID := proofSet.ProofSetID
+	pending := requests
+	// assigned holds the root IDs handed out so far, by root, so requests
+	// sharing a root get the same ID and no two roots get the same one.
+	assigned := make(map[string]string)
+	consecutiveErrors := 0
+	for attempt := 1; attempt <= rootPollMaxAttempts && len(pending) > 0 && consecutiveErrors < rootPollMaxConsecErrors; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(ctx, rootPollInterval); err != nil {
+				break
+			}
+		}
+		if attempt%5 == 0 {
+			reportBatch(pending, UploadProgress{
+				Status:   "finalizing",
+				Progress: 96,
+				Message:  "Waiting for blockchain confirmation...",
+			})
+		}
+
+		log.Info(fmt.Sprintf("Polling get-proof-set attempt %d/%d for %d root(s)...", attempt, rootPollMaxAttempts, len(pending)))
+
+		remoteProofSet, err := client.GetProofSet(ctx, proofSetID)
+		if err != nil {
+			consecutiveErrors++
+			log.WithField("error", err.Error()).
+				WithField("consecutiveErrors", consecutiveErrors).
+				Warning(fmt.Sprintf("get-proof-set failed during poll attempt %d", attempt))
+			continue
+		}
+		consecutiveErrors = 0
+
+		claimed, err := claimedRootIDs(proofSet.ID)
+		if err != nil {
+			log.WithField("error", err.Error()).Warning("Failed to fetch root IDs claimed by stored pieces")
+			continue
+		}
+
+		for _, id := range assigned {
+			claimed[id] = true
+		}
+
+		var unresolved []*rootRequest
+		for _, request := range pending {
+			key := request.root.String()
+			rootID, ok := assigned[key]
+			if !ok {
+				root, found := newestUnclaimedRoot(remoteProofSet, request.cid, claimed)
+				if !found {
+					unresolved = append(unresolved, request)
+					continue
+				}
+				rootID = root.ID
+				assigned[key] = rootID
+				claimed[rootID] = true
+			}
+			log.WithField("integerRootID", rootID).
+				WithField("matchedBaseCID", request.cid).
+				Info(fmt.Sprintf("Found integer Root ID on poll attempt %d", attempt))
+			request.done <- rootResult{rootID: rootID}
+		}
+		pending = unresolved
+	}
+
+	reason := fmt.Sprintf("not found after %d attempts", rootPollMaxAttempts)
+	switch {
+	case ctx.Err() != nil:
+		reason = "every upload in the batch gave up"
+	case consecutiveErrors >= rootPollMaxConsecErrors:
+		reason = fmt.Sprintf("get-proof-set failed %d times in a row", consecutiveErrors)
+	}
+	for _, request := range pending {
+		log.WithField("baseCID", request.cid).
+			WithField("proofSetID", proofSetID).
+			WithField("reason", reason).
+			Warning("Failed to find integer Root ID in get-proof-set output after polling. Leaving it to the root reconciler.")
+		request.report(UploadProgress{
+			Status:   "finalizing",
+			Progress: 98,
+			Message:  "Root ID not confirmed yet due to blockchain indexing delay. It will be confirmed in the background.",
+		})
+		request.done <- rootResult{}
+	}
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// uploadStatusAggregating is the status of a prepared job waiting for the
+// aggregator to pack it with other small files. Workers do not claim such
+// jobs.
+const uploadStatusAggregating = "aggregating"
+
+// aggregateEntry locates a file inside an aggregate payload.
+type aggregateEntry struct {
+	PieceCID string `json:"pieceCid"`
+	Filename string `json:"filename"`
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+}
+
+// aggregateIndex describes the files of an aggregate payload. An aggregate
+// is the concatenation of its files, followed by the index as JSON and the
+// length of the index as an 8-byte big-endian integer, so an aggregate can
+// be unpacked without the database.
+type aggregateIndex struct {
+	Files []aggregateEntry `json:"files"`
+}
+
+// aggregateMember is an upload job packed into an aggregate.
+type aggregateMember struct {
+	job    *models.UploadJob
+	record *models.File
+	entry  aggregateEntry
+	ctx    context.Context
+	end    func()
+	// pieces holds the stored replica per provider.
+	pieces []*models.Piece
+}
+
+// aggregatable reports whether a file is small enough to be packed with
+// other small files instead of being stored as a piece of its own.
+func aggregatable(record *models.File) bool {
+	return cfg.Aggregation.Threshold > 0 && record.Size > 0 && record.Size < cfg.Aggregation.Threshold
+}
+
+// queueForAggregation hands a prepared job to the aggregator.
+func queueForAggregation(job *models.UploadJob, replicas []models.ReplicaProgress) {
+	log.WithField("jobID", job.ID).
+		WithField("size", formatFileSize(job.TotalSize)).
+		WithField("threshold", formatFileSize(cfg.Aggregation.Threshold)).
+		Info("Queueing small file for aggregation")
+	saveUploadProgress(job.ID, UploadProgress{
+		Status:   uploadStatusAggregating,
+		Progress: 25,
+		Message:  "Waiting to be stored together with other small files...",
+		Replicas: replicas,
+	})
+}
+
+// runAggregator stores the jobs waiting for aggregation as aggregates once
+// enough of them are waiting or the oldest has waited AGGREGATE_WINDOW.
+func runAggregator(aggregatorID string) {
+	ticker := time.NewTicker(uploadJobPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushAggregates(aggregatorID)
+	}
+}
+
+func flushAggregates(aggregatorID string) {
+	var groups []struct {
+		UserID     uint
+		ProviderID *uint
+		Files      int
+		Bytes      int64
+		Oldest     time.Time
+	}
+	err := db.Model(&models.UploadJob{}).
+		Select("user_id, provider_id, COUNT(*) AS files, SUM(total_size) AS bytes, MIN(updated_at) AS oldest").
+		Where("status = ?", uploadStatusAggregating).
+		Where("lease_expires_at IS NULL OR lease_expires_at < ?", time.Now()).
+		Group("user_id, provider_id").
+		Scan(&groups).Error
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Failed to list uploads waiting for aggregation")
+		return
+	}
+
+	for _, group := range groups {
+		due := group.Files >= cfg.Aggregation.MaxFiles ||
+			group.Bytes >= cfg.Aggregation.MaxSize ||
+			time.Since(group.Oldest) >= cfg.Aggregation.Window ||
+			cfg.Aggregation.Threshold == 0
+		if !due {
+			continue
+		}
+		jobs, err := claimAggregate(aggregatorID, group.UserID, group.ProviderID)
+		if err != nil {
+			log.WithField("userID", group.UserID).WithField("error", err.Error()).Error("Failed to claim uploads for aggregation")
+			continue
+		}
+		if len(jobs) > 0 {
+			go storeAggregate(aggregatorID, jobs)
+		}
+	}
+}
+
+// claimAggregate leases the oldest jobs of a user waiting for aggregation
+// with the same provider, up to AGGREGATE_MAX_FILES files and
+// AGGREGATE_MAX_SIZE bytes.
+func claimAggregate(aggregatorID string, userID uint, providerID *uint) ([]models.UploadJob, error) {
+	var claimed []models.UploadJob
+	now := time.Now()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND user_id = ?", uploadStatusAggregating, userID).
+			Where("lease_expires_at IS NULL OR lease_expires_at < ?", now)
+		if providerID == nil {
+			query = query.Where("provider_id IS NULL")
+		} else {
+			query = query.Where("provider_id = ?", *providerID)
+		}
+		var jobs []models.UploadJob
+		if err := query.Order("created_at ASC").Limit(cfg.Aggregation.MaxFiles).Find(&jobs).Error; err != nil {
+			return err
+		}
+
+		var size int64
+		ids := []string{}
+		for _, job := range jobs {
+			if len(claimed) > 0 && size+job.TotalSize > cfg.Aggregation.MaxSize {
+				break
+			}
+			size += job.TotalSize
+			claimed = append(claimed, job)
+			ids = append(ids, job.ID)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		leaseExpiresAt := now.Add(uploadJobLease)
+		for i := range claimed {
+			claimed[i].ClaimedBy = aggregatorID
+			claimed[i].LeaseExpiresAt = &leaseExpiresAt
+		}
+		return tx.Model(&models.UploadJob{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"status":           "uploading",
+			"claimed_by":       aggregatorID,
+			"lease_expires_at": leaseExpiresAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// storeAggregate packs the payloads of jobs into one aggregate, stores it
+// with the user's providers and saves a Piece per file and provider
+// locating the file inside the aggregate. Files sharing the aggregate share
+// its root, which stays in the proof set until the last of them is removed.
+func storeAggregate(aggregatorID string, jobs []models.UploadJob) {
+	var members []*aggregateMember
+	for i := range jobs {
+		ctx, end := beginUploadJob(aggregatorID, &jobs[i])
+		member := &aggregateMember{job: &jobs[i], ctx: ctx, end: end}
+		defer member.end()
+
+		record, err := uploadJobFile(member.job)
+		if err != nil {
+			log.WithField("jobID", member.job.ID).WithField("error", err.Error()).Error("Failed to save file information")
+			saveUploadProgress(member.job.ID, UploadProgress{
+				Status:  "error",
+				Error:   "Failed to save file information to database",
+				Message: err.Error(),
+			})
+			continue
+		}
+		member.record = record
+		members = append(members, member)
+	}
+	if len(members) == 0 {
+		return
+	}
+	userID := members[0].job.UserID
+
+	failAll := func(failure string, err error) {
+		log.WithField("userID", userID).
+			WithField("files", len(members)).
+			WithField("error", err.Error()).
+			Error(failure)
+		for _, member := range members {
+			db.Delete(member.record)
+			saveUploadProgress(member.job.ID, UploadProgress{
+				Status:  "error",
+				Error:   failure,
+				Message: err.Error(),
+			})
+		}
+	}
+
+	provider, err := uploadJobProvider(members[0].job)
+	if err != nil {
+		failAll("Failed to select storage provider", err)
+		return
+	}
+	providers, err := replicaProviders(provider, members[0].record.ReplicationFactor)
+	if err != nil {
+		failAll("Failed to select storage providers", err)
+		return
+	}
+
+	dir := uploadPayloadDir("aggregate-" + uuid.New().String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		failAll("Failed to create aggregate", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	payloadPath := filepath.Join(dir, "aggregate")
+	size, err := writeAggregate(payloadPath, members)
+	if err != nil {
+		failAll("Failed to create aggregate", err)
+		return
+	}
+
+	log.WithField("userID", userID).
+		WithField("files", len(members)).
+		WithField("size", formatFileSize(size)).
+		WithField("providers", len(providers)).
+		Info("Storing aggregate of small files")
+
+	waiting := make([]context.Context, len(members))
+	for i, member := range members {
+		waiting[i] = member.ctx
+		member.pieces = make([]*models.Piece, len(providers))
+
+		replicas := make([]models.ReplicaProgress, len(providers))
+		for j, p := range providers {
+			replicas[j] = models.ReplicaProgress{Provider: p.Name, Status: "pending"}
+		}
+		saveUploadProgress(member.job.ID, UploadProgress{
+			Status:   "uploading",
+			Progress: 30,
+			Message:  fmt.Sprintf("Uploading together with %d other small file(s)...", len(members)-1),
+			Replicas: replicas,
+		})
+	}
+	ctx, cancel := batchContext(waiting)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range providers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			report := func(progress UploadProgress) {
+				for _, member := range members {
+					reportReplica(member.job.ID, i, progress)
+				}
+			}
+			filename := fmt.Sprintf("aggregate of %d files", len(members))
+			root, err := storeRoot(ctx, userID, filename, payloadPath, size, &providers[i], 30, nil, report)
+			if err != nil {
+				log.WithField("provider", providers[i].Name).
+					WithField("error", err.Error()).
+					Error("Aggregate upload failed")
+				return
+			}
+			// The root is in the proof set, so every member is recorded,
+			// including uploads cancelled meanwhile.
+			for _, member := range members {
+				piece := encryptionOf(&models.Piece{
+					UserID:          member.record.UserID,
+					FileID:          &member.record.ID,
+					CID:             member.record.CID,
+					Filename:        member.record.Filename,
+					Size:            member.record.Size,
+					ServiceName:     providers[i].ServiceName,
+					ServiceURL:      providers[i].ServiceURL,
+					ProofSetID:      &root.ProofSet.ID,
+					RootID:          root.RootID,
+					RootState:       root.RootState,
+					RootCheckedAt:   root.RootCheckedAt,
+					AggregateCID:    root.CID,
+					AggregateOffset: member.entry.Offset,
+					AggregateLength: member.entry.Length,
+				}, member.job)
+				if err := db.Create(piece).Error; err != nil {
+					log.WithField("jobID", member.job.ID).WithField("error", err.Error()).Error("Failed to save piece information")
+					reportReplica(member.job.ID, i, UploadProgress{
+						Status:  "error",
+						Error:   "Failed to save piece information to database",
+						Message: err.Error(),
+					})
+					continue
+				}
+				member.pieces[i] = piece
+				finishReplica(member.job.ID, i, piece)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, member := range members {
+		completeUpload(member.ctx, member.job, member.record, member.pieces)
+	}
+}
+
+// writeAggregate writes the payloads of members to path as an aggregate
+// and records where each one is in the member's entry. It returns the size
+// of the aggregate.
+func writeAggregate(path string, members []*aggregateMember) (int64, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	var index aggregateIndex
+	var offset int64
+	for _, member := range members {
+		in, err := os.Open(member.job.PayloadPath)
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return 0, err
+		}
+		member.entry = aggregateEntry{
+			PieceCID: member.record.CID,
+			Filename: member.record.Filename,
+			Offset:   offset,
+			Length:   n,
+		}
+		index.Files = append(index.Files, member.entry)
+		offset += n
+	}
+
+	encoded, err := json.Marshal(index)
+	if err != nil {
+		return 0, err
+	}
+	trailer := make([]byte, 8)
+	binary.BigEndian.PutUint64(trailer, uint64(len(encoded)))
+	if _, err := out.Write(append(encoded, trailer...)); err != nil {
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	return offset + int64(len(encoded)) + int64(len(trailer)), nil
+}
+
+// extractAggregated replaces path, holding a downloaded aggregate, with the
+// bytes of the file replica locates inside it.
+func extractAggregated(path string, replica *models.Piece) error {
+	aggregate, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer aggregate.Close()
+
+	extracted := path + ".extracted"
+	out, err := os.Create(extracted)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.NewSectionReader(aggregate, replica.AggregateOffset, replica.AggregateLength))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != replica.AggregateLength {
+		err = fmt.Errorf("aggregate %s is too short: got %d of %d bytes at offset %d", replica.AggregateCID, n, replica.AggregateLength, replica.AggregateOffset)
+	}
+	if err != nil {
+		os.Remove(extracted)
+		return err
+	}
+	return os.Rename(extracted, path)
+}
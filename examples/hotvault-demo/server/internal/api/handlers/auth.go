@@ -1,16 +1,12 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"os/exec"
-	"regexp"
-	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
@@ -19,6 +15,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/hotvault/backend/config"
 	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
 	"github.com/hotvault/backend/internal/services"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -231,9 +228,10 @@ func (h *AuthHandler) VerifySignature(c *gin.Context) {
 
 // CreateProofSet godoc
 // @Summary Create Proof Set
-// @Description Manually initiates the creation of a proof set for the authenticated user if one doesn't exist.
+// @Description Manually initiates the creation of a proof set for the authenticated user on the selected storage provider if one doesn't exist.
 // @Tags Proof Set
 // @Security ApiKeyAuth
+// @Param provider query string false "Storage provider name or ID"
 // @Produce json
 // @Success 200 {object} map[string]interface{} "message:Proof set creation initiated successfully"
 // @Failure 400 {object} ErrorResponse
@@ -253,8 +251,15 @@ func (h *AuthHandler) CreateProofSet(c *gin.Context) {
 		return
 	}
 
+	provider, err := selectStorageProvider(user.ID, c.Query("provider"))
+	if err != nil {
+		authLog.WithField("userID", user.ID).Errorf("Failed to select storage provider: %v", err)
+		c.JSON(providerErrorStatus(err), ErrorResponse{Error: "Failed to select storage provider: " + err.Error()})
+		return
+	}
+
 	var existingProofSet models.ProofSet
-	err := h.db.Where("user_id = ?", user.ID).First(&existingProofSet).Error
+	err = h.db.Where("user_id = ? AND provider_id = ?", user.ID, provider.ID).First(&existingProofSet).Error
 	if err == nil {
 		if existingProofSet.ProofSetID != "" {
 			authLog.WithField("userID", user.ID).Warn("CreateProofSet called but ProofSetID already exists.")
@@ -275,26 +280,18 @@ func (h *AuthHandler) CreateProofSet(c *gin.Context) {
 		authLog.WithField("userID", user.ID).Info("No existing proof set record found.")
 	}
 
-	go func(u *models.User) {
-		authLog.WithField("userID", u.ID).Info("Starting background proof set creation...")
-		if err := h.createProofSetForUser(u); err != nil {
-			authLog.WithField("userID", u.ID).Errorf("Background proof set creation failed: %v", err)
-		} else {
-			authLog.WithField("userID", u.ID).Info("Background proof set creation completed successfully.")
-		}
-	}(&user)
+	if !startProofSetCreation(&user, provider) {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Proof set creation is already in progress for this user. Check status."})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Proof set creation initiated successfully. Monitor /auth/status for readiness."})
 }
 
-func (h *AuthHandler) createProofSetForUser(user *models.User) error {
-	pdptoolPath := h.cfg.PdptoolPath
-	if pdptoolPath == "" {
-		return errors.New("pdptool path not configured")
-	}
-	serviceName := h.cfg.ServiceName
-	serviceURL := h.cfg.ServiceURL
-	recordKeeper := h.cfg.RecordKeeper
+func createProofSetForUser(user *models.User, provider *models.StorageProvider) error {
+	serviceName := provider.ServiceName
+	serviceURL := provider.ServiceURL
+	recordKeeper := provider.RecordKeeper
 
 	if serviceName == "" || serviceURL == "" || recordKeeper == "" {
 		errMsg := "service name, service url, or record keeper not configured"
@@ -302,14 +299,7 @@ func (h *AuthHandler) createProofSetForUser(user *models.User) error {
 		return errors.New(errMsg)
 	}
 
-	// Change working directory to pdptool directory
-	pdptoolDir := getPdptoolParentDir(pdptoolPath)
-	if err := os.Chdir(pdptoolDir); err != nil {
-		errMsg := fmt.Sprintf("Failed to change working directory to pdptool directory: %v", err)
-		authLog.Error(errMsg)
-		return errors.New(errMsg)
-	}
-	authLog.WithField("pdptoolDir", pdptoolDir).Info("Changed working directory to pdptool directory")
+	client := pdpClientFor(pdp.Service{Name: serviceName, URL: serviceURL})
 
 	authLog.Infof("[Goroutine Create] Creating proof set for user %d (Address: %s)...", user.ID, user.WalletAddress)
 
@@ -324,67 +314,38 @@ func (h *AuthHandler) createProofSetForUser(user *models.User) error {
 	}
 	authLog.WithField("extraDataHex", extraDataHex).Info("[Goroutine Create] ABI encoded extra data for user ", user.ID)
 
-	createProofSetArgs := []string{
-		"create-proof-set",
-		"--service-url", serviceURL,
-		"--service-name", serviceName,
-		"--recordkeeper", recordKeeper,
-		"--extra-data", extraDataHex,
-	}
-
-	createProofSetCmd := exec.Command(pdptoolPath, createProofSetArgs...)
-
-	var createProofSetOutput bytes.Buffer
-	var createProofSetError bytes.Buffer
-	createProofSetCmd.Stdout = &createProofSetOutput
-	createProofSetCmd.Stderr = &createProofSetError
+	authLog.WithField("recordKeeper", recordKeeper).Info("[Goroutine Create] Executing create-proof-set for user ", user.ID)
 
-	authLog.WithField("command", pdptoolPath+" "+strings.Join(createProofSetArgs, " ")).Info("[Goroutine Create] Executing create-proof-set command for user ", user.ID)
-
-	if err := createProofSetCmd.Run(); err != nil {
-		errMsg := fmt.Sprintf("[Goroutine Create] Failed to run create-proof-set command for user %d: %v", user.ID, err)
+	txHash, err := client.CreateProofSet(context.Background(), pdp.CreateProofSetRequest{
+		RecordKeeper: recordKeeper,
+		ExtraData:    extraDataHex,
+	})
+	if err != nil {
+		errMsg := fmt.Sprintf("[Goroutine Create] Failed to create proof set for user %d: %v", user.ID, err)
 		authLog.WithFields(logrus.Fields{
-			"userID":  user.ID,
-			"error":   err.Error(),
-			"stderr":  createProofSetError.String(),
-			"stdout":  createProofSetOutput.String(),
-			"command": pdptoolPath + " " + strings.Join(createProofSetArgs, " "),
+			"userID": user.ID,
+			"error":  err.Error(),
 		}).Error(errMsg)
-		return errors.New(errMsg + ", stderr: " + createProofSetError.String())
+		return errors.New(errMsg)
 	}
 
-	outputStr := createProofSetOutput.String()
-	authLog.WithField("createOutput", outputStr).Debug("[Goroutine Create] Create proof set output for user ", user.ID)
-
-	txHashRegex := regexp.MustCompile(`Location: /pdp/proof-sets/created/(0x[a-fA-F0-9]{64})`)
-	txHashMatches := txHashRegex.FindStringSubmatch(outputStr)
-	var txHash string
-
-	if len(txHashMatches) > 1 {
-		txHash = txHashMatches[1]
-		authLog.WithField("txHash", txHash).Infof("[Goroutine Create] Extracted transaction hash for user %d. Updating database and starting polling...", user.ID)
-
-		proofSetToUpdate := models.ProofSet{
-			UserID:          user.ID,
-			TransactionHash: txHash,
-			ServiceName:     serviceName,
-			ServiceURL:      serviceURL,
-		}
-		result := h.db.Where(models.ProofSet{UserID: user.ID}).Assign(proofSetToUpdate).FirstOrCreate(&models.ProofSet{})
-		if result.Error != nil {
-			errMsg := fmt.Sprintf("[Goroutine Create] Failed to save/update proof set with txHash for user %d: %v", user.ID, result.Error)
-			authLog.Error(errMsg)
-			return errors.New(errMsg)
-		}
+	authLog.WithField("txHash", txHash).Infof("[Goroutine Create] Extracted transaction hash for user %d. Updating database and starting polling...", user.ID)
 
-	} else {
-		authLog.Warn("[Goroutine Create] Could not extract transaction hash using Location regex for user ", user.ID, ". Check pdptool output format.")
-		errMsg := fmt.Sprintf("[Goroutine Create] Failed to extract transaction hash needed for polling for user %d. Output: %s", user.ID, outputStr)
+	proofSetToUpdate := models.ProofSet{
+		UserID:          user.ID,
+		ProviderID:      &provider.ID,
+		TransactionHash: txHash,
+		ServiceName:     serviceName,
+		ServiceURL:      serviceURL,
+	}
+	result := db.Where("user_id = ? AND provider_id = ?", user.ID, provider.ID).Assign(proofSetToUpdate).FirstOrCreate(&models.ProofSet{})
+	if result.Error != nil {
+		errMsg := fmt.Sprintf("[Goroutine Create] Failed to save/update proof set with txHash for user %d: %v", user.ID, result.Error)
 		authLog.Error(errMsg)
 		return errors.New(errMsg)
 	}
 
-	extractedID, pollErr := h.pollForProofSetID(pdptoolPath, serviceURL, serviceName, txHash, user)
+	extractedID, pollErr := pollForProofSetID(client, txHash, user)
 	if pollErr != nil {
 		authLog.Errorf("[Goroutine Create] Failed to poll for proof set ID for user %d: %v", user.ID, pollErr)
 		return pollErr
@@ -393,7 +354,7 @@ func (h *AuthHandler) createProofSetForUser(user *models.User) error {
 	finalUpdate := models.ProofSet{
 		ProofSetID: extractedID,
 	}
-	result := h.db.Model(&models.ProofSet{}).Where("user_id = ?", user.ID).Updates(finalUpdate)
+	result = db.Model(&models.ProofSet{}).Where("user_id = ? AND provider_id = ?", user.ID, provider.ID).Updates(finalUpdate)
 	if result.Error != nil {
 		errMsg := fmt.Sprintf("[Goroutine Create] Failed to update proof set with ProofSetID for user %d: %v", user.ID, result.Error)
 		authLog.Error(errMsg)
@@ -405,24 +366,18 @@ func (h *AuthHandler) createProofSetForUser(user *models.User) error {
 		return errors.New(errMsg)
 	}
 	authLog.WithField("proofSetPdpID", extractedID).Infof("[Goroutine Create] Successfully updated proof set with ID for user %d", user.ID)
+
+	emitWebhookEvent(user.ID, WebhookEventProofSetReady, gin.H{
+		"proofSetId":      extractedID,
+		"providerId":      provider.ID,
+		"serviceName":     serviceName,
+		"serviceUrl":      serviceURL,
+		"transactionHash": txHash,
+	})
 	return nil
 }
 
-func (h *AuthHandler) pollForProofSetID(pdptoolPath, serviceURL, serviceName, txHash string, user *models.User) (string, error) {
-	proofSetIDRegex := regexp.MustCompile(`ProofSet ID:[ \t]*(\d+)`)
-	creationStatusRegex := regexp.MustCompile(`Proofset Created:[ \t]*(true|false)`)
-	txStatusRegex := regexp.MustCompile(`Transaction Status:[ \t]*(confirmed|pending|failed)`)
-	txSuccessRegex := regexp.MustCompile(`Transaction Successful:[ \t]*(true|false|Pending)`)
-
-	// Change working directory to pdptool directory
-	pdptoolDir := getPdptoolParentDir(pdptoolPath)
-	if err := os.Chdir(pdptoolDir); err != nil {
-		errMsg := fmt.Sprintf("Failed to change working directory to pdptool directory: %v", err)
-		authLog.Error(errMsg)
-		return "", errors.New(errMsg)
-	}
-	authLog.WithField("pdptoolDir", pdptoolDir).Info("Changed working directory to pdptool directory")
-
+func pollForProofSetID(client pdp.PDPClient, txHash string, user *models.User) (string, error) {
 	sleepDuration := 10 * time.Second
 	attemptCounter := 0
 	const maxLogInterval = 6
@@ -431,68 +386,25 @@ func (h *AuthHandler) pollForProofSetID(pdptoolPath, serviceURL, serviceName, tx
 
 	for {
 		attemptCounter++
-		getStatusCmd := exec.Command(
-			pdptoolPath,
-			"get-proof-set-create-status",
-			"--service-url", serviceURL,
-			"--service-name", serviceName,
-			"--tx-hash", txHash,
-		)
-
-		var getStatusOutput bytes.Buffer
-		var getStatusError bytes.Buffer
-		getStatusCmd.Stdout = &getStatusOutput
-		getStatusCmd.Stderr = &getStatusError
-
-		cmdString := fmt.Sprintf("%s %s", pdptoolPath, strings.Join(getStatusCmd.Args[1:], " "))
-		authLog.WithField("command", cmdString).
-			WithField("attempt", attemptCounter).
+
+		authLog.WithField("attempt", attemptCounter).
 			WithField("txHash", txHash).
 			WithField("userID", user.ID).
-			Info("[Goroutine Polling] Executing get-proof-set-create-status command")
-
-		err := getStatusCmd.Run()
-		statusOutput := getStatusOutput.String()
-		statusStderr := getStatusError.String()
+			Info("[Goroutine Polling] Fetching proof set creation status")
 
+		status, err := client.GetProofSetStatus(context.Background(), txHash)
 		if err != nil {
 			authLog.WithField("error", err.Error()).
-				WithField("stderr", statusStderr).
-				WithField("command", cmdString).
 				WithField("attempt", attemptCounter).
 				WithField("userID", user.ID).
-				Warnf("[Goroutine Polling] Failed to run get-proof-set-create-status command, retrying in %v...", sleepDuration)
+				Warnf("[Goroutine Polling] Failed to get proof set creation status, retrying in %v...", sleepDuration)
 			time.Sleep(sleepDuration)
 			continue
 		}
 
-		authLog.WithField("statusOutput", statusOutput).
-			WithField("attempt", attemptCounter).
-			WithField("userID", user.ID).
-			WithField("txHash", txHash).
-			Info("[Goroutine Polling] get-proof-set-create-status command output")
-
-		txStatusMatch := txStatusRegex.FindStringSubmatch(statusOutput)
-		txSuccessMatch := txSuccessRegex.FindStringSubmatch(statusOutput)
-		createdMatch := creationStatusRegex.FindStringSubmatch(statusOutput)
-		idMatch := proofSetIDRegex.FindStringSubmatch(statusOutput)
-
-		var txStatus, txSuccess, createdStatus string
-		if len(txStatusMatch) > 1 {
-			txStatus = txStatusMatch[1]
-		}
-		if len(txSuccessMatch) > 1 {
-			txSuccess = txSuccessMatch[1]
-		}
-		if len(createdMatch) > 1 {
-			createdStatus = createdMatch[1]
-		}
-
-		// Log the status details for each polling attempt
-		var idMatchValue string
-		if len(idMatch) > 1 {
-			idMatchValue = idMatch[1]
-		} else {
+		idFound := status.ID != ""
+		idMatchValue := status.ID
+		if !idFound {
 			idMatchValue = "none"
 		}
 
@@ -500,40 +412,41 @@ func (h *AuthHandler) pollForProofSetID(pdptoolPath, serviceURL, serviceName, tx
 			"userID":        user.ID,
 			"txHash":        txHash,
 			"attempt":       attemptCounter,
-			"txStatus":      txStatus,
-			"txSuccess":     txSuccess,
-			"createdStatus": createdStatus,
-			"idFound":       len(idMatch) > 1,
+			"txStatus":      status.TxStatus,
+			"txSuccess":     status.TxSuccess,
+			"createdStatus": status.Created,
+			"idFound":       idFound,
 			"idMatch":       idMatchValue,
 		}).Info("[Goroutine Polling] Current proof set creation status")
 
-		if txStatus == "confirmed" && txSuccess == "true" && createdStatus == "true" && len(idMatch) > 1 {
-			proofSetIDStr := idMatch[1]
-			authLog.WithField("proofSetID", proofSetIDStr).WithField("attempts", attemptCounter).Infof("[Goroutine Polling] Successfully extracted proof set ID for user %d", user.ID)
-			return proofSetIDStr, nil
+		confirmed := status.TxStatus == pdp.TxStatusConfirmed
+
+		if confirmed && status.TxSuccess && status.Created && idFound {
+			authLog.WithField("proofSetID", status.ID).WithField("attempts", attemptCounter).Infof("[Goroutine Polling] Successfully extracted proof set ID for user %d", user.ID)
+			return status.ID, nil
 		}
 
-		if txStatus == "confirmed" && txSuccess == "true" && createdStatus == "false" {
-			authLog.Infof("[Goroutine Polling] Attempt %d: Transaction confirmed for user %d, but proofset creation still processing (TxStatus: %s, TxSuccess: %s, CreatedStatus: %s)... Polling again in %v.",
-				attemptCounter, user.ID, txStatus, txSuccess, createdStatus, sleepDuration)
+		if confirmed && status.TxSuccess && !status.Created {
+			authLog.Infof("[Goroutine Polling] Attempt %d: Transaction confirmed for user %d, but proofset creation still processing (TxStatus: %s, TxSuccess: %t, CreatedStatus: %t)... Polling again in %v.",
+				attemptCounter, user.ID, status.TxStatus, status.TxSuccess, status.Created, sleepDuration)
 			time.Sleep(sleepDuration)
 			continue
 		}
 
-		if txStatus == "confirmed" && (txSuccess == "false" || (createdStatus == "true" && len(idMatch) == 0)) {
-			authLog.Errorf("[Goroutine Polling] Proof set creation failed or stalled for user %d (TxStatus: %s, TxSuccess: %s, CreatedStatus: %s, ID Found: %t). Output: %s",
-				user.ID, txStatus, txSuccess, createdStatus, len(idMatch) > 1, statusOutput)
-			return "", fmt.Errorf("proof set creation failed or stalled post-confirmation for tx %s (status: %s, success: %s, created: %s)", txHash, txStatus, txSuccess, createdStatus)
+		if confirmed && (!status.TxSuccess || (status.Created && !idFound)) {
+			authLog.Errorf("[Goroutine Polling] Proof set creation failed or stalled for user %d (TxStatus: %s, TxSuccess: %t, CreatedStatus: %t, ID Found: %t)",
+				user.ID, status.TxStatus, status.TxSuccess, status.Created, idFound)
+			return "", fmt.Errorf("proof set creation failed or stalled post-confirmation for tx %s (status: %s, success: %t, created: %t)", txHash, status.TxStatus, status.TxSuccess, status.Created)
 		}
 
-		if txStatus == "failed" {
-			authLog.Errorf("[Goroutine Polling] Proof set creation transaction failed for user %d (TxStatus: %s). Output: %s",
-				user.ID, txStatus, statusOutput)
-			return "", fmt.Errorf("proof set creation transaction failed for tx %s (status: %s)", txHash, txStatus)
+		if status.TxStatus == pdp.TxStatusFailed {
+			authLog.Errorf("[Goroutine Polling] Proof set creation transaction failed for user %d (TxStatus: %s)",
+				user.ID, status.TxStatus)
+			return "", fmt.Errorf("proof set creation transaction failed for tx %s (status: %s)", txHash, status.TxStatus)
 		}
 
-		if txStatus == "pending" || txStatus == "" {
-			authLog.Infof("[Goroutine Polling] Attempt %d: Proof set creation still pending for user %d (TxStatus: '%s')... Polling again in %v.", attemptCounter, user.ID, txStatus, sleepDuration)
+		if status.TxStatus == pdp.TxStatusPending || status.TxStatus == "" {
+			authLog.Infof("[Goroutine Polling] Attempt %d: Proof set creation still pending for user %d (TxStatus: '%s')... Polling again in %v.", attemptCounter, user.ID, status.TxStatus, sleepDuration)
 			if attemptCounter%maxLogInterval == 0 {
 				authLog.WithField("attempt", attemptCounter).Info("[Goroutine Polling] Still waiting for proof set ID for user ", user.ID, " (TxHash: ", txHash, ")")
 			}
@@ -541,8 +454,8 @@ func (h *AuthHandler) pollForProofSetID(pdptoolPath, serviceURL, serviceName, tx
 			continue
 		}
 
-		authLog.Warnf("[Goroutine Polling] Attempt %d: Encountered unhandled status for user %d (TxStatus: %s, TxSuccess: %s, CreatedStatus: %s). Retrying in %v... Output: %s",
-			attemptCounter, user.ID, txStatus, txSuccess, createdStatus, sleepDuration, statusOutput)
+		authLog.Warnf("[Goroutine Polling] Attempt %d: Encountered unhandled status for user %d (TxStatus: %s, TxSuccess: %t, CreatedStatus: %t). Retrying in %v...",
+			attemptCounter, user.ID, status.TxStatus, status.TxSuccess, status.Created, sleepDuration)
 		time.Sleep(sleepDuration)
 	}
 }
@@ -594,7 +507,11 @@ func (h *AuthHandler) CheckAuthStatus(c *gin.Context) {
 	var proofSet models.ProofSet
 	isReady := false
 	isInitiated := false
-	if err := h.db.Where("user_id = ?", claims.UserID).First(&proofSet).Error; err == nil {
+	query := h.db.Where("user_id = ?", claims.UserID)
+	if provider, err := selectStorageProvider(claims.UserID, ""); err == nil {
+		query = query.Where("provider_id = ?", provider.ID)
+	}
+	if err := query.First(&proofSet).Error; err == nil {
 		if proofSet.ProofSetID != "" {
 			isReady = true
 		}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
+)
+
+// useFakePDP serves every PDP service with an in-memory client for the
+// duration of the test.
+func useFakePDP(t *testing.T) *pdp.FakeClient {
+	t.Helper()
+	previous := pdpClientFor
+	fake := pdp.NewFakeClient()
+	SetPDPClientFactory(fake.Factory())
+	t.Cleanup(func() { pdpClientFor = previous })
+	return fake
+}
+
+func userProvider(t *testing.T, user *models.User) *models.StorageProvider {
+	t.Helper()
+	var provider models.StorageProvider
+	if err := db.First(&provider, *user.ProviderID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &provider
+}
+
+func TestCreateProofSetForUser(t *testing.T) {
+	useTestDB(t)
+	fake := useFakePDP(t)
+	user := createTestUser(t, "0x00000000000000000000000000000000000000aa")
+	provider := userProvider(t, user)
+
+	fake.FailNext("CreateProofSet", errors.New("service unavailable"))
+	if err := createProofSetForUser(user, provider); err == nil {
+		t.Fatal("createProofSetForUser succeeded although the service failed")
+	}
+	var count int64
+	db.Model(&models.ProofSet{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("%d proof sets stored for a failed creation", count)
+	}
+
+	if err := createProofSetForUser(user, provider); err != nil {
+		t.Fatal(err)
+	}
+	var proofSet models.ProofSet
+	if err := db.Where("user_id = ? AND provider_id = ?", user.ID, provider.ID).First(&proofSet).Error; err != nil {
+		t.Fatal(err)
+	}
+	if proofSet.ProofSetID != "1" || proofSet.TransactionHash == "" || proofSet.ServiceURL != provider.ServiceURL {
+		t.Errorf("stored proof set: %+v", proofSet)
+	}
+
+	// Polling returns the ID of a proof set the service has created.
+	if id, err := pollForProofSetID(fake, proofSet.TransactionHash, user); err != nil || id != "1" {
+		t.Errorf("pollForProofSetID = %q, %v", id, err)
+	}
+}
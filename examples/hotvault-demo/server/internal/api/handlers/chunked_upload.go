@@ -1,41 +1,77 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-type ChunkedUploadInfo struct {
-	ID             string       `json:"id"`
-	UserID         uint         `json:"userId"`
-	Filename       string       `json:"filename"`
-	ChunkSize      int64        `json:"chunkSize"`
-	TotalSize      int64        `json:"totalSize"`
-	TotalChunks    int          `json:"totalChunks"`
-	UploadedChunks int          `json:"uploadedChunks"`
-	ChunksReceived map[int]bool `json:"-"`
-	TempDir        string       `json:"-"`
-	Status         string       `json:"status"`
-	CreatedAt      time.Time    `json:"createdAt"`
-	UpdatedAt      time.Time    `json:"updatedAt"`
-	FileType       string       `json:"fileType"`
+const (
+	// chunkedUploadExpiry is how long an idle chunked upload session is
+	// kept before its chunks are removed.
+	chunkedUploadExpiry = 24 * time.Hour
+	// chunkFormOverhead is the room allowed for the multipart framing and
+	// form fields around a chunk.
+	chunkFormOverhead = 64 << 10
+	// chunkedPayloadName is the file the chunks are assembled into, next
+	// to the chunk_N files.
+	chunkedPayloadName = "payload"
+)
+
+// errUploadClaimed is returned when a chunked upload is being completed by
+// another request.
+var errUploadClaimed = errors.New("upload is already being processed")
+
+// chunkChecksumHeader carries the hex SHA-256 of a chunk. It may also be
+// sent as the "sha256" form field. A chunk without one is rejected unless
+// cfg.Uploads.AllowUnverifiedChunks is set, and so is a chunk that does
+// not match; the digest of the chunk as stored is returned either way.
+const chunkChecksumHeader = "X-Chunk-SHA256"
+
+// parseSHA256 normalises a hex SHA-256 digest, returning false if it is
+// malformed. An empty digest is valid and means none was supplied.
+func parseSHA256(digest string) (string, bool) {
+	digest = strings.ToLower(strings.TrimSpace(digest))
+	if digest == "" {
+		return "", true
+	}
+	if len(digest) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", false
+	}
+	return digest, true
 }
 
-var (
-	chunkedUploads      = make(map[string]*ChunkedUploadInfo)
-	chunkedUploadsMutex sync.RWMutex
-)
+// chunkSHA256 returns the hex SHA-256 of a received chunk.
+func chunkSHA256(upload *models.ChunkedUpload, index int) (string, error) {
+	file, err := os.Open(filepath.Join(upload.ChunkDir, fmt.Sprintf("chunk_%d", index)))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
 func init() {
 	go func() {
@@ -48,20 +84,57 @@ func init() {
 }
 
 func cleanupOldChunkedUploads() {
-	threshold := time.Now().Add(-24 * time.Hour)
-
-	chunkedUploadsMutex.Lock()
-	defer chunkedUploadsMutex.Unlock()
-
-	for id, info := range chunkedUploads {
-		if info.UpdatedAt.Before(threshold) {
-			if info.TempDir != "" {
-				os.RemoveAll(info.TempDir)
-			}
-			delete(chunkedUploads, id)
-			log.WithField("uploadId", id).Info("Cleaned up expired chunked upload")
+	if db == nil {
+		return
+	}
+
+	// Sessions being assembled or processed are owned by their upload job,
+	// which removes them when it finishes.
+	var expired []models.ChunkedUpload
+	if err := db.Where("updated_at < ?", time.Now().Add(-chunkedUploadExpiry)).
+		Where("status NOT IN ?", []string{"assembling", "processing"}).
+		Find(&expired).Error; err != nil {
+		log.WithField("error", err.Error()).Error("Failed to list expired chunked uploads")
+		return
+	}
+
+	for _, upload := range expired {
+		if upload.ChunkDir != "" {
+			os.RemoveAll(upload.ChunkDir)
 		}
+		if err := db.Delete(&upload).Error; err != nil {
+			log.WithField("uploadId", upload.ID).WithField("error", err.Error()).Error("Failed to delete expired chunked upload")
+			continue
+		}
+		log.WithField("uploadId", upload.ID).Info("Cleaned up expired chunked upload")
+	}
+}
+
+// loadChunkedUpload fetches a chunked upload session owned by userID. It
+// writes the error response and returns nil if there is none.
+func loadChunkedUpload(c *gin.Context, uploadID string, userID uint) *models.ChunkedUpload {
+	var upload models.ChunkedUpload
+	if err := db.First(&upload, "id = ?", uploadID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Upload ID not found",
+			})
+			return nil
+		}
+		log.WithField("uploadId", uploadID).WithField("error", err.Error()).Error("Failed to fetch chunked upload")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch upload",
+		})
+		return nil
+	}
+
+	if upload.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "You don't have permission to access this upload",
+		})
+		return nil
 	}
+	return &upload
 }
 
 func InitChunkedUpload(c *gin.Context) {
@@ -73,12 +146,18 @@ func InitChunkedUpload(c *gin.Context) {
 		return
 	}
 
+	if rejectIfUploadQueueFull(c) {
+		return
+	}
+
 	var request struct {
 		Filename    string `json:"filename" binding:"required"`
 		TotalSize   int64  `json:"totalSize" binding:"required"`
 		ChunkSize   int64  `json:"chunkSize" binding:"required"`
 		TotalChunks int    `json:"totalChunks" binding:"required"`
 		FileType    string `json:"fileType" binding:"required"`
+		Provider    string `json:"provider"`
+		SHA256      string `json:"sha256"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -88,36 +167,92 @@ func InitChunkedUpload(c *gin.Context) {
 		return
 	}
 
+	if request.TotalChunks < 1 || request.ChunkSize < 1 || request.TotalSize < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "totalSize, chunkSize and totalChunks must be positive",
+		})
+		return
+	}
+
+	if request.TotalSize > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "File too large",
+			"message": "Maximum file size is " + formatFileSize(maxUploadSize),
+		})
+		return
+	}
+
+	if chunks := (request.TotalSize + request.ChunkSize - 1) / request.ChunkSize; int64(request.TotalChunks) != chunks {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("totalChunks must be %d for a totalSize of %d in chunks of %d", chunks, request.TotalSize, request.ChunkSize),
+		})
+		return
+	}
+
+	fileDigest, ok := parseSHA256(request.SHA256)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "sha256 must be a hex-encoded SHA-256 digest",
+		})
+		return
+	}
+	if fileDigest == "" && !cfg.Uploads.AllowUnverifiedChunks {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "sha256 of the file is required",
+		})
+		return
+	}
+
+	provider, err := selectStorageProvider(userID.(uint), request.Provider)
+	if err != nil {
+		c.JSON(providerErrorStatus(err), gin.H{
+			"error": "Failed to select storage provider: " + err.Error(),
+		})
+		return
+	}
+
 	uploadID := uuid.New().String()
-	tempDir := filepath.Join(os.TempDir(), "chunked_uploads", uploadID)
+	chunkDir := filepath.Join(cfg.Uploads.ChunkDir, uploadID)
 
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
+	if err := os.MkdirAll(chunkDir, 0755); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to create temp directory: " + err.Error(),
+			"error": "Failed to create chunk directory: " + err.Error(),
 		})
 		return
 	}
 
-	now := time.Now()
-	uploadInfo := &ChunkedUploadInfo{
+	upload := &models.ChunkedUpload{
 		ID:             uploadID,
 		UserID:         userID.(uint),
+		ProviderID:     &provider.ID,
 		Filename:       request.Filename,
+		FileType:       request.FileType,
 		ChunkSize:      request.ChunkSize,
 		TotalSize:      request.TotalSize,
 		TotalChunks:    request.TotalChunks,
-		UploadedChunks: 0,
-		ChunksReceived: make(map[int]bool),
-		TempDir:        tempDir,
+		ChunksReceived: make([]byte, (request.TotalChunks+7)/8),
+		ChunkDir:       chunkDir,
+		SHA256:         fileDigest,
 		Status:         "initialized",
-		CreatedAt:      now,
-		UpdatedAt:      now,
-		FileType:       request.FileType,
 	}
-
-	chunkedUploadsMutex.Lock()
-	chunkedUploads[uploadID] = uploadInfo
-	chunkedUploadsMutex.Unlock()
+	// The session reserves its size against the quota until it is handed
+	// to a job.
+	usage, err := reserveQuota(upload.UserID, upload.TotalSize, nil, func(tx *gorm.DB) error {
+		return tx.Create(upload).Error
+	})
+	if errors.Is(err, errQuotaExceeded) {
+		os.RemoveAll(chunkDir)
+		respondQuotaExceeded(c, upload.UserID, upload.TotalSize, usage)
+		return
+	}
+	if err != nil {
+		os.RemoveAll(chunkDir)
+		log.WithField("error", err.Error()).Error("Failed to save chunked upload")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to initialize upload: " + err.Error(),
+		})
+		return
+	}
 
 	log.WithField("uploadId", uploadID).
 		WithField("filename", request.Filename).
@@ -165,21 +300,8 @@ func UploadChunk(c *gin.Context) {
 		return
 	}
 
-	chunkedUploadsMutex.RLock()
-	uploadInfo, exists := chunkedUploads[uploadID]
-	chunkedUploadsMutex.RUnlock()
-
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Upload ID not found",
-		})
-		return
-	}
-
-	if uploadInfo.UserID != userID.(uint) {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error": "You don't have permission to access this upload",
-		})
+	uploadInfo := loadChunkedUpload(c, uploadID, userID.(uint))
+	if uploadInfo == nil {
 		return
 	}
 
@@ -190,28 +312,73 @@ func UploadChunk(c *gin.Context) {
 		return
 	}
 
-	chunkedUploadsMutex.RLock()
-	_, chunkExists := uploadInfo.ChunksReceived[chunkIndex]
-	chunkedUploadsMutex.RUnlock()
-
-	if chunkExists {
-		c.JSON(http.StatusOK, gin.H{
+	if uploadInfo.HasChunk(chunkIndex) {
+		response := gin.H{
 			"message":        fmt.Sprintf("Chunk %d already received", chunkIndex),
 			"uploadId":       uploadID,
 			"chunkIndex":     chunkIndex,
 			"uploadedChunks": uploadInfo.UploadedChunks,
 			"totalChunks":    uploadInfo.TotalChunks,
+		}
+		if digest, err := chunkSHA256(uploadInfo, chunkIndex); err == nil {
+			response["sha256"] = digest
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if uploadInfo.Status == "assembling" || uploadInfo.Status == "processing" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Upload is already being processed",
 		})
 		return
 	}
 
+	// Every chunk but the last is ChunkSize bytes.
+	chunkLimit := uploadInfo.TotalSize - int64(chunkIndex)*uploadInfo.ChunkSize
+	if chunkLimit > uploadInfo.ChunkSize {
+		chunkLimit = uploadInfo.ChunkSize
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, chunkLimit+chunkFormOverhead)
+
 	file, err := c.FormFile("chunk")
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Chunk %d must not exceed %d bytes", chunkIndex, chunkLimit),
+			})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Failed to get chunk data: " + err.Error(),
 		})
 		return
 	}
+	if file.Size > chunkLimit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("Chunk %d must not exceed %d bytes", chunkIndex, chunkLimit),
+		})
+		return
+	}
+
+	checksum := c.GetHeader(chunkChecksumHeader)
+	if checksum == "" {
+		checksum = c.PostForm("sha256")
+	}
+	chunkDigest, ok := parseSHA256(checksum)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Chunk checksum must be a hex-encoded SHA-256 digest",
+		})
+		return
+	}
+	if chunkDigest == "" && !cfg.Uploads.AllowUnverifiedChunks {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Chunk checksum is required in the " + chunkChecksumHeader + " header or sha256 form field",
+		})
+		return
+	}
 
 	src, err := file.Open()
 	if err != nil {
@@ -222,33 +389,95 @@ func UploadChunk(c *gin.Context) {
 	}
 	defer src.Close()
 
-	chunkPath := filepath.Join(uploadInfo.TempDir, fmt.Sprintf("chunk_%d", chunkIndex))
-	dst, err := os.Create(chunkPath)
+	if err := os.MkdirAll(uploadInfo.ChunkDir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create chunk directory: " + err.Error(),
+		})
+		return
+	}
+
+	// The chunk is written under a temporary name and renamed once complete,
+	// so a crash never leaves a partial chunk that looks received.
+	chunkPath := filepath.Join(uploadInfo.ChunkDir, fmt.Sprintf("chunk_%d", chunkIndex))
+	partPath := chunkPath + ".part"
+	dst, err := os.Create(partPath)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to create chunk file: " + err.Error(),
 		})
 		return
 	}
-	defer dst.Close()
 
-	if _, err = io.Copy(dst, src); err != nil {
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(dst, hasher), src); err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partPath)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to save chunk data: " + err.Error(),
 		})
 		return
 	}
 
-	chunkedUploadsMutex.Lock()
-	uploadInfo.ChunksReceived[chunkIndex] = true
-	uploadInfo.UploadedChunks++
-	uploadInfo.UpdatedAt = time.Now()
-	if uploadInfo.UploadedChunks == uploadInfo.TotalChunks {
-		uploadInfo.Status = "allChunksReceived"
-	} else {
-		uploadInfo.Status = "inProgress"
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if chunkDigest != "" && actual != chunkDigest {
+		os.Remove(partPath)
+		log.WithField("uploadId", uploadID).
+			WithField("chunkIndex", chunkIndex).
+			WithField("expected", chunkDigest).
+			WithField("actual", actual).
+			Warning("Rejected chunk with checksum mismatch")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":      fmt.Sprintf("Chunk %d failed checksum verification", chunkIndex),
+			"uploadId":   uploadID,
+			"chunkIndex": chunkIndex,
+			"expected":   chunkDigest,
+			"actual":     actual,
+			"retryable":  true,
+		})
+		return
+	}
+
+	if err := os.Rename(partPath, chunkPath); err != nil {
+		os.Remove(partPath)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to save chunk data: " + err.Error(),
+		})
+		return
+	}
+
+	// Record the chunk under a row lock so concurrent chunks of the same
+	// upload don't overwrite each other's bits.
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(uploadInfo, "id = ?", uploadID).Error; err != nil {
+			return err
+		}
+		if !uploadInfo.MarkChunk(chunkIndex) {
+			return nil
+		}
+		if uploadInfo.UploadedChunks == uploadInfo.TotalChunks {
+			uploadInfo.Status = "allChunksReceived"
+		} else {
+			uploadInfo.Status = "inProgress"
+		}
+		return tx.Model(uploadInfo).Updates(map[string]interface{}{
+			"chunks_received": uploadInfo.ChunksReceived,
+			"uploaded_chunks": uploadInfo.UploadedChunks,
+			"status":          uploadInfo.Status,
+		}).Error
+	})
+	if err != nil {
+		log.WithField("uploadId", uploadID).WithField("error", err.Error()).Error("Failed to record chunk")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to record chunk: " + err.Error(),
+		})
+		return
 	}
-	chunkedUploadsMutex.Unlock()
 
 	log.WithField("uploadId", uploadID).
 		WithField("chunkIndex", chunkIndex).
@@ -263,6 +492,7 @@ func UploadChunk(c *gin.Context) {
 		"uploadedChunks":    uploadInfo.UploadedChunks,
 		"totalChunks":       uploadInfo.TotalChunks,
 		"allChunksReceived": uploadInfo.UploadedChunks == uploadInfo.TotalChunks,
+		"sha256":            actual,
 	})
 }
 
@@ -286,21 +516,8 @@ func CompleteChunkedUpload(c *gin.Context) {
 		return
 	}
 
-	chunkedUploadsMutex.RLock()
-	uploadInfo, exists := chunkedUploads[request.UploadID]
-	chunkedUploadsMutex.RUnlock()
-
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Upload ID not found",
-		})
-		return
-	}
-
-	if uploadInfo.UserID != userID.(uint) {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error": "You don't have permission to access this upload",
-		})
+	uploadInfo := loadChunkedUpload(c, request.UploadID, userID.(uint))
+	if uploadInfo == nil {
 		return
 	}
 
@@ -310,17 +527,69 @@ func CompleteChunkedUpload(c *gin.Context) {
 				uploadInfo.UploadedChunks, uploadInfo.TotalChunks),
 			"uploadedChunks": uploadInfo.UploadedChunks,
 			"totalChunks":    uploadInfo.TotalChunks,
+			"missingChunks":  uploadInfo.MissingChunks(),
 		})
 		return
 	}
 
-	chunkedUploadsMutex.Lock()
-	uploadInfo.Status = "assembling"
-	chunkedUploadsMutex.Unlock()
+	if uploadInfo.Status == "assembling" || uploadInfo.Status == "processing" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Upload is already being processed",
+			"jobId": uploadInfo.JobID,
+		})
+		return
+	}
+
+	if rejectIfUploadQueueFull(c) {
+		return
+	}
 
 	jobID := uuid.New().String()
 
-	go assembleAndProcessFile(uploadInfo, jobID, userID.(uint))
+	job := &models.UploadJob{
+		ID:              jobID,
+		UserID:          userID.(uint),
+		ProviderID:      uploadInfo.ProviderID,
+		Filename:        uploadInfo.Filename,
+		TotalSize:       uploadInfo.TotalSize,
+		PayloadPath:     filepath.Join(uploadInfo.ChunkDir, chunkedPayloadName),
+		ChunkDir:        uploadInfo.ChunkDir,
+		ChunkCount:      uploadInfo.TotalChunks,
+		ChunkedUploadID: uploadInfo.ID,
+		SHA256:          uploadInfo.SHA256,
+		Stage:           models.UploadStageQueued,
+		Status:          "assembling",
+		Message:         "Waiting for an upload worker",
+	}
+	// Claim the session as the job is queued so two completes can't both
+	// enqueue a job for it. The job takes over the session's quota
+	// reservation.
+	usage, err := enqueueUploadJob(job, func(tx *gorm.DB) error {
+		result := tx.Model(&models.ChunkedUpload{}).
+			Where("id = ? AND status NOT IN ?", uploadInfo.ID, []string{"assembling", "processing"}).
+			Updates(map[string]interface{}{"status": "assembling", "job_id": jobID})
+		if result.Error == nil && result.RowsAffected == 0 {
+			return errUploadClaimed
+		}
+		return result.Error
+	})
+	if errors.Is(err, errUploadClaimed) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Upload is already being processed",
+		})
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		respondQuotaExceeded(c, userID.(uint), uploadInfo.TotalSize, usage)
+		return
+	}
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("uploadId", uploadInfo.ID).Error("Failed to queue upload job")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to queue upload: " + err.Error(),
+		})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "Finalizing chunked upload",
@@ -347,21 +616,8 @@ func GetChunkedUploadStatus(c *gin.Context) {
 		return
 	}
 
-	chunkedUploadsMutex.RLock()
-	uploadInfo, exists := chunkedUploads[uploadID]
-	chunkedUploadsMutex.RUnlock()
-
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Upload ID not found",
-		})
-		return
-	}
-
-	if uploadInfo.UserID != userID.(uint) {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error": "You don't have permission to access this upload",
-		})
+	uploadInfo := loadChunkedUpload(c, uploadID, userID.(uint))
+	if uploadInfo == nil {
 		return
 	}
 
@@ -370,50 +626,51 @@ func GetChunkedUploadStatus(c *gin.Context) {
 		"status":         uploadInfo.Status,
 		"uploadedChunks": uploadInfo.UploadedChunks,
 		"totalChunks":    uploadInfo.TotalChunks,
+		"missingChunks":  uploadInfo.MissingChunks(),
+		"chunkSize":      uploadInfo.ChunkSize,
 		"filename":       uploadInfo.Filename,
 		"totalSize":      uploadInfo.TotalSize,
 		"progress":       float64(uploadInfo.UploadedChunks) / float64(uploadInfo.TotalChunks) * 100,
+		"jobId":          uploadInfo.JobID,
 	})
 }
 
-func assembleAndProcessFile(uploadInfo *ChunkedUploadInfo, jobID string, userID uint) {
-	uploadJobsLock.Lock()
-	uploadJobs[jobID] = UploadProgress{
-		Status:    "assembling",
-		Progress:  0,
-		Message:   "Assembling file chunks",
-		Filename:  uploadInfo.Filename,
-		TotalSize: uploadInfo.TotalSize,
-		JobID:     jobID,
-	}
-	uploadJobsLock.Unlock()
-
-	chunkedUploadsMutex.Lock()
-	uploadInfo.Status = "assembling"
-	chunkedUploadsMutex.Unlock()
-
-	if _, err := os.Stat(uploadInfo.TempDir); os.IsNotExist(err) {
-		log.WithField("tempDir", uploadInfo.TempDir).Error("Temp directory doesn't exist")
-		updateJobStatus(jobID, UploadProgress{
+// assembleChunks joins the chunks of a chunked upload job into its payload
+// file. It reports a failure on the job and returns false if the chunks
+// cannot be assembled.
+func assembleChunks(job *models.UploadJob) bool {
+	jobID := job.ID
+	chunkDir := job.ChunkDir
+
+	setChunkedUploadStatus(job.ChunkedUploadID, "assembling")
+	saveUploadProgress(jobID, UploadProgress{
+		Status:   "assembling",
+		Progress: 0,
+		Message:  "Assembling file chunks",
+	})
+
+	if _, err := os.Stat(chunkDir); os.IsNotExist(err) {
+		log.WithField("tempDir", chunkDir).Error("Temp directory doesn't exist")
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
 			Error:   "Failed to locate temporary directory",
-			Message: fmt.Sprintf("Directory %s doesn't exist", uploadInfo.TempDir),
+			Message: fmt.Sprintf("Directory %s doesn't exist", chunkDir),
 		})
-		return
+		return false
 	}
 
-	finalFilePath := filepath.Join(uploadInfo.TempDir, uploadInfo.Filename)
+	finalFilePath := job.PayloadPath
 
 	if _, err := os.Stat(finalFilePath); err == nil {
 		log.WithField("finalFilePath", finalFilePath).Info("Final file already exists, removing it")
 		if err := os.Remove(finalFilePath); err != nil {
 			log.WithField("error", err.Error()).Error("Failed to remove existing final file")
-			updateJobStatus(jobID, UploadProgress{
+			saveUploadProgress(jobID, UploadProgress{
 				Status:  "error",
 				Error:   "Failed to prepare final file",
 				Message: fmt.Sprintf("Failed to remove existing file: %s", err.Error()),
 			})
-			return
+			return false
 		}
 	}
 
@@ -422,12 +679,12 @@ func assembleAndProcessFile(uploadInfo *ChunkedUploadInfo, jobID string, userID
 		log.WithField("error", err.Error()).
 			WithField("finalFilePath", finalFilePath).
 			Error("Failed to create final file")
-		updateJobStatus(jobID, UploadProgress{
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
 			Error:   "Failed to create final file",
 			Message: err.Error(),
 		})
-		return
+		return false
 	}
 
 	defer func() {
@@ -437,28 +694,25 @@ func assembleAndProcessFile(uploadInfo *ChunkedUploadInfo, jobID string, userID
 	}()
 
 	totalBytesWritten := int64(0)
-	missingChunks := false
+	hasher := sha256.New()
 
-	for i := 0; i < uploadInfo.TotalChunks; i++ {
-		updateJobStatus(jobID, UploadProgress{
-			Status:    "assembling",
-			Progress:  int(float64(i) / float64(uploadInfo.TotalChunks) * 30), // Assembly = 0-30%
-			Message:   fmt.Sprintf("Assembling chunks: %d/%d", i+1, uploadInfo.TotalChunks),
-			Filename:  uploadInfo.Filename,
-			TotalSize: uploadInfo.TotalSize,
+	for i := 0; i < job.ChunkCount; i++ {
+		saveUploadProgress(jobID, UploadProgress{
+			Status:   "assembling",
+			Progress: int(float64(i) / float64(job.ChunkCount) * 30), // Assembly = 0-30%
+			Message:  fmt.Sprintf("Assembling chunks: %d/%d", i+1, job.ChunkCount),
 		})
 
-		chunkPath := filepath.Join(uploadInfo.TempDir, fmt.Sprintf("chunk_%d", i))
+		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("chunk_%d", i))
 
 		if _, err := os.Stat(chunkPath); os.IsNotExist(err) {
 			log.WithField("chunkPath", chunkPath).Error("Chunk file doesn't exist")
-			missingChunks = true
-			updateJobStatus(jobID, UploadProgress{
+			saveUploadProgress(jobID, UploadProgress{
 				Status:  "error",
 				Error:   fmt.Sprintf("Missing chunk %d", i),
 				Message: fmt.Sprintf("Chunk file %s doesn't exist", chunkPath),
 			})
-			return
+			return false
 		}
 
 		chunkData, err := ioutil.ReadFile(chunkPath)
@@ -466,65 +720,74 @@ func assembleAndProcessFile(uploadInfo *ChunkedUploadInfo, jobID string, userID
 			log.WithField("error", err.Error()).
 				WithField("chunkPath", chunkPath).
 				Error("Failed to read chunk")
-			updateJobStatus(jobID, UploadProgress{
+			saveUploadProgress(jobID, UploadProgress{
 				Status:  "error",
 				Error:   fmt.Sprintf("Failed to read chunk %d", i),
 				Message: err.Error(),
 			})
-			return
+			return false
 		}
 
+		hasher.Write(chunkData)
 		bytesWritten, err := finalFile.Write(chunkData)
 		if err != nil {
 			log.WithField("error", err.Error()).
 				WithField("chunkPath", chunkPath).
 				Error("Failed to write chunk to final file")
-			updateJobStatus(jobID, UploadProgress{
+			saveUploadProgress(jobID, UploadProgress{
 				Status:  "error",
 				Error:   fmt.Sprintf("Failed to write chunk %d to final file", i),
 				Message: err.Error(),
 			})
-			return
+			return false
 		}
 
 		totalBytesWritten += int64(bytesWritten)
 	}
 
-	if missingChunks {
-		log.Error("Some chunks were missing, cannot assemble file")
-		return
-	}
-
-	if totalBytesWritten != uploadInfo.TotalSize {
-		log.WithField("expectedSize", uploadInfo.TotalSize).
+	if totalBytesWritten != job.TotalSize {
+		log.WithField("expectedSize", job.TotalSize).
 			WithField("actualSize", totalBytesWritten).
 			Error("Assembled file size mismatch")
-		updateJobStatus(jobID, UploadProgress{
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
 			Error:   "Assembled file size mismatch",
-			Message: fmt.Sprintf("Expected %d bytes but wrote %d bytes", uploadInfo.TotalSize, totalBytesWritten),
+			Message: fmt.Sprintf("Expected %d bytes but wrote %d bytes", job.TotalSize, totalBytesWritten),
 		})
-		return
+		return false
+	}
+
+	if actual := hex.EncodeToString(hasher.Sum(nil)); job.SHA256 != "" && actual != job.SHA256 {
+		log.WithField("jobID", jobID).
+			WithField("expected", job.SHA256).
+			WithField("actual", actual).
+			Error("Assembled file checksum mismatch")
+		saveUploadProgress(jobID, UploadProgress{
+			Status:  "error",
+			Error:   "Assembled file checksum mismatch",
+			Message: fmt.Sprintf("Expected SHA-256 %s but the assembled file hashes to %s", job.SHA256, actual),
+		})
+		return false
 	}
 
 	if err := finalFile.Sync(); err != nil {
 		log.WithField("error", err.Error()).Error("Failed to sync final file")
-		updateJobStatus(jobID, UploadProgress{
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
 			Error:   "Failed to sync final file",
 			Message: err.Error(),
 		})
-		return
+		return false
 	}
 
 	if err := finalFile.Close(); err != nil {
 		log.WithField("error", err.Error()).Error("Failed to close final file")
-		updateJobStatus(jobID, UploadProgress{
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
 			Error:   "Failed to close final file",
 			Message: err.Error(),
 		})
-		return
+		return false
 	}
 
 	finalFile = nil
@@ -534,143 +797,45 @@ func assembleAndProcessFile(uploadInfo *ChunkedUploadInfo, jobID string, userID
 		log.WithField("error", err.Error()).
 			WithField("finalFilePath", finalFilePath).
 			Error("Failed to stat assembled file")
-		updateJobStatus(jobID, UploadProgress{
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
 			Error:   "Failed to verify assembled file",
 			Message: fmt.Sprintf("Error: %s", err.Error()),
 		})
-		return
+		return false
 	}
 
-	if fileInfo.Size() != uploadInfo.TotalSize {
-		log.WithField("expectedSize", uploadInfo.TotalSize).
+	if fileInfo.Size() != job.TotalSize {
+		log.WithField("expectedSize", job.TotalSize).
 			WithField("actualSize", fileInfo.Size()).
 			Error("Final file size mismatch after stat")
-		updateJobStatus(jobID, UploadProgress{
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
 			Error:   "Final file size mismatch",
-			Message: fmt.Sprintf("Expected %d bytes but got %d bytes", uploadInfo.TotalSize, fileInfo.Size()),
+			Message: fmt.Sprintf("Expected %d bytes but got %d bytes", job.TotalSize, fileInfo.Size()),
 		})
-		return
+		return false
 	}
 
-	updateJobStatus(jobID, UploadProgress{
-		Status:    "processing",
-		Progress:  30,
-		Message:   "File assembled, starting processing",
-		Filename:  uploadInfo.Filename,
-		TotalSize: uploadInfo.TotalSize,
+	saveUploadProgress(jobID, UploadProgress{
+		Status:   "processing",
+		Progress: 30,
+		Message:  "File assembled, starting processing",
 	})
-
-	chunkedUploadsMutex.Lock()
-	uploadInfo.Status = "processing"
-	chunkedUploadsMutex.Unlock()
+	setChunkedUploadStatus(job.ChunkedUploadID, "processing")
 
 	log.WithField("finalFilePath", finalFilePath).
 		WithField("fileSize", fileInfo.Size()).
 		Info("File successfully assembled, proceeding to processing")
+	return true
+}
 
-	fileHeader := &multipart.FileHeader{
-		Filename: uploadInfo.Filename,
-		Size:     uploadInfo.TotalSize,
-		Header:   make(map[string][]string),
-	}
-
-	uploadPathsLock.Lock()
-	filePaths[jobID] = finalFilePath
-	log.WithField("jobID", jobID).
-		WithField("finalFilePath", finalFilePath).
-		Info("Storing file path for processing")
-	uploadPathsLock.Unlock()
-
-	uploadPathsLock.RLock()
-	storedPath, pathExists := filePaths[jobID]
-	uploadPathsLock.RUnlock()
-
-	if !pathExists || storedPath != finalFilePath {
-		log.WithField("jobID", jobID).
-			WithField("expectedPath", finalFilePath).
-			WithField("storedPath", storedPath).
-			WithField("pathExists", pathExists).
-			Error("File path was not stored correctly")
-		updateJobStatus(jobID, UploadProgress{
-			Status:  "error",
-			Error:   "Internal error: file path not stored correctly",
-			Message: "Please try again or contact support",
-		})
+// setChunkedUploadStatus updates the status of a chunked upload session.
+func setChunkedUploadStatus(uploadID, status string) {
+	if uploadID == "" {
 		return
 	}
-
-	processUpload(jobID, fileHeader, userID, cfg.PdptoolPath)
-
-	go func() {
-		time.Sleep(5 * time.Second)
-
-		uploadJobsLock.RLock()
-		progress, exists := uploadJobs[jobID]
-		uploadJobsLock.RUnlock()
-
-		if exists && (progress.Status == "complete" || progress.Status == "error") {
-			log.WithField("tempDir", uploadInfo.TempDir).Info("Cleaning up temp directory after completion")
-			os.RemoveAll(uploadInfo.TempDir)
-
-			uploadPathsLock.Lock()
-			delete(filePaths, jobID)
-			uploadPathsLock.Unlock()
-
-			chunkedUploadsMutex.Lock()
-			delete(chunkedUploads, uploadInfo.ID)
-			chunkedUploadsMutex.Unlock()
-
-			log.WithField("uploadId", uploadInfo.ID).
-				WithField("jobId", jobID).
-				Info("Cleaned up completed chunked upload")
-		} else {
-			log.WithField("uploadId", uploadInfo.ID).
-				WithField("jobId", jobID).
-				WithField("status", progress.Status).
-				Info("Upload still in progress, will clean up later")
-
-			go func() {
-				cleanupTicker := time.NewTicker(10 * time.Second)
-				defer cleanupTicker.Stop()
-
-				for range cleanupTicker.C {
-					uploadJobsLock.RLock()
-					progress, exists := uploadJobs[jobID]
-					uploadJobsLock.RUnlock()
-
-					if !exists || progress.Status == "complete" || progress.Status == "error" {
-						log.WithField("uploadId", uploadInfo.ID).
-							WithField("jobId", jobID).
-							Info("Cleaning up chunked upload in delayed cleanup")
-
-						os.RemoveAll(uploadInfo.TempDir)
-
-						uploadPathsLock.Lock()
-						delete(filePaths, jobID)
-						uploadPathsLock.Unlock()
-
-						chunkedUploadsMutex.Lock()
-						delete(chunkedUploads, uploadInfo.ID)
-						chunkedUploadsMutex.Unlock()
-
-						return
-					}
-				}
-			}()
-		}
-	}()
-}
-
-var (
-	filePaths       = make(map[string]string)
-	uploadPathsLock sync.RWMutex
-)
-
-func updateJobStatus(jobID string, progress UploadProgress) {
-	progress.JobID = jobID
-	uploadJobsLock.Lock()
-	uploadJobs[jobID] = progress
-	uploadJobsLock.Unlock()
+	if err := db.Model(&models.ChunkedUpload{}).Where("id = ?", uploadID).Update("status", status).Error; err != nil {
+		log.WithField("uploadId", uploadID).WithField("error", err.Error()).Warning("Failed to update chunked upload status")
+	}
 }
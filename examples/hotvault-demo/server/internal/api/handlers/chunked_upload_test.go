@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+)
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseSHA256(t *testing.T) {
+	digest := hexSHA256([]byte("hotvault"))
+	for input, want := range map[string]string{
+		"":                            "",
+		digest:                        digest,
+		" " + strings.ToUpper(digest): digest,
+	} {
+		if got, ok := parseSHA256(input); !ok || got != want {
+			t.Errorf("parseSHA256(%q) = %q, %v; want %q", input, got, ok, want)
+		}
+	}
+	for _, input := range []string{"abc", digest[:62], "zz" + digest[2:], digest + "00"} {
+		if _, ok := parseSHA256(input); ok {
+			t.Errorf("parseSHA256(%q) accepted a malformed digest", input)
+		}
+	}
+}
+
+// decode unmarshals a JSON response body.
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response %q: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+func jsonRequest(method, target string, body interface{}) *http.Request {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest(method, target, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func initChunked(t *testing.T, userID uint, size int64, chunkSize int64, digest string) *httptest.ResponseRecorder {
+	t.Helper()
+	chunks := (size + chunkSize - 1) / chunkSize
+	return serveAs(userID, InitChunkedUpload, jsonRequest("POST", "/api/v1/upload/chunked/init", gin.H{
+		"filename":    "report.pdf",
+		"totalSize":   size,
+		"chunkSize":   chunkSize,
+		"totalChunks": chunks,
+		"fileType":    "application/pdf",
+		"sha256":      digest,
+	}))
+}
+
+// sendChunk uploads a chunk with its digest in the checksum header, or in
+// the form when formDigest is set.
+func sendChunk(userID uint, uploadID string, index int, data []byte, digest string, formDigest bool) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if formDigest {
+		form.WriteField("sha256", digest)
+	}
+	part, _ := form.CreateFormFile("chunk", "chunk")
+	part.Write(data)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/api/v1/upload/chunked/chunk?uploadId="+uploadID+"&chunkIndex="+strconv.Itoa(index), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if !formDigest && digest != "" {
+		r.Header.Set(chunkChecksumHeader, digest)
+	}
+	return serveAs(userID, UploadChunk, r)
+}
+
+func chunkedStatus(t *testing.T, userID uint, uploadID string) map[string]interface{} {
+	t.Helper()
+	w := serveAs(userID, GetChunkedUploadStatus, httptest.NewRequest("GET", "/api/v1/upload/chunked/status/"+uploadID, nil),
+		gin.Param{Key: "uploadId", Value: uploadID})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status: %d %s", w.Code, w.Body)
+	}
+	return decode(t, w)
+}
+
+func completeChunked(userID uint, uploadID string) *httptest.ResponseRecorder {
+	return serveAs(userID, CompleteChunkedUpload, jsonRequest("POST", "/api/v1/upload/chunked/complete", gin.H{"uploadId": uploadID}))
+}
+
+func TestChunkedUploadSession(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xchunked")
+
+	data := []byte("0123456789")
+	chunks := [][]byte{data[0:4], data[4:8], data[8:10]}
+	w := initChunked(t, user.ID, int64(len(data)), 4, hexSHA256(data))
+	if w.Code != http.StatusOK {
+		t.Fatalf("init: %d %s", w.Code, w.Body)
+	}
+	uploadID := decode(t, w)["uploadId"].(string)
+
+	// A chunk that does not match its checksum is refused and stays missing.
+	w = sendChunk(user.ID, uploadID, 1, []byte("4567"), hexSHA256([]byte("xxxx")), false)
+	if w.Code != http.StatusUnprocessableEntity || decode(t, w)["retryable"] != true {
+		t.Fatalf("corrupted chunk: %d %s", w.Code, w.Body)
+	}
+	if missing := chunkedStatus(t, user.ID, uploadID)["missingChunks"]; !reflect.DeepEqual(missing, []interface{}{0.0, 1.0, 2.0}) {
+		t.Errorf("missingChunks = %v after a rejected chunk", missing)
+	}
+
+	w = sendChunk(user.ID, uploadID, 1, chunks[1], hexSHA256(chunks[1]), false)
+	if w.Code != http.StatusOK || decode(t, w)["sha256"] != hexSHA256(chunks[1]) {
+		t.Fatalf("chunk 1: %d %s", w.Code, w.Body)
+	}
+	w = sendChunk(user.ID, uploadID, 1, []byte("other"), hexSHA256([]byte("other")), false)
+	if body := decode(t, w); w.Code != http.StatusOK || body["uploadedChunks"] != 1.0 || body["sha256"] != hexSHA256(chunks[1]) {
+		t.Errorf("chunk 1 sent again: %d %s", w.Code, w.Body)
+	}
+
+	w = completeChunked(user.ID, uploadID)
+	if body := decode(t, w); w.Code != http.StatusBadRequest || !reflect.DeepEqual(body["missingChunks"], []interface{}{0.0, 2.0}) {
+		t.Fatalf("early complete: %d %s", w.Code, w.Body)
+	}
+
+	if w = sendChunk(user.ID, uploadID, 0, chunks[0], "", false); w.Code != http.StatusBadRequest {
+		t.Errorf("chunk without a digest: %d %s", w.Code, w.Body)
+	}
+	if w = sendChunk(user.ID, uploadID, 0, chunks[0], hexSHA256(chunks[0]), false); w.Code != http.StatusOK {
+		t.Fatalf("chunk 0: %d %s", w.Code, w.Body)
+	}
+	if w = sendChunk(user.ID, uploadID, 2, chunks[2], hexSHA256(chunks[2]), true); w.Code != http.StatusOK || decode(t, w)["allChunksReceived"] != true {
+		t.Fatalf("chunk 2: %d %s", w.Code, w.Body)
+	}
+	status := chunkedStatus(t, user.ID, uploadID)
+	if status["status"] != "allChunksReceived" || len(status["missingChunks"].([]interface{})) != 0 {
+		t.Errorf("status after the last chunk: %v", status)
+	}
+
+	w = completeChunked(user.ID, uploadID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	jobID := decode(t, w)["jobId"].(string)
+	if w = completeChunked(user.ID, uploadID); w.Code != http.StatusConflict {
+		t.Errorf("second complete: %d %s, want 409", w.Code, w.Body)
+	}
+
+	job, err := loadUploadJob(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ChunkedUploadID != uploadID || job.TotalSize != int64(len(data)) || job.ChunkCount != 3 || job.Status != "assembling" {
+		t.Errorf("queued job: %+v", job)
+	}
+	var session models.ChunkedUpload
+	db.First(&session, "id = ?", uploadID)
+	if session.JobID != jobID || session.Status != "assembling" {
+		t.Errorf("session after complete: job %q, status %q", session.JobID, session.Status)
+	}
+
+	// The job took over the session's reservation rather than adding to it.
+	usage, err := storageUsageFor(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.PendingBytes != int64(len(data)) || usage.PendingPieces != 1 {
+		t.Errorf("pending %d bytes in %d pieces, want %d bytes in 1", usage.PendingBytes, usage.PendingPieces, len(data))
+	}
+
+	if !assembleChunks(job) {
+		t.Fatal("assembleChunks failed")
+	}
+	if assembled, err := os.ReadFile(job.PayloadPath); err != nil || !bytes.Equal(assembled, data) {
+		t.Errorf("assembled %q, %v; want %q", assembled, err, data)
+	}
+}
+
+func TestChunkedUploadRejectsBadAssembly(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xassembly")
+
+	w := initChunked(t, user.ID, 4, 4, hexSHA256([]byte("abcd")))
+	uploadID := decode(t, w)["uploadId"].(string)
+	sendChunk(user.ID, uploadID, 0, []byte("abce"), hexSHA256([]byte("abce")), false)
+	jobID := decode(t, completeChunked(user.ID, uploadID))["jobId"].(string)
+
+	job, _ := loadUploadJob(jobID)
+	if assembleChunks(job) {
+		t.Fatal("assembled a file that does not match its digest")
+	}
+	if job, _ = loadUploadJob(jobID); job.Status != "error" || job.Error != "Assembled file checksum mismatch" {
+		t.Errorf("job status %q, error %q", job.Status, job.Error)
+	}
+}
+
+func TestChunkedUploadAccess(t *testing.T) {
+	useTestDB(t)
+	owner := createTestUser(t, "0xowner")
+	other := createTestUser(t, "0xother")
+
+	uploadID := decode(t, initChunked(t, owner.ID, 4, 4, hexSHA256([]byte("abcd"))))["uploadId"].(string)
+	if w := sendChunk(other.ID, uploadID, 0, []byte("abcd"), hexSHA256([]byte("abcd")), false); w.Code != http.StatusForbidden {
+		t.Errorf("chunk from another user: %d", w.Code)
+	}
+	if w := completeChunked(other.ID, uploadID); w.Code != http.StatusForbidden {
+		t.Errorf("complete by another user: %d", w.Code)
+	}
+	if w := sendChunk(owner.ID, uploadID, 1, []byte("abcd"), hexSHA256([]byte("abcd")), false); w.Code != http.StatusBadRequest {
+		t.Errorf("chunk out of range: %d", w.Code)
+	}
+	if w := sendChunk(owner.ID, "missing", 0, []byte("abcd"), hexSHA256([]byte("abcd")), false); w.Code != http.StatusNotFound {
+		t.Errorf("unknown upload: %d", w.Code)
+	}
+}
+
+func TestChunkedUploadQuota(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xquota")
+	quota := int64(10)
+	db.Model(user).Update("quota_bytes", quota)
+
+	w := initChunked(t, user.ID, 8, 4, hexSHA256([]byte("abcdefgh")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("init within the quota: %d %s", w.Code, w.Body)
+	}
+	uploadID := decode(t, w)["uploadId"].(string)
+
+	// The first session holds 8 of the 10 bytes until it is stored.
+	if w := initChunked(t, user.ID, 8, 4, hexSHA256([]byte("abcdefgh"))); w.Code != http.StatusForbidden {
+		t.Errorf("init over the quota: %d %s", w.Code, w.Body)
+	}
+
+	sendChunk(user.ID, uploadID, 0, []byte("abcd"), hexSHA256([]byte("abcd")), false)
+	sendChunk(user.ID, uploadID, 1, []byte("efgh"), hexSHA256([]byte("efgh")), false)
+	if w := completeChunked(user.ID, uploadID); w.Code != http.StatusOK {
+		t.Errorf("complete of a session that holds its reservation: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestChunkedUploadLimits(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xlimits")
+
+	for name, request := range map[string]gin.H{
+		"too many chunks":   {"totalSize": 10, "chunkSize": 4, "totalChunks": 1 << 30},
+		"too few chunks":    {"totalSize": 10, "chunkSize": 4, "totalChunks": 2},
+		"larger than a max": {"totalSize": maxUploadSize + 1, "chunkSize": maxUploadSize, "totalChunks": 2},
+	} {
+		request["filename"] = "big.bin"
+		request["fileType"] = "application/octet-stream"
+		request["sha256"] = hexSHA256(nil)
+		w := serveAs(user.ID, InitChunkedUpload, jsonRequest("POST", "/api/v1/upload/chunked/init", request))
+		if w.Code != http.StatusBadRequest && w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	// A file named like a chunk is assembled next to the chunks without
+	// overwriting them.
+	w := serveAs(user.ID, InitChunkedUpload, jsonRequest("POST", "/api/v1/upload/chunked/init", gin.H{
+		"filename": "chunk_0", "fileType": "application/octet-stream", "totalSize": 6, "chunkSize": 4, "totalChunks": 2,
+		"sha256": hexSHA256([]byte("abcdef")),
+	}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("init: %d %s", w.Code, w.Body)
+	}
+	uploadID := decode(t, w)["uploadId"].(string)
+
+	if w := sendChunk(user.ID, uploadID, 0, []byte("abcde"), hexSHA256([]byte("abcde")), false); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk larger than chunkSize: %d %s", w.Code, w.Body)
+	}
+	if w := sendChunk(user.ID, uploadID, 1, []byte("efg"), hexSHA256([]byte("efg")), false); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("last chunk past totalSize: %d %s", w.Code, w.Body)
+	}
+	sendChunk(user.ID, uploadID, 0, []byte("abcd"), hexSHA256([]byte("abcd")), false)
+	sendChunk(user.ID, uploadID, 1, []byte("ef"), hexSHA256([]byte("ef")), false)
+
+	job, err := loadUploadJob(decode(t, completeChunked(user.ID, uploadID))["jobId"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assembleChunks(job) {
+		t.Fatal("assembleChunks failed")
+	}
+	if assembled, err := os.ReadFile(job.PayloadPath); err != nil || string(assembled) != "abcdef" {
+		t.Errorf("assembled %q, %v", assembled, err)
+	}
+}
+
+// Without ALLOW_UNVERIFIED_CHUNKS a session needs the digest of the file.
+func TestChunkedUploadUnverified(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xunverified")
+
+	if w := initChunked(t, user.ID, 4, 4, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("init without a digest: %d %s", w.Code, w.Body)
+	}
+
+	cfg.Uploads.AllowUnverifiedChunks = true
+	w := initChunked(t, user.ID, 4, 4, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("init: %d %s", w.Code, w.Body)
+	}
+	uploadID := decode(t, w)["uploadId"].(string)
+	if w := sendChunk(user.ID, uploadID, 0, []byte("abcd"), "", false); w.Code != http.StatusOK || decode(t, w)["sha256"] != hexSHA256([]byte("abcd")) {
+		t.Fatalf("chunk without a digest: %d %s", w.Code, w.Body)
+	}
+
+	job, err := loadUploadJob(decode(t, completeChunked(user.ID, uploadID))["jobId"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assembleChunks(job) {
+		t.Fatal("assembleChunks failed")
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
+	"gorm.io/gorm"
+)
+
+// storedReplicaOf returns a confirmed replica on provider of a file with
+// the given piece CID, or nil if there is none. The search is limited to
+// the files of userID unless userID is 0. Replicas of excludeFileID and
+// segments of split files are skipped.
+func storedReplicaOf(pieceCID string, provider *models.StorageProvider, userID, excludeFileID uint) (*models.Piece, error) {
+	query := db.Model(&models.Piece{}).
+		Joins("JOIN files ON files.id = pieces.file_id AND files.deleted_at IS NULL").
+		Where("files.c_id = ? AND files.id <> ?", pieceCID, excludeFileID).
+		Where("pieces.service_name = ? AND pieces.service_url = ?", provider.ServiceName, provider.ServiceURL).
+		Where("pieces.pending_removal = ? AND pieces.root_state = ?", false, models.RootConfirmed).
+		Where("pieces.root_id IS NOT NULL AND pieces.root_id <> ''").
+		Where("pieces.manifest_id IS NULL")
+	if userID != 0 {
+		query = query.Where("pieces.user_id = ?", userID)
+	}
+
+	var piece models.Piece
+	if err := query.Order("pieces.id").First(&piece).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &piece, nil
+}
+
+// linkDuplicateReplica stores record with provider by sharing the root of
+// a replica of the same content the user already has there, instead of
+// uploading it again. It returns nil if the user has no such replica.
+func linkDuplicateReplica(record *models.File, provider *models.StorageProvider) (*models.Piece, error) {
+	if record.CID == "" {
+		return nil, nil
+	}
+	source, err := storedReplicaOf(record.CID, provider, record.UserID, record.ID)
+	if err != nil || source == nil {
+		return nil, err
+	}
+
+	piece := &models.Piece{
+		UserID:      record.UserID,
+		FileID:      &record.ID,
+		CID:         source.CID,
+		Filename:    record.Filename,
+		Size:        record.Size,
+		ServiceName: source.ServiceName,
+		ServiceURL:  source.ServiceURL,
+		ProofSetID:  source.ProofSetID,
+		RootID:      source.RootID,
+
+		RootState:     source.RootState,
+		RootCheckedAt: source.RootCheckedAt,
+
+		AggregateCID:    source.AggregateCID,
+		AggregateOffset: source.AggregateOffset,
+		AggregateLength: source.AggregateLength,
+
+		EncryptionKeyID: source.EncryptionKeyID,
+		WrappedDataKey:  source.WrappedDataKey,
+	}
+	if err := db.Create(piece).Error; err != nil {
+		return nil, err
+	}
+
+	log.WithField("fileID", record.ID).
+		WithField("pieceCID", record.CID).
+		WithField("provider", provider.Name).
+		WithField("sharedPieceID", source.ID).
+		WithField("rootID", *source.RootID).
+		Info("Linked duplicate upload to existing root")
+	return piece, nil
+}
+
+// providerUploadOf returns the upload result of the same content stored
+// with provider for any user, letting a replica skip the upload and only
+// add the root to its own proof set. It returns nil unless
+// DEDUP_ACROSS_USERS is enabled and such an upload exists.
+func providerUploadOf(record *models.File, provider *models.StorageProvider) *pdp.UploadResult {
+	if !cfg.DedupAcrossUsers || record.CID == "" {
+		return nil
+	}
+	source, err := storedReplicaOf(record.CID, provider, 0, record.ID)
+	if err != nil {
+		log.WithField("pieceCID", record.CID).WithField("error", err.Error()).Warning("Failed to look up stored copies of upload")
+		return nil
+	}
+	if source == nil || source.AggregateCID != "" || source.EncryptionKeyID != nil {
+		// Files packed into an aggregate have no upload of their own, and
+		// encrypted files can only be read by their owner.
+		return nil
+	}
+
+	root := pdp.ParseRoot(source.CID)
+	result := &pdp.UploadResult{CID: source.CID, RootCID: root.CID}
+	if len(root.Subroots) > 0 {
+		result.SubrootCID = root.Subroots[0]
+	}
+	return result
+}
+
+// rootShared reports whether another piece references the root of a
+// replica, in which case the root must stay in its proof set when the
+// replica is removed.
+func rootShared(replica *models.Piece) (bool, error) {
+	if replica.ProofSetID == nil || replica.RootID == nil || *replica.RootID == "" {
+		return false, nil
+	}
+	var others int64
+	err := db.Model(&models.Piece{}).
+		Where("proof_set_id = ? AND root_id = ? AND id <> ?", *replica.ProofSetID, *replica.RootID, replica.ID).
+		Count(&others).Error
+	return others > 0, err
+}
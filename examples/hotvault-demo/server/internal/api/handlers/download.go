@@ -1,17 +1,17 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
 )
 
 // @Summary Download a file from PDP service
@@ -39,48 +39,22 @@ func DownloadFile(c *gin.Context) {
 		return
 	}
 
-	var piece models.Piece
-	if err := db.Where("c_id = ?", cid).First(&piece).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Piece not found",
-		})
-		return
-	}
-
-	pdptoolPath := cfg.PdptoolPath
-	if pdptoolPath == "" {
-		log.Error("PDPTool path not configured in environment/config")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Server configuration error: PDPTool path missing",
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
 		})
 		return
 	}
 
-	if _, err := os.Stat(pdptoolPath); os.IsNotExist(err) {
-		log.WithField("path", pdptoolPath).Error("pdptool not found at configured path")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "pdptool executable not found at configured path",
-		})
-		return
-	}
-
-	// Change working directory to pdptool directory
-	pdptoolDir := getPdptoolParentDir(pdptoolPath)
-	if err := os.Chdir(pdptoolDir); err != nil {
-		log.Error(fmt.Sprintf("Failed to change working directory to pdptool directory: %v", err))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to set working directory",
+	var replicas []models.Piece
+	if err := db.Where("c_id = ? AND user_id = ?", cid, userID).Order("pending_removal ASC, id ASC").Find(&replicas).Error; err != nil || len(replicas) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Piece not found",
 		})
 		return
 	}
-	log.WithField("pdptoolDir", pdptoolDir).Info("Changed working directory to pdptool directory")
-
-	log.WithField("path", pdptoolPath).Info("Using pdptool at path")
-
-	processCid := cid
-	if parts := strings.Split(cid, ":"); len(parts) > 0 {
-		processCid = parts[0]
-	}
+	piece := replicas[0]
 
 	tempDir, err := os.MkdirTemp("", "pdp-download-*")
 	if err != nil {
@@ -91,43 +65,16 @@ func DownloadFile(c *gin.Context) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	chunkFile := filepath.Join(tempDir, "chunks.txt")
-	if err := os.WriteFile(chunkFile, []byte(processCid), 0644); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": fmt.Sprintf("Failed to create chunk file: %v", err),
-		})
-		return
-	}
-
 	outputFile := filepath.Join(tempDir, piece.Filename)
-	downloadCmd := exec.Command(
-		pdptoolPath,
-		"download-file",
-		"--service-url", piece.ServiceURL,
-		"--chunk-file", chunkFile,
-		"--output-file", outputFile,
-	)
-
-	log.WithField("command", "download-file").
-		WithField("serviceURL", piece.ServiceURL).
-		WithField("chunkFile", chunkFile).
-		WithField("outputFile", outputFile).
-		WithField("cid", cid).
-		WithField("processCid", processCid).
-		WithField("filename", piece.Filename).
-		Info("Executing download-file command")
-
-	var errOutput bytes.Buffer
-	downloadCmd.Stderr = &errOutput
-
-	if err := downloadCmd.Run(); err != nil {
-		errorMsg := fmt.Sprintf("Failed to download file: %v", err)
-		log.WithField("error", err.Error()).WithField("stderr", errOutput.String()).Error(errorMsg)
+
+	downloadErr := downloadPiece(c.Request.Context(), &piece, replicas, outputFile)
+	if downloadErr != nil {
+		errorMsg := fmt.Sprintf("Failed to download file: %v", downloadErr)
+		log.WithField("error", downloadErr.Error()).Error(errorMsg)
 
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   errorMsg,
-			"details": err.Error(),
-			"stderr":  errOutput.String(),
+			"details": downloadErr.Error(),
 		})
 		return
 	}
@@ -164,3 +111,59 @@ func DownloadFile(c *gin.Context) {
 		return
 	}
 }
+
+// downloadReplicas downloads a piece to outputFile from the first of its
+// replicas able to serve it. Every replica holds the same data, so the next
+// provider is tried when one fails. A replica packed into an aggregate is
+// served by downloading the aggregate and extracting the file from it.
+func downloadReplicas(ctx context.Context, cid string, replicas []models.Piece, outputFile string) error {
+	var downloadErr error
+	for _, replica := range replicas {
+		client := pdpClientFor(pdp.Service{Name: replica.ServiceName, URL: replica.ServiceURL})
+
+		if replica.AggregateCID != "" {
+			log.WithField("serviceURL", replica.ServiceURL).
+				WithField("cid", cid).
+				WithField("aggregateCID", replica.AggregateCID).
+				WithField("offset", replica.AggregateOffset).
+				WithField("length", replica.AggregateLength).
+				Info("Downloading file from aggregate on PDP service")
+
+			downloadErr = client.DownloadFile(ctx, replica.AggregateCID, outputFile)
+			if downloadErr == nil {
+				downloadErr = extractAggregated(outputFile, &replica)
+			}
+			if downloadErr == nil {
+				downloadErr = decryptDownload(outputFile, &replica)
+			}
+			if downloadErr == nil {
+				return nil
+			}
+			log.WithField("error", downloadErr.Error()).
+				WithField("pieceID", replica.ID).
+				WithField("serviceURL", replica.ServiceURL).
+				Warning("Failed to download file from aggregate replica")
+			continue
+		}
+
+		log.WithField("serviceURL", replica.ServiceURL).
+			WithField("outputFile", outputFile).
+			WithField("cid", cid).
+			WithField("filename", replica.Filename).
+			Info("Downloading file from PDP service")
+
+		downloadErr = client.DownloadFile(ctx, cid, outputFile)
+		if downloadErr == nil && replica.ManifestID == nil {
+			// Segments are decrypted once the file is reassembled.
+			downloadErr = decryptDownload(outputFile, &replica)
+		}
+		if downloadErr == nil {
+			return nil
+		}
+		log.WithField("error", downloadErr.Error()).
+			WithField("pieceID", replica.ID).
+			WithField("serviceURL", replica.ServiceURL).
+			Warning("Failed to download file from replica")
+	}
+	return downloadErr
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/envelope"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+var errEncryptionNotConfigured = errors.New("ENCRYPTION_MASTER_KEY is not set")
+
+type SetUserEncryptionRequest struct {
+	// EncryptUploads overrides ENCRYPT_UPLOADS for the user; null clears
+	// the override.
+	EncryptUploads *bool `json:"encryptUploads"`
+}
+
+// validateEncryptionConfig checks the master key at startup, so a
+// misconfigured key fails fast instead of failing every encrypted upload.
+func validateEncryptionConfig() error {
+	if cfg.Encryption.MasterKey == "" {
+		if cfg.Encryption.Enabled {
+			return fmt.Errorf("ENCRYPT_UPLOADS requires ENCRYPTION_MASTER_KEY")
+		}
+		return nil
+	}
+	_, err := masterKey()
+	return err
+}
+
+func masterKey() ([]byte, error) {
+	if cfg.Encryption.MasterKey == "" {
+		return nil, errEncryptionNotConfigured
+	}
+	key, err := hex.DecodeString(cfg.Encryption.MasterKey)
+	if err != nil || len(key) != envelope.KeySize {
+		return nil, fmt.Errorf("ENCRYPTION_MASTER_KEY must be %d hex-encoded bytes", envelope.KeySize)
+	}
+	return key, nil
+}
+
+// encryptionEnabledFor reports whether a user's uploads are encrypted.
+func encryptionEnabledFor(userID uint) bool {
+	var user models.User
+	if err := db.Select("id", "encrypt_uploads").First(&user, userID).Error; err == nil && user.EncryptUploads != nil {
+		return *user.EncryptUploads
+	}
+	return cfg.Encryption.Enabled
+}
+
+// The additional data binds wrapped keys to their owner, so a wrapped key
+// copied to another row does not unwrap.
+func userKeyAAD(userID uint) []byte {
+	return []byte(fmt.Sprintf("hotvault user key %d", userID))
+}
+
+func dataKeyAAD(userKeyID uint) []byte {
+	return []byte(fmt.Sprintf("hotvault data key %d", userKeyID))
+}
+
+// userKeyFor returns the newest key encryption key of a user and its
+// unwrapped value, creating the user's first key if needed.
+func userKeyFor(userID uint) (*models.UserKey, []byte, error) {
+	master, err := masterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var userKey models.UserKey
+	err = db.Where("user_id = ?", userID).Order("id DESC").First(&userKey).Error
+	if err == nil {
+		kek, err := envelope.Unwrap(master, userKey.WrappedKey, userKeyAAD(userID))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to unwrap key %d of user %d: %w", userKey.ID, userID, err)
+		}
+		return &userKey, kek, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, err
+	}
+
+	kek, err := envelope.NewKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := envelope.Wrap(master, kek, userKeyAAD(userID))
+	if err != nil {
+		return nil, nil, err
+	}
+	userKey = models.UserKey{UserID: userID, WrappedKey: wrapped}
+	if err := db.Create(&userKey).Error; err != nil {
+		return nil, nil, err
+	}
+	log.WithField("userID", userID).WithField("userKeyID", userKey.ID).Info("Created user encryption key")
+	return &userKey, kek, nil
+}
+
+// dataKeyOf unwraps the key a piece's content is encrypted with. Only a
+// key of the piece's owner is unwrapped.
+func dataKeyOf(piece *models.Piece) ([]byte, error) {
+	keyID := *piece.EncryptionKeyID
+	var userKey models.UserKey
+	if err := db.First(&userKey, keyID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load user key %d: %w", keyID, err)
+	}
+	if userKey.UserID != piece.UserID {
+		return nil, fmt.Errorf("user key %d does not belong to the owner of piece %d", keyID, piece.ID)
+	}
+	master, err := masterKey()
+	if err != nil {
+		return nil, err
+	}
+	kek, err := envelope.Unwrap(master, userKey.WrappedKey, userKeyAAD(userKey.UserID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap user key %d: %w", keyID, err)
+	}
+	dataKey, err := envelope.Unwrap(kek, piece.WrappedDataKey, dataKeyAAD(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// encryptPayload replaces the payload of a job with its encryption under a
+// new data key, and records the wrapped key on the job.
+func encryptPayload(ctx context.Context, job *models.UploadJob, report func(UploadProgress)) error {
+	userKey, kek, err := userKeyFor(job.UserID)
+	if err != nil {
+		return err
+	}
+	dataKey, err := envelope.NewKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := envelope.Wrap(kek, dataKey, dataKeyAAD(userKey.ID))
+	if err != nil {
+		return err
+	}
+
+	err = prepareLimiter.acquire(ctx, func() {
+		report(UploadProgress{
+			Status:   "encrypting",
+			Progress: 25,
+			Message:  "Waiting for a free preparation slot...",
+		})
+	})
+	if err != nil {
+		return err
+	}
+	defer prepareLimiter.release()
+
+	report(UploadProgress{
+		Status:   "encrypting",
+		Progress: 25,
+		Message:  "Encrypting file...",
+	})
+
+	encryptedPath := job.PayloadPath + ".enc"
+	if err := encryptFile(ctx, job.PayloadPath, encryptedPath, dataKey); err != nil {
+		os.Remove(encryptedPath)
+		return err
+	}
+
+	err = db.Model(job).Updates(map[string]interface{}{
+		"payload_path":      encryptedPath,
+		"encryption_key_id": userKey.ID,
+		"wrapped_data_key":  wrapped,
+	}).Error
+	if err != nil {
+		os.Remove(encryptedPath)
+		return err
+	}
+	os.Remove(job.PayloadPath)
+
+	job.PayloadPath = encryptedPath
+	job.EncryptionKeyID = &userKey.ID
+	job.WrappedDataKey = wrapped
+
+	log.WithField("jobID", job.ID).
+		WithField("userKeyID", userKey.ID).
+		Info("Upload payload encrypted")
+	return nil
+}
+
+func encryptFile(ctx context.Context, src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := envelope.Encrypt(out, &contextReader{ctx: ctx, r: in}, key); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// payloadSize is the size of a job's payload as sent to providers.
+func payloadSize(job *models.UploadJob) int64 {
+	if job.WrappedDataKey != nil {
+		return envelope.EncryptedSize(job.TotalSize)
+	}
+	return job.TotalSize
+}
+
+// encryptionOf copies the key metadata of a job's payload to a piece
+// storing it.
+func encryptionOf(piece *models.Piece, job *models.UploadJob) *models.Piece {
+	piece.EncryptionKeyID = job.EncryptionKeyID
+	piece.WrappedDataKey = job.WrappedDataKey
+	return piece
+}
+
+// decryptDownload replaces path, holding the downloaded content of piece,
+// with its plaintext. Unencrypted pieces are left as they are.
+func decryptDownload(path string, piece *models.Piece) error {
+	if piece.EncryptionKeyID == nil {
+		return nil
+	}
+	dataKey, err := dataKeyOf(piece)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	decrypted := path + ".decrypted"
+	out, err := os.Create(decrypted)
+	if err != nil {
+		return err
+	}
+	err = envelope.Decrypt(out, in, dataKey)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(decrypted)
+		return fmt.Errorf("failed to decrypt piece %d: %w", piece.ID, err)
+	}
+	return os.Rename(decrypted, path)
+}
+
+// SetUserEncryption sets whether a user's uploads are encrypted
+// @Summary Set user upload encryption (admin)
+// @Description Override ENCRYPT_UPLOADS for a user. A null value clears the override. Files already stored are not affected.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param id path int true "User ID"
+// @Param request body SetUserEncryptionRequest true "Encryption setting"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/admin/users/{id}/encryption [put]
+func SetUserEncryption(c *gin.Context) {
+	var request SetUserEncryptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if request.EncryptUploads != nil && *request.EncryptUploads {
+		if _, err := masterKey(); err != nil {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "Encryption is not configured",
+				"details": err.Error(),
+			})
+			return
+		}
+	}
+
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "User not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch user",
+		})
+		return
+	}
+
+	if err := db.Model(&user).Update("encrypt_uploads", request.EncryptUploads).Error; err != nil {
+		log.WithField("error", err.Error()).WithField("userID", user.ID).Error("Failed to set upload encryption")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to set upload encryption",
+		})
+		return
+	}
+
+	log.WithField("userID", user.ID).WithField("encryptUploads", request.EncryptUploads).Info("Set user upload encryption")
+	c.JSON(http.StatusOK, gin.H{
+		"userId":                  user.ID,
+		"encryptUploads":          request.EncryptUploads,
+		"effectiveEncryptUploads": encryptionEnabledFor(user.ID),
+	})
+}
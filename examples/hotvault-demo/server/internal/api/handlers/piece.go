@@ -22,8 +22,23 @@ type PieceResponse struct {
 	ProofSetDbID      *uint      `json:"proofSetDbId,omitempty"`
 	ServiceProofSetID *string    `json:"serviceProofSetId,omitempty"`
 	RootID            *string    `json:"rootId,omitempty"`
+	RootState         string     `json:"rootState,omitempty"`
 	CreatedAt         time.Time  `json:"createdAt"`
 	UpdatedAt         time.Time  `json:"updatedAt"`
+	// Replication details, set for files uploaded with replication.
+	FileID            *uint             `json:"fileId,omitempty"`
+	ReplicationFactor int               `json:"replicationFactor,omitempty"`
+	Health            string            `json:"health,omitempty"`
+	Replicas          []ReplicaResponse `json:"replicas,omitempty"`
+}
+
+type ReplicaResponse struct {
+	PieceID           uint    `json:"pieceId"`
+	ServiceName       string  `json:"serviceName"`
+	ServiceURL        string  `json:"serviceUrl"`
+	ServiceProofSetID *string `json:"serviceProofSetId,omitempty"`
+	RootID            *string `json:"rootId,omitempty"`
+	Status            string  `json:"status"`
 }
 
 type ProofSetsResponse struct {
@@ -44,7 +59,7 @@ type ProofSetWithPieces struct {
 
 // GetUserPieces returns all pieces for the authenticated user
 // @Summary Get user's pieces
-// @Description Get all pieces uploaded by the authenticated user, including service proof set ID
+// @Description Get all files uploaded by the authenticated user, including service proof set ID. Replicated files are listed once with the health of each replica.
 // @Tags pieces
 // @Produce json
 // @Success 200 {array} PieceResponse
@@ -87,8 +102,33 @@ func GetUserPieces(c *gin.Context) {
 		}
 	}
 
+	fileIDs := make([]uint, 0, len(pieces))
+	for _, piece := range pieces {
+		if piece.FileID != nil {
+			fileIDs = append(fileIDs, *piece.FileID)
+		}
+	}
+
+	fileMap := make(map[uint]models.File)
+	if len(fileIDs) > 0 {
+		var files []models.File
+		if err := db.Where("id IN ?", fileIDs).Find(&files).Error; err != nil {
+			log.WithField("error", err.Error()).Error("Failed to fetch files for pieces")
+		} else {
+			for _, file := range files {
+				fileMap[file.ID] = file
+			}
+		}
+	}
+
 	responsePieces := make([]PieceResponse, 0, len(pieces))
+	fileEntries := make(map[uint]int)
 	for _, piece := range pieces {
+		// A segmented file is listed through its first segment.
+		if piece.ManifestID != nil && piece.SegmentIndex > 0 {
+			continue
+		}
+
 		var pendingRemovalPtr *bool
 		if piece.PendingRemoval {
 			tempVal := true
@@ -107,9 +147,13 @@ func GetUserPieces(c *gin.Context) {
 			RemovalDate:    piece.RemovalDate,
 			ProofSetDbID:   piece.ProofSetID,
 			RootID:         piece.RootID,
+			RootState:      piece.RootState,
 			CreatedAt:      piece.CreatedAt,
 			UpdatedAt:      piece.UpdatedAt,
 		}
+		if piece.ManifestID != nil && piece.FileID != nil {
+			respPiece.Size = fileMap[*piece.FileID].Size
+		}
 		if piece.ProofSetID != nil {
 			if proofSet, ok := proofSetMap[*piece.ProofSetID]; ok {
 				if proofSet.ProofSetID != "" {
@@ -118,7 +162,52 @@ func GetUserPieces(c *gin.Context) {
 				}
 			}
 		}
-		responsePieces = append(responsePieces, respPiece)
+
+		if piece.FileID == nil {
+			responsePieces = append(responsePieces, respPiece)
+			continue
+		}
+
+		replica := ReplicaResponse{
+			PieceID:           piece.ID,
+			ServiceName:       piece.ServiceName,
+			ServiceURL:        piece.ServiceURL,
+			ServiceProofSetID: respPiece.ServiceProofSetID,
+			RootID:            piece.RootID,
+			Status:            replicaStatus(&piece),
+		}
+
+		index, seen := fileEntries[*piece.FileID]
+		if !seen {
+			respPiece.FileID = piece.FileID
+			respPiece.ReplicationFactor = fileMap[*piece.FileID].ReplicationFactor
+			respPiece.Replicas = []ReplicaResponse{replica}
+			fileEntries[*piece.FileID] = len(responsePieces)
+			responsePieces = append(responsePieces, respPiece)
+			continue
+		}
+
+		entry := &responsePieces[index]
+		replicas := append(entry.Replicas, replica)
+		// Present the file through an active replica where there is one.
+		if replica.Status == ReplicaActive && entry.Replicas[0].Status != ReplicaActive {
+			respPiece.FileID = entry.FileID
+			respPiece.ReplicationFactor = entry.ReplicationFactor
+			*entry = respPiece
+			replicas = append([]ReplicaResponse{replica}, replicas[:len(replicas)-1]...)
+		}
+		entry.Replicas = replicas
+	}
+
+	for i := range responsePieces {
+		entry := &responsePieces[i]
+		if entry.FileID == nil {
+			continue
+		}
+		if entry.ReplicationFactor < 1 {
+			entry.ReplicationFactor = 1
+		}
+		entry.Health = fileHealth(entry.Replicas, entry.ReplicationFactor)
 	}
 
 	c.JSON(http.StatusOK, responsePieces)
@@ -293,6 +382,7 @@ func GetProofSets(c *gin.Context) {
 			RemovalDate:    piece.RemovalDate,
 			ProofSetDbID:   piece.ProofSetID,
 			RootID:         piece.RootID,
+			RootState:      piece.RootState,
 			CreatedAt:      piece.CreatedAt,
 			UpdatedAt:      piece.UpdatedAt,
 		}
@@ -330,8 +420,9 @@ func GetPieceProofs(c *gin.Context) {
 }
 
 // @Summary Get User's Proof Set ID
-// @Description Get the proof set ID for the authenticated user
+// @Description Get the proof set ID for the authenticated user on the selected storage provider
 // @Tags proofset
+// @Param provider query string false "Storage provider name or ID"
 // @Produce json
 // @Success 200 {object} map[string]string
 // @Failure 401 {object} ErrorResponse
@@ -346,8 +437,13 @@ func GetUserProofSetID(c *gin.Context) {
 		return
 	}
 
+	query := db.Where("user_id = ?", userID)
+	if provider, err := selectStorageProvider(userID.(uint), c.Query("provider")); err == nil {
+		query = query.Where("provider_id = ?", provider.ID)
+	}
+
 	var proofSet models.ProofSet
-	if err := db.Where("user_id = ?", userID).First(&proofSet).Error; err != nil {
+	if err := query.First(&proofSet).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{
 				"error": "Proof set not found for user",
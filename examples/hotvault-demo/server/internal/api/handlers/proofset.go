@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+var (
+	proofSetCreations     = make(map[string]bool)
+	proofSetCreationsLock sync.Mutex
+)
+
+func proofSetCreationKey(userID, providerID uint) string {
+	return fmt.Sprintf("%d-%d", userID, providerID)
+}
+
+// startProofSetCreation creates a proof set for the user on the provider in
+// the background. It returns false if a creation is already running.
+func startProofSetCreation(user *models.User, provider *models.StorageProvider) bool {
+	key := proofSetCreationKey(user.ID, provider.ID)
+
+	proofSetCreationsLock.Lock()
+	if proofSetCreations[key] {
+		proofSetCreationsLock.Unlock()
+		return false
+	}
+	proofSetCreations[key] = true
+	proofSetCreationsLock.Unlock()
+
+	go func(u models.User, p models.StorageProvider) {
+		defer func() {
+			proofSetCreationsLock.Lock()
+			delete(proofSetCreations, key)
+			proofSetCreationsLock.Unlock()
+		}()
+
+		authLog.WithField("userID", u.ID).WithField("providerID", p.ID).Info("Starting background proof set creation...")
+		if err := createProofSetForUser(&u, &p); err != nil {
+			authLog.WithField("userID", u.ID).WithField("providerID", p.ID).Errorf("Background proof set creation failed: %v", err)
+		} else {
+			authLog.WithField("userID", u.ID).WithField("providerID", p.ID).Info("Background proof set creation completed successfully.")
+		}
+	}(*user, *provider)
+	return true
+}
+
+func proofSetCreationRunning(userID, providerID uint) bool {
+	proofSetCreationsLock.Lock()
+	defer proofSetCreationsLock.Unlock()
+	return proofSetCreations[proofSetCreationKey(userID, providerID)]
+}
+
+// ensureProofSet returns the user's ready proof set on the provider,
+// starting its creation if there is none and waiting up to timeout for it.
+// onWait is called on every poll while waiting. Waiting stops when ctx is
+// done; a creation already started carries on in the background.
+func ensureProofSet(ctx context.Context, userID uint, provider *models.StorageProvider, timeout time.Duration, onWait func()) (*models.ProofSet, error) {
+	const pollInterval = 10 * time.Second
+	deadline := time.Now().Add(timeout)
+	started := false
+
+	for {
+		var proofSet models.ProofSet
+		err := db.Where("user_id = ? AND provider_id = ?", userID, provider.ID).First(&proofSet).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if err == nil && proofSet.ProofSetID != "" {
+			return &proofSet, nil
+		}
+
+		if !proofSetCreationRunning(userID, provider.ID) {
+			if started {
+				return nil, fmt.Errorf("proof set creation on provider %s failed", provider.Name)
+			}
+			// A stored transaction hash without a running poller means the
+			// creation was interrupted; start over.
+			var user models.User
+			if err := db.First(&user, userID).Error; err != nil {
+				return nil, err
+			}
+			log.WithField("userID", userID).
+				WithField("provider", provider.Name).
+				Info("No proof set on storage provider, creating one")
+			startProofSetCreation(&user, provider)
+		}
+		started = true
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for proof set on provider %s", provider.Name)
+		}
+		if onWait != nil {
+			onWait()
+		}
+		if err := sleepContext(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleepContext waits for d or until ctx is done, returning ctx's error in
+// the latter case.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,569 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	ProviderPolicyDefault   = "default"
+	ProviderPolicyLeastUsed = "least-used"
+)
+
+var (
+	errProviderNotFound = errors.New("storage provider not found")
+	errProviderDisabled = errors.New("storage provider is disabled")
+	errNoProvider       = errors.New("no storage provider available")
+)
+
+type CreateStorageProviderRequest struct {
+	Name         string `json:"name" binding:"required"`
+	ServiceName  string `json:"serviceName" binding:"required"`
+	ServiceURL   string `json:"serviceUrl" binding:"required"`
+	RecordKeeper string `json:"recordKeeper"`
+	Enabled      *bool  `json:"enabled"`
+	IsDefault    bool   `json:"isDefault"`
+}
+
+type UpdateStorageProviderRequest struct {
+	Name         *string `json:"name"`
+	ServiceName  *string `json:"serviceName"`
+	ServiceURL   *string `json:"serviceUrl"`
+	RecordKeeper *string `json:"recordKeeper"`
+	Enabled      *bool   `json:"enabled"`
+	IsDefault    *bool   `json:"isDefault"`
+}
+
+type SetUserProviderRequest struct {
+	// Provider is a provider name or ID; empty clears the assignment.
+	Provider string `json:"provider"`
+}
+
+type AvailableProvider struct {
+	ID        uint   `json:"id"`
+	Name      string `json:"name"`
+	IsDefault bool   `json:"isDefault"`
+}
+
+// seedStorageProviders registers the provider from SERVICE_NAME/SERVICE_URL
+// when the registry is empty and links proof sets created before the
+// registry existed to their provider.
+func seedStorageProviders() error {
+	var count int64
+	if err := db.Model(&models.StorageProvider{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 && cfg.ServiceName != "" && cfg.ServiceURL != "" {
+		provider := models.StorageProvider{
+			Name:         "default",
+			ServiceName:  cfg.ServiceName,
+			ServiceURL:   cfg.ServiceURL,
+			RecordKeeper: cfg.RecordKeeper,
+			Enabled:      true,
+			IsDefault:    true,
+		}
+		if err := db.Create(&provider).Error; err != nil {
+			return err
+		}
+		log.WithField("providerID", provider.ID).
+			WithField("serviceURL", provider.ServiceURL).
+			Info("Registered default storage provider from configuration")
+	}
+
+	var providers []models.StorageProvider
+	if err := db.Find(&providers).Error; err != nil {
+		return err
+	}
+	for _, provider := range providers {
+		result := db.Model(&models.ProofSet{}).
+			Where("provider_id IS NULL AND service_name = ? AND service_url = ?", provider.ServiceName, provider.ServiceURL).
+			Update("provider_id", provider.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			log.WithField("providerID", provider.ID).
+				WithField("proofSets", result.RowsAffected).
+				Info("Linked existing proof sets to storage provider")
+		}
+	}
+	return nil
+}
+
+// findStorageProvider looks a provider up by ID or name.
+func findStorageProvider(ref string) (*models.StorageProvider, error) {
+	var provider models.StorageProvider
+	query := db.Where("name = ?", ref)
+	if id, err := strconv.ParseUint(ref, 10, 64); err == nil {
+		query = db.Where("id = ?", id)
+	}
+	if err := query.First(&provider).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errProviderNotFound
+		}
+		return nil, err
+	}
+	return &provider, nil
+}
+
+// selectStorageProvider picks the provider for an upload: the requested one
+// if given, then the provider assigned to the user, then the configured
+// STORAGE_PROVIDER_POLICY.
+func selectStorageProvider(userID uint, requested string) (*models.StorageProvider, error) {
+	if requested != "" {
+		provider, err := findStorageProvider(requested)
+		if err != nil {
+			return nil, err
+		}
+		if !provider.Enabled {
+			return nil, errProviderDisabled
+		}
+		return provider, nil
+	}
+
+	var user models.User
+	if err := db.Select("id", "provider_id").First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	if user.ProviderID != nil {
+		var provider models.StorageProvider
+		err := db.Where("id = ? AND enabled = ?", *user.ProviderID, true).First(&provider).Error
+		if err == nil {
+			return &provider, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		log.WithField("userID", userID).
+			WithField("providerID", *user.ProviderID).
+			Warning("Assigned storage provider is unavailable, falling back to provider policy")
+	}
+
+	providers, err := providersByPolicy(nil, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &providers[0], nil
+}
+
+// providersByPolicy returns up to limit enabled providers, excluding the
+// given IDs, in the order STORAGE_PROVIDER_POLICY prefers them.
+func providersByPolicy(exclude []uint, limit int) ([]models.StorageProvider, error) {
+	var providers []models.StorageProvider
+	var query *gorm.DB
+	switch cfg.ProviderPolicy {
+	case ProviderPolicyLeastUsed:
+		query = db.Table("storage_providers").
+			Select("storage_providers.*").
+			Joins("LEFT JOIN proof_sets ON proof_sets.provider_id = storage_providers.id AND proof_sets.deleted_at IS NULL").
+			Joins("LEFT JOIN pieces ON pieces.proof_set_id = proof_sets.id AND pieces.deleted_at IS NULL").
+			Where("storage_providers.enabled = ? AND storage_providers.deleted_at IS NULL", true).
+			Group("storage_providers.id").
+			Order("COALESCE(SUM(pieces.size), 0) ASC, storage_providers.id ASC")
+		if len(exclude) > 0 {
+			query = query.Where("storage_providers.id NOT IN ?", exclude)
+		}
+	default:
+		query = db.Model(&models.StorageProvider{}).Where("enabled = ?", true).Order("is_default DESC, id ASC")
+		if len(exclude) > 0 {
+			query = query.Where("id NOT IN ?", exclude)
+		}
+	}
+	if err := query.Limit(limit).Find(&providers).Error; err != nil {
+		return nil, err
+	}
+	if len(providers) == 0 {
+		return nil, errNoProvider
+	}
+	return providers, nil
+}
+
+// providerErrorStatus maps provider selection errors to an HTTP status.
+func providerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errProviderNotFound):
+		return http.StatusBadRequest
+	case errors.Is(err, errProviderDisabled):
+		return http.StatusBadRequest
+	case errors.Is(err, errNoProvider):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// clearDefaultProvider unsets the default flag on every provider except id.
+func clearDefaultProvider(tx *gorm.DB, id uint) error {
+	return tx.Model(&models.StorageProvider{}).
+		Where("id <> ? AND is_default = ?", id, true).
+		Update("is_default", false).Error
+}
+
+// GetAvailableProviders lists the providers an upload can be routed to
+// @Summary List storage providers
+// @Description List the enabled storage providers that can be selected with the provider upload parameter
+// @Tags providers
+// @Produce json
+// @Success 200 {array} AvailableProvider
+// @Router /api/v1/providers [get]
+func GetAvailableProviders(c *gin.Context) {
+	var providers []models.StorageProvider
+	if err := db.Where("enabled = ?", true).Order("id ASC").Find(&providers).Error; err != nil {
+		log.WithField("error", err.Error()).Error("Failed to fetch storage providers")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch storage providers",
+		})
+		return
+	}
+
+	response := make([]AvailableProvider, 0, len(providers))
+	for _, provider := range providers {
+		response = append(response, AvailableProvider{
+			ID:        provider.ID,
+			Name:      provider.Name,
+			IsDefault: provider.IsDefault,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ListStorageProviders returns every registered storage provider
+// @Summary List storage providers (admin)
+// @Description List all registered storage providers, including disabled ones
+// @Tags admin
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Success 200 {array} models.StorageProvider
+// @Router /api/v1/admin/providers [get]
+func ListStorageProviders(c *gin.Context) {
+	var providers []models.StorageProvider
+	if err := db.Order("id ASC").Find(&providers).Error; err != nil {
+		log.WithField("error", err.Error()).Error("Failed to fetch storage providers")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch storage providers",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, providers)
+}
+
+// GetStorageProvider returns a storage provider
+// @Summary Get storage provider (admin)
+// @Tags admin
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param id path string true "Provider ID or name"
+// @Success 200 {object} models.StorageProvider
+// @Router /api/v1/admin/providers/{id} [get]
+func GetStorageProvider(c *gin.Context) {
+	provider, err := findStorageProvider(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, errProviderNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Storage provider not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch storage provider",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, provider)
+}
+
+// CreateStorageProvider registers a storage provider
+// @Summary Register storage provider (admin)
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param request body CreateStorageProviderRequest true "Provider"
+// @Success 201 {object} models.StorageProvider
+// @Router /api/v1/admin/providers [post]
+func CreateStorageProvider(c *gin.Context) {
+	var request CreateStorageProviderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	if _, err := strconv.ParseUint(request.Name, 10, 64); err == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Provider name must not be numeric",
+		})
+		return
+	}
+
+	provider := models.StorageProvider{
+		Name:         request.Name,
+		ServiceName:  request.ServiceName,
+		ServiceURL:   strings.TrimRight(request.ServiceURL, "/"),
+		RecordKeeper: request.RecordKeeper,
+		Enabled:      true,
+		IsDefault:    request.IsDefault,
+	}
+	if provider.RecordKeeper == "" {
+		provider.RecordKeeper = cfg.RecordKeeper
+	}
+	if request.Enabled != nil {
+		provider.Enabled = *request.Enabled
+	}
+	if provider.RecordKeeper == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "recordKeeper is required",
+		})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Create skips zero values that have a column default, so write
+		// the flags explicitly.
+		if err := tx.Create(&provider).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&provider).Updates(map[string]interface{}{
+			"enabled":    provider.Enabled,
+			"is_default": provider.IsDefault,
+		}).Error; err != nil {
+			return err
+		}
+		if provider.IsDefault {
+			return clearDefaultProvider(tx, provider.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("name", request.Name).Error("Failed to create storage provider")
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Failed to create storage provider",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	log.WithField("providerID", provider.ID).
+		WithField("name", provider.Name).
+		WithField("serviceURL", provider.ServiceURL).
+		Info("Registered storage provider")
+	c.JSON(http.StatusCreated, provider)
+}
+
+// UpdateStorageProvider changes a storage provider
+// @Summary Update storage provider (admin)
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param id path string true "Provider ID or name"
+// @Param request body UpdateStorageProviderRequest true "Fields to change"
+// @Success 200 {object} models.StorageProvider
+// @Router /api/v1/admin/providers/{id} [put]
+func UpdateStorageProvider(c *gin.Context) {
+	provider, err := findStorageProvider(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, errProviderNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Storage provider not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch storage provider",
+		})
+		return
+	}
+
+	var request UpdateStorageProviderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if request.Name != nil {
+		if _, err := strconv.ParseUint(*request.Name, 10, 64); err == nil || *request.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Provider name must be non-empty and not numeric",
+			})
+			return
+		}
+		updates["name"] = *request.Name
+	}
+	if request.ServiceName != nil {
+		updates["service_name"] = *request.ServiceName
+	}
+	if request.ServiceURL != nil {
+		updates["service_url"] = strings.TrimRight(*request.ServiceURL, "/")
+	}
+	if request.RecordKeeper != nil {
+		updates["record_keeper"] = *request.RecordKeeper
+	}
+	if request.Enabled != nil {
+		updates["enabled"] = *request.Enabled
+	}
+	if request.IsDefault != nil {
+		updates["is_default"] = *request.IsDefault
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(provider).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if request.IsDefault != nil && *request.IsDefault {
+			return clearDefaultProvider(tx, provider.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("providerID", provider.ID).Error("Failed to update storage provider")
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Failed to update storage provider",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := db.First(provider, provider.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to reload storage provider",
+		})
+		return
+	}
+
+	log.WithField("providerID", provider.ID).Info("Updated storage provider")
+	c.JSON(http.StatusOK, provider)
+}
+
+// DeleteStorageProvider removes a storage provider
+// @Summary Delete storage provider (admin)
+// @Description Delete a storage provider that holds no proof sets. Providers in use should be disabled instead.
+// @Tags admin
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param id path string true "Provider ID or name"
+// @Success 200 {object} map[string]string
+// @Router /api/v1/admin/providers/{id} [delete]
+func DeleteStorageProvider(c *gin.Context) {
+	provider, err := findStorageProvider(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, errProviderNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Storage provider not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch storage provider",
+		})
+		return
+	}
+
+	var proofSets int64
+	if err := db.Model(&models.ProofSet{}).Where("provider_id = ?", provider.ID).Count(&proofSets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to check storage provider usage",
+		})
+		return
+	}
+	if proofSets > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Storage provider holds proof sets",
+			"message": fmt.Sprintf("%d proof sets use this provider; disable it instead", proofSets),
+		})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("provider_id = ?", provider.ID).Update("provider_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Delete(provider).Error
+	})
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("providerID", provider.ID).Error("Failed to delete storage provider")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete storage provider",
+		})
+		return
+	}
+
+	log.WithField("providerID", provider.ID).WithField("name", provider.Name).Info("Deleted storage provider")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Storage provider deleted",
+	})
+}
+
+// SetUserProvider routes a user's uploads to a storage provider
+// @Summary Assign storage provider to user (admin)
+// @Description Route all uploads of a user that do not name a provider to the given provider. An empty provider clears the assignment.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param id path int true "User ID"
+// @Param request body SetUserProviderRequest true "Provider"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/admin/users/{id}/provider [put]
+func SetUserProvider(c *gin.Context) {
+	var request SetUserProviderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "User not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch user",
+		})
+		return
+	}
+
+	var providerID *uint
+	if request.Provider != "" {
+		provider, err := findStorageProvider(request.Provider)
+		if err != nil {
+			c.JSON(providerErrorStatus(err), gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		providerID = &provider.ID
+	}
+
+	if err := db.Model(&user).Update("provider_id", providerID).Error; err != nil {
+		log.WithField("error", err.Error()).WithField("userID", user.ID).Error("Failed to assign storage provider")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to assign storage provider",
+		})
+		return
+	}
+
+	log.WithField("userID", user.ID).WithField("provider", request.Provider).Info("Assigned storage provider to user")
+	c.JSON(http.StatusOK, gin.H{
+		"userId":     user.ID,
+		"providerId": providerID,
+	})
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// StorageUsage reports what a user stores against their quota. Every
+// replica of a piece counts, while files sharing a root through
+// deduplication count once. Pending covers uploads accepted but not yet
+// stored, at their declared size. A zero quota is unlimited.
+type StorageUsage struct {
+	UsedBytes     int64 `json:"usedBytes"`
+	UsedPieces    int64 `json:"usedPieces"`
+	PendingBytes  int64 `json:"pendingBytes"`
+	PendingPieces int64 `json:"pendingPieces"`
+	QuotaBytes    int64 `json:"quotaBytes"`
+	QuotaPieces   int64 `json:"quotaPieces"`
+	// Remaining is what may still be uploaded; nil when unlimited.
+	RemainingBytes  *int64 `json:"remainingBytes"`
+	RemainingPieces *int64 `json:"remainingPieces"`
+}
+
+type SetUserQuotaRequest struct {
+	// QuotaBytes and QuotaPieces override DEFAULT_QUOTA_BYTES and
+	// DEFAULT_QUOTA_PIECES; null falls back to the default and 0 is
+	// unlimited.
+	QuotaBytes  *int64 `json:"quotaBytes"`
+	QuotaPieces *int64 `json:"quotaPieces"`
+}
+
+// errQuotaExceeded is returned by checkQuota and reserveQuota when an
+// upload does not fit in the user's quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// storageUsageFor computes the usage of a user from their stored pieces
+// and unfinished uploads.
+func storageUsageFor(userID uint) (*StorageUsage, error) {
+	return storageUsageIn(db, userID)
+}
+
+// storageUsageIn is storageUsageFor run on tx.
+func storageUsageIn(tx *gorm.DB, userID uint) (*StorageUsage, error) {
+	var user models.User
+	if err := tx.Select("id", "quota_bytes", "quota_pieces").First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	usage := &StorageUsage{
+		QuotaBytes:  cfg.Quota.Bytes,
+		QuotaPieces: cfg.Quota.Pieces,
+	}
+	if user.QuotaBytes != nil {
+		usage.QuotaBytes = *user.QuotaBytes
+	}
+	if user.QuotaPieces != nil {
+		usage.QuotaPieces = *user.QuotaPieces
+	}
+
+	// Files deduplicated against the same root are stored once; files
+	// packed into the same aggregate share its root at different offsets.
+	var stored struct {
+		Bytes  int64
+		Pieces int64
+	}
+	roots := tx.Model(&models.Piece{}).
+		Select("MAX(size) AS size").
+		Where("user_id = ? AND pending_removal = ?", userID, false).
+		Group("proof_set_id, COALESCE(root_id, CAST(id AS TEXT)), aggregate_offset")
+	err := tx.Table("(?) AS roots", roots).
+		Select("COALESCE(SUM(size), 0) AS bytes, COUNT(*) AS pieces").
+		Scan(&stored).Error
+	if err != nil {
+		return nil, err
+	}
+	usage.UsedBytes = stored.Bytes
+	usage.UsedPieces = stored.Pieces
+
+	// Uploads in flight: queued jobs, and chunked and tus sessions that
+	// have not been handed to a job yet.
+	var pending, sessions struct {
+		Bytes int64
+		Count int64
+	}
+	err = tx.Model(&models.UploadJob{}).
+		Select("COALESCE(SUM(total_size), 0) AS bytes, COUNT(*) AS count").
+		Where("user_id = ? AND status NOT IN ?", userID, terminalUploadStatuses).
+		Scan(&pending).Error
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Model(&models.ChunkedUpload{}).
+		Select("COALESCE(SUM(total_size), 0) AS bytes, COUNT(*) AS count").
+		Where("user_id = ? AND (job_id = '' OR job_id IS NULL)", userID).
+		Scan(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	pending.Bytes += sessions.Bytes
+	pending.Count += sessions.Count
+	err = tx.Model(&models.TusUpload{}).
+		Select("COALESCE(SUM(upload_length), 0) AS bytes, COUNT(*) AS count").
+		Where("user_id = ? AND status = ?", userID, tusStatusUploading).
+		Scan(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	pending.Bytes += sessions.Bytes
+	pending.Count += sessions.Count
+
+	factor := int64(replicationFactorFor(userID))
+	usage.PendingBytes = pending.Bytes * factor
+	usage.PendingPieces = pending.Count * factor
+
+	if usage.QuotaBytes > 0 {
+		remaining := usage.QuotaBytes - usage.UsedBytes - usage.PendingBytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.RemainingBytes = &remaining
+	}
+	if usage.QuotaPieces > 0 {
+		remaining := usage.QuotaPieces - usage.UsedPieces - usage.PendingPieces
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.RemainingPieces = &remaining
+	}
+	return usage, nil
+}
+
+// checkQuota returns errQuotaExceeded if a new upload of size bytes, stored
+// with every replica, would exceed the user's quota.
+func checkQuota(userID uint, size int64) (*StorageUsage, error) {
+	return checkQuotaIn(db, userID, size)
+}
+
+// checkQuotaIn is checkQuota run on tx.
+func checkQuotaIn(tx *gorm.DB, userID uint, size int64) (*StorageUsage, error) {
+	usage, err := storageUsageIn(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	factor := int64(replicationFactorFor(userID))
+	if usage.RemainingBytes != nil && size*factor > *usage.RemainingBytes {
+		return usage, errQuotaExceeded
+	}
+	if usage.RemainingPieces != nil && factor > *usage.RemainingPieces {
+		return usage, errQuotaExceeded
+	}
+	return usage, nil
+}
+
+// reserveQuota runs create, which inserts the row that holds an upload of
+// size bytes against the user's quota, if the upload fits. The user row is
+// locked while usage is computed and the row inserted, so concurrent
+// uploads cannot both claim the same remaining bytes. handoff, if not nil,
+// runs first in the same transaction to release a reservation the new row
+// takes over, such as the session a job is queued for.
+func reserveQuota(userID uint, size int64, handoff, create func(tx *gorm.DB) error) (*StorageUsage, error) {
+	var usage *StorageUsage
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id").
+			First(&user, userID).Error
+		if err != nil {
+			return err
+		}
+		if handoff != nil {
+			if err := handoff(tx); err != nil {
+				return err
+			}
+		}
+		usage, err = checkQuotaIn(tx, userID, size)
+		if err != nil {
+			return err
+		}
+		return create(tx)
+	})
+	return usage, err
+}
+
+// rejectIfOverQuota answers 403 when an upload of size bytes does not fit
+// in the user's quota. It returns true if the request was rejected.
+func rejectIfOverQuota(c *gin.Context, userID uint, size int64) bool {
+	usage, err := checkQuota(userID, size)
+	if err == nil {
+		return false
+	}
+	if !errors.Is(err, errQuotaExceeded) {
+		log.WithField("error", err.Error()).WithField("userID", userID).Error("Failed to check storage quota")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to check storage quota",
+		})
+		return true
+	}
+	respondQuotaExceeded(c, userID, size, usage)
+	return true
+}
+
+// respondQuotaExceeded answers 403 for an upload of size bytes that does
+// not fit in the user's quota.
+func respondQuotaExceeded(c *gin.Context, userID uint, size int64, usage *StorageUsage) {
+	log.WithField("userID", userID).
+		WithField("size", formatFileSize(size)).
+		WithField("usedBytes", usage.UsedBytes).
+		WithField("quotaBytes", usage.QuotaBytes).
+		Warning("Upload rejected by storage quota")
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":   "Storage quota exceeded",
+		"message": fmt.Sprintf("Uploading %s would exceed your storage quota", formatFileSize(size)),
+		"usage":   usage,
+	})
+}
+
+// GetUsage reports the storage used by the authenticated user
+// @Summary Get storage usage
+// @Description Get the bytes and pieces stored by the user, counting every replica, against their quota
+// @Tags upload
+// @Produce json
+// @Success 200 {object} StorageUsage
+// @Router /api/v1/usage [get]
+func GetUsage(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	usage, err := storageUsageFor(userID.(uint))
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("userID", userID).Error("Failed to compute storage usage")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to compute storage usage",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// SetUserQuota sets the storage quota of a user
+// @Summary Set user storage quota (admin)
+// @Description Override DEFAULT_QUOTA_BYTES and DEFAULT_QUOTA_PIECES for a user. Null clears an override; 0 is unlimited.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param id path int true "User ID"
+// @Param request body SetUserQuotaRequest true "Storage quota"
+// @Success 200 {object} StorageUsage
+// @Router /api/v1/admin/users/{id}/quota [put]
+func SetUserQuota(c *gin.Context) {
+	var request SetUserQuotaRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if (request.QuotaBytes != nil && *request.QuotaBytes < 0) || (request.QuotaPieces != nil && *request.QuotaPieces < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "quotaBytes and quotaPieces must not be negative",
+		})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "User not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch user",
+		})
+		return
+	}
+
+	err := db.Model(&user).Updates(map[string]interface{}{
+		"quota_bytes":  request.QuotaBytes,
+		"quota_pieces": request.QuotaPieces,
+	}).Error
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("userID", user.ID).Error("Failed to set storage quota")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to set storage quota",
+		})
+		return
+	}
+
+	usage, err := storageUsageFor(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to compute storage usage",
+		})
+		return
+	}
+
+	log.WithField("userID", user.ID).
+		WithField("quotaBytes", usage.QuotaBytes).
+		WithField("quotaPieces", usage.QuotaPieces).
+		Info("Set user storage quota")
+	c.JSON(http.StatusOK, usage)
+}
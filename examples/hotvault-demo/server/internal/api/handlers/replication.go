@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	ReplicaActive         = "active"
+	ReplicaPendingRemoval = "pending_removal"
+	ReplicaUnconfirmed    = "unconfirmed"
+	ReplicaRootMissing    = "root_missing"
+
+	FileHealthy     = "healthy"
+	FileDegraded    = "degraded"
+	FileUnavailable = "unavailable"
+)
+
+type SetUserReplicationRequest struct {
+	// ReplicationFactor is the number of providers to store each upload
+	// with; null or 0 falls back to REPLICATION_FACTOR.
+	ReplicationFactor *int `json:"replicationFactor"`
+}
+
+// replicationFactorFor returns how many providers a user's uploads are
+// stored with.
+func replicationFactorFor(userID uint) int {
+	factor := cfg.ReplicationFactor
+	var user models.User
+	if err := db.Select("id", "replication_factor").First(&user, userID).Error; err == nil &&
+		user.ReplicationFactor != nil && *user.ReplicationFactor > 0 {
+		factor = *user.ReplicationFactor
+	}
+	if factor < 1 {
+		factor = 1
+	}
+	return factor
+}
+
+// replicaProviders returns the providers an upload is replicated to: the
+// primary provider followed by up to factor-1 other enabled providers in
+// policy order. Fewer are returned when not enough providers are enabled.
+func replicaProviders(primary *models.StorageProvider, factor int) ([]models.StorageProvider, error) {
+	providers := []models.StorageProvider{*primary}
+	if factor <= 1 {
+		return providers, nil
+	}
+
+	others, err := providersByPolicy([]uint{primary.ID}, factor-1)
+	if err != nil && !errors.Is(err, errNoProvider) {
+		return nil, err
+	}
+	providers = append(providers, others...)
+	if len(providers) < factor {
+		log.WithField("replicationFactor", factor).
+			WithField("providers", len(providers)).
+			Warning("Not enough enabled storage providers to meet the replication factor")
+	}
+	return providers, nil
+}
+
+// reportReplica records the progress of one replica of an upload job. The
+// first replica also drives the job's overall status until it finishes.
+func reportReplica(jobID string, index int, progress UploadProgress) {
+	updateUploadProgress(jobID, func(job *UploadProgress) {
+		if index >= len(job.Replicas) {
+			return
+		}
+		replica := &job.Replicas[index]
+		replica.Status = progress.Status
+		replica.Message = progress.Message
+		if progress.ProofSetID != "" {
+			replica.ProofSetID = progress.ProofSetID
+		}
+		if progress.Error != "" {
+			replica.Error = progress.Error
+		}
+
+		if index == 0 && progress.Status != "error" {
+			job.Status = progress.Status
+			job.Progress = progress.Progress
+			job.Message = progress.Message
+			if progress.CID != "" {
+				job.CID = progress.CID
+			}
+			if progress.ProofSetID != "" {
+				job.ProofSetID = progress.ProofSetID
+			}
+		}
+	})
+}
+
+// finishReplica marks a replica of an upload job as stored.
+func finishReplica(jobID string, index int, piece *models.Piece) {
+	updateUploadProgress(jobID, func(job *UploadProgress) {
+		if index >= len(job.Replicas) {
+			return
+		}
+		replica := &job.Replicas[index]
+		replica.Status = "complete"
+		replica.Message = ""
+		replica.Error = ""
+		if piece.RootID != nil {
+			replica.RootID = *piece.RootID
+		}
+	})
+}
+
+// replicaStatus classifies a stored replica.
+func replicaStatus(piece *models.Piece) string {
+	switch {
+	case piece.PendingRemoval:
+		return ReplicaPendingRemoval
+	case piece.RootState == models.RootMissing:
+		return ReplicaRootMissing
+	case piece.RootState == models.RootIDUnconfirmed || piece.RootID == nil || *piece.RootID == "":
+		return ReplicaUnconfirmed
+	default:
+		return ReplicaActive
+	}
+}
+
+// fileHealth summarises the replicas of a file against its replication
+// factor.
+func fileHealth(replicas []ReplicaResponse, factor int) string {
+	active := 0
+	for _, replica := range replicas {
+		if replica.Status == ReplicaActive {
+			active++
+		}
+	}
+	switch {
+	case active == 0:
+		return FileUnavailable
+	case active < factor:
+		return FileDegraded
+	default:
+		return FileHealthy
+	}
+}
+
+// SetUserReplication sets how many providers a user's uploads are stored with
+// @Summary Set user replication factor (admin)
+// @Description Override REPLICATION_FACTOR for a user. A null or zero factor clears the override.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Param id path int true "User ID"
+// @Param request body SetUserReplicationRequest true "Replication factor"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/admin/users/{id}/replication [put]
+func SetUserReplication(c *gin.Context) {
+	var request SetUserReplicationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if request.ReplicationFactor != nil && *request.ReplicationFactor < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "replicationFactor must not be negative",
+		})
+		return
+	}
+	if request.ReplicationFactor != nil && *request.ReplicationFactor == 0 {
+		request.ReplicationFactor = nil
+	}
+
+	var user models.User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "User not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch user",
+		})
+		return
+	}
+
+	if err := db.Model(&user).Update("replication_factor", request.ReplicationFactor).Error; err != nil {
+		log.WithField("error", err.Error()).WithField("userID", user.ID).Error("Failed to set replication factor")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to set replication factor",
+		})
+		return
+	}
+
+	log.WithField("userID", user.ID).WithField("replicationFactor", request.ReplicationFactor).Info("Set user replication factor")
+	c.JSON(http.StatusOK, gin.H{
+		"userId":                     user.ID,
+		"replicationFactor":          request.ReplicationFactor,
+		"effectiveReplicationFactor": replicationFactorFor(user.ID),
+	})
+}
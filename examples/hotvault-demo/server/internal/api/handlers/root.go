@@ -1,24 +1,22 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"os/exec"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
 	"gorm.io/gorm"
 )
 
 type RemoveRootRequest struct {
-	PieceID     uint   `json:"pieceId" binding:"required"`
-	ProofSetID  int    `json:"proofSetId"`
-	ServiceURL  string `json:"serviceUrl"`
-	ServiceName string `json:"serviceName"`
-	RootID      string `json:"rootId"`
+	PieceID    uint   `json:"pieceId" binding:"required"`
+	ProofSetID int    `json:"proofSetId"`
+	RootID     string `json:"rootId"`
 }
 
 type ProofSet struct {
@@ -34,13 +32,14 @@ type Root struct {
 	PieceIDs []uint `json:"piece_ids"`
 }
 
-// @Summary Remove roots using pdptool
-// @Description Remove a specific root from the PDP service
+// @Summary Remove roots from proof set
+// @Description Remove a specific root from the PDP service. Replicas of the same file on other storage providers are removed as well. A piece whose Root ID is not confirmed yet is looked up in its proof set first; the request fails with 409 if the root has not appeared there.
 // @Tags roots
 // @Accept json
 // @Produce json
 // @Param request body RemoveRootRequest true "Remove root request data"
 // @Success 200 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
 // @Router /api/v1/roots/remove [post]
 func RemoveRoot(c *gin.Context) {
 	if db == nil {
@@ -90,7 +89,25 @@ func RemoveRoot(c *gin.Context) {
 		return
 	}
 
-	if piece.RootID == nil || *piece.RootID == "" {
+	if piece.RootState == models.RootIDUnconfirmed {
+		if err := confirmPieceRoot(c.Request.Context(), &piece); err != nil {
+			if errors.Is(err, errRootUnconfirmed) {
+				c.JSON(http.StatusConflict, gin.H{
+					"error": "The Root ID of this piece is not confirmed in the proof set yet. Try again later.",
+				})
+				return
+			}
+			log.WithField("pieceID", piece.ID).WithField("error", err.Error()).Error("Failed to confirm Root ID of piece")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to confirm Root ID: " + err.Error(),
+			})
+			return
+		}
+	}
+	// A root that never appeared in the proof set has nothing to remove.
+	rootMissing := piece.RootState == models.RootMissing
+
+	if !rootMissing && (piece.RootID == nil || *piece.RootID == "") {
 		log.WithField("pieceID", piece.ID).Error("Piece is missing the stored Root ID")
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Internal error: Piece is missing the required Root ID",
@@ -125,18 +142,9 @@ func RemoveRoot(c *gin.Context) {
 	serviceURL := piece.ServiceURL
 	serviceName := piece.ServiceName
 	serviceProofSetIDStr := proofSet.ProofSetID
-	storedIntegerRootIDStr := *piece.RootID
-
-	if request.ServiceURL != "" {
-		serviceURL = request.ServiceURL
-		log.WithField("pieceID", piece.ID).Info("Overriding Service URL from request")
-	}
-	if request.ServiceName != "" {
-		serviceName = request.ServiceName
-		log.WithField("pieceID", piece.ID).Info("Overriding Service Name from request")
-	}
+	storedIntegerRootIDStr := pieceRootID(&piece)
 
-	if _, err := strconv.Atoi(storedIntegerRootIDStr); err != nil {
+	if _, err := strconv.Atoi(storedIntegerRootIDStr); err != nil && !rootMissing {
 		log.WithField("pieceID", piece.ID).WithField("storedRootID", storedIntegerRootIDStr).Error("Stored Root ID in piece record is not a valid integer string")
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Internal error: Invalid Root ID format stored for piece",
@@ -149,94 +157,168 @@ func RemoveRoot(c *gin.Context) {
 		WithField("integerRootID", storedIntegerRootIDStr).
 		Info("Proceeding with root removal using stored data")
 
-	pdptoolPath := cfg.PdptoolPath
-	if pdptoolPath == "" {
-		log.Error("PDPTool path not configured in environment/config")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Server configuration error: PDPTool path missing",
-		})
-		return
-	}
-
-	if _, err := os.Stat(pdptoolPath); os.IsNotExist(err) {
-		log.WithField("path", pdptoolPath).Error("pdptool not found at configured path")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "pdptool executable not found at configured path",
-			"path":  pdptoolPath,
+	if serviceURL == "" || serviceName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Service URL and Service Name are required but missing from piece/proofset data",
 		})
 		return
 	}
 
-	// Change working directory to pdptool directory
-	pdptoolDir := getPdptoolParentDir(pdptoolPath)
-	if err := os.Chdir(pdptoolDir); err != nil {
-		log.Error(fmt.Sprintf("Failed to change working directory to pdptool directory: %v", err))
+	shared, err := rootShared(&piece)
+	if err != nil {
+		log.WithField("pieceID", piece.ID).WithField("error", err.Error()).Error("Failed to check for shared root")
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to set working directory",
-		})
-		return
-	}
-	log.WithField("pdptoolDir", pdptoolDir).Info("Changed working directory to pdptool directory")
-
-	if serviceURL == "" || serviceName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Service URL and Service Name are required but missing from piece/proofset data",
+			"error": "Failed to check for shared root: " + err.Error(),
 		})
 		return
 	}
 
-	removeArgs := []string{
-		"remove-roots",
-		"--service-url", serviceURL,
-		"--service-name", serviceName,
-		"--proof-set-id", serviceProofSetIDStr,
-		"--root-id", storedIntegerRootIDStr,
-	}
-	removeCmd := exec.Command(pdptoolPath, removeArgs...)
+	if shared {
+		// Another file was deduplicated against this root.
+		log.WithField("pieceID", piece.ID).
+			WithField("integerRootID", storedIntegerRootIDStr).
+			Info("Root is shared with another file, keeping it in the proof set")
+	} else if rootMissing {
+		log.WithField("pieceID", piece.ID).
+			WithField("rootCID", rootCIDOf(&piece)).
+			Info("Root never appeared in the proof set, deleting piece only")
+	} else {
+		client := pdpClientFor(pdp.Service{Name: serviceName, URL: serviceURL})
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	removeCmd.Stdout = &stdout
-	removeCmd.Stderr = &stderr
+		log.WithField("serviceProofSetID", serviceProofSetIDStr).
+			WithField("integerRootID", storedIntegerRootIDStr).
+			Info("Executing remove-roots command")
 
-	cmdStr := removeCmd.String()
-	log.WithField("command", cmdStr).Info("Executing remove-roots command")
+		if err := client.RemoveRoots(c.Request.Context(), serviceProofSetIDStr, []string{storedIntegerRootIDStr}); err != nil {
+			log.WithField("error", err.Error()).
+				WithField("serviceProofSetID", serviceProofSetIDStr).
+				WithField("integerRootID", storedIntegerRootIDStr).
+				Error("Failed to remove root from proof set")
 
-	if err := removeCmd.Run(); err != nil {
-		errMsg := stderr.String()
-		if errMsg == "" {
-			errMsg = err.Error()
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to remove root: " + err.Error(),
+				"details": err.Error(),
+			})
+			return
 		}
 
-		log.WithField("error", err.Error()).
-			WithField("stderr", errMsg).
-			WithField("command", cmdStr).
-			Error("Failed to execute pdptool remove-roots command")
-
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to remove root: " + errMsg,
-			"details": err.Error(),
-			"command": cmdStr,
-		})
-		return
+		log.Info("remove-roots executed successfully")
 	}
 
-	log.WithField("output", stdout.String()).Info("pdptool remove-roots executed successfully")
-
 	if err := db.Delete(&piece).Error; err != nil {
 		log.WithField("pieceID", piece.ID).WithField("error", err.Error()).Error("Failed to delete piece from database after successful root removal")
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Root removal command succeeded, but failed to delete piece record from DB",
-			"output":  stdout.String(),
 			"dbError": err.Error(),
 		})
 		return
 	}
 
 	log.WithField("pieceID", piece.ID).Info("Piece successfully deleted from database")
+	emitRootRemovedWebhook(&piece)
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"message": "Root removed successfully and piece deleted",
-		"output":  stdout.String(),
-	})
+	}
+	if piece.FileID != nil {
+		removed, failures, err := removeFileReplicas(c.Request.Context(), *piece.FileID, userID.(uint))
+		response["replicasRemoved"] = removed
+		if err != nil {
+			response["replicaError"] = err.Error()
+		}
+		if len(failures) > 0 {
+			response["replicaErrors"] = failures
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// removeFileReplicas removes the remaining replicas of a file from their
+// proof sets and deletes them. The file record is deleted once no replica
+// is left. It returns the number of replicas removed and an error message
+// per replica that could not be removed.
+func removeFileReplicas(ctx context.Context, fileID, userID uint) (int, map[uint]string, error) {
+	var replicas []models.Piece
+	if err := db.Where("file_id = ? AND user_id = ?", fileID, userID).Find(&replicas).Error; err != nil {
+		log.WithField("fileID", fileID).WithField("error", err.Error()).Error("Failed to fetch file replicas")
+		return 0, nil, err
+	}
+
+	removed := 0
+	failures := make(map[uint]string)
+	for _, replica := range replicas {
+		if err := removeReplicaRoot(ctx, &replica, userID); err != nil {
+			log.WithField("pieceID", replica.ID).
+				WithField("fileID", fileID).
+				WithField("error", err.Error()).
+				Error("Failed to remove file replica")
+			failures[replica.ID] = err.Error()
+			continue
+		}
+		if err := db.Delete(&replica).Error; err != nil {
+			failures[replica.ID] = err.Error()
+			continue
+		}
+		emitRootRemovedWebhook(&replica)
+		removed++
+	}
+
+	if len(failures) == 0 {
+		if err := db.Delete(&models.File{}, fileID).Error; err != nil {
+			log.WithField("fileID", fileID).WithField("error", err.Error()).Error("Failed to delete file record")
+		}
+		if err := db.Where("file_id = ?", fileID).Delete(&models.Manifest{}).Error; err != nil {
+			log.WithField("fileID", fileID).WithField("error", err.Error()).Error("Failed to delete file manifest")
+		}
+	}
+	return removed, failures, nil
+}
+
+// removeReplicaRoot removes a replica's root from its proof set.
+func removeReplicaRoot(ctx context.Context, replica *models.Piece, userID uint) error {
+	if replica.ProofSetID == nil {
+		return nil
+	}
+	switch replica.RootState {
+	case models.RootIDUnconfirmed:
+		if err := confirmPieceRoot(ctx, replica); err != nil {
+			return fmt.Errorf("failed to confirm root ID: %w", err)
+		}
+		if replica.RootState == models.RootMissing {
+			return nil
+		}
+	case models.RootMissing:
+		// The root never appeared in the proof set.
+		return nil
+	}
+	if replica.RootID == nil || *replica.RootID == "" {
+		// Nothing was added to a proof set for this replica.
+		return nil
+	}
+	shared, err := rootShared(replica)
+	if err != nil {
+		return fmt.Errorf("failed to check for shared root: %w", err)
+	}
+	if shared {
+		log.WithField("pieceID", replica.ID).
+			WithField("integerRootID", *replica.RootID).
+			Info("Root is shared with another file, keeping it in the proof set")
+		return nil
+	}
+
+	var proofSet models.ProofSet
+	if err := db.Where("id = ? AND user_id = ?", *replica.ProofSetID, userID).First(&proofSet).Error; err != nil {
+		return fmt.Errorf("failed to fetch proof set: %w", err)
+	}
+	if proofSet.ProofSetID == "" {
+		return errors.New("proof set record is incomplete")
+	}
+
+	client := pdpClientFor(pdp.Service{Name: replica.ServiceName, URL: replica.ServiceURL})
+	log.WithField("pieceID", replica.ID).
+		WithField("serviceProofSetID", proofSet.ProofSetID).
+		WithField("integerRootID", *replica.RootID).
+		Info("Removing file replica root")
+	return client.RemoveRoots(ctx, proofSet.ProofSetID, []string{*replica.RootID})
 }
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
+)
+
+var (
+	errRootUnconfirmed = errors.New("root ID not confirmed in the proof set yet")
+
+	rootReconcilerOnce sync.Once
+)
+
+// pieceRootID returns the root ID of a piece, or an empty string while it
+// is not known.
+func pieceRootID(piece *models.Piece) string {
+	if piece.RootID == nil {
+		return ""
+	}
+	return *piece.RootID
+}
+
+// rootCIDOf returns the CID the proof set lists the root of a piece under.
+// Files packed into an aggregate share the root of the aggregate.
+func rootCIDOf(piece *models.Piece) string {
+	cid := piece.CID
+	if piece.AggregateCID != "" {
+		cid = piece.AggregateCID
+	}
+	return pdp.ParseRoot(cid).CID
+}
+
+// startRootReconciler starts looking up the root IDs of pieces stored
+// before their root showed up in the proof set.
+func startRootReconciler() {
+	rootReconcilerOnce.Do(func() {
+		go runRootReconciler()
+
+		log.WithField("interval", cfg.RootReconcile.Interval.String()).
+			WithField("missingAfter", cfg.RootReconcile.MissingAfter.String()).
+			Info("Started root reconciler")
+	})
+}
+
+func runRootReconciler() {
+	flagFallbackRootIDs()
+
+	ticker := time.NewTicker(cfg.RootReconcile.Interval)
+	defer ticker.Stop()
+	for {
+		reconcileRoots(context.Background())
+		<-ticker.C
+	}
+}
+
+// flagFallbackRootIDs marks pieces saved with the root ID "1", which used
+// to be stored when the real root ID could not be found, as unconfirmed so
+// the reconciler checks them. Pieces whose root ID was checked since are
+// left alone.
+func flagFallbackRootIDs() {
+	result := db.Model(&models.Piece{}).
+		Where("root_id = ? AND root_state = ? AND root_checked_at IS NULL", "1", models.RootConfirmed).
+		Updates(map[string]interface{}{
+			"root_id":    nil,
+			"root_state": models.RootIDUnconfirmed,
+		})
+	if result.Error != nil {
+		log.WithField("error", result.Error.Error()).Error("Failed to flag pieces stored with the fallback Root ID")
+	} else if result.RowsAffected > 0 {
+		log.WithField("pieces", result.RowsAffected).Warning("Flagged pieces stored with the fallback Root ID for reconciliation")
+	}
+}
+
+// claimedRootIDs returns the root IDs of a proof set that stored pieces
+// already reference.
+func claimedRootIDs(proofSetID uint) (map[string]bool, error) {
+	var ids []string
+	err := db.Model(&models.Piece{}).
+		Where("proof_set_id = ? AND root_id IS NOT NULL AND root_id <> ''", proofSetID).
+		Distinct().
+		Pluck("root_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	claimed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		claimed[id] = true
+	}
+	return claimed, nil
+}
+
+// newestUnclaimedRoot returns the root of remote listed under cid with the
+// highest ID that no piece references yet. A proof set can hold several
+// roots with the same CID, for content uploaded again; the one added last
+// is the newest.
+func newestUnclaimedRoot(remote *pdp.ProofSet, cid string, claimed map[string]bool) (pdp.Root, bool) {
+	var newest pdp.Root
+	found := false
+	for _, root := range remote.FindRoots(cid) {
+		if claimed[root.ID] {
+			continue
+		}
+		if !found || rootIDLess(newest.ID, root.ID) {
+			newest = root
+			found = true
+		}
+	}
+	return newest, found
+}
+
+// rootIDLess orders root IDs numerically.
+func rootIDLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// rootGroups splits unconfirmed pieces into the pieces sharing each root:
+// files packed into one aggregate share its root, any other piece has a
+// root of its own.
+func rootGroups(pieces []*models.Piece) [][]*models.Piece {
+	var groups [][]*models.Piece
+	aggregates := make(map[string]int)
+	for _, piece := range pieces {
+		if piece.AggregateCID != "" {
+			if i, ok := aggregates[piece.AggregateCID]; ok {
+				groups[i] = append(groups[i], piece)
+				continue
+			}
+			aggregates[piece.AggregateCID] = len(groups)
+		}
+		groups = append(groups, []*models.Piece{piece})
+	}
+	return groups
+}
+
+// reconcileRoots matches the unconfirmed pieces of every proof set against
+// the roots the proof set lists.
+func reconcileRoots(ctx context.Context) {
+	var pieces []models.Piece
+	err := db.Where("root_state = ? AND proof_set_id IS NOT NULL", models.RootIDUnconfirmed).
+		Order("proof_set_id, id").
+		Find(&pieces).Error
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Failed to fetch pieces with unconfirmed Root IDs")
+		return
+	}
+
+	byProofSet := make(map[uint][]*models.Piece)
+	for i := range pieces {
+		proofSetID := *pieces[i].ProofSetID
+		byProofSet[proofSetID] = append(byProofSet[proofSetID], &pieces[i])
+	}
+
+	for proofSetID, unconfirmed := range byProofSet {
+		remote, err := fetchProofSetRoots(ctx, unconfirmed[0])
+		if err != nil {
+			// The pieces are retried on the next run; a proof set that
+			// cannot be fetched says nothing about whether a root exists.
+			log.WithField("proofSetDbId", proofSetID).
+				WithField("pieces", len(unconfirmed)).
+				WithField("error", err.Error()).
+				Warning("Failed to fetch proof set roots for reconciliation")
+			continue
+		}
+		now := time.Now()
+		for _, group := range rootGroups(unconfirmed) {
+			if err := matchRoot(group, remote, now); err != nil {
+				log.WithField("pieceID", group[0].ID).WithField("error", err.Error()).Error("Failed to save reconciled Root ID")
+			}
+		}
+	}
+}
+
+// fetchProofSetRoots fetches the proof set holding a piece from its
+// provider.
+func fetchProofSetRoots(ctx context.Context, piece *models.Piece) (*pdp.ProofSet, error) {
+	var proofSet models.ProofSet
+	if err := db.First(&proofSet, *piece.ProofSetID).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch proof set: %w", err)
+	}
+	if proofSet.ProofSetID == "" {
+		return nil, errors.New("proof set record is incomplete")
+	}
+	client := pdpClientFor(pdp.Service{Name: piece.ServiceName, URL: piece.ServiceURL})
+	return client.GetProofSet(ctx, proofSet.ProofSetID)
+}
+
+// matchRoot looks up the root shared by a group of unconfirmed pieces in
+// remote, the proof set holding them, among the roots no other piece
+// references, and saves its root ID if found. Pieces whose root has not
+// appeared MissingAfter after they were stored are flagged as missing.
+func matchRoot(group []*models.Piece, remote *pdp.ProofSet, now time.Time) error {
+	first := group[0]
+	claimed, err := claimedRootIDs(*first.ProofSetID)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"root_checked_at": now,
+	}
+	root, found := newestUnclaimedRoot(remote, rootCIDOf(first), claimed)
+	switch {
+	case found:
+		updates["root_id"] = root.ID
+		updates["root_state"] = models.RootConfirmed
+	case now.Sub(first.CreatedAt) >= cfg.RootReconcile.MissingAfter:
+		updates["root_state"] = models.RootMissing
+	}
+
+	ids := make([]uint, len(group))
+	for i, piece := range group {
+		ids[i] = piece.ID
+	}
+	// Only unconfirmed pieces are updated, so a concurrent lookup of the
+	// same pieces is not overwritten.
+	result := db.Model(&models.Piece{}).
+		Where("id IN ? AND root_state = ?", ids, models.RootIDUnconfirmed).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected < int64(len(group)) {
+		for _, piece := range group {
+			if err := db.First(piece, piece.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, piece := range group {
+		piece.RootCheckedAt = &now
+		switch {
+		case found:
+			piece.RootID = &root.ID
+			piece.RootState = models.RootConfirmed
+		case updates["root_state"] == models.RootMissing:
+			piece.RootState = models.RootMissing
+		}
+	}
+	switch {
+	case found:
+		log.WithField("pieceIDs", ids).
+			WithField("rootCID", root.CID).
+			WithField("integerRootID", root.ID).
+			Info("Reconciled Root ID")
+	case updates["root_state"] == models.RootMissing:
+		log.WithField("pieceIDs", ids).
+			WithField("rootCID", rootCIDOf(first)).
+			WithField("storedAt", first.CreatedAt).
+			Warning("Root never appeared in the proof set, flagging pieces as missing their root")
+	}
+	return nil
+}
+
+// confirmPieceRoot looks up the root of an unconfirmed piece right away,
+// for operations that need its root ID. It returns errRootUnconfirmed if
+// the root has not appeared in the proof set yet.
+func confirmPieceRoot(ctx context.Context, piece *models.Piece) error {
+	group := []*models.Piece{piece}
+	if piece.AggregateCID != "" {
+		var siblings []models.Piece
+		err := db.Where("proof_set_id = ? AND aggregate_c_id = ? AND root_state = ? AND id <> ?",
+			*piece.ProofSetID, piece.AggregateCID, models.RootIDUnconfirmed, piece.ID).
+			Find(&siblings).Error
+		if err != nil {
+			return err
+		}
+		for i := range siblings {
+			group = append(group, &siblings[i])
+		}
+	}
+
+	remote, err := fetchProofSetRoots(ctx, piece)
+	if err != nil {
+		return err
+	}
+	if err := matchRoot(group, remote, time.Now()); err != nil {
+		return err
+	}
+	if piece.RootState == models.RootIDUnconfirmed {
+		return errRootUnconfirmed
+	}
+	return nil
+}
@@ -0,0 +1,1238 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/sigv4"
+	"gorm.io/gorm"
+)
+
+// The S3 gateway serves path-style requests under /s3. A bucket is one of
+// the user's proof sets, named proofset-<local proof set ID> since on-chain
+// IDs repeat across providers, and an object is the
+// newest piece in that proof set whose filename is the key. Writes go
+// through the upload job queue and respond once the job has finished.
+const (
+	s3Namespace        = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3BucketPrefix     = "proofset-"
+	s3MaxKeys          = 1000
+	s3MaxParts         = 10000
+	s3JobPollInterval  = 1 * time.Second
+	s3MultipartExpiry  = 7 * 24 * time.Hour
+	s3MaxRequestXML    = 1 << 20
+	s3TimestampFormat  = "2006-01-02T15:04:05.000Z"
+	s3StorageClass     = "STANDARD"
+	s3DefaultObjectExt = "object"
+)
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              *int             `xml:"KeyCount,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker,omitempty"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUploadRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type s3DeleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name          `xml:"DeleteResult"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	Deleted []s3DeletedObject `xml:"Deleted"`
+	Errors  []s3DeleteError   `xml:"Error"`
+}
+
+func init() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			cleanupOldS3MultipartUploads()
+		}
+	}()
+}
+
+// cleanupOldS3MultipartUploads removes multipart uploads neither completed
+// nor aborted within s3MultipartExpiry.
+func cleanupOldS3MultipartUploads() {
+	if db == nil {
+		return
+	}
+
+	var expired []models.S3MultipartUpload
+	if err := db.Where("updated_at < ?", time.Now().Add(-s3MultipartExpiry)).Find(&expired).Error; err != nil {
+		log.WithField("error", err.Error()).Error("Failed to list expired S3 multipart uploads")
+		return
+	}
+	for _, upload := range expired {
+		os.RemoveAll(upload.Dir)
+		if err := db.Delete(&upload).Error; err != nil {
+			log.WithField("uploadId", upload.ID).WithField("error", err.Error()).Error("Failed to delete expired S3 multipart upload")
+			continue
+		}
+		log.WithField("uploadId", upload.ID).Info("Cleaned up expired S3 multipart upload")
+	}
+}
+
+// s3Error writes an S3 error response.
+func s3Error(c *gin.Context, status int, code, message string) {
+	c.Header("x-amz-request-id", uuid.New().String())
+	if c.Request.Method == http.MethodHead {
+		c.AbortWithStatus(status)
+		return
+	}
+	c.Abort()
+	c.XML(status, s3ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Resource:  c.Request.URL.Path,
+		RequestID: c.Writer.Header().Get("x-amz-request-id"),
+	})
+}
+
+// s3XML writes a successful S3 XML response.
+func s3XML(c *gin.Context, status int, body interface{}) {
+	c.Header("x-amz-request-id", uuid.New().String())
+	c.XML(status, body)
+}
+
+func s3InternalError(c *gin.Context, err error) {
+	log.WithField("path", c.Request.URL.Path).WithField("error", err.Error()).Error("S3 request failed")
+	s3Error(c, http.StatusInternalServerError, "InternalError", err.Error())
+}
+
+// s3BodyError answers a request whose body could not be read or stored.
+func s3BodyError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, sigv4.ErrContentSHA256Mismatch):
+		s3Error(c, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match the request body")
+	case errors.Is(err, sigv4.ErrSignatureMismatch):
+		s3Error(c, http.StatusForbidden, "SignatureDoesNotMatch", "A chunk signature does not match the chunk")
+	case errors.Is(err, sigv4.ErrMalformedChunk):
+		s3Error(c, http.StatusBadRequest, "IncompleteBody", err.Error())
+	default:
+		s3InternalError(c, err)
+	}
+}
+
+// S3Auth authenticates S3 requests by their SigV4 signature and replaces
+// the request body with the verified payload.
+func S3Auth(c *gin.Context) {
+	var key models.AccessKey
+	lookup := func(accessKeyID string) (string, error) {
+		if err := db.Where("access_key_id = ?", accessKeyID).First(&key).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", sigv4.ErrInvalidAccessKey
+			}
+			return "", err
+		}
+		return key.SecretAccessKey, nil
+	}
+
+	signature, err := sigv4.Verify(c.Request, lookup, time.Now().UTC())
+	if err != nil {
+		switch {
+		case errors.Is(err, sigv4.ErrMissingAuth):
+			s3Error(c, http.StatusForbidden, "AccessDenied", "Access Denied")
+		case errors.Is(err, sigv4.ErrUnsupportedAlgorithm):
+			s3Error(c, http.StatusBadRequest, "InvalidRequest", "Only AWS Signature Version 4 is supported")
+		case errors.Is(err, sigv4.ErrMalformedAuth):
+			s3Error(c, http.StatusBadRequest, "AuthorizationHeaderMalformed", err.Error())
+		case errors.Is(err, sigv4.ErrInvalidAccessKey):
+			s3Error(c, http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records")
+		case errors.Is(err, sigv4.ErrSignatureMismatch):
+			s3Error(c, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+		case errors.Is(err, sigv4.ErrRequestTimeSkewed):
+			s3Error(c, http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+		case errors.Is(err, sigv4.ErrRequestExpired):
+			s3Error(c, http.StatusForbidden, "AccessDenied", "Request has expired")
+		default:
+			s3InternalError(c, err)
+		}
+		return
+	}
+
+	body, err := signature.Body(c.Request.Body)
+	if err != nil {
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "Unsupported x-amz-content-sha256: "+signature.PayloadHash)
+		return
+	}
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, c.Request.Body}
+	if decoded := c.GetHeader("X-Amz-Decoded-Content-Length"); decoded != "" {
+		if length, err := strconv.ParseInt(decoded, 10, 64); err == nil {
+			c.Request.ContentLength = length
+		}
+	}
+
+	now := time.Now()
+	db.Model(&key).UpdateColumn("last_used_at", now)
+
+	c.Set("userID", key.UserID)
+	c.Next()
+}
+
+// S3ListBuckets lists the user's proof sets as buckets
+// @Summary S3 ListBuckets
+// @Tags s3
+// @Produce xml
+// @Router /s3/ [get]
+func S3ListBuckets(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var proofSets []models.ProofSet
+	if err := db.Where("user_id = ? AND proof_set_id <> ''", userID).Order("id").Find(&proofSets).Error; err != nil {
+		s3InternalError(c, err)
+		return
+	}
+
+	result := s3ListBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: strconv.FormatUint(uint64(userID), 10), DisplayName: strconv.FormatUint(uint64(userID), 10)},
+	}
+	for _, proofSet := range proofSets {
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         s3BucketName(&proofSet),
+			CreationDate: proofSet.CreatedAt.UTC().Format(s3TimestampFormat),
+		})
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+// S3Bucket serves requests on a bucket
+// @Summary S3 bucket operations
+// @Description ListObjects (V1 and V2), HeadBucket, GetBucketLocation and DeleteObjects
+// @Tags s3
+// @Produce xml
+// @Param bucket path string true "Bucket name, proofset-<local proof set ID>"
+// @Router /s3/{bucket} [get]
+func S3Bucket(c *gin.Context) {
+	proofSet := s3LoadBucket(c)
+	if proofSet == nil {
+		return
+	}
+
+	query := c.Request.URL.Query()
+	switch c.Request.Method {
+	case http.MethodHead:
+		c.Header("x-amz-request-id", uuid.New().String())
+		c.Status(http.StatusOK)
+	case http.MethodGet:
+		switch {
+		case query.Has("location"):
+			s3XML(c, http.StatusOK, s3LocationConstraint{Xmlns: s3Namespace})
+		case query.Has("uploads"), query.Has("versions"), query.Has("policy"), query.Has("acl"):
+			s3Error(c, http.StatusNotImplemented, "NotImplemented", "This bucket operation is not supported")
+		default:
+			s3ListObjects(c, proofSet)
+		}
+	case http.MethodPost:
+		if query.Has("delete") {
+			s3DeleteObjects(c, proofSet)
+			return
+		}
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "This bucket operation is not supported")
+	case http.MethodPut, http.MethodDelete:
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "Buckets are the proof sets of your storage providers and cannot be created or deleted")
+	default:
+		s3Error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource")
+	}
+}
+
+// S3Object serves requests on an object
+// @Summary S3 object operations
+// @Description PutObject, GetObject, HeadObject, DeleteObject and multipart uploads
+// @Tags s3
+// @Param bucket path string true "Bucket name, proofset-<local proof set ID>"
+// @Param key path string true "Object key"
+// @Router /s3/{bucket}/{key} [get]
+func S3Object(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		S3Bucket(c)
+		return
+	}
+
+	proofSet := s3LoadBucket(c)
+	if proofSet == nil {
+		return
+	}
+
+	query := c.Request.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch c.Request.Method {
+	case http.MethodGet:
+		if uploadID != "" {
+			s3Error(c, http.StatusNotImplemented, "NotImplemented", "ListParts is not supported")
+			return
+		}
+		s3GetObject(c, proofSet, key)
+	case http.MethodHead:
+		s3HeadObject(c, proofSet, key)
+	case http.MethodPut:
+		switch {
+		case c.GetHeader("X-Amz-Copy-Source") != "":
+			s3Error(c, http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported")
+		case uploadID != "":
+			s3UploadPart(c, proofSet, key, uploadID)
+		default:
+			s3PutObject(c, proofSet, key)
+		}
+	case http.MethodPost:
+		switch {
+		case query.Has("uploads"):
+			s3CreateMultipartUpload(c, proofSet, key)
+		case uploadID != "":
+			s3CompleteMultipartUpload(c, proofSet, key, uploadID)
+		default:
+			s3Error(c, http.StatusNotImplemented, "NotImplemented", "This object operation is not supported")
+		}
+	case http.MethodDelete:
+		if uploadID != "" {
+			s3AbortMultipartUpload(c, proofSet, key, uploadID)
+			return
+		}
+		s3DeleteObject(c, proofSet, key)
+	default:
+		s3Error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource")
+	}
+}
+
+// s3BucketName is the bucket of a proof set. It is keyed on the local
+// proof set ID: the same on-chain ID can exist at several providers.
+func s3BucketName(proofSet *models.ProofSet) string {
+	return s3BucketPrefix + strconv.FormatUint(uint64(proofSet.ID), 10)
+}
+
+// s3LoadBucket returns the proof set named by the bucket parameter. It
+// writes NoSuchBucket and returns nil if the user has no such proof set.
+func s3LoadBucket(c *gin.Context) *models.ProofSet {
+	name := c.Param("bucket")
+	id, err := strconv.ParseUint(strings.TrimPrefix(name, s3BucketPrefix), 10, 64)
+	if !strings.HasPrefix(name, s3BucketPrefix) || err != nil {
+		s3Error(c, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return nil
+	}
+
+	var proofSet models.ProofSet
+	err = db.Where("id = ? AND user_id = ? AND proof_set_id <> ''", id, c.GetUint("userID")).First(&proofSet).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s3Error(c, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+			return nil
+		}
+		s3InternalError(c, err)
+		return nil
+	}
+	return &proofSet
+}
+
+// s3Objects selects the live pieces of a bucket.
+func s3Objects(proofSet *models.ProofSet) *gorm.DB {
+	return db.Model(&models.Piece{}).
+		Where("proof_set_id = ? AND user_id = ? AND pending_removal = ?", proofSet.ID, proofSet.UserID, false).
+		Where("segment_index = ?", 0)
+}
+
+// s3FindObject returns the newest piece stored under key, or nil.
+func s3FindObject(proofSet *models.ProofSet, key string) (*models.Piece, error) {
+	var piece models.Piece
+	err := s3Objects(proofSet).Where("filename = ?", key).Order("id DESC").First(&piece).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &piece, nil
+}
+
+// s3ETags returns the quoted ETag of each piece by piece ID: the MD5 based
+// tag recorded for objects written through the gateway, the CID otherwise.
+func s3ETags(pieces []models.Piece) (map[uint]string, error) {
+	var fileIDs []uint
+	for _, piece := range pieces {
+		if piece.FileID != nil {
+			fileIDs = append(fileIDs, *piece.FileID)
+		}
+	}
+
+	fileETags := make(map[uint]string)
+	if len(fileIDs) > 0 {
+		var files []models.File
+		if err := db.Select("id", "e_tag").Where("id IN ?", fileIDs).Find(&files).Error; err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			fileETags[file.ID] = file.ETag
+		}
+	}
+
+	etags := make(map[uint]string, len(pieces))
+	for _, piece := range pieces {
+		etag := piece.CID
+		if piece.FileID != nil && fileETags[*piece.FileID] != "" {
+			etag = fileETags[*piece.FileID]
+		}
+		etags[piece.ID] = `"` + etag + `"`
+	}
+	return etags, nil
+}
+
+func s3ObjectHeaders(c *gin.Context, piece *models.Piece) error {
+	etags, err := s3ETags([]models.Piece{*piece})
+	if err != nil {
+		return err
+	}
+	c.Header("x-amz-request-id", uuid.New().String())
+	c.Header("ETag", etags[piece.ID])
+	c.Header("Last-Modified", piece.CreatedAt.UTC().Format(http.TimeFormat))
+	c.Header("Accept-Ranges", "bytes")
+	return nil
+}
+
+func s3HeadObject(c *gin.Context, proofSet *models.ProofSet, key string) {
+	piece, err := s3FindObject(proofSet, key)
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	if piece == nil {
+		s3Error(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	size, err := objectSize(piece)
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	if err := s3ObjectHeaders(c, piece); err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+}
+
+func s3GetObject(c *gin.Context, proofSet *models.ProofSet, key string) {
+	piece, err := s3FindObject(proofSet, key)
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	if piece == nil {
+		s3Error(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	var replicas []models.Piece
+	if err := db.Where("c_id = ? AND user_id = ?", piece.CID, piece.UserID).Order("pending_removal ASC, id ASC").Find(&replicas).Error; err != nil {
+		s3InternalError(c, err)
+		return
+	}
+
+	tempDir, err := os.MkdirTemp("", "s3-download-*")
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	outputFile := filepath.Join(tempDir, s3DefaultObjectExt)
+	if err := downloadPiece(c.Request.Context(), piece, replicas, outputFile); err != nil {
+		s3InternalError(c, fmt.Errorf("failed to download object: %w", err))
+		return
+	}
+
+	file, err := os.Open(outputFile)
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	defer file.Close()
+
+	if err := s3ObjectHeaders(c, piece); err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, key, piece.CreatedAt, file)
+}
+
+// s3PayloadName is the payload file name for an object key.
+func s3PayloadName(key string) string {
+	name := filepath.Base(key)
+	if name == "." || name == "/" || name == "" {
+		return s3DefaultObjectExt
+	}
+	return name
+}
+
+// s3CheckContentMD5 compares a Content-MD5 header, if any, with digest.
+func s3CheckContentMD5(c *gin.Context, digest []byte) bool {
+	header := c.GetHeader("Content-MD5")
+	if header == "" {
+		return true
+	}
+	expected, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || string(expected) != string(digest) {
+		s3Error(c, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+		return false
+	}
+	return true
+}
+
+// s3RejectIfQueueFull answers SlowDown when the upload queue is full.
+func s3RejectIfQueueFull(c *gin.Context) bool {
+	var waiting int64
+	if err := waitingUploadJobs().Count(&waiting).Error; err != nil {
+		s3InternalError(c, err)
+		return true
+	}
+	if int(waiting) < cfg.Uploads.QueueLimit {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(uploadQueueRetryAfter.Seconds())))
+	s3Error(c, http.StatusServiceUnavailable, "SlowDown", "Upload queue is full, please reduce your request rate")
+	return true
+}
+
+// s3RejectIfOverQuota answers QuotaExceeded when an object of size bytes
+// does not fit in the user's storage quota.
+func s3RejectIfOverQuota(c *gin.Context, userID uint, size int64) bool {
+	_, err := checkQuota(userID, size)
+	if err == nil {
+		return false
+	}
+	s3QuotaError(c, err)
+	return true
+}
+
+// s3QuotaError answers QuotaExceeded for errQuotaExceeded and an internal
+// error otherwise.
+func s3QuotaError(c *gin.Context, err error) {
+	if errors.Is(err, errQuotaExceeded) {
+		s3Error(c, http.StatusForbidden, "QuotaExceeded", "Storing this object would exceed your storage quota")
+		return
+	}
+	s3InternalError(c, err)
+}
+
+func s3PutObject(c *gin.Context, proofSet *models.ProofSet, key string) {
+	if c.Request.ContentLength > maxUploadSize {
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", "Maximum object size is "+formatFileSize(maxUploadSize))
+		return
+	}
+	if s3RejectIfQueueFull(c) {
+		return
+	}
+	if c.Request.ContentLength > 0 && s3RejectIfOverQuota(c, proofSet.UserID, c.Request.ContentLength) {
+		return
+	}
+
+	jobID := uuid.New().String()
+	hasher := md5.New()
+	body := io.LimitReader(c.Request.Body, maxUploadSize+1)
+	payload, err := spoolUploadPayload(jobID, s3PayloadName(key), body, hasher)
+	if err != nil {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		s3BodyError(c, err)
+		return
+	}
+	if payload.Size > maxUploadSize {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", "Maximum object size is "+formatFileSize(maxUploadSize))
+		return
+	}
+	if payload.Size == 0 {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", "Empty objects cannot be stored as pieces")
+		return
+	}
+	digest := hasher.Sum(nil)
+	if !s3CheckContentMD5(c, digest) {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		return
+	}
+
+	etag := hex.EncodeToString(digest)
+	if !s3StoreObject(c, proofSet, key, jobID, payload, etag) {
+		return
+	}
+
+	c.Header("x-amz-request-id", uuid.New().String())
+	c.Header("ETag", `"`+etag+`"`)
+	c.Status(http.StatusOK)
+}
+
+// s3StoreObject queues a received payload and waits for it to be stored.
+// It writes the error response and returns false on failure.
+func s3StoreObject(c *gin.Context, proofSet *models.ProofSet, key, jobID string, payload *spooledUpload, etag string) bool {
+	return s3QueueObject(c, proofSet, key, jobID, payload, etag, nil) && s3AwaitObject(c, proofSet, key, jobID)
+}
+
+// s3QueueObject queues a received payload as an upload job to the bucket's
+// provider. A payload whose piece was computed while it was received skips
+// the preparation stage. handoff is passed to enqueueUploadJob; it returns
+// gorm.ErrRecordNotFound if the multipart upload it completes is gone. The
+// payload is removed and the error response written if the job is not
+// queued.
+func s3QueueObject(c *gin.Context, proofSet *models.ProofSet, key, jobID string, payload *spooledUpload, etag string, handoff func(tx *gorm.DB) error) bool {
+	job := &models.UploadJob{
+		ID:          jobID,
+		UserID:      proofSet.UserID,
+		ProviderID:  proofSet.ProviderID,
+		Filename:    key,
+		TotalSize:   payload.Size,
+		PayloadPath: payload.Path,
+		SHA256:      payload.SHA256,
+		ETag:        etag,
+		Stage:       models.UploadStageReceived,
+		Status:      "queued",
+		Message:     "Waiting for an upload worker",
+	}
+	if payload.Piece != nil {
+		job.Stage = models.UploadStagePrepared
+		job.PieceCID = payload.Piece.CID
+	}
+	if _, err := enqueueUploadJob(job, handoff); err != nil {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s3Error(c, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+			return false
+		}
+		s3QuotaError(c, err)
+		return false
+	}
+
+	log.WithField("jobID", jobID).
+		WithField("bucket", s3BucketName(proofSet)).
+		WithField("key", key).
+		WithField("size", formatFileSize(payload.Size)).
+		Info("Queued S3 object upload")
+	return true
+}
+
+// s3AwaitObject waits for the upload job of an object to finish. Older
+// objects under the same key are removed once the new one is stored. It
+// writes the error response and returns false on failure.
+func s3AwaitObject(c *gin.Context, proofSet *models.ProofSet, key, jobID string) bool {
+	job, err := waitForUploadJob(c.Request.Context(), jobID)
+	if err != nil {
+		s3InternalError(c, fmt.Errorf("upload job %s: %w", jobID, err))
+		return false
+	}
+	if job.Status != "complete" {
+		s3InternalError(c, fmt.Errorf("upload job %s failed: %s", jobID, job.Error))
+		return false
+	}
+
+	var older []models.Piece
+	query := s3Objects(proofSet).Where("filename = ?", key)
+	if job.FileID != nil {
+		query = query.Where("file_id IS NULL OR file_id <> ?", *job.FileID)
+	}
+	if err := query.Find(&older).Error; err != nil {
+		log.WithField("key", key).WithField("error", err.Error()).Warning("Failed to look up replaced S3 objects")
+	} else if err := s3DeletePieces(c.Request.Context(), proofSet.UserID, older); err != nil {
+		log.WithField("key", key).WithField("error", err.Error()).Warning("Failed to remove replaced S3 object")
+	}
+	return true
+}
+
+// waitForUploadJob polls an upload job until it reaches a terminal status
+// or ctx is done.
+func waitForUploadJob(ctx context.Context, jobID string) (*models.UploadJob, error) {
+	for {
+		job, err := loadUploadJob(jobID)
+		if err != nil {
+			return nil, err
+		}
+		if isTerminalUploadStatus(job.Status) {
+			return job, nil
+		}
+		if err := sleepContext(ctx, s3JobPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// s3DeletePieces removes pieces from their proof sets. Pieces belonging to
+// a file are removed with every replica of that file.
+func s3DeletePieces(ctx context.Context, userID uint, pieces []models.Piece) error {
+	files := make(map[uint]bool)
+	for i := range pieces {
+		piece := &pieces[i]
+		if piece.FileID != nil {
+			if files[*piece.FileID] {
+				continue
+			}
+			files[*piece.FileID] = true
+			_, failures, err := removeFileReplicas(ctx, *piece.FileID, userID)
+			if err != nil {
+				return err
+			}
+			for pieceID, failure := range failures {
+				return fmt.Errorf("failed to remove piece %d: %s", pieceID, failure)
+			}
+			continue
+		}
+
+		if err := removeReplicaRoot(ctx, piece, userID); err != nil {
+			return err
+		}
+		if err := db.Delete(piece).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func s3DeleteObject(c *gin.Context, proofSet *models.ProofSet, key string) {
+	if err := s3DeleteKey(c.Request.Context(), proofSet, key); err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	c.Header("x-amz-request-id", uuid.New().String())
+	c.Status(http.StatusNoContent)
+}
+
+// s3DeleteKey removes every object stored under key. Deleting a missing
+// key succeeds, as in S3.
+func s3DeleteKey(ctx context.Context, proofSet *models.ProofSet, key string) error {
+	var pieces []models.Piece
+	if err := s3Objects(proofSet).Where("filename = ?", key).Find(&pieces).Error; err != nil {
+		return err
+	}
+	if err := s3DeletePieces(ctx, proofSet.UserID, pieces); err != nil {
+		return err
+	}
+	if len(pieces) > 0 {
+		log.WithField("bucket", s3BucketName(proofSet)).WithField("key", key).Info("Deleted S3 object")
+	}
+	return nil
+}
+
+func s3DeleteObjects(c *gin.Context, proofSet *models.ProofSet) {
+	var request s3DeleteRequest
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, s3MaxRequestXML)).Decode(&request); err != nil {
+		s3Error(c, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+
+	result := s3DeleteResult{Xmlns: s3Namespace}
+	for _, object := range request.Objects {
+		if err := s3DeleteKey(c.Request.Context(), proofSet, object.Key); err != nil {
+			result.Errors = append(result.Errors, s3DeleteError{Key: object.Key, Code: "InternalError", Message: err.Error()})
+			continue
+		}
+		if !request.Quiet {
+			result.Deleted = append(result.Deleted, s3DeletedObject{Key: object.Key})
+		}
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+func s3ListObjects(c *gin.Context, proofSet *models.ProofSet) {
+	query := c.Request.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	v2 := query.Get("list-type") == "2"
+
+	maxKeys := s3MaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			s3Error(c, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+			return
+		}
+		if parsed < maxKeys {
+			maxKeys = parsed
+		}
+	}
+
+	result := s3ListObjectsResult{
+		Xmlns:     s3Namespace,
+		Name:      s3BucketName(proofSet),
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+
+	after := ""
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		after = result.StartAfter
+		if result.ContinuationToken != "" {
+			decoded, err := base64.URLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				s3Error(c, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+				return
+			}
+			after = string(decoded)
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		after = marker
+	}
+
+	var pieces []models.Piece
+	listing := s3Objects(proofSet).Where("filename > ?", after)
+	if prefix != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+		listing = listing.Where("filename LIKE ?", escaped+"%")
+	}
+	if err := listing.Order("filename ASC, id DESC").Find(&pieces).Error; err != nil {
+		s3InternalError(c, err)
+		return
+	}
+
+	// Pieces are ordered by key, newest first, so the first piece of each
+	// key is the current object.
+	var newest []models.Piece
+	seenPrefixes := make(map[string]bool)
+	lastKey, lastEntry := "", ""
+	count := 0
+	for _, piece := range pieces {
+		if piece.Filename == lastKey {
+			continue
+		}
+		lastKey = piece.Filename
+
+		commonPrefix := ""
+		if delimiter != "" {
+			if index := strings.Index(piece.Filename[len(prefix):], delimiter); index >= 0 {
+				commonPrefix = piece.Filename[:len(prefix)+index+len(delimiter)]
+			}
+		}
+		if commonPrefix != "" && (seenPrefixes[commonPrefix] || commonPrefix <= after) {
+			continue
+		}
+
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		count++
+		if commonPrefix != "" {
+			seenPrefixes[commonPrefix] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: commonPrefix})
+			lastEntry = commonPrefix
+		} else {
+			newest = append(newest, piece)
+			lastEntry = piece.Filename
+		}
+	}
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(lastEntry))
+		} else if delimiter != "" {
+			result.NextMarker = lastEntry
+		}
+	}
+
+	etags, err := s3ETags(newest)
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	for _, piece := range newest {
+		size, err := objectSize(&piece)
+		if err != nil {
+			s3InternalError(c, err)
+			return
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key:          piece.Filename,
+			LastModified: piece.CreatedAt.UTC().Format(s3TimestampFormat),
+			ETag:         etags[piece.ID],
+			Size:         size,
+			StorageClass: s3StorageClass,
+		})
+	}
+	if v2 {
+		result.KeyCount = &count
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+func s3CreateMultipartUpload(c *gin.Context, proofSet *models.ProofSet, key string) {
+	uploadID := uuid.New().String()
+	upload := &models.S3MultipartUpload{
+		ID:         uploadID,
+		UserID:     proofSet.UserID,
+		ProofSetID: proofSet.ID,
+		Key:        key,
+		Dir:        filepath.Join(cfg.Uploads.ChunkDir, "s3-"+uploadID),
+	}
+	if err := os.MkdirAll(upload.Dir, 0755); err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	if err := db.Create(upload).Error; err != nil {
+		os.RemoveAll(upload.Dir)
+		s3InternalError(c, err)
+		return
+	}
+
+	log.WithField("uploadId", uploadID).WithField("key", key).Info("Created S3 multipart upload")
+	s3XML(c, http.StatusOK, s3InitiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   s3BucketName(proofSet),
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+// s3LoadMultipartUpload returns a multipart upload of key in the bucket. It
+// writes NoSuchUpload and returns nil if there is none.
+func s3LoadMultipartUpload(c *gin.Context, proofSet *models.ProofSet, key, uploadID string) *models.S3MultipartUpload {
+	var upload models.S3MultipartUpload
+	err := db.Where("id = ? AND user_id = ? AND proof_set_id = ? AND key = ?", uploadID, proofSet.UserID, proofSet.ID, key).
+		First(&upload).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s3Error(c, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+			return nil
+		}
+		s3InternalError(c, err)
+		return nil
+	}
+	return &upload
+}
+
+func s3PartPath(upload *models.S3MultipartUpload, partNumber int) string {
+	return filepath.Join(upload.Dir, fmt.Sprintf("part_%d", partNumber))
+}
+
+func s3UploadPart(c *gin.Context, proofSet *models.ProofSet, key, uploadID string) {
+	partNumber, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Part number must be an integer between 1 and %d", s3MaxParts))
+		return
+	}
+
+	if c.Request.ContentLength > maxUploadSize {
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", "Maximum part size is "+formatFileSize(maxUploadSize))
+		return
+	}
+
+	upload := s3LoadMultipartUpload(c, proofSet, key, uploadID)
+	if upload == nil {
+		return
+	}
+
+	// Parts are not reserved against the quota until the upload is
+	// completed, so each part must fit together with the parts before it.
+	partPath := s3PartPath(upload, partNumber)
+	stored, err := s3PartsSize(upload, partPath)
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	if c.Request.ContentLength > 0 && s3RejectIfOverQuota(c, proofSet.UserID, stored+c.Request.ContentLength) {
+		return
+	}
+
+	tempPath := partPath + ".part"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	hasher := md5.New()
+	written, err := io.Copy(io.MultiWriter(file, hasher), io.LimitReader(c.Request.Body, maxUploadSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		s3BodyError(c, err)
+		return
+	}
+	if written > maxUploadSize {
+		os.Remove(tempPath)
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", "Maximum part size is "+formatFileSize(maxUploadSize))
+		return
+	}
+	if s3RejectIfOverQuota(c, proofSet.UserID, stored+written) {
+		os.Remove(tempPath)
+		return
+	}
+
+	digest := hasher.Sum(nil)
+	if !s3CheckContentMD5(c, digest) {
+		os.Remove(tempPath)
+		return
+	}
+	if err := os.Rename(tempPath, partPath); err != nil {
+		os.Remove(tempPath)
+		s3InternalError(c, err)
+		return
+	}
+	db.Model(upload).UpdateColumn("updated_at", time.Now())
+
+	c.Header("x-amz-request-id", uuid.New().String())
+	c.Header("ETag", `"`+hex.EncodeToString(digest)+`"`)
+	c.Status(http.StatusOK)
+}
+
+// s3PartsSize returns the size of the parts received for a multipart
+// upload, leaving out the part at except, which is being replaced.
+func s3PartsSize(upload *models.S3MultipartUpload, except string) (int64, error) {
+	entries, err := os.ReadDir(upload.Dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		path := filepath.Join(upload.Dir, entry.Name())
+		if !strings.HasPrefix(entry.Name(), "part_") || strings.HasSuffix(entry.Name(), ".part") || path == except {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+func s3CompleteMultipartUpload(c *gin.Context, proofSet *models.ProofSet, key, uploadID string) {
+	upload := s3LoadMultipartUpload(c, proofSet, key, uploadID)
+	if upload == nil {
+		return
+	}
+
+	var request s3CompleteMultipartUploadRequest
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, s3MaxRequestXML)).Decode(&request); err != nil || len(request.Parts) == 0 {
+		s3Error(c, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+	if !sort.SliceIsSorted(request.Parts, func(i, j int) bool {
+		return request.Parts[i].PartNumber < request.Parts[j].PartNumber
+	}) {
+		s3Error(c, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+		return
+	}
+	if s3RejectIfQueueFull(c) {
+		return
+	}
+
+	jobID := uuid.New().String()
+	payloadDir := uploadPayloadDir(jobID)
+	if err := os.MkdirAll(payloadDir, 0755); err != nil {
+		s3InternalError(c, err)
+		return
+	}
+	payloadPath := filepath.Join(payloadDir, s3PayloadName(key))
+	payload, err := os.Create(payloadPath)
+	if err != nil {
+		os.RemoveAll(payloadDir)
+		s3InternalError(c, err)
+		return
+	}
+
+	// The ETag of a multipart object is the MD5 of its parts' MD5s.
+	var size int64
+	partDigests := md5.New()
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber == request.Parts[i-1].PartNumber {
+			payload.Close()
+			os.RemoveAll(payloadDir)
+			s3Error(c, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+			return
+		}
+		written, digest, err := s3AppendPart(payload, s3PartPath(upload, part.PartNumber))
+		if err != nil || hex.EncodeToString(digest) != strings.Trim(part.ETag, `"`) {
+			payload.Close()
+			os.RemoveAll(payloadDir)
+			s3Error(c, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d could not be found or its ETag does not match", part.PartNumber))
+			return
+		}
+		size += written
+		partDigests.Write(digest)
+	}
+	if err := payload.Close(); err != nil {
+		os.RemoveAll(payloadDir)
+		s3InternalError(c, err)
+		return
+	}
+	if size > maxUploadSize {
+		os.RemoveAll(payloadDir)
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", "Maximum object size is "+formatFileSize(maxUploadSize))
+		return
+	}
+
+	// The multipart upload is deleted as the job is queued, so its parts
+	// are kept for a retry if the object is rejected.
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(partDigests.Sum(nil)), len(request.Parts))
+	queued := s3QueueObject(c, proofSet, key, jobID, &spooledUpload{Path: payloadPath, Size: size}, etag, func(tx *gorm.DB) error {
+		result := tx.Delete(&models.S3MultipartUpload{}, "id = ?", upload.ID)
+		if result.Error == nil && result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return result.Error
+	})
+	if !queued {
+		return
+	}
+	os.RemoveAll(upload.Dir)
+	if !s3AwaitObject(c, proofSet, key, jobID) {
+		return
+	}
+
+	bucket := s3BucketName(proofSet)
+	s3XML(c, http.StatusOK, s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: strings.TrimSuffix(c.Request.URL.Path, "/"),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     `"` + etag + `"`,
+	})
+}
+
+// s3AppendPart copies a part file to dst and returns its size and MD5.
+func s3AppendPart(dst io.Writer, partPath string) (int64, []byte, error) {
+	part, err := os.Open(partPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer part.Close()
+
+	hasher := md5.New()
+	written, err := io.Copy(io.MultiWriter(dst, hasher), part)
+	return written, hasher.Sum(nil), err
+}
+
+func s3AbortMultipartUpload(c *gin.Context, proofSet *models.ProofSet, key, uploadID string) {
+	upload := s3LoadMultipartUpload(c, proofSet, key, uploadID)
+	if upload == nil {
+		return
+	}
+
+	os.RemoveAll(upload.Dir)
+	if err := db.Delete(upload).Error; err != nil {
+		s3InternalError(c, err)
+		return
+	}
+
+	log.WithField("uploadId", uploadID).WithField("key", key).Info("Aborted S3 multipart upload")
+	c.Header("x-amz-request-id", uuid.New().String())
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+)
+
+// serveS3 runs an S3 object handler for r.
+func serveS3(r *http.Request, handler func(c *gin.Context)) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = r
+	handler(c)
+	return w
+}
+
+func s3Part(proofSet *models.ProofSet, uploadID string, partNumber int, data string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("PUT", "/s3/bucket/key?partNumber="+strconv.Itoa(partNumber)+"&uploadId="+uploadID, strings.NewReader(data))
+	return serveS3(r, func(c *gin.Context) { s3UploadPart(c, proofSet, "key", uploadID) })
+}
+
+func s3Complete(ctx context.Context, proofSet *models.ProofSet, uploadID string, parts ...string) *httptest.ResponseRecorder {
+	var body strings.Builder
+	body.WriteString("<CompleteMultipartUpload>")
+	for i, part := range parts {
+		sum := md5.Sum([]byte(part))
+		fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>\"%s\"</ETag></Part>", i+1, hex.EncodeToString(sum[:]))
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	r := httptest.NewRequest("POST", "/s3/bucket/key?uploadId="+uploadID, strings.NewReader(body.String())).WithContext(ctx)
+	return serveS3(r, func(c *gin.Context) { s3CompleteMultipartUpload(c, proofSet, "key", uploadID) })
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xs3")
+	db.Model(user).Update("quota_bytes", 10)
+	proofSet := &models.ProofSet{UserID: user.ID, ProviderID: user.ProviderID, ProofSetID: "7", ServiceName: "test", ServiceURL: "http://pdp.test"}
+	if err := db.Create(proofSet).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	upload := &models.S3MultipartUpload{ID: "mpu", UserID: user.ID, ProofSetID: proofSet.ID, Key: "key", Dir: t.TempDir()}
+	if err := db.Create(upload).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("PUT", "/s3/bucket/key?partNumber=1&uploadId=mpu", strings.NewReader("x"))
+	r.ContentLength = maxUploadSize + 1
+	if w := serveS3(r, func(c *gin.Context) { s3UploadPart(c, proofSet, "key", "mpu") }); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "EntityTooLarge") {
+		t.Errorf("oversized part: %d %s", w.Code, w.Body)
+	}
+
+	// Parts count against the quota as they arrive.
+	if w := s3Part(proofSet, "mpu", 1, "123456"); w.Code != http.StatusOK {
+		t.Fatalf("part 1: %d %s", w.Code, w.Body)
+	}
+	if w := s3Part(proofSet, "mpu", 2, "123456"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "QuotaExceeded") {
+		t.Errorf("part over the quota: %d %s", w.Code, w.Body)
+	}
+	if w := s3Part(proofSet, "mpu", 1, "1234"); w.Code != http.StatusOK {
+		t.Errorf("replacing part 1: %d %s", w.Code, w.Body)
+	}
+	if w := s3Part(proofSet, "mpu", 2, "567890"); w.Code != http.StatusOK {
+		t.Fatalf("part 2: %d %s", w.Code, w.Body)
+	}
+
+	// A rejected complete keeps the parts so it can be retried.
+	db.Model(user).Update("quota_bytes", 5)
+	if w := s3Complete(context.Background(), proofSet, "mpu", "1234", "567890"); w.Code != http.StatusForbidden {
+		t.Fatalf("complete over the quota: %d %s", w.Code, w.Body)
+	}
+	var count int64
+	db.Model(&models.S3MultipartUpload{}).Where("id = ?", "mpu").Count(&count)
+	if _, err := os.Stat(s3PartPath(upload, 2)); err != nil || count != 1 {
+		t.Fatalf("rejected complete removed the upload: %d rows, %v", count, err)
+	}
+
+	// No worker runs here: the request gives up waiting once the job is
+	// queued.
+	db.Model(user).Update("quota_bytes", 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s3Complete(ctx, proofSet, "mpu", "1234", "567890")
+	db.Model(&models.S3MultipartUpload{}).Where("id = ?", "mpu").Count(&count)
+	if _, err := os.Stat(upload.Dir); !os.IsNotExist(err) || count != 0 {
+		t.Errorf("queued upload kept: %d rows, %v", count, err)
+	}
+	var job models.UploadJob
+	if err := db.Where("user_id = ? AND filename = ?", user.ID, "key").First(&job).Error; err != nil || job.TotalSize != 10 {
+		t.Errorf("queued job: %+v, %v", job, err)
+	}
+	if w := s3Complete(context.Background(), proofSet, "mpu", "1234", "567890"); w.Code != http.StatusNotFound {
+		t.Errorf("second complete: %d %s", w.Code, w.Body)
+	}
+}
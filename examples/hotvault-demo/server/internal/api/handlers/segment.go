@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp/commp"
+	"gorm.io/gorm"
+)
+
+const (
+	// segmentDownloadAttempts is how often a segment is tried across its
+	// replicas before a download fails.
+	segmentDownloadAttempts = 3
+	segmentDownloadBackoff  = 5 * time.Second
+)
+
+// segmented reports whether a file is large enough to be split into
+// segments.
+func segmented(record *models.File) bool {
+	return cfg.Segments.Threshold > 0 && record.Size > cfg.Segments.Threshold
+}
+
+// segmentPath is where segment index of a job's payload is written. The
+// segments are kept next to the payload and removed with it.
+func segmentPath(job *models.UploadJob, index int) string {
+	return filepath.Join(filepath.Dir(job.PayloadPath), "segments", fmt.Sprintf("segment-%05d", index))
+}
+
+// storeSegmented stores a large file as segments: the payload is split,
+// every segment is stored with each provider as a piece of its own, and
+// the replica on a provider is complete once all segments are stored
+// there.
+func storeSegmented(ctx context.Context, job *models.UploadJob, record *models.File, providers []models.StorageProvider) {
+	jobID := job.ID
+
+	manifest, err := prepareManifest(ctx, job, record)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithField("jobID", jobID).WithField("error", err.Error()).Error("Failed to split file into segments")
+		db.Delete(record)
+		saveUploadProgress(jobID, UploadProgress{
+			Status:  "error",
+			Error:   "Failed to split file into segments",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	// Segments stored before an interrupted run are kept.
+	var existing []models.Piece
+	if err := db.Where("file_id = ? AND manifest_id = ?", record.ID, manifest.ID).Find(&existing).Error; err != nil {
+		log.WithField("error", err.Error()).WithField("fileID", record.ID).Error("Failed to fetch stored segments")
+	}
+
+	replicas := make([]models.ReplicaProgress, len(providers))
+	for i, p := range providers {
+		replicas[i] = models.ReplicaProgress{Provider: p.Name, Status: "pending"}
+	}
+	saveUploadProgress(jobID, UploadProgress{
+		Status:   "uploading",
+		Progress: 30,
+		Message:  fmt.Sprintf("Uploading %d segments to %d storage provider(s)...", len(manifest.Segments), len(providers)),
+		Replicas: replicas,
+	})
+
+	pieces := make([]*models.Piece, len(providers))
+	var wg sync.WaitGroup
+	for i := range providers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			piece, err := storeSegments(ctx, job, record, manifest, &providers[i], i, existing)
+			if err != nil {
+				log.WithField("jobID", jobID).
+					WithField("provider", providers[i].Name).
+					WithField("error", err.Error()).
+					Error("Segmented replica upload failed")
+				return
+			}
+			pieces[i] = piece
+			finishReplica(jobID, i, piece)
+		}(i)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		// A cancelled upload leaves no partial segments behind.
+		if _, _, err := removeFileReplicas(context.Background(), record.ID, record.UserID); err != nil {
+			log.WithField("fileID", record.ID).WithField("error", err.Error()).Warning("Failed to remove segments of cancelled upload")
+		}
+	}
+	completeUpload(ctx, job, record, pieces)
+	if ctx.Err() != nil || !anyStored(pieces) {
+		db.Delete(manifest)
+	}
+}
+
+// storeSegments stores the segments of a file missing on provider and
+// returns the piece of the first segment, which stands for the replica.
+// index is the replica's position in the job's Replicas. Segments stored
+// on provider are removed again if one of them fails.
+func storeSegments(ctx context.Context, job *models.UploadJob, record *models.File, manifest *models.Manifest, provider *models.StorageProvider, index int, existing []models.Piece) (*models.Piece, error) {
+	report := func(progress UploadProgress) {
+		reportReplica(job.ID, index, progress)
+	}
+
+	stored := make([]*models.Piece, len(manifest.Segments))
+	for i := range existing {
+		piece := &existing[i]
+		if piece.ServiceName == provider.ServiceName && piece.ServiceURL == provider.ServiceURL && piece.SegmentIndex < len(stored) {
+			stored[piece.SegmentIndex] = piece
+		}
+	}
+
+	count := len(manifest.Segments)
+	for s, segment := range manifest.Segments {
+		if stored[s] != nil {
+			continue
+		}
+
+		// Each segment takes an equal share of the replica's progress.
+		segmentReport := func(progress UploadProgress) {
+			progress.Progress = 30 + (s*100+progress.Progress)*(95-30)/(count*100)
+			progress.Message = fmt.Sprintf("Segment %d/%d: %s", s+1, count, progress.Message)
+			report(progress)
+		}
+		name := fmt.Sprintf("%s (segment %d/%d)", record.Filename, s+1, count)
+		root, err := storeRoot(ctx, record.UserID, name, segmentPath(job, s), segment.Size, provider, 0, nil, segmentReport)
+		if err == nil {
+			piece := encryptionOf(&models.Piece{
+				UserID:        record.UserID,
+				FileID:        &record.ID,
+				CID:           root.CID,
+				Filename:      record.Filename,
+				Size:          segment.Size,
+				ServiceName:   provider.ServiceName,
+				ServiceURL:    provider.ServiceURL,
+				ProofSetID:    &root.ProofSet.ID,
+				RootID:        root.RootID,
+				RootState:     root.RootState,
+				RootCheckedAt: root.RootCheckedAt,
+				ManifestID:    &manifest.ID,
+				SegmentIndex:  s,
+			}, job)
+			if err = db.Create(piece).Error; err == nil {
+				stored[s] = piece
+				log.WithField("fileID", record.ID).
+					WithField("provider", provider.Name).
+					WithField("segment", s).
+					WithField("integerRootID", pieceRootID(piece)).
+					WithField("rootState", piece.RootState).
+					Info("Segment stored")
+				continue
+			}
+			report(UploadProgress{
+				Status:  "error",
+				Error:   "Failed to save piece information to database",
+				Message: err.Error(),
+			})
+		}
+		if ctx.Err() == nil {
+			removeSegments(stored, record.UserID)
+		}
+		return nil, fmt.Errorf("segment %d: %w", s, err)
+	}
+	return stored[0], nil
+}
+
+// removeSegments removes stored segments of a failed replica.
+func removeSegments(segments []*models.Piece, userID uint) {
+	for _, segment := range segments {
+		if segment == nil {
+			continue
+		}
+		if err := removeReplicaRoot(context.Background(), segment, userID); err != nil {
+			log.WithField("pieceID", segment.ID).WithField("error", err.Error()).Warning("Failed to remove segment of failed upload")
+			continue
+		}
+		db.Delete(segment)
+	}
+}
+
+func anyStored(pieces []*models.Piece) bool {
+	for _, piece := range pieces {
+		if piece != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareManifest returns the manifest of a file, splitting the job's
+// payload into segments unless that was done by an earlier run whose
+// segments are still there.
+func prepareManifest(ctx context.Context, job *models.UploadJob, record *models.File) (*models.Manifest, error) {
+	var manifest models.Manifest
+	err := db.Where("file_id = ?", record.ID).First(&manifest).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil && segmentsPresent(job, &manifest) {
+		return &manifest, nil
+	}
+
+	err = prepareLimiter.acquire(ctx, func() {
+		saveUploadProgress(job.ID, UploadProgress{
+			Status:   "preparing",
+			Progress: 25,
+			Message:  "Waiting for a free preparation slot...",
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	split, err := splitPayload(ctx, job, cfg.Segments.Size)
+	prepareLimiter.release()
+	if err != nil {
+		return nil, err
+	}
+
+	split.ID = manifest.ID
+	split.UserID = record.UserID
+	split.FileID = record.ID
+	if err := db.Save(split).Error; err != nil {
+		return nil, err
+	}
+
+	log.WithField("fileID", record.ID).
+		WithField("segments", len(split.Segments)).
+		WithField("segmentSize", formatFileSize(split.SegmentSize)).
+		WithField("sha256", split.SHA256).
+		Info("File split into segments")
+	return split, nil
+}
+
+// segmentsPresent reports whether the segment files of a manifest exist.
+func segmentsPresent(job *models.UploadJob, manifest *models.Manifest) bool {
+	for i, segment := range manifest.Segments {
+		info, err := os.Stat(segmentPath(job, i))
+		if err != nil || info.Size() != segment.Size {
+			return false
+		}
+	}
+	return len(manifest.Segments) > 0
+}
+
+// splitPayload writes the job's payload as segments of segmentSize bytes,
+// computing the piece commitment of each and the SHA-256 of the whole
+// file in the same pass.
+func splitPayload(ctx context.Context, job *models.UploadJob, segmentSize int64) (*models.Manifest, error) {
+	src, err := os.Open(job.PayloadPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	dir := filepath.Dir(segmentPath(job, 0))
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	manifest := &models.Manifest{SegmentSize: segmentSize}
+	for index := 0; ; index++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		saveUploadProgress(job.ID, UploadProgress{
+			Status:         "preparing",
+			Progress:       25,
+			Message:        fmt.Sprintf("Splitting file into segments (segment %d)...", index+1),
+			BytesProcessed: manifest.Size,
+		})
+
+		path := segmentPath(job, index)
+		dst, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		calc := commp.New()
+		n, err := io.CopyN(io.MultiWriter(dst, calc, hasher), src, segmentSize)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 {
+			os.Remove(path)
+			break
+		}
+
+		piece, err := calc.Digest()
+		if err != nil {
+			return nil, err
+		}
+		manifest.Segments = append(manifest.Segments, models.ManifestSegment{PieceCID: piece.CID, Size: n})
+		manifest.Size += n
+		if n < segmentSize {
+			break
+		}
+	}
+	manifest.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	return manifest, nil
+}
+
+// downloadPiece downloads the file a piece belongs to into outputFile.
+// replicas are the pieces with the same CID to try in turn.
+func downloadPiece(ctx context.Context, piece *models.Piece, replicas []models.Piece, outputFile string) error {
+	if piece.ManifestID == nil {
+		return downloadReplicas(ctx, piece.CID, replicas, outputFile)
+	}
+	return downloadSegments(ctx, *piece.ManifestID, outputFile)
+}
+
+// downloadSegments reassembles a segmented file into outputFile. Each
+// segment is downloaded from any provider holding it and retried on its
+// own, and the reassembled file is checked against the manifest's SHA-256.
+func downloadSegments(ctx context.Context, manifestID uint, outputFile string) error {
+	var manifest models.Manifest
+	if err := db.First(&manifest, manifestID).Error; err != nil {
+		return fmt.Errorf("failed to load manifest: %w", err)
+	}
+
+	var pieces []models.Piece
+	err := db.Where("manifest_id = ?", manifestID).
+		Order("segment_index ASC, pending_removal ASC, id ASC").
+		Find(&pieces).Error
+	if err != nil {
+		return err
+	}
+	replicas := make([][]models.Piece, len(manifest.Segments))
+	for _, piece := range pieces {
+		if piece.SegmentIndex < len(replicas) {
+			replicas[piece.SegmentIndex] = append(replicas[piece.SegmentIndex], piece)
+		}
+	}
+
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	for i, segment := range manifest.Segments {
+		if len(replicas[i]) == 0 {
+			return fmt.Errorf("segment %d of %d is not stored", i+1, len(manifest.Segments))
+		}
+		segmentFile := fmt.Sprintf("%s.segment-%d", outputFile, i)
+		for attempt := 1; ; attempt++ {
+			err = downloadReplicas(ctx, replicas[i][0].CID, replicas[i], segmentFile)
+			if err == nil {
+				if info, statErr := os.Stat(segmentFile); statErr != nil {
+					err = statErr
+				} else if info.Size() != segment.Size {
+					err = fmt.Errorf("got %d bytes, expected %d", info.Size(), segment.Size)
+				}
+			}
+			if err == nil || attempt == segmentDownloadAttempts {
+				break
+			}
+			log.WithField("manifestID", manifestID).
+				WithField("segment", i).
+				WithField("attempt", attempt).
+				WithField("error", err.Error()).
+				Warning("Failed to download segment, retrying")
+			if err := sleepContext(ctx, time.Duration(attempt)*segmentDownloadBackoff); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download segment %d of %d: %w", i+1, len(manifest.Segments), err)
+		}
+
+		err = appendSegment(io.MultiWriter(out, hasher), segmentFile)
+		os.Remove(segmentFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if digest := hex.EncodeToString(hasher.Sum(nil)); digest != manifest.SHA256 {
+		return fmt.Errorf("reassembled file has SHA-256 %s, expected %s", digest, manifest.SHA256)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return decryptDownload(outputFile, &pieces[0])
+}
+
+func appendSegment(dst io.Writer, path string) error {
+	segment, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+	_, err = io.Copy(dst, segment)
+	return err
+}
+
+// objectSize is the size of the file a piece belongs to: the size of the
+// whole file for a segment. The manifest holds the size of the stored,
+// possibly encrypted, payload, so the file's own size is used.
+func objectSize(piece *models.Piece) (int64, error) {
+	if piece.ManifestID == nil || piece.FileID == nil {
+		return piece.Size, nil
+	}
+	var record models.File
+	if err := db.Select("id", "size").First(&record, *piece.FileID).Error; err != nil {
+		return 0, err
+	}
+	return record.Size, nil
+}
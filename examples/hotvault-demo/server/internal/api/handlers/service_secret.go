@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/config"
+	"github.com/hotvault/backend/internal/pdp/secret"
+)
+
+var serviceSecrets *secret.Store
+
+// openServiceSecrets opens the keystore holding the PDP service key. An
+// existing pdpservice.json is imported on first start. With the pdptool
+// client and PDP_SECRET_EXPORT_PLAINTEXT the active key is also written back
+// to it, since pdptool can only read the secret from its working directory.
+func openServiceSecrets(appConfig *config.Config) (*secret.Store, error) {
+	secretPath := serviceSecretPath(appConfig)
+
+	storePath := appConfig.ServiceSecret.StorePath
+	if storePath == "" {
+		storePath = filepath.Join(filepath.Dir(secretPath), "pdpservice.keystore")
+	}
+	keyFile := appConfig.ServiceSecret.KeyFile
+	if appConfig.ServiceSecret.Passphrase == "" {
+		if keyFile == "" {
+			return nil, errors.New("PDP_SECRET_PASSPHRASE or PDP_SECRET_KEYFILE must be set to protect the keystore")
+		}
+		inside, err := withinDir(keyFile, filepath.Dir(storePath))
+		if err != nil {
+			return nil, err
+		}
+		if inside {
+			return nil, fmt.Errorf("PDP_SECRET_KEYFILE %s must be outside the keystore directory %s", keyFile, filepath.Dir(storePath))
+		}
+	}
+
+	opts := secret.Options{
+		StorePath:  storePath,
+		Passphrase: appConfig.ServiceSecret.Passphrase,
+		KeyFile:    keyFile,
+		ImportPath: secretPath,
+	}
+	if appConfig.PDPClient == "" || appConfig.PDPClient == "pdptool" {
+		if appConfig.ServiceSecret.ExportPlaintext {
+			opts.ExportPath = secretPath
+			log.WithField("path", secretPath).Warning("Exporting the service secret in plaintext for pdptool")
+		} else {
+			log.WithField("path", secretPath).Info("pdptool reads the service secret from this file; it is not updated from the keystore")
+		}
+	}
+	return secret.Open(opts)
+}
+
+// withinDir reports whether path is dir or lies below it.
+func withinDir(path, dir string) (bool, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return false, nil
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))), nil
+}
+
+// GetServiceSecret returns the public keys of the PDP service secret
+// @Summary Get service secret public keys
+// @Description Returns the active, pending and previous public keys of the PDP service secret so they can be registered with the provider
+// @Tags admin
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Success 200 {object} secret.Status
+// @Router /api/v1/admin/service-secret [get]
+func GetServiceSecret(c *gin.Context) {
+	if serviceSecrets == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Service secret store is not configured",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, serviceSecrets.Status())
+}
+
+// RotateServiceSecret generates a pending service key
+// @Summary Start service secret rotation
+// @Description Generates a pending service key. Requests are still signed with the active key until the pending key is promoted, so its public key can be registered with the provider first.
+// @Tags admin
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Success 200 {object} secret.KeyInfo
+// @Router /api/v1/admin/service-secret/rotate [post]
+func RotateServiceSecret(c *gin.Context) {
+	if serviceSecrets == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Service secret store is not configured",
+		})
+		return
+	}
+
+	info, err := serviceSecrets.Rotate()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Failed to rotate service secret")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to rotate service secret",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	log.WithField("fingerprint", info.Fingerprint).Info("Service secret rotation started")
+	c.JSON(http.StatusOK, info)
+}
+
+// PromoteServiceSecret makes the pending service key active
+// @Summary Complete service secret rotation
+// @Description Makes the pending service key active. The replaced key is kept as the previous key.
+// @Tags admin
+// @Produce json
+// @Param X-Admin-Token header string true "Admin API token"
+// @Success 200 {object} secret.KeyInfo
+// @Router /api/v1/admin/service-secret/promote [post]
+func PromoteServiceSecret(c *gin.Context) {
+	if serviceSecrets == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Service secret store is not configured",
+		})
+		return
+	}
+
+	info, err := serviceSecrets.Promote()
+	if err != nil {
+		if errors.Is(err, secret.ErrNoPendingKey) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "No pending service secret, start a rotation first",
+			})
+			return
+		}
+		log.WithField("error", err.Error()).Error("Failed to promote service secret")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to promote service secret",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	log.WithField("fingerprint", info.Fingerprint).Info("Service secret rotation completed")
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,592 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// tus 1.0 (https://tus.io/protocols/resumable-upload) with the creation,
+// termination and checksum extensions. A tus upload's ID is also the ID of
+// the upload job queued when it completes, so clients can follow processing
+// at /upload/status/:jobId.
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,checksum"
+	tusContentType = "application/offset+octet-stream"
+
+	// tusChecksumMismatch is the status for a PATCH whose body does not
+	// match its Upload-Checksum.
+	tusChecksumMismatch = 460
+
+	tusStatusUploading = "uploading"
+	tusStatusComplete  = "complete"
+)
+
+// tusChecksumAlgorithms are the Upload-Checksum algorithms accepted.
+var tusChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// tusLocks holds the uploads a PATCH is currently writing to on this
+// server.
+var tusLocks sync.Map
+
+func init() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			cleanupOldTusUploads()
+		}
+	}()
+}
+
+// cleanupOldTusUploads removes tus uploads idle for longer than
+// chunkedUploadExpiry. Payloads of completed uploads belong to their upload
+// job and are left alone.
+func cleanupOldTusUploads() {
+	if db == nil {
+		return
+	}
+
+	var expired []models.TusUpload
+	if err := db.Where("updated_at < ?", time.Now().Add(-chunkedUploadExpiry)).Find(&expired).Error; err != nil {
+		log.WithField("error", err.Error()).Error("Failed to list expired tus uploads")
+		return
+	}
+
+	for _, upload := range expired {
+		if upload.Status == tusStatusUploading {
+			os.RemoveAll(uploadPayloadDir(upload.ID))
+		}
+		if err := db.Delete(&upload).Error; err != nil {
+			log.WithField("uploadId", upload.ID).WithField("error", err.Error()).Error("Failed to delete expired tus upload")
+			continue
+		}
+		log.WithField("uploadId", upload.ID).Info("Cleaned up expired tus upload")
+	}
+}
+
+// TusResumable sets the Tus-Resumable header on every response and rejects
+// requests for a protocol version this server doesn't speak.
+func TusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{
+			"error": "Unsupported tus version, expected Tus-Resumable: " + tusVersion,
+		})
+		return
+	}
+	c.Next()
+}
+
+// TusOptions describes the tus server
+// @Summary tus server capabilities
+// @Description Report the tus versions, extensions, maximum size and checksum algorithms supported
+// @Tags tus
+// @Success 204
+// @Router /api/v1/tus/ [options]
+func TusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+	c.Header("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+	c.Status(http.StatusNoContent)
+}
+
+// TusCreate creates a tus upload
+// @Summary Create a tus upload
+// @Description Create an upload of Upload-Length bytes. Upload-Metadata may carry filename, filetype and provider.
+// @Tags tus
+// @Param Authorization header string true "Bearer token"
+// @Param Tus-Resumable header string true "1.0.0"
+// @Param Upload-Length header int true "Size of the upload in bytes"
+// @Param Upload-Metadata header string false "tus metadata"
+// @Success 201
+// @Router /api/v1/tus/ [post]
+func TusCreate(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Upload-Defer-Length is not supported",
+		})
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Upload-Length must be a positive integer",
+		})
+		return
+	}
+	if length > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "File too large",
+			"message": "Maximum file size is " + formatFileSize(maxUploadSize),
+		})
+		return
+	}
+
+	rawMetadata := c.GetHeader("Upload-Metadata")
+	metadata, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid Upload-Metadata: " + err.Error(),
+		})
+		return
+	}
+
+	if rejectIfUploadQueueFull(c) {
+		return
+	}
+	provider, err := selectStorageProvider(userID.(uint), metadata["provider"])
+	if err != nil {
+		c.JSON(providerErrorStatus(err), gin.H{
+			"error": "Failed to select storage provider: " + err.Error(),
+		})
+		return
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	filename = filepath.Base(filename)
+	if filename == "" || filename == "." || filename == string(filepath.Separator) {
+		filename = "upload"
+	}
+	fileType := metadata["filetype"]
+	if fileType == "" {
+		fileType = metadata["type"]
+	}
+
+	uploadID := uuid.New().String()
+	payloadDir := uploadPayloadDir(uploadID)
+	if err := os.MkdirAll(payloadDir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create upload directory: " + err.Error(),
+		})
+		return
+	}
+
+	upload := &models.TusUpload{
+		ID:           uploadID,
+		UserID:       userID.(uint),
+		ProviderID:   &provider.ID,
+		Filename:     filename,
+		FileType:     fileType,
+		Metadata:     rawMetadata,
+		PayloadPath:  filepath.Join(payloadDir, filename),
+		UploadLength: length,
+		Status:       tusStatusUploading,
+	}
+	// The upload reserves its length against the quota until it is
+	// complete.
+	usage, err := reserveQuota(upload.UserID, length, nil, func(tx *gorm.DB) error {
+		return tx.Create(upload).Error
+	})
+	if errors.Is(err, errQuotaExceeded) {
+		os.RemoveAll(payloadDir)
+		respondQuotaExceeded(c, upload.UserID, length, usage)
+		return
+	}
+	if err != nil {
+		os.RemoveAll(payloadDir)
+		log.WithField("error", err.Error()).Error("Failed to save tus upload")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create upload: " + err.Error(),
+		})
+		return
+	}
+
+	log.WithField("uploadId", uploadID).
+		WithField("filename", filename).
+		WithField("totalSize", formatFileSize(length)).
+		Info("Created tus upload")
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+uploadID)
+	c.Status(http.StatusCreated)
+}
+
+// TusHead reports the offset of a tus upload
+// @Summary Get tus upload offset
+// @Tags tus
+// @Param Authorization header string true "Bearer token"
+// @Param Tus-Resumable header string true "1.0.0"
+// @Param id path string true "Upload ID"
+// @Success 200
+// @Router /api/v1/tus/{id} [head]
+func TusHead(c *gin.Context) {
+	upload, status := loadTusUpload(c)
+	if upload == nil {
+		c.Status(status)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	if upload.Metadata != "" {
+		c.Header("Upload-Metadata", upload.Metadata)
+	}
+	c.Status(http.StatusOK)
+}
+
+// TusPatch appends bytes to a tus upload
+// @Summary Append to a tus upload
+// @Description Write the request body at Upload-Offset. The upload is queued for processing once all bytes have arrived.
+// @Tags tus
+// @Accept application/offset+octet-stream
+// @Param Authorization header string true "Bearer token"
+// @Param Tus-Resumable header string true "1.0.0"
+// @Param Upload-Offset header int true "Offset the body starts at"
+// @Param Upload-Checksum header string false "Checksum algorithm and base64 digest of the body"
+// @Param id path string true "Upload ID"
+// @Success 204
+// @Failure 409 {object} map[string]interface{}
+// @Failure 460 {object} map[string]interface{}
+// @Router /api/v1/tus/{id} [patch]
+func TusPatch(c *gin.Context) {
+	if c.ContentType() != tusContentType {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "Content-Type must be " + tusContentType,
+		})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Upload-Offset must be a non-negative integer",
+		})
+		return
+	}
+
+	var hasher hash.Hash
+	var expectedSum []byte
+	if checksum := c.GetHeader("Upload-Checksum"); checksum != "" {
+		algorithm, digest, _ := strings.Cut(checksum, " ")
+		newHash, ok := tusChecksumAlgorithms[algorithm]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Unsupported checksum algorithm: " + algorithm,
+			})
+			return
+		}
+		expectedSum, err = base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Upload-Checksum digest must be base64 encoded",
+			})
+			return
+		}
+		hasher = newHash()
+	}
+
+	upload, status := loadTusUpload(c)
+	if upload == nil {
+		c.JSON(status, gin.H{
+			"error": http.StatusText(status),
+		})
+		return
+	}
+
+	if _, busy := tusLocks.LoadOrStore(upload.ID, struct{}{}); busy {
+		c.JSON(http.StatusLocked, gin.H{
+			"error": "Another request is writing to this upload",
+		})
+		return
+	}
+	defer tusLocks.Delete(upload.ID)
+
+	// Reload under the lock so the offset is current.
+	if err := db.First(upload, "id = ?", upload.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch upload",
+		})
+		return
+	}
+
+	if offset != upload.UploadOffset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+		c.JSON(http.StatusConflict, gin.H{
+			"error":        "Upload-Offset does not match the current offset",
+			"uploadOffset": upload.UploadOffset,
+		})
+		return
+	}
+
+	remaining := upload.UploadLength - upload.UploadOffset
+	if c.Request.ContentLength > remaining {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": "Request body exceeds Upload-Length",
+		})
+		return
+	}
+
+	if remaining > 0 {
+		written, err := writeTusChunk(upload, c.Request.Body, remaining, hasher)
+		if err == nil && hasher != nil && !bytes.Equal(hasher.Sum(nil), expectedSum) {
+			log.WithField("uploadId", upload.ID).WithField("offset", offset).Warning("Rejected tus chunk with checksum mismatch")
+			truncateTusPayload(upload)
+			c.JSON(tusChecksumMismatch, gin.H{
+				"error":     "Checksum Mismatch",
+				"retryable": true,
+			})
+			return
+		}
+		if err != nil {
+			if hasher != nil {
+				// A partial body can't be checked against the checksum.
+				written = 0
+				truncateTusPayload(upload)
+			}
+			log.WithField("uploadId", upload.ID).
+				WithField("written", written).
+				WithField("error", err.Error()).
+				Warning("tus upload interrupted")
+		}
+
+		if written > 0 {
+			result := db.Model(&models.TusUpload{}).
+				Where("id = ? AND upload_offset = ?", upload.ID, upload.UploadOffset).
+				Update("upload_offset", upload.UploadOffset+written)
+			if result.Error != nil || result.RowsAffected == 0 {
+				truncateTusPayload(upload)
+				c.JSON(http.StatusConflict, gin.H{
+					"error": "Upload was modified concurrently",
+				})
+				return
+			}
+			upload.UploadOffset += written
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":        "Failed to write upload data: " + err.Error(),
+				"uploadOffset": upload.UploadOffset,
+			})
+			return
+		}
+	}
+
+	if upload.UploadOffset == upload.UploadLength && upload.Status == tusStatusUploading {
+		usage, err := finishTusUpload(upload)
+		if errors.Is(err, errQuotaExceeded) {
+			respondQuotaExceeded(c, upload.UserID, upload.UploadLength, usage)
+			return
+		}
+		if err != nil {
+			log.WithField("uploadId", upload.ID).WithField("error", err.Error()).Error("Failed to queue tus upload")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to queue upload: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// TusDelete terminates a tus upload
+// @Summary Terminate a tus upload
+// @Description Discard an upload. A completed upload still being processed is cancelled.
+// @Tags tus
+// @Param Authorization header string true "Bearer token"
+// @Param Tus-Resumable header string true "1.0.0"
+// @Param id path string true "Upload ID"
+// @Success 204
+// @Router /api/v1/tus/{id} [delete]
+func TusDelete(c *gin.Context) {
+	upload, status := loadTusUpload(c)
+	if upload == nil {
+		c.JSON(status, gin.H{
+			"error": http.StatusText(status),
+		})
+		return
+	}
+
+	if _, busy := tusLocks.LoadOrStore(upload.ID, struct{}{}); busy {
+		c.JSON(http.StatusLocked, gin.H{
+			"error": "Another request is writing to this upload",
+		})
+		return
+	}
+	defer tusLocks.Delete(upload.ID)
+
+	if upload.Status == tusStatusUploading {
+		os.RemoveAll(uploadPayloadDir(upload.ID))
+	} else if job, err := loadUploadJob(upload.JobID); err == nil && !isTerminalUploadStatus(job.Status) {
+		if _, err := cancelUploadJob(job); err != nil {
+			log.WithField("jobID", job.ID).WithField("error", err.Error()).Error("Failed to cancel upload job")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to cancel upload: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	if err := db.Delete(upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete upload: " + err.Error(),
+		})
+		return
+	}
+
+	log.WithField("uploadId", upload.ID).Info("Terminated tus upload")
+	c.Status(http.StatusNoContent)
+}
+
+// loadTusUpload fetches the tus upload named in the path if it belongs to
+// the caller, otherwise it returns nil and the status to answer with.
+func loadTusUpload(c *gin.Context) (*models.TusUpload, int) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		return nil, http.StatusUnauthorized
+	}
+
+	var upload models.TusUpload
+	if err := db.First(&upload, "id = ?", c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, http.StatusNotFound
+		}
+		log.WithField("uploadId", c.Param("id")).WithField("error", err.Error()).Error("Failed to fetch tus upload")
+		return nil, http.StatusInternalServerError
+	}
+	if upload.UserID != userID.(uint) {
+		return nil, http.StatusForbidden
+	}
+	return &upload, 0
+}
+
+// writeTusChunk writes up to limit bytes of body to the payload at the
+// upload's offset and returns how many were written.
+func writeTusChunk(upload *models.TusUpload, body io.Reader, limit int64, hasher hash.Hash) (int64, error) {
+	file, err := os.OpenFile(upload.PayloadPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// Drop anything past the recorded offset left by an interrupted write.
+	if err := file.Truncate(upload.UploadOffset); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(upload.UploadOffset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var dst io.Writer = file
+	if hasher != nil {
+		dst = io.MultiWriter(file, hasher)
+	}
+	written, err := io.Copy(dst, io.LimitReader(body, limit))
+	if err == nil {
+		err = file.Sync()
+	}
+	return written, err
+}
+
+// truncateTusPayload discards payload bytes past the upload's offset.
+func truncateTusPayload(upload *models.TusUpload) {
+	if err := os.Truncate(upload.PayloadPath, upload.UploadOffset); err != nil && !os.IsNotExist(err) {
+		log.WithField("uploadId", upload.ID).WithField("error", err.Error()).Warning("Failed to truncate tus payload")
+	}
+}
+
+// finishTusUpload queues a fully received tus upload for processing. It
+// returns errQuotaExceeded with the usage if the upload no longer fits in
+// the user's quota.
+func finishTusUpload(upload *models.TusUpload) (*StorageUsage, error) {
+	job := &models.UploadJob{
+		ID:          upload.ID,
+		UserID:      upload.UserID,
+		ProviderID:  upload.ProviderID,
+		Filename:    upload.Filename,
+		TotalSize:   upload.UploadLength,
+		PayloadPath: upload.PayloadPath,
+		Stage:       models.UploadStageReceived,
+		Status:      "queued",
+		Message:     "Waiting for an upload worker",
+	}
+	complete := func(tx *gorm.DB) error {
+		return tx.Model(upload).Updates(map[string]interface{}{
+			"status": tusStatusComplete,
+			"job_id": job.ID,
+		}).Error
+	}
+	// A job may already exist if a previous attempt failed after queueing
+	// it. Otherwise the job takes over the upload's quota reservation.
+	if _, err := loadUploadJob(job.ID); errors.Is(err, gorm.ErrRecordNotFound) {
+		if usage, err := enqueueUploadJob(job, complete); err != nil {
+			return usage, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := complete(db); err != nil {
+		return nil, err
+	}
+	upload.Status = tusStatusComplete
+	upload.JobID = job.ID
+
+	log.WithField("uploadId", upload.ID).
+		WithField("filename", upload.Filename).
+		WithField("totalSize", formatFileSize(upload.UploadLength)).
+		Info("tus upload complete, queued for processing")
+	return nil, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated keys,
+// each optionally followed by a space and a base64 value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, errors.New("value of " + key + " is not base64 encoded")
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
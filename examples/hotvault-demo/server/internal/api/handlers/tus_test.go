@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+)
+
+// tusRouter serves the tus routes as set up in routes.go, authenticated as
+// userID.
+func tusRouter(userID uint) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	v1 := router.Group("/api/v1")
+	v1.OPTIONS("/tus/", TusResumable, TusOptions)
+	tus := v1.Group("/tus", func(c *gin.Context) { c.Set("userID", userID) }, TusResumable)
+	tus.POST("/", TusCreate)
+	tus.HEAD("/:id", TusHead)
+	tus.PATCH("/:id", TusPatch)
+	tus.DELETE("/:id", TusDelete)
+	return router
+}
+
+func tusRequest(router http.Handler, method, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		if value == "" {
+			r.Header.Del(name)
+		} else {
+			r.Header.Set(name, value)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// tusPatch sends body at offset with an optional Upload-Checksum.
+func tusPatch(router http.Handler, location string, offset int64, body, checksum string) *httptest.ResponseRecorder {
+	return tusRequest(router, "PATCH", location, body, map[string]string{
+		"Content-Type":    tusContentType,
+		"Upload-Offset":   strconv.FormatInt(offset, 10),
+		"Upload-Checksum": checksum,
+	})
+}
+
+func tusChecksum(algorithm string, sum []byte) string {
+	return algorithm + " " + base64.StdEncoding.EncodeToString(sum)
+}
+
+func createTus(t *testing.T, router http.Handler, length int) string {
+	t.Helper()
+	w := tusRequest(router, "POST", "/api/v1/tus/", "", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain")),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/api/v1/tus/") {
+		t.Fatalf("Location = %q", location)
+	}
+	return location
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==, is_confidential,provider cHJvdmlkZXI=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"filename": "world_domination_plan.pdf", "is_confidential": "", "provider": "provider"}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("metadata = %v, want %v", metadata, want)
+	}
+	if metadata, err := parseTusMetadata(" "); err != nil || len(metadata) != 0 {
+		t.Errorf("empty header: %v, %v", metadata, err)
+	}
+	for _, header := range []string{"filename not-base64!", "a YQ==,,b YQ=="} {
+		if _, err := parseTusMetadata(header); err == nil {
+			t.Errorf("parseTusMetadata(%q) accepted a malformed header", header)
+		}
+	}
+}
+
+// The protocol checks run before the upload is looked up.
+func TestTusProtocolChecks(t *testing.T) {
+	router := tusRouter(1)
+
+	w := tusRequest(router, "OPTIONS", "/api/v1/tus/", "", map[string]string{"Tus-Resumable": ""})
+	if w.Code != http.StatusNoContent || w.Header().Get("Tus-Version") != tusVersion ||
+		w.Header().Get("Tus-Extension") != tusExtensions || w.Header().Get("Tus-Checksum-Algorithm") != "sha1,sha256,md5" {
+		t.Errorf("OPTIONS: %d %v", w.Code, w.Header())
+	}
+
+	w = tusRequest(router, "POST", "/api/v1/tus/", "", map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "5"})
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("Tus-Version") != tusVersion {
+		t.Errorf("unsupported version: %d", w.Code)
+	}
+	if w.Header().Get("Tus-Resumable") != tusVersion {
+		t.Error("response has no Tus-Resumable header")
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"wrong content type":  {"Content-Type": "application/octet-stream", "Upload-Offset": "0"},
+		"no offset":           {"Content-Type": tusContentType},
+		"unknown checksum":    {"Content-Type": tusContentType, "Upload-Offset": "0", "Upload-Checksum": "crc32 AAAAAA=="},
+		"checksum not base64": {"Content-Type": tusContentType, "Upload-Offset": "0", "Upload-Checksum": "sha1 !!"},
+	} {
+		w := tusRequest(router, "PATCH", "/api/v1/tus/some-upload", "data", headers)
+		if w.Code != http.StatusUnsupportedMediaType && w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	for name, length := range map[string]string{"missing": "", "zero": "0", "not a number": "ten"} {
+		if w := tusRequest(router, "POST", "/api/v1/tus/", "", map[string]string{"Upload-Length": length}); w.Code != http.StatusBadRequest {
+			t.Errorf("Upload-Length %s: %d", name, w.Code)
+		}
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xtus")
+	router := tusRouter(user.ID)
+
+	location := createTus(t, router, 11)
+	uploadID := strings.TrimPrefix(location, "/api/v1/tus/")
+
+	w := tusRequest(router, "HEAD", location, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "0" || w.Header().Get("Upload-Length") != "11" ||
+		w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("HEAD: %d %v", w.Code, w.Header())
+	}
+
+	sum := sha1.Sum([]byte("hello "))
+	if w := tusPatch(router, location, 0, "hello ", tusChecksum("sha1", sum[:])); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("first PATCH: %d %s", w.Code, w.Body)
+	}
+	if w := tusPatch(router, location, 0, "hello ", ""); w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("PATCH at a stale offset: %d %v", w.Code, w.Header())
+	}
+	if w := tusPatch(router, location, 6, "world and more", ""); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH past Upload-Length: %d", w.Code)
+	}
+
+	// A body that fails its checksum is discarded and the offset kept.
+	sum5 := md5.Sum([]byte("world"))
+	if w := tusPatch(router, location, 6, "w0rld", tusChecksum("md5", sum5[:])); w.Code != tusChecksumMismatch {
+		t.Fatalf("corrupted PATCH: %d %s", w.Code, w.Body)
+	}
+	if w := tusRequest(router, "HEAD", location, "", nil); w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("offset after a checksum mismatch = %s, want 6", w.Header().Get("Upload-Offset"))
+	}
+
+	if w := tusPatch(router, location, 6, "world", tusChecksum("md5", sum5[:])); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("last PATCH: %d %s", w.Code, w.Body)
+	}
+
+	var upload models.TusUpload
+	db.First(&upload, "id = ?", uploadID)
+	if upload.Status != tusStatusComplete || upload.JobID != uploadID || upload.Filename != "notes.txt" || upload.FileType != "text/plain" {
+		t.Errorf("completed upload: %+v", upload)
+	}
+	job, err := loadUploadJob(uploadID)
+	if err != nil {
+		t.Fatalf("no job queued for the upload: %v", err)
+	}
+	if job.Status != "queued" || job.TotalSize != 11 || job.PayloadPath != upload.PayloadPath {
+		t.Errorf("queued job: %+v", job)
+	}
+	if payload, err := os.ReadFile(job.PayloadPath); err != nil || string(payload) != "hello world" {
+		t.Errorf("payload = %q, %v", payload, err)
+	}
+
+	// The job took over the upload's reservation rather than adding to it.
+	usage, err := storageUsageFor(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.PendingBytes != 11 || usage.PendingPieces != 1 {
+		t.Errorf("pending %d bytes in %d pieces, want 11 bytes in 1", usage.PendingBytes, usage.PendingPieces)
+	}
+
+	// Terminating a completed upload cancels its queued job.
+	if w := tusRequest(router, "DELETE", location, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if job, _ := loadUploadJob(uploadID); job.Status != "cancelled" {
+		t.Errorf("job of a terminated upload is %s", job.Status)
+	}
+}
+
+func TestTusDelete(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xtusdelete")
+	router := tusRouter(user.ID)
+
+	location := createTus(t, router, 10)
+	tusPatch(router, location, 0, "hello", "")
+
+	if w := tusRequest(tusRouter(user.ID+1), "DELETE", location, "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE by another user: %d", w.Code)
+	}
+	if w := tusRequest(router, "DELETE", location, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(uploadPayloadDir(strings.TrimPrefix(location, "/api/v1/tus/"))); !os.IsNotExist(err) {
+		t.Errorf("payload of a terminated upload was kept: %v", err)
+	}
+	if w := tusRequest(router, "HEAD", location, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE: %d", w.Code)
+	}
+}
+
+func TestTusQuota(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xtusquota")
+	db.Model(user).Update("quota_bytes", 10)
+	router := tusRouter(user.ID)
+
+	location := createTus(t, router, 8)
+	w := tusRequest(router, "POST", "/api/v1/tus/", "", map[string]string{"Upload-Length": "8"})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("upload over the quota: %d %s", w.Code, w.Body)
+	}
+	if w := tusPatch(router, location, 0, "12345678", ""); w.Code != http.StatusNoContent {
+		t.Errorf("completing an upload that holds its reservation: %d %s", w.Code, w.Body)
+	}
+}
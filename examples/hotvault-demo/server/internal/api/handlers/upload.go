@@ -1,20 +1,13 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -22,20 +15,24 @@ import (
 	"github.com/google/uuid"
 	"github.com/hotvault/backend/config"
 	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
+	"github.com/hotvault/backend/internal/pdp/commp"
+	"github.com/hotvault/backend/internal/pdp/curio"
+	"github.com/hotvault/backend/internal/pdp/pdptool"
 	"github.com/hotvault/backend/pkg/logger"
 	"gorm.io/gorm"
 )
 
 var (
-	log logger.Logger
-	db  *gorm.DB
-	cfg *config.Config
+	log          logger.Logger
+	db           *gorm.DB
+	cfg          *config.Config
+	pdpClientFor pdp.Factory
 )
 
-var (
-	uploadJobs     = make(map[string]UploadProgress)
-	uploadJobsLock sync.RWMutex
-)
+// proofSetWaitTimeout bounds how long an upload waits for the user's proof
+// set on the selected provider to be created.
+const proofSetWaitTimeout = 30 * time.Minute
 
 func init() {
 	log = logger.NewLogger()
@@ -70,39 +67,93 @@ func Initialize(database *gorm.DB, appConfig *config.Config) {
 	}
 	db = database
 	cfg = appConfig
+	if err := validateEncryptionConfig(); err != nil {
+		log.Fatal(fmt.Sprintf("Invalid encryption configuration: %v", err))
+	}
+	if pdpClientFor == nil {
+		store, err := openServiceSecrets(cfg)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Failed to open PDP service secret: %v", err))
+		}
+		serviceSecrets = store
 
-	// Change working directory to pdptool directory
-	if cfg.PdptoolPath != "" {
-		pdptoolDir := getPdptoolParentDir(cfg.PdptoolPath)
-		if err := os.Chdir(pdptoolDir); err != nil {
-			log.Error(fmt.Sprintf("Failed to change working directory to pdptool directory: %v", err))
-			return
+		factory, err := newPDPClientFactory(cfg, store)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Failed to initialize PDP client: %v", err))
 		}
-		log.WithField("pdptoolDir", pdptoolDir).Info("Changed working directory to pdptool directory")
+		pdpClientFor = factory
 	}
 
+	if err := seedStorageProviders(); err != nil {
+		log.Error(fmt.Sprintf("Failed to seed storage providers: %v", err))
+	}
+
+	startUploadWorkers()
+	startWebhookWorkers()
+	startRootReconciler()
+
 	log.Info("Upload handler initialized with database and configuration")
 }
 
+// SetPDPClientFactory overrides the PDP client used by the handlers, e.g.
+// with pdp.NewFakeClient().Factory() when pdptool is unavailable.
+func SetPDPClientFactory(factory pdp.Factory) {
+	pdpClientFor = factory
+}
+
+// newPDPClientFactory selects the PDP client implementation configured by
+// PDP_CLIENT: "pdptool" runs the pdptool binary, "http" talks to the PDP
+// service API directly.
+func newPDPClientFactory(appConfig *config.Config, keys curio.KeySource) (pdp.Factory, error) {
+	switch appConfig.PDPClient {
+	case "", "pdptool":
+		return pdptool.NewFactory(appConfig.PdptoolPath, serviceSecretPath(appConfig))
+	case "http":
+		return curio.NewFactory(keys), nil
+	default:
+		return nil, fmt.Errorf("unknown PDP client %q", appConfig.PDPClient)
+	}
+}
+
+func serviceSecretPath(appConfig *config.Config) string {
+	if appConfig.ServiceSecretPath != "" {
+		return appConfig.ServiceSecretPath
+	}
+	if appConfig.PdptoolPath != "" {
+		return filepath.Join(getPdptoolParentDir(appConfig.PdptoolPath), pdptool.ServiceSecretFile)
+	}
+	return pdptool.ServiceSecretFile
+}
+
 type UploadProgress struct {
-	Status     string `json:"status"`
-	Progress   int    `json:"progress,omitempty"`
-	Message    string `json:"message,omitempty"`
-	CID        string `json:"cid,omitempty"`
-	Error      string `json:"error,omitempty"`
-	Filename   string `json:"filename,omitempty"`
-	TotalSize  int64  `json:"totalSize,omitempty"`
-	JobID      string `json:"jobId,omitempty"`
-	ProofSetID string `json:"proofSetId,omitempty"`
+	Status         string `json:"status"`
+	Progress       int    `json:"progress,omitempty"`
+	Message        string `json:"message,omitempty"`
+	CID            string `json:"cid,omitempty"`
+	Error          string `json:"error,omitempty"`
+	Filename       string `json:"filename,omitempty"`
+	TotalSize      int64  `json:"totalSize,omitempty"`
+	JobID          string `json:"jobId,omitempty"`
+	ProofSetID     string `json:"proofSetId,omitempty"`
+	BytesProcessed int64  `json:"bytesProcessed,omitempty"`
+	// Replicas reports the upload to each storage provider.
+	Replicas []models.ReplicaProgress `json:"replicas,omitempty"`
+	// QueuePosition is the job's place among the jobs waiting for a
+	// worker, starting at 1.
+	QueuePosition int `json:"queuePosition,omitempty"`
 }
 
 // @Summary Upload a file to PDP service
-// @Description Upload a file to the PDP service with piece preparation and returns a job ID for status polling
+// @Description Upload a file to the PDP service with piece preparation and returns a job ID for status polling. The form is streamed: the file is written to a staging file while its piece commitment is computed.
 // @Tags upload
 // @Accept multipart/form-data
 // @Param file formData file true "File to upload"
+// @Param provider formData string false "Storage provider name or ID"
+// @Param X-Content-SHA256 header string false "Hex-encoded SHA-256 of the file"
 // @Produce json
 // @Success 200 {object} UploadProgress
+// @Failure 422 {object} map[string]interface{} "The file does not match X-Content-SHA256"
+// @Failure 429 {object} map[string]string "Upload queue is full; retry after the Retry-After delay"
 // @Router /api/v1/upload [post]
 func UploadFile(c *gin.Context) {
 	userID, exists := c.Get("userID")
@@ -112,64 +163,107 @@ func UploadFile(c *gin.Context) {
 		})
 		return
 	}
-	const MAX_UPLOAD_SIZE = 10 * 1024 * 1024 * 1024
-	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MAX_UPLOAD_SIZE)
+	if c.Request.ContentLength > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "File too large",
+			"message": fmt.Sprintf("Maximum file size is %s", formatFileSize(maxUploadSize)),
+		})
+		return
+	}
+	if rejectIfUploadQueueFull(c) {
+		return
+	}
+	// The form is larger than the file it carries, so only what is left of
+	// Content-Length after the form's own overhead must fit here. The exact
+	// size is checked once the file is received, as the job is queued.
+	if rejectIfOverQuota(c, userID.(uint), max(c.Request.ContentLength-uploadFormOverhead, 1)) {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize)
 
-	file, err := c.FormFile("file")
+	jobID := uuid.New().String()
+	form, err := receiveUploadForm(c, jobID)
 	if err != nil {
-		var maxBytesError *http.MaxBytesError
-		if errors.As(err, &maxBytesError) {
-			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
-				"error":   "File too large",
-				"message": fmt.Sprintf("Maximum file size is %s", formatFileSize(MAX_UPLOAD_SIZE)),
-			})
-			return
-		}
+		os.RemoveAll(uploadPayloadDir(jobID))
+		uploadBodyError(c, err)
+		return
+	}
 
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Failed to get file from form",
+	provider, err := selectStorageProvider(userID.(uint), form.provider)
+	if err != nil {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		log.WithField("error", err.Error()).WithField("userID", userID).Error("Failed to select storage provider")
+		c.JSON(providerErrorStatus(err), gin.H{
+			"error":   "Failed to select storage provider",
 			"message": err.Error(),
 		})
 		return
 	}
 
-	jobID := uuid.New().String()
+	enqueueSpooledUpload(c, userID.(uint), provider, jobID, form.filename, form.file)
+}
 
-	uploadJobsLock.Lock()
-	uploadJobs[jobID] = UploadProgress{
-		Status:    "uploading",
-		Progress:  0,
-		Message:   "Starting upload",
-		Filename:  file.Filename,
-		TotalSize: file.Size,
-		JobID:     jobID,
-	}
-	uploadJobsLock.Unlock()
-
-	pdptoolPath := cfg.PdptoolPath
-	if _, err := os.Stat(pdptoolPath); os.IsNotExist(err) {
-		log.WithField("pdptoolPath", pdptoolPath).Error("PDPTool executable not found")
-		uploadJobsLock.Lock()
-		uploadJobs[jobID] = UploadProgress{
-			Status:  "error",
-			Error:   "PDPTool executable not found",
-			Message: fmt.Sprintf("File not found at %s", pdptoolPath),
-		}
-		uploadJobsLock.Unlock()
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "PDPTool executable not found",
-			"message": fmt.Sprintf("File not found at %s", pdptoolPath),
-		})
-		return
+// uploadForm is a multipart upload form read by receiveUploadForm.
+type uploadForm struct {
+	filename string
+	provider string
+	file     *spooledUpload
+}
+
+// maxUploadFormField bounds the non-file fields of an upload form.
+const maxUploadFormField = 1024
+
+// uploadFormOverhead allows for the boundaries, part headers and fields an
+// upload form carries besides the file.
+const uploadFormOverhead = 64 << 10
+
+// receiveUploadForm reads a multipart upload form part by part, spooling
+// the file straight to the job's payload directory instead of letting the
+// form parser buffer it in memory and temporary files first.
+func receiveUploadForm(c *gin.Context, jobID string) (*uploadForm, error) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, err
 	}
 
-	go processUpload(jobID, file, userID.(uint), pdptoolPath)
+	form := &uploadForm{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Upload started",
-		"jobId":   jobID,
-		"status":  "processing",
-	})
+		switch part.FormName() {
+		case "file":
+			if form.file != nil {
+				part.Close()
+				return nil, errors.New("only one file may be uploaded per request")
+			}
+			form.filename = filepath.Base(part.FileName())
+			if part.FileName() == "" || form.filename == "." || form.filename == "/" {
+				part.Close()
+				return nil, errors.New("file has no file name")
+			}
+			form.file, err = spoolUploadPayload(jobID, form.filename, part, nil)
+		case "provider":
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(part, maxUploadFormField))
+			form.provider = string(value)
+		}
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if form.file == nil {
+		return nil, errors.New("form has no file field")
+	}
+	return form, nil
 }
 
 // @Summary Get upload status
@@ -182,53 +276,94 @@ func UploadFile(c *gin.Context) {
 func GetUploadStatus(c *gin.Context) {
 	jobID := c.Param("jobId")
 
-	uploadJobsLock.RLock()
-	progress, exists := uploadJobs[jobID]
-	uploadJobsLock.RUnlock()
-
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Upload job not found",
+	job, err := loadUploadJob(jobID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Upload job not found",
+			})
+			return
+		}
+		log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to fetch upload job")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch upload job",
 		})
 		return
 	}
 
+	progress := uploadJobProgress(job)
+	progress.QueuePosition = uploadQueuePosition(job)
 	c.JSON(http.StatusOK, progress)
 }
 
-func processUpload(jobID string, file *multipart.FileHeader, userID uint, pdptoolPath string) {
-	serviceName := cfg.ServiceName
-	serviceURL := cfg.ServiceURL
-	if serviceName == "" || serviceURL == "" {
-		log.Error("Service Name or Service URL not configured")
-		uploadJobsLock.Lock()
-		progress := uploadJobs[jobID]
-		progress.Status = "error"
-		progress.Error = "Server configuration error: Service Name/URL missing"
-		uploadJobs[jobID] = progress
-		uploadJobsLock.Unlock()
+// @Summary Cancel an upload
+// @Description Cancel a queued or running upload job. Running pdptool commands are stopped and the job's temporary files are removed.
+// @Tags upload
+// @Produce json
+// @Param jobId path string true "Job ID"
+// @Success 200 {object} UploadProgress
+// @Success 202 {object} UploadProgress "Cancellation requested; the job is being stopped"
+// @Router /api/v1/upload/{jobId} [delete]
+func CancelUpload(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
 		return
 	}
 
-	// Change working directory to pdptool directory
-	pdptoolDir := getPdptoolParentDir(pdptoolPath)
-	if err := os.Chdir(pdptoolDir); err != nil {
-		log.Error(fmt.Sprintf("Failed to change working directory to pdptool directory: %v", err))
-		uploadJobsLock.Lock()
-		progress := uploadJobs[jobID]
-		progress.Status = "error"
-		progress.Error = "Failed to set working directory"
-		uploadJobs[jobID] = progress
-		uploadJobsLock.Unlock()
+	jobID := c.Param("jobId")
+	job, err := loadUploadJob(jobID)
+	if err != nil || job.UserID != userID.(uint) {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Upload job not found",
+			})
+			return
+		}
+		log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to fetch upload job")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch upload job",
+		})
 		return
 	}
-	log.WithField("pdptoolDir", pdptoolDir).Info("Changed working directory to pdptool directory")
+
+	if isTerminalUploadStatus(job.Status) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Upload job has already finished",
+			"status": job.Status,
+		})
+		return
+	}
+
+	job, err = cancelUploadJob(job)
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to cancel upload job")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to cancel upload job",
+		})
+		return
+	}
+
+	log.WithField("jobID", jobID).WithField("status", job.Status).Info("Upload cancellation requested")
+
+	status := http.StatusAccepted
+	if isTerminalUploadStatus(job.Status) {
+		status = http.StatusOK
+	}
+	c.JSON(status, uploadJobProgress(job))
+}
+
+// processUpload runs a claimed upload job from its last completed stage:
+// chunked uploads are assembled, the piece commitment is computed and the
+// file is replicated to the user's storage providers.
+func processUpload(ctx context.Context, job *models.UploadJob) {
+	jobID := job.ID
+	userID := job.UserID
 
 	updateStatus := func(progress UploadProgress) {
-		progress.JobID = jobID
-		uploadJobsLock.Lock()
-		uploadJobs[jobID] = progress
-		uploadJobsLock.Unlock()
+		saveUploadProgress(jobID, progress)
 	}
 
 	currentStage := "starting"
@@ -236,7 +371,7 @@ func processUpload(jobID string, file *multipart.FileHeader, userID uint, pdptoo
 
 	prepareWeight := 20
 
-	fileSizeMB := float64(file.Size) / (1024 * 1024)
+	fileSizeMB := float64(job.TotalSize) / (1024 * 1024)
 
 	baseDelay := time.Duration(2+int(fileSizeMB/5)) * time.Second
 	if baseDelay < 2*time.Second {
@@ -246,826 +381,643 @@ func processUpload(jobID string, file *multipart.FileHeader, userID uint, pdptoo
 		baseDelay = 10 * time.Second
 	}
 
-	prepareTimeout := time.Duration(30+int(fileSizeMB*2)) * time.Second
-	if prepareTimeout > 3600*time.Second {
-		prepareTimeout = 3600 * time.Second
-	}
-
 	uploadTimeout := time.Duration(30+int(fileSizeMB*3)) * time.Second
 	if uploadTimeout > 7200*time.Second {
 		uploadTimeout = 7200 * time.Second
 	}
 
-	log.WithField("fileSize", file.Size).
+	log.WithField("fileSize", job.TotalSize).
 		WithField("fileSizeMB", fileSizeMB).
 		WithField("baseDelay", baseDelay).
-		WithField("prepareTimeout", prepareTimeout).
 		WithField("uploadTimeout", uploadTimeout).
 		Info("Calculated timeouts for file processing")
 
-	if _, err := os.Stat("pdpservice.json"); os.IsNotExist(err) {
-		currentStage = "preparing"
-		updateStatus(UploadProgress{
-			Status:   "preparing",
-			Progress: currentProgress,
-			Message:  "Creating service secret",
-		})
-
-		createSecretCmd := exec.Command(pdptoolPath, "create-service-secret")
-		var createSecretOutput bytes.Buffer
-		var createSecretError bytes.Buffer
-		createSecretCmd.Stdout = &createSecretOutput
-		createSecretCmd.Stderr = &createSecretError
-		if err := createSecretCmd.Run(); err != nil {
+	if job.Stage == models.UploadStageQueued {
+		if job.ChunkDir == "" {
 			updateStatus(UploadProgress{
 				Status:  "error",
-				Error:   "Failed to create service secret",
-				Message: createSecretError.String(),
+				Error:   "Upload payload missing",
+				Message: "The upload job has no file to process",
 			})
 			return
 		}
-		currentProgress += 5
+		if !assembleChunks(job) {
+			return
+		}
+		if err := setUploadJobStage(job, models.UploadStageReceived, nil); err != nil {
+			log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to record upload stage")
+			return
+		}
 	}
 
-	uploadPathsLock.RLock()
-	existingFilePath, hasExistingPath := filePaths[jobID]
-	uploadPathsLock.RUnlock()
+	tempFilePath := job.PayloadPath
+	if _, err := os.Stat(tempFilePath); err != nil {
+		log.WithField("error", err.Error()).
+			WithField("path", tempFilePath).
+			Error("Upload payload does not exist")
+		updateStatus(UploadProgress{
+			Status:  "error",
+			Error:   "Failed to verify temporary file",
+			Message: fmt.Sprintf("File does not exist: %s", err.Error()),
+		})
+		return
+	}
+
+	if job.Stage == models.UploadStageReceived {
+		currentProgress += 5
+		currentStage = "preparing"
+
+		updateStatus(UploadProgress{
+			Status:   currentStage,
+			Progress: currentProgress,
+			Message:  "Preparing piece",
+		})
 
-	var tempFilePath string
-	if hasExistingPath {
-		tempFilePath = existingFilePath
-		log.WithField("path", tempFilePath).Info("Using existing file path from chunked upload")
-	} else {
-		tempDir, err := os.MkdirTemp("", fmt.Sprintf("upload-%s-", jobID))
+		pieceFile, err := os.Open(tempFilePath)
 		if err != nil {
-			log.WithField("error", err.Error()).Error("Failed to create temporary directory")
+			log.WithField("error", err.Error()).
+				WithField("path", tempFilePath).
+				Error("Failed to open file for piece preparation")
 			updateStatus(UploadProgress{
 				Status:  "error",
-				Error:   "Failed to create temporary directory",
+				Error:   "Failed to prepare piece",
 				Message: err.Error(),
 			})
 			return
 		}
 
-		originalFilename := filepath.Base(file.Filename)
-		tempFilePath = filepath.Join(tempDir, originalFilename)
-
-		src, err := file.Open()
+		err = prepareLimiter.acquire(ctx, func() {
+			updateStatus(UploadProgress{
+				Status:   currentStage,
+				Progress: currentProgress,
+				Message:  "Waiting for a free preparation slot...",
+			})
+		})
 		if err != nil {
-			log.WithField("error", err.Error()).
-				WithField("filename", file.Filename).
-				Error("Failed to open uploaded file")
+			pieceFile.Close()
+			return
+		}
+		prepareStartProgress := currentProgress
+		lastReported := prepareStartProgress
+		preparedPiece, err := commp.Compute(ctx, pieceFile, func(done int64) {
+			if job.TotalSize <= 0 {
+				return
+			}
+			progress := prepareStartProgress + int(done*int64(prepareWeight)/job.TotalSize)
+			if progress <= lastReported && done < job.TotalSize {
+				return
+			}
+			lastReported = progress
 			updateStatus(UploadProgress{
-				Status:  "error",
-				Error:   "Failed to open uploaded file",
-				Message: err.Error(),
+				Status:         currentStage,
+				Progress:       progress,
+				Message:        "Preparing piece data...",
+				BytesProcessed: done,
 			})
+		})
+		pieceFile.Close()
+		prepareLimiter.release()
+		if ctx.Err() != nil {
 			return
 		}
-		defer src.Close()
-
-		dst, err := os.Create(tempFilePath)
 		if err != nil {
 			log.WithField("error", err.Error()).
 				WithField("path", tempFilePath).
-				Error("Failed to create temporary file")
+				Error("Failed to compute piece commitment")
 			updateStatus(UploadProgress{
 				Status:  "error",
-				Error:   "Failed to create temporary file",
+				Error:   "Failed to prepare piece",
 				Message: err.Error(),
 			})
 			return
 		}
 
-		written, err := io.Copy(dst, src)
-		dst.Close()
+		log.WithField("pieceCID", preparedPiece.CID).
+			WithField("paddedSize", preparedPiece.PaddedSize).
+			Info("Piece prepared")
 
-		if err != nil {
-			log.WithField("error", err.Error()).
-				WithField("path", tempFilePath).
-				Error("Failed to save uploaded file")
-			updateStatus(UploadProgress{
-				Status:  "error",
-				Error:   "Failed to save uploaded file",
-				Message: err.Error(),
-			})
-			os.RemoveAll(tempDir)
+		if err := setUploadJobStage(job, models.UploadStagePrepared, map[string]interface{}{
+			"piece_cid": preparedPiece.CID,
+		}); err != nil {
+			log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to record upload stage")
 			return
 		}
+		job.PieceCID = preparedPiece.CID
+	}
 
-		if written != file.Size {
-			err := fmt.Errorf("file size mismatch: expected %d bytes, wrote %d bytes", file.Size, written)
-			log.WithField("error", err.Error()).
-				WithField("path", tempFilePath).
-				Error("Failed to save complete file")
+	if job.Stage != models.UploadStagePrepared {
+		return
+	}
+
+	// The payload is encrypted once; a job resumed after encryption keeps
+	// its key.
+	if job.WrappedDataKey == nil && encryptionEnabledFor(userID) {
+		if err := encryptPayload(ctx, job, updateStatus); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to encrypt upload")
 			updateStatus(UploadProgress{
 				Status:  "error",
-				Error:   "Failed to save complete file",
+				Error:   "Failed to encrypt file",
 				Message: err.Error(),
 			})
-			os.RemoveAll(tempDir)
 			return
 		}
-
-		log.WithField("path", tempFilePath).
-			WithField("size", formatFileSize(written)).
-			Info("File saved to temporary location")
+		tempFilePath = job.PayloadPath
 	}
 
-	if _, err := os.Stat(tempFilePath); os.IsNotExist(err) {
-		log.WithField("error", err.Error()).
-			WithField("path", tempFilePath).
-			Error("Temporary file does not exist after save")
+	provider, err := uploadJobProvider(job)
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("userID", userID).Error("Failed to select storage provider")
 		updateStatus(UploadProgress{
 			Status:  "error",
-			Error:   "Failed to verify temporary file",
-			Message: fmt.Sprintf("File does not exist: %s", err.Error()),
+			Error:   "Failed to select storage provider",
+			Message: err.Error(),
 		})
 		return
 	}
 
-	currentProgress += 5
-	currentStage = "preparing"
-
-	updateStatus(UploadProgress{
-		Status:   currentStage,
-		Progress: currentProgress,
-		Message:  "Preparing piece",
-	})
+	record, err := uploadJobFile(job)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Failed to save file information")
+		updateStatus(UploadProgress{
+			Status:  "error",
+			Error:   "Failed to save file information to database",
+			Message: err.Error(),
+		})
+		return
+	}
 
-	var prepareOutput bytes.Buffer
-	var prepareError bytes.Buffer
-	prepareCmd := exec.Command(pdptoolPath, "prepare-piece", tempFilePath)
-	prepareCmd.Stdout = &prepareOutput
-	prepareCmd.Stderr = &prepareError
+	providers, err := replicaProviders(provider, record.ReplicationFactor)
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("userID", userID).Error("Failed to select replica providers")
+		updateStatus(UploadProgress{
+			Status:  "error",
+			Error:   "Failed to select storage providers",
+			Message: err.Error(),
+		})
+		return
+	}
 
-	prepareCtx, prepareCancel := context.WithTimeout(context.Background(), prepareTimeout)
-	defer prepareCancel()
+	if segmented(record) {
+		storeSegmented(ctx, job, record, providers)
+		return
+	}
 
-	prepareCmdWithTimeout := exec.CommandContext(prepareCtx, pdptoolPath, "prepare-piece", tempFilePath)
-	prepareCmdWithTimeout.Stdout = &prepareOutput
-	prepareCmdWithTimeout.Stderr = &prepareError
+	// Replicas stored before an interrupted run are kept.
+	var existing []models.Piece
+	if err := db.Where("file_id = ?", record.ID).Find(&existing).Error; err != nil {
+		log.WithField("error", err.Error()).WithField("fileID", record.ID).Error("Failed to fetch stored replicas")
+	}
 
-	prepareDone := make(chan bool)
-	go func() {
-		prepareStartProgress := currentProgress
-		for i := 0; i < prepareWeight; i++ {
-			select {
-			case <-prepareDone:
-				return
-			case <-time.After(100 * time.Millisecond):
-				if currentProgress < prepareStartProgress+prepareWeight-1 {
-					currentProgress++
-					if i%5 == 0 {
-						updateStatus(UploadProgress{
-							Status:   currentStage,
-							Progress: currentProgress,
-							Message:  "Preparing piece data...",
-						})
-					}
+	pieces := make([]*models.Piece, len(providers))
+	replicas := make([]models.ReplicaProgress, len(providers))
+	for i, p := range providers {
+		replicas[i] = models.ReplicaProgress{Provider: p.Name, Status: "pending"}
+		for j := range existing {
+			if existing[j].ServiceName == p.ServiceName && existing[j].ServiceURL == p.ServiceURL {
+				pieces[i] = &existing[j]
+				replicas[i].Status = "complete"
+				if existing[j].RootID != nil {
+					replicas[i].RootID = *existing[j].RootID
 				}
+				break
 			}
 		}
-	}()
-
-	if err := prepareCmdWithTimeout.Run(); err != nil {
-		close(prepareDone)
+	}
 
-		if prepareCtx.Err() == context.DeadlineExceeded {
-			updateStatus(UploadProgress{
-				Status:  "error",
-				Error:   "Prepare piece command timed out",
-				Message: fmt.Sprintf("Operation timed out after %v. Try a smaller file or contact support.", prepareTimeout),
-			})
-		} else {
-			updateStatus(UploadProgress{
-				Status:  "error",
-				Error:   "Failed to prepare piece",
-				Message: prepareError.String(),
-			})
+	// Content the user already stores with a provider is linked to the
+	// existing root there instead of being uploaded again.
+	linked := 0
+	for i := range providers {
+		if pieces[i] != nil {
+			continue
 		}
+		piece, err := linkDuplicateReplica(record, &providers[i])
+		if err != nil {
+			log.WithField("fileID", record.ID).
+				WithField("provider", providers[i].Name).
+				WithField("error", err.Error()).
+				Warning("Failed to look up duplicate of upload, uploading it")
+			continue
+		}
+		if piece == nil {
+			continue
+		}
+		pieces[i] = piece
+		replicas[i].Status = "complete"
+		replicas[i].Message = "Linked to an existing copy of the file"
+		replicas[i].RootID = *piece.RootID
+		linked++
+	}
+	if linked > 0 {
+		log.WithField("jobID", jobID).
+			WithField("pieceCID", record.CID).
+			WithField("linkedReplicas", linked).
+			Info("Deduplicated upload against stored content")
+	}
+
+	// Small files are stored together with other small files of the user
+	// by the aggregator, unless a replica of the file is already stored.
+	if aggregatable(record) && linked == 0 && len(existing) == 0 {
+		queueForAggregation(job, replicas)
 		return
 	}
 
-	close(prepareDone)
-	currentProgress = prepareWeight + 10
-	currentStage = "uploading"
-
 	updateStatus(UploadProgress{
-		Status:   currentStage,
-		Progress: currentProgress,
-		Message:  fmt.Sprintf("Uploading file... (%.1f MB)", fileSizeMB),
+		Status:   "uploading",
+		Progress: prepareWeight + 10,
+		Message:  fmt.Sprintf("Uploading to %d storage provider(s)...", len(providers)),
+		Replicas: replicas,
 	})
 
-	time.Sleep(10 * time.Second)
-
-	var uploadOutput bytes.Buffer
-	var uploadError bytes.Buffer
-
-	uploadArgs := []string{
-		"upload-file",
-		"--service-url", cfg.ServiceURL,
-		"--service-name", cfg.ServiceName,
-		tempFilePath,
+	var wg sync.WaitGroup
+	for i := range providers {
+		if pieces[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			piece, err := replicateToProvider(ctx, job, i, record, tempFilePath, &providers[i], prepareWeight+10)
+			if err != nil {
+				log.WithField("jobID", jobID).
+					WithField("provider", providers[i].Name).
+					WithField("error", err.Error()).
+					Error("Replica upload failed")
+				return
+			}
+			pieces[i] = piece
+			finishReplica(jobID, i, piece)
+		}(i)
 	}
+	wg.Wait()
 
-	uploadCmd := exec.Command(pdptoolPath, uploadArgs...)
-	uploadCmd.Stdout = &uploadOutput
-	uploadCmd.Stderr = &uploadError
-
-	log.WithField("command", pdptoolPath).
-		WithField("args", strings.Join(uploadArgs, " ")).
-		WithField("fileSize", formatFileSize(file.Size)).
-		WithField("timeout", "none").
-		Info("Executing pdptool upload-file command")
-
-	updateStatus(UploadProgress{
-		Status:   currentStage,
-		Progress: currentProgress,
-		Message:  fmt.Sprintf("Uploading file... (%.1f MB)", fileSizeMB),
-	})
-
-	uploadRunErr := uploadCmd.Run()
-	if uploadRunErr != nil {
-		stderrStr := uploadError.String()
-		stdoutStr := uploadOutput.String()
-
-		log.WithField("error", uploadRunErr.Error()).
-			WithField("stderr", stderrStr).
-			WithField("stdout", stdoutStr).
-			Error("Upload command failed")
-
-		updateStatus(UploadProgress{
-			Status:  "error",
-			Error:   "Upload command failed",
-			Message: stderrStr,
-		})
-		return
-	}
+	completeUpload(ctx, job, record, pieces)
+}
 
-	outputStr := uploadOutput.String()
-	outputLines := strings.Split(outputStr, "\n")
-
-	cidRegex := regexp.MustCompile(`^(baga[a-zA-Z0-9]+)(?::(baga[a-zA-Z0-9]+))?$`)
-	var compoundCID string
-	var baseCID string
-	var subrootCID string
-
-	for i := len(outputLines) - 1; i >= 0; i-- {
-		trimmedLine := strings.TrimSpace(outputLines[i])
-		if cidRegex.MatchString(trimmedLine) {
-			matches := cidRegex.FindStringSubmatch(trimmedLine)
-			if len(matches) > 1 {
-				compoundCID = matches[0]
-				baseCID = matches[1]
-				if len(matches) > 2 && matches[2] != "" {
-					subrootCID = matches[2]
-				} else {
-					subrootCID = baseCID
-				}
-				log.WithField("compoundCID", compoundCID).WithField("baseCID", baseCID).WithField("subrootCID", subrootCID).Info("Found and parsed CID in output lines")
-				break
-			}
+// completeUpload finishes a job once its replicas have been stored: pieces
+// holds the stored replica per provider, nil where storing failed. The file
+// record is deleted if no replica was stored.
+func completeUpload(ctx context.Context, job *models.UploadJob, record *models.File, pieces []*models.Piece) {
+	jobID := job.ID
+
+	if ctx.Err() != nil {
+		var stored int64
+		db.Model(&models.Piece{}).Where("file_id = ?", record.ID).Count(&stored)
+		if stored == 0 {
+			db.Delete(record)
 		}
+		return
 	}
 
-	if compoundCID == "" {
-		var lastNonEmpty string
-		for i := len(outputLines) - 1; i >= 0; i-- {
-			line := strings.TrimSpace(outputLines[i])
-			if line != "" {
-				lastNonEmpty = line
-				break
-			}
+	var primary *models.Piece
+	stored := 0
+	for _, piece := range pieces {
+		if piece == nil {
+			continue
 		}
-
-		if lastNonEmpty != "" {
-			log.WithField("lastLine", lastNonEmpty).Warning("Using last non-empty output line as CID (fallback, parsing may fail)")
-			compoundCID = lastNonEmpty
-			if idx := strings.Index(compoundCID, ":"); idx != -1 {
-				baseCID = compoundCID[:idx]
-			} else {
-				baseCID = compoundCID
-			}
-			subrootCID = baseCID
-		} else {
-			log.Error("Upload completed but failed to extract CID from pdptool output.")
-			updateStatus(UploadProgress{
-				Status:  "error",
-				Error:   "Failed to extract CID from upload response",
-				Message: "Could not determine upload result CID.",
-			})
-			return
+		if primary == nil {
+			primary = piece
 		}
+		stored++
 	}
 
-	log.WithField("uploadOutputCID", compoundCID).
-		WithField("parsedBaseCID", baseCID).
-		WithField("parsedSubrootCID", subrootCID).
-		Info("CIDs extracted from upload-file output, before calling add-roots")
-
-	log.WithField("filename", file.Filename).
-		WithField("size", file.Size).
-		WithField("service_name", serviceName).
-		WithField("service_url", serviceURL).
-		WithField("compoundCID", compoundCID).
-		Info("File uploaded successfully, proceeding to add root")
-
-	currentProgress = 95
-	currentStage = "adding_root"
-	updateStatus(UploadProgress{
-		Status:   currentStage,
-		Progress: currentProgress,
-		Message:  "Finding or creating a proof set for your file...",
-		CID:      compoundCID,
-	})
-
-	// Reduced delay before adding root
-	preAddRootDelay := 1 * time.Second
-	log.Info(fmt.Sprintf("Waiting %v before adding root to allow service registration...", preAddRootDelay))
-	time.Sleep(preAddRootDelay)
-
-	var proofSet models.ProofSet
-	if err := db.Where("user_id = ?", userID).First(&proofSet).Error; err != nil {
-		errMsg := "Failed to query proof set for user."
-		if err == gorm.ErrRecordNotFound {
-			errMsg = "Proof set not found for user. Please re-authenticate."
-			log.WithField("userID", userID).Error(errMsg)
-		} else {
-			log.WithField("userID", userID).WithField("error", err).Error("Database error fetching proof set")
+	if primary == nil {
+		db.Delete(record)
+		failure := "Upload failed"
+		if current, err := loadUploadJob(jobID); err == nil && len(current.Replicas) > 0 {
+			failure = current.Replicas[0].Error
 		}
-		updateStatus(UploadProgress{
+		saveUploadProgress(jobID, UploadProgress{
 			Status:  "error",
-			Error:   errMsg,
-			Message: "Upload cannot proceed without a valid proof set.",
-			CID:     compoundCID,
+			Error:   failure,
+			Message: fmt.Sprintf("Upload failed on all %d storage provider(s)", len(pieces)),
 		})
 		return
 	}
 
-	if proofSet.ProofSetID == "" {
-		errMsg := "Proof set creation is still pending. Please wait."
-		log.WithField("userID", userID).WithField("dbProofSetID", proofSet.ID).Warning(errMsg)
-		updateStatus(UploadProgress{
-			Status:     "pending",
-			Error:      errMsg,
-			Message:    "The proof set is being initialized. Please try uploading again shortly.",
-			CID:        compoundCID,
-			ProofSetID: proofSet.ProofSetID,
-		})
-		return
+	message := "Upload completed successfully"
+	if stored < record.ReplicationFactor {
+		message = fmt.Sprintf("Upload completed on %d of %d storage providers", stored, record.ReplicationFactor)
 	}
 
-	log.WithField("userID", userID).WithField("serviceProofSetID", proofSet.ProofSetID).Info("Found ready proof set for user, proceeding to add root")
+	var proofSet models.ProofSet
+	db.First(&proofSet, *primary.ProofSetID)
 
-	updateStatus(UploadProgress{
-		Status:     currentStage,
-		Progress:   currentProgress,
-		Message:    fmt.Sprintf("Adding root to proof set %s...", proofSet.ProofSetID),
-		CID:        compoundCID,
+	if err := setUploadJobStage(job, models.UploadStageStored, nil); err != nil {
+		log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to record upload stage")
+	}
+	saveUploadProgress(jobID, UploadProgress{
+		Status:     "complete",
+		Progress:   100,
+		Message:    message,
+		CID:        primary.CID,
 		ProofSetID: proofSet.ProofSetID,
 	})
+}
 
-	rootArgument := compoundCID
-	addRootsArgs := []string{
-		"add-roots",
-		"--service-url", cfg.ServiceURL,
-		"--service-name", cfg.ServiceName,
-		"--proof-set-id", proofSet.ProofSetID,
-		"--root", rootArgument,
-	}
-
-	log.WithField("add-roots-args", strings.Join(addRootsArgs, " ")).Info("Adding root to proof set")
-
-	cmdDir := pdptoolDir
-	secretPath := filepath.Join(cmdDir, "pdpservice.json")
-	log.WithField("expectedCmdDir", cmdDir).Info("Checking command working directory")
-	log.WithField("checkingSecretPath", secretPath).Info("Checking for pdpservice.json")
-	if _, errStat := os.Stat(secretPath); errStat == nil {
-		log.Info("pdpservice.json FOUND at the expected location.")
-	} else if os.IsNotExist(errStat) {
-		log.Error("pdpservice.json NOT FOUND at the expected location.")
-	} else {
-		log.WithField("error", errStat.Error()).Error("Error checking for pdpservice.json")
-	}
-
-	maxRetries := 100
-	backoff := 10 * time.Second
-	maxBackoff := 10 * time.Second
-	success := false
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt > 1 {
-			time.Sleep(backoff)
+// uploadJobProvider returns the primary storage provider of a job, choosing
+// one again if the provider it was queued for is gone or disabled.
+func uploadJobProvider(job *models.UploadJob) (*models.StorageProvider, error) {
+	if job.ProviderID != nil {
+		var provider models.StorageProvider
+		err := db.Where("id = ? AND enabled = ?", *job.ProviderID, true).First(&provider).Error
+		if err == nil {
+			return &provider, nil
 		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		log.WithField("jobID", job.ID).
+			WithField("providerID", *job.ProviderID).
+			Warning("Storage provider of upload job is unavailable, selecting another")
+	}
+	return selectStorageProvider(job.UserID, "")
+}
 
-		log.WithField("command", pdptoolPath).
-			WithField("args", strings.Join(addRootsArgs, " ")).
-			WithField("attempt", attempt).
-			WithField("maxRetries", maxRetries).
-			Info("Executing add-roots command")
-
-		updateStatus(UploadProgress{
-			Status:     currentStage,
-			Progress:   currentProgress,
-			Message:    "Adding root to proof...",
-			CID:        compoundCID,
-			ProofSetID: proofSet.ProofSetID,
-		})
-
-		addRootCmd := exec.Command(pdptoolPath, addRootsArgs...)
-		var addRootOutput bytes.Buffer
-		var addRootError bytes.Buffer
-		addRootCmd.Stdout = &addRootOutput
-		addRootCmd.Stderr = &addRootError
-
-		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-		defer cancel()
-
-		cmdWithTimeout := exec.CommandContext(ctx, pdptoolPath, addRootsArgs...)
-		cmdWithTimeout.Dir = pdptoolDir
-		cmdWithTimeout.Stdout = &addRootOutput
-		cmdWithTimeout.Stderr = &addRootError
-
-		if err := cmdWithTimeout.Run(); err != nil {
-			stderrStr := addRootError.String()
-			stdoutStr := addRootOutput.String()
-
-			if ctx.Err() == context.DeadlineExceeded {
-				log.WithField("attempt", attempt).
-					WithField("maxRetries", maxRetries).
-					Error("Command execution timed out after 60 seconds")
-
-				if attempt < maxRetries {
-					updateStatus(UploadProgress{
-						Status:     currentStage,
-						Progress:   currentProgress,
-						Message:    fmt.Sprintf("Command timed out. Retrying %d/%d...", attempt+1, maxRetries),
-						CID:        compoundCID,
-						ProofSetID: proofSet.ProofSetID,
-					})
-
-					time.Sleep(backoff)
-
-					backoff *= 2
-					if backoff > maxBackoff {
-						backoff = maxBackoff
-					}
-					continue
-				} else {
-					updateStatus(UploadProgress{
-						Status:     "error",
-						Error:      "Command timed out after multiple attempts",
-						Message:    "The service took too long to respond. Please try again later.",
-						CID:        compoundCID,
-						ProofSetID: proofSet.ProofSetID,
-					})
-					return
-				}
-			}
-
-			log.WithField("error", err.Error()).
-				WithField("stderr", stderrStr).
-				WithField("stdout", stdoutStr).
-				WithField("commandArgs", strings.Join(addRootsArgs, " ")).
-				WithField("attempt", attempt).
-				WithField("maxRetries", maxRetries).
-				Error("pdptool add-roots command failed")
-
-			shouldRetry := false
-
-			if strings.Contains(stderrStr, "subroot CID") && strings.Contains(stderrStr, "not found or does not belong to service") {
-				shouldRetry = true
-			} else if strings.Contains(stderrStr, "Size must be a multiple of 32") {
-				shouldRetry = true
-			} else if strings.Contains(stderrStr, "Failed to send transaction") {
-				shouldRetry = true
-			} else if strings.Contains(stderrStr, "status code 500") || strings.Contains(stderrStr, "status code 400") {
-				shouldRetry = true
-			} else if strings.Contains(stderrStr, "Failed to retrieve next challenge epoch") ||
-				strings.Contains(stderrStr, "can't scan NULL into") {
-				shouldRetry = true
-			} else if strings.Contains(stderrStr, "not found") {
-				shouldRetry = true
-			} else if strings.Contains(stderrStr, "can't add root to non-existing proof set") {
-				shouldRetry = true
-			} else {
-				shouldRetry = true
-			}
-
-			if shouldRetry && attempt < maxRetries {
-				retryDelay := backoff + time.Duration(rand.Int63n(int64(backoff/2)))
-				log.WithField("retryDelay", retryDelay.String()).Info("Waiting before retry")
-				time.Sleep(retryDelay)
-				backoff *= 2
-				if backoff > maxBackoff {
-					backoff = maxBackoff
-				}
-				continue
-			}
-
-			if attempt >= maxRetries {
-				updateStatus(UploadProgress{
-					Status:     "error",
-					Error:      "Failed to add root to proof set after multiple attempts",
-					Message:    stderrStr,
-					CID:        compoundCID,
-					ProofSetID: proofSet.ProofSetID,
-				})
-				return
-			}
-
-			updateStatus(UploadProgress{
-				Status:     "error",
-				Error:      "Failed to add root to proof set",
-				Message:    stderrStr,
-				CID:        compoundCID,
-				ProofSetID: proofSet.ProofSetID,
-			})
-			return
+// uploadJobFile returns the file record of a job, creating it on the first
+// run of the replication stage.
+func uploadJobFile(job *models.UploadJob) (*models.File, error) {
+	if job.FileID != nil {
+		var record models.File
+		err := db.First(&record, *job.FileID).Error
+		if err == nil {
+			return &record, nil
 		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
 
-		addRootStderrStrOnSuccess := addRootError.String()
-		if addRootStderrStrOnSuccess != "" {
-			log.WithField("stderr", addRootStderrStrOnSuccess).Warning("add-roots command succeeded but produced output on stderr")
+	record := &models.File{
+		UserID:            job.UserID,
+		Filename:          job.Filename,
+		Size:              job.TotalSize,
+		CID:               job.PieceCID,
+		ETag:              job.ETag,
+		ReplicationFactor: replicationFactorFor(job.UserID),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(record).Error; err != nil {
+			return err
 		}
+		return tx.Model(job).Update("file_id", record.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	job.FileID = &record.ID
+	return record, nil
+}
 
-		addRootStdoutStr := addRootOutput.String()
-		log.WithField("proofSetID", proofSet.ProofSetID).
-			WithField("rootUsed", rootArgument).
-			WithField("stdout", addRootStdoutStr).
-			WithField("attempt", attempt).
-			Info("add-roots command completed successfully")
+// replicateToProvider stores the prepared file with one provider: it uploads
+// the file, adds it as a root to the user's proof set there and saves the
+// replica as a Piece of record. index is the replica's position in the job's
+// Replicas; replica 0 also drives the job's overall progress.
+func replicateToProvider(ctx context.Context, job *models.UploadJob, index int, record *models.File, tempFilePath string, provider *models.StorageProvider, startProgress int) (*models.Piece, error) {
+	report := func(progress UploadProgress) {
+		reportReplica(job.ID, index, progress)
+	}
+	fail := func(progress UploadProgress) (*models.Piece, error) {
+		progress.Status = "error"
+		report(progress)
+		return nil, fmt.Errorf("%s: %s", progress.Error, progress.Message)
+	}
 
-		success = true
-		break
+	// The provider may already hold this content for another user, in which
+	// case only the root has to be added. Encrypted payloads are unique to
+	// the upload.
+	var uploaded *pdp.UploadResult
+	if job.WrappedDataKey == nil {
+		uploaded = providerUploadOf(record, provider)
+	}
+	if uploaded != nil {
+		log.WithField("pieceCID", record.CID).
+			WithField("provider", provider.Name).
+			Info("Content already stored with provider, skipping upload")
 	}
 
-	if !success {
-		updateStatus(UploadProgress{
-			Status:     "error",
-			Error:      "Failed to add root to proof set after multiple attempts",
-			Message:    "Service did not accept the root after multiple attempts.",
-			CID:        compoundCID,
-			ProofSetID: proofSet.ProofSetID,
-		})
-		return
+	root, err := storeRoot(ctx, record.UserID, record.Filename, tempFilePath, payloadSize(job), provider, startProgress, uploaded, report)
+	if err != nil {
+		return nil, err
 	}
+	compoundCID := root.CID
+	proofSet := root.ProofSet
 
-	currentProgress = 96
-	currentStage = "finalizing"
-	updateStatus(UploadProgress{
-		Status:     currentStage,
-		Progress:   currentProgress,
-		Message:    "Confirming Root ID assignment...",
+	report(UploadProgress{
+		Status:     "adding_root",
+		Progress:   98,
+		Message:    "Saving piece information to database...",
 		CID:        compoundCID,
 		ProofSetID: proofSet.ProofSetID,
 	})
 
-	var extractedIntegerRootID string
-	pollInterval := 10 * time.Second
-	maxPollInterval := 10 * time.Second
-	maxPollAttempts := 100
-	pollAttempt := 0
-	foundRootInPoll := false
-	consecutiveErrors := 0
-	maxConsecutiveErrors := 10
-
-	for pollAttempt < maxPollAttempts {
-		if pollAttempt > 0 {
-			log.Info("Applying fixed 30-second delay before poll attempt")
-			time.Sleep(10 * time.Second)
-		}
-
-		pollAttempt++
+	piece := encryptionOf(&models.Piece{
+		UserID:        record.UserID,
+		FileID:        &record.ID,
+		CID:           compoundCID,
+		Filename:      record.Filename,
+		Size:          record.Size,
+		ServiceName:   provider.ServiceName,
+		ServiceURL:    provider.ServiceURL,
+		ProofSetID:    &proofSet.ID,
+		RootID:        root.RootID,
+		RootState:     root.RootState,
+		RootCheckedAt: root.RootCheckedAt,
+	}, job)
 
-		if pollAttempt%5 == 0 {
-			updateStatus(UploadProgress{
-				Status:     currentStage,
-				Progress:   currentProgress,
-				Message:    "Waiting for blockchain confirmation...",
-				CID:        compoundCID,
-				ProofSetID: proofSet.ProofSetID,
-			})
-		}
-
-		log.Info(fmt.Sprintf("Polling get-proof-set attempt %d/%d...", pollAttempt, maxPollAttempts))
-
-		getProofSetArgs := []string{
-			"get-proof-set",
-			"--service-url", cfg.ServiceURL,
-			"--service-name", cfg.ServiceName,
-			proofSet.ProofSetID,
-		}
-		getProofSetCmd := exec.Command(pdptoolPath, getProofSetArgs...)
-		var getProofSetStdout bytes.Buffer
-		var getProofSetStderr bytes.Buffer
-		getProofSetCmd.Stdout = &getProofSetStdout
-		getProofSetCmd.Stderr = &getProofSetStderr
-
-		log.WithField("command", pdptoolPath).WithField("args", strings.Join(getProofSetArgs, " ")).Debug(fmt.Sprintf("Executing get-proof-set poll attempt %d", pollAttempt))
+	if result := db.Create(piece); result.Error != nil {
+		log.WithField("error", result.Error.Error()).Error("Failed to save piece information")
+		return fail(UploadProgress{
+			Error:      "Failed to save piece information to database",
+			Message:    result.Error.Error(),
+			CID:        compoundCID,
+			ProofSetID: proofSet.ProofSetID,
+		})
+	}
 
-		if err := getProofSetCmd.Run(); err != nil {
-			stderrStr := getProofSetStderr.String()
-			log.WithField("error", err.Error()).
-				WithField("stderr", stderrStr).
-				Warning(fmt.Sprintf("pdptool get-proof-set command failed during poll attempt %d. Retrying after %v...", pollAttempt, pollInterval))
+	log.WithField("pieceId", piece.ID).WithField("integerRootID", pieceRootID(piece)).WithField("rootState", piece.RootState).Info("Piece information saved successfully")
 
-			consecutiveErrors++
+	return piece, nil
+}
 
-			if strings.Contains(stderrStr, "Failed to retrieve next challenge epoch") ||
-				strings.Contains(stderrStr, "can't scan NULL into") {
+// providerRoot is content stored with a provider as a root of the user's
+// proof set there.
+type providerRoot struct {
+	// CID is the compound "root:subroot" upload CID.
+	CID      string
+	ProofSet *models.ProofSet
+	// RootID is nil, and RootState root_id_unconfirmed, when the root was
+	// added but its ID did not show up in the proof set in time.
+	RootID        *string
+	RootState     string
+	RootCheckedAt *time.Time
+}
 
-				log.Info("Detected proof set initialization error, this is normal during proof set creation")
+// storeRoot uploads payloadPath to provider, unless uploaded holds the
+// result of an earlier upload of the same content, and adds it as a root to
+// the proof set of userID there. Progress and failures are passed to report.
+func storeRoot(ctx context.Context, userID uint, filename, payloadPath string, size int64, provider *models.StorageProvider, startProgress int, uploaded *pdp.UploadResult, report func(UploadProgress)) (*providerRoot, error) {
+	fail := func(progress UploadProgress) (*providerRoot, error) {
+		progress.Status = "error"
+		report(progress)
+		return nil, fmt.Errorf("%s: %s", progress.Error, progress.Message)
+	}
 
-				if consecutiveErrors > 5 {
-					if pollInterval < maxPollInterval {
-						pollInterval += time.Second
-					}
-				}
+	if provider.ServiceName == "" || provider.ServiceURL == "" {
+		log.WithField("provider", provider.Name).Error("Service Name or Service URL not configured for storage provider")
+		return fail(UploadProgress{
+			Error:   "Server configuration error",
+			Message: "Service Name/URL missing",
+		})
+	}
 
-				time.Sleep(pollInterval)
-				continue
-			}
+	client := pdpClientFor(pdp.Service{Name: provider.ServiceName, URL: provider.ServiceURL})
+	fileSizeMB := float64(size) / (1024 * 1024)
 
-			if consecutiveErrors > maxConsecutiveErrors {
-				log.Warning(fmt.Sprintf("Received %d consecutive errors while polling for root ID", consecutiveErrors))
+	currentStage := "uploading"
+	currentProgress := startProgress
 
-				if pollInterval < maxPollInterval {
-					pollInterval *= 2
-					if pollInterval > maxPollInterval {
-						pollInterval = maxPollInterval
-					}
-				}
-			}
+	uploadResult := uploaded
+	if uploadResult == nil {
+		report(UploadProgress{
+			Status:   currentStage,
+			Progress: currentProgress,
+			Message:  fmt.Sprintf("Uploading file... (%.1f MB)", fileSizeMB),
+		})
 
-			time.Sleep(pollInterval)
-			continue
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return nil, err
 		}
 
-		consecutiveErrors = 0
+		log.WithField("fileSize", formatFileSize(size)).
+			WithField("timeout", "none").
+			Info("Uploading file to PDP service")
 
-		getProofSetOutput := getProofSetStdout.String()
-		log.WithField("output", getProofSetOutput).Debug(fmt.Sprintf("get-proof-set poll attempt %d output received", pollAttempt))
+		report(UploadProgress{
+			Status:   currentStage,
+			Progress: currentProgress,
+			Message:  fmt.Sprintf("Uploading file... (%.1f MB)", fileSizeMB),
+		})
 
-		if strings.Contains(getProofSetOutput, "Roots:") && !strings.Contains(getProofSetOutput, "Root ID:") {
-			log.Debug("Found proof set but no roots listed yet. Continuing to poll...")
-			time.Sleep(pollInterval)
-			continue
+		err := transferLimiter.acquire(ctx, func() {
+			report(UploadProgress{
+				Status:   currentStage,
+				Progress: currentProgress,
+				Message:  fmt.Sprintf("Waiting for a free upload slot for %s...", provider.Name),
+			})
+		})
+		if err != nil {
+			return nil, err
 		}
+		uploadResult, err = client.UploadFile(ctx, payloadPath)
+		transferLimiter.release()
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Upload command failed")
 
-		lines := strings.Split(getProofSetOutput, "\n")
-		var lastSeenRootID string
-		foundMatchThisAttempt := false
-		sawAnyRootID := false
-
-		for _, line := range lines {
-			trimmedLine := strings.TrimSpace(line)
-			if trimmedLine == "" {
-				continue
-			}
-
-			if idx := strings.Index(trimmedLine, "Root ID:"); idx != -1 {
-				sawAnyRootID = true
-				potentialIDValue := strings.TrimSpace(trimmedLine[idx+len("Root ID:"):])
-				log.Debug(fmt.Sprintf("[Parsing] Found line containing 'Root ID:', potential value: '%s'", potentialIDValue))
-				if _, err := strconv.Atoi(potentialIDValue); err == nil {
-					lastSeenRootID = potentialIDValue
-					log.Debug(fmt.Sprintf("[Parsing] Captured integer Root ID: %s", lastSeenRootID))
-				} else {
-					lastSeenRootID = ""
-					log.Debug(fmt.Sprintf("[Parsing] Found 'Root ID:' but value '%s' is not integer, resetting lastSeenRootID", potentialIDValue))
-				}
-			}
-
-			if idx := strings.Index(trimmedLine, "Root CID:"); idx != -1 {
-				outputCID := strings.TrimSpace(trimmedLine[idx+len("Root CID:"):])
-				log.Debug(fmt.Sprintf("[Parsing] Found line containing 'Root CID:', value: '%s'", outputCID))
-				if outputCID == baseCID {
-					log.Debug(fmt.Sprintf("[Parsing] CID '%s' matches baseCID '%s'. Checking lastSeenRootID ('%s')...", outputCID, baseCID, lastSeenRootID))
-					if lastSeenRootID != "" {
-						extractedIntegerRootID = lastSeenRootID
-						log.WithField("integerRootID", extractedIntegerRootID).WithField("matchedBaseCID", baseCID).Info(fmt.Sprintf("Successfully matched base CID and found associated integer Root ID on poll attempt %d", pollAttempt))
-						foundMatchThisAttempt = true
-						break
-					} else {
-						log.WithField("matchedBaseCID", baseCID).Warning(fmt.Sprintf("Matched base CID on poll attempt %d but no preceding integer Root ID was captured (lastSeenRootID was empty)", pollAttempt))
-					}
-				}
-			}
+			return fail(UploadProgress{
+				Error:   "Upload command failed",
+				Message: err.Error(),
+			})
 		}
+	}
 
-		if foundMatchThisAttempt {
-			foundRootInPoll = true
-			break
-		}
+	compoundCID := uploadResult.CID
+	baseCID := uploadResult.RootCID
+	subrootCID := uploadResult.SubrootCID
 
-		if sawAnyRootID {
-			log.Info("Proof set has roots, but none matching our CID yet. Polling again.")
-			pollInterval = 10 * time.Second
-		}
+	log.WithField("uploadOutputCID", compoundCID).
+		WithField("parsedBaseCID", baseCID).
+		WithField("parsedSubrootCID", subrootCID).
+		Info("CIDs extracted from upload-file output, before calling add-roots")
 
-		log.Debug(fmt.Sprintf("Root CID %s not found in get-proof-set output on attempt %d. Waiting %v...", baseCID, pollAttempt, pollInterval))
-		time.Sleep(pollInterval)
-	}
+	log.WithField("filename", filename).
+		WithField("size", size).
+		WithField("service_name", provider.ServiceName).
+		WithField("service_url", provider.ServiceURL).
+		WithField("compoundCID", compoundCID).
+		Info("File uploaded successfully, proceeding to add root")
 
-	if !foundRootInPoll && consecutiveErrors < maxConsecutiveErrors {
-		log.WithField("baseCID", baseCID).
-			WithField("proofSetID", proofSet.ProofSetID).
-			WithField("attempts", maxPollAttempts).
-			Warning("Failed to find integer Root ID in get-proof-set output after polling. Using fallback Root ID.")
+	currentProgress = 95
+	currentStage = "adding_root"
+	report(UploadProgress{
+		Status:   currentStage,
+		Progress: currentProgress,
+		Message:  "Finding or creating a proof set for your file...",
+		CID:      compoundCID,
+	})
 
-		extractedIntegerRootID = "1"
-		foundRootInPoll = true
+	// Reduced delay before adding root
+	preAddRootDelay := 1 * time.Second
+	log.Info(fmt.Sprintf("Waiting %v before adding root to allow service registration...", preAddRootDelay))
+	if err := sleepContext(ctx, preAddRootDelay); err != nil {
+		return nil, err
+	}
 
-		updateStatus(UploadProgress{
-			Status:     currentStage,
-			Progress:   98,
-			Message:    "Using default Root ID due to blockchain indexing delay.",
-			CID:        compoundCID,
-			ProofSetID: proofSet.ProofSetID,
+	proofSet, err := ensureProofSet(ctx, userID, provider, proofSetWaitTimeout, func() {
+		report(UploadProgress{
+			Status:   currentStage,
+			Progress: currentProgress,
+			Message:  fmt.Sprintf("Waiting for your proof set on %s to be created...", provider.Name),
+			CID:      compoundCID,
 		})
-	} else if !foundRootInPoll {
-		log.WithField("baseCID", baseCID).
-			WithField("proofSetID", proofSet.ProofSetID).
-			WithField("attempts", maxPollAttempts).
-			Error("Failed to find integer Root ID in get-proof-set output after polling.")
-		updateStatus(UploadProgress{
-			Status:     "error",
-			Progress:   98,
-			Message:    "Error: Could not confirm integer Root ID assignment after polling.",
-			Error:      fmt.Sprintf("Polling for Root ID timed out after %d attempts", maxPollAttempts),
-			CID:        compoundCID,
-			ProofSetID: proofSet.ProofSetID,
+	})
+	if err != nil {
+		log.WithField("userID", userID).
+			WithField("provider", provider.Name).
+			WithField("error", err.Error()).
+			Error("No ready proof set for upload")
+		return fail(UploadProgress{
+			Error:   "Proof set not available",
+			Message: err.Error(),
+			CID:     compoundCID,
 		})
-		return
 	}
 
-	currentProgress = 98
-	rootIDToSave := extractedIntegerRootID
+	log.WithField("userID", userID).WithField("serviceProofSetID", proofSet.ProofSetID).Info("Found ready proof set for user, proceeding to add root")
 
-	updateStatus(UploadProgress{
+	report(UploadProgress{
 		Status:     currentStage,
 		Progress:   currentProgress,
-		Message:    "Saving piece information to database...",
+		Message:    fmt.Sprintf("Adding root to proof set %s...", proofSet.ProofSetID),
 		CID:        compoundCID,
 		ProofSetID: proofSet.ProofSetID,
 	})
 
-	piece := &models.Piece{
-		UserID:      userID,
-		CID:         compoundCID,
-		Filename:    file.Filename,
-		Size:        file.Size,
-		ServiceName: cfg.ServiceName,
-		ServiceURL:  cfg.ServiceURL,
-		ProofSetID:  &proofSet.ID,
-		RootID:      &rootIDToSave,
-	}
+	rootToAdd := pdp.ParseRoot(compoundCID)
+	log.WithField("proofSetID", proofSet.ProofSetID).
+		WithField("root", rootToAdd.String()).
+		Info("Queueing root for proof set")
 
-	if result := db.Create(piece); result.Error != nil {
-		log.WithField("error", result.Error.Error()).Error("Failed to save piece information")
-		updateStatus(UploadProgress{
-			Status:     "error",
-			Error:      "Failed to save piece information to database",
-			Message:    result.Error.Error(),
+	rootIDToSave, err := addRootsBatcher.addRoot(ctx, client, proofSet, rootToAdd, baseCID, func(progress UploadProgress) {
+		progress.CID = compoundCID
+		progress.ProofSetID = proofSet.ProofSetID
+		report(progress)
+	})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		log.WithField("proofSetID", proofSet.ProofSetID).
+			WithField("root", rootToAdd.String()).
+			WithField("error", err.Error()).
+			Error("Failed to add root to proof set")
+		return fail(UploadProgress{
+			Error:      "Failed to add root to proof set",
+			Message:    err.Error(),
 			CID:        compoundCID,
 			ProofSetID: proofSet.ProofSetID,
 		})
-		return
 	}
 
-	log.WithField("pieceId", piece.ID).WithField("integerRootID", rootIDToSave).Info("Piece information saved successfully with integer Root ID")
-
-	currentProgress = 100
-
-	updateStatus(UploadProgress{
-		Status:     "complete",
-		Progress:   currentProgress,
-		Message:    "Upload completed successfully",
-		CID:        compoundCID,
-		Filename:   file.Filename,
-		ProofSetID: proofSet.ProofSetID,
-	})
-
-	go func() {
-		var tempDir string
-
-		if !hasExistingPath && tempFilePath != "" {
-			tempDir = filepath.Dir(tempFilePath)
-		}
-
-		time.Sleep(1 * time.Hour)
-
-		uploadJobsLock.Lock()
-		delete(uploadJobs, jobID)
-		uploadJobsLock.Unlock()
-
-		if tempDir != "" && !hasExistingPath {
-			log.WithField("jobID", jobID).
-				WithField("tempDir", tempDir).
-				Info("Cleaning up temporary directory after successful upload")
-			os.RemoveAll(tempDir)
-		}
-	}()
+	stored := &providerRoot{CID: compoundCID, ProofSet: proofSet, RootState: models.RootIDUnconfirmed}
+	if rootIDToSave != "" {
+		now := time.Now()
+		stored.RootID = &rootIDToSave
+		stored.RootState = models.RootConfirmed
+		stored.RootCheckedAt = &now
+	}
+	return stored, nil
 }
@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// uploadEventPollInterval is how often streams re-read their jobs,
+	// picking up jobs run by other servers, whose changes are not
+	// published here. A heartbeat is sent at the same interval to keep
+	// idle streams open.
+	uploadEventPollInterval = 5 * time.Second
+	// uploadEventBacklog is how many events a stream may fall behind
+	// before it drops them and re-reads its jobs instead.
+	uploadEventBacklog   = 1024
+	uploadEventWriteWait = 10 * time.Second
+)
+
+// uploadEvent is the state of a job after one of its changes.
+type uploadEvent struct {
+	progress  UploadProgress
+	updatedAt time.Time
+}
+
+// uploadSubscriber is a stream waiting for changes to the upload jobs of a
+// user: to one job, or to any of them when jobID is empty.
+type uploadSubscriber struct {
+	userID uint
+	jobID  string
+	signal chan struct{}
+
+	mu     sync.Mutex
+	events []uploadEvent
+	// lagged is set when events overflowed uploadEventBacklog.
+	lagged bool
+}
+
+var (
+	// uploadSubscribers holds the streams of each user.
+	uploadSubscribers     = make(map[uint]map[*uploadSubscriber]struct{})
+	uploadSubscribersLock sync.Mutex
+
+	// webSocketOrigins are the cross-origin pages allowed to open event
+	// WebSockets; they are authenticated by cookie, so any other origin
+	// is refused.
+	webSocketOrigins []string
+)
+
+// SetWebSocketOrigins sets the origins, besides the server's own, whose
+// pages may open upload event WebSockets.
+func SetWebSocketOrigins(origins []string) {
+	webSocketOrigins = origins
+}
+
+func subscribeUploadEvents(userID uint, jobID string) *uploadSubscriber {
+	subscriber := &uploadSubscriber{
+		userID: userID,
+		jobID:  jobID,
+		signal: make(chan struct{}, 1),
+	}
+	uploadSubscribersLock.Lock()
+	if uploadSubscribers[userID] == nil {
+		uploadSubscribers[userID] = make(map[*uploadSubscriber]struct{})
+	}
+	uploadSubscribers[userID][subscriber] = struct{}{}
+	uploadSubscribersLock.Unlock()
+	return subscriber
+}
+
+func (s *uploadSubscriber) unsubscribe() {
+	uploadSubscribersLock.Lock()
+	delete(uploadSubscribers[s.userID], s)
+	if len(uploadSubscribers[s.userID]) == 0 {
+		delete(uploadSubscribers, s.userID)
+	}
+	uploadSubscribersLock.Unlock()
+}
+
+// push queues an event for the stream and wakes it.
+func (s *uploadSubscriber) push(event uploadEvent) {
+	s.mu.Lock()
+	if len(s.events) < uploadEventBacklog {
+		s.events = append(s.events, event)
+	} else {
+		s.events = nil
+		s.lagged = true
+	}
+	s.mu.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the events queued since the last call, and whether some
+// were dropped because the stream fell too far behind.
+func (s *uploadSubscriber) take() ([]uploadEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events, lagged := s.events, s.lagged
+	s.events = nil
+	s.lagged = false
+	return events, lagged
+}
+
+// publishUploadEvent pushes the state of a job, as just stored, to the
+// streams of its user. Every change is pushed; a stream that receives two
+// states of a job out of order drops the older one.
+func publishUploadEvent(job *models.UploadJob) {
+	subscribers := uploadJobSubscribers(job)
+	if len(subscribers) == 0 {
+		return
+	}
+
+	// The queue position is read from the database, so it is computed
+	// without holding uploadSubscribersLock.
+	event := uploadEvent{
+		progress:  uploadJobProgress(job),
+		updatedAt: job.UpdatedAt,
+	}
+	event.progress.QueuePosition = uploadQueuePosition(job)
+	for _, subscriber := range subscribers {
+		subscriber.push(event)
+	}
+}
+
+// uploadJobSubscribers returns the streams waiting for changes to job.
+func uploadJobSubscribers(job *models.UploadJob) []*uploadSubscriber {
+	uploadSubscribersLock.Lock()
+	defer uploadSubscribersLock.Unlock()
+	var subscribers []*uploadSubscriber
+	for subscriber := range uploadSubscribers[job.UserID] {
+		if subscriber.jobID == "" || subscriber.jobID == job.ID {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	return subscribers
+}
+
+// uploadEventStream is the state of one client's stream of the jobs of a
+// user, or of one of them when jobID is set.
+type uploadEventStream struct {
+	userID uint
+	jobID  string
+	// sent holds the event last sent per job, so only changes are sent
+	// and a state older than one already sent is not.
+	sent map[string]uploadEvent
+	// finished is set once the final state of the stream's job was sent.
+	finished bool
+}
+
+// accept records event as sent and returns true unless it is stale or
+// unchanged.
+func (s *uploadEventStream) accept(event uploadEvent) bool {
+	jobID := event.progress.JobID
+	if last, ok := s.sent[jobID]; ok {
+		if event.updatedAt.Before(last.updatedAt) || reflect.DeepEqual(last.progress, event.progress) {
+			return false
+		}
+	}
+	s.sent[jobID] = event
+	if s.jobID != "" && isTerminalUploadStatus(event.progress.Status) {
+		s.finished = true
+	}
+	return true
+}
+
+// poll reads the stream's jobs and returns the progress of those that
+// changed since they were last sent: unfinished jobs, and those that were
+// unfinished when last sent.
+func (s *uploadEventStream) poll() ([]UploadProgress, error) {
+	query := db.Where("user_id = ?", s.userID)
+	if s.jobID != "" {
+		query = query.Where("id = ?", s.jobID)
+	} else {
+		var ids []string
+		for jobID, event := range s.sent {
+			if !isTerminalUploadStatus(event.progress.Status) {
+				ids = append(ids, jobID)
+			}
+		}
+		query = query.Where("status NOT IN ? OR id IN ?", terminalUploadStatuses, ids)
+	}
+
+	var jobs []models.UploadJob
+	if err := query.Order("created_at ASC").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	if s.jobID != "" && len(jobs) == 0 {
+		// The job was pruned.
+		s.finished = true
+		return nil, nil
+	}
+
+	var updates []UploadProgress
+	for i := range jobs {
+		job := &jobs[i]
+		event := uploadEvent{
+			progress:  uploadJobProgress(job),
+			updatedAt: job.UpdatedAt,
+		}
+		event.progress.QueuePosition = uploadQueuePosition(job)
+		if s.accept(event) {
+			updates = append(updates, event.progress)
+		}
+	}
+	return updates, nil
+}
+
+// streamUploadEvents sends the progress of a user's jobs, or of the job
+// jobID, to send on every change, starting with their current state. It
+// returns when ctx is done, sending fails or the job has finished.
+// heartbeat is called every uploadEventPollInterval.
+func streamUploadEvents(ctx context.Context, userID uint, jobID string, send func(UploadProgress) error, heartbeat func() error) error {
+	subscriber := subscribeUploadEvents(userID, jobID)
+	defer subscriber.unsubscribe()
+
+	stream := &uploadEventStream{
+		userID: userID,
+		jobID:  jobID,
+		sent:   make(map[string]uploadEvent),
+	}
+	ticker := time.NewTicker(uploadEventPollInterval)
+	defer ticker.Stop()
+
+	poll := true
+	for {
+		var updates []UploadProgress
+		if poll {
+			var err error
+			updates, err = stream.poll()
+			if err != nil {
+				log.WithField("userID", userID).
+					WithField("jobID", jobID).
+					WithField("error", err.Error()).
+					Warning("Failed to read upload jobs for event stream")
+			}
+		}
+		for _, progress := range updates {
+			if err := send(progress); err != nil {
+				return err
+			}
+		}
+		if stream.finished {
+			return nil
+		}
+
+		poll = false
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+			poll = true
+		case <-subscriber.signal:
+			events, lagged := subscriber.take()
+			if lagged {
+				poll = true
+				continue
+			}
+			for _, event := range events {
+				if !stream.accept(event) {
+					continue
+				}
+				if err := send(event.progress); err != nil {
+					return err
+				}
+				if stream.finished {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// uploadEventsUser returns the user streaming upload events and the job
+// requested, if any, replying with an error if the user may not stream it.
+func uploadEventsUser(c *gin.Context) (uint, string, bool) {
+	userIDValue, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return 0, "", false
+	}
+	userID := userIDValue.(uint)
+
+	jobID := c.Param("jobId")
+	if jobID == "" {
+		return userID, "", true
+	}
+	job, err := loadUploadJob(jobID)
+	if err != nil || job.UserID != userID {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Upload job not found",
+			})
+			return 0, "", false
+		}
+		log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to fetch upload job")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch upload job",
+		})
+		return 0, "", false
+	}
+	return userID, jobID, true
+}
+
+// StreamUploadEvents streams the progress of an upload job as Server-Sent Events
+// @Summary Stream upload progress (SSE)
+// @Description Push every progress change of an upload job as a "progress" event carrying an UploadProgress, starting with its current state. The stream ends once the job has finished.
+// @Tags upload
+// @Produce text/event-stream
+// @Param jobId path string true "Job ID"
+// @Success 200 {object} UploadProgress
+// @Router /api/v1/upload/events/{jobId} [get]
+func StreamUploadEvents(c *gin.Context) {
+	userID, jobID, ok := uploadEventsUser(c)
+	if !ok {
+		return
+	}
+	serveUploadEventSource(c, userID, jobID)
+}
+
+// StreamUserUploadEvents streams the progress of all of the user's upload jobs as Server-Sent Events
+// @Summary Stream progress of all uploads (SSE)
+// @Description Push every progress change of the user's upload jobs as "progress" events carrying an UploadProgress, starting with the current state of every unfinished job. Jobs created later are included.
+// @Tags upload
+// @Produce text/event-stream
+// @Success 200 {object} UploadProgress
+// @Router /api/v1/upload/events [get]
+func StreamUserUploadEvents(c *gin.Context) {
+	userID, _, ok := uploadEventsUser(c)
+	if !ok {
+		return
+	}
+	serveUploadEventSource(c, userID, "")
+}
+
+func serveUploadEventSource(c *gin.Context, userID uint, jobID string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stop reverse proxies from buffering the stream.
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	err := streamUploadEvents(ctx, userID, jobID, func(progress UploadProgress) error {
+		c.SSEvent("progress", progress)
+		c.Writer.Flush()
+		return ctx.Err()
+	}, func() error {
+		if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		log.WithField("userID", userID).WithField("jobID", jobID).WithField("error", err.Error()).Warning("Upload event stream failed")
+	}
+}
+
+var uploadEventUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkWebSocketOrigin,
+}
+
+// checkWebSocketOrigin accepts clients without an Origin, such as CLIs,
+// pages of this server and pages of webSocketOrigins.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range webSocketOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// UploadEventsWebSocket streams the progress of an upload job over a WebSocket
+// @Summary Stream upload progress (WebSocket)
+// @Description Upgrade to a WebSocket that receives every progress change of an upload job as a JSON UploadProgress message, starting with its current state. The server closes the socket once the job has finished.
+// @Tags upload
+// @Param jobId path string true "Job ID"
+// @Success 101 {object} UploadProgress
+// @Router /api/v1/upload/ws/{jobId} [get]
+func UploadEventsWebSocket(c *gin.Context) {
+	userID, jobID, ok := uploadEventsUser(c)
+	if !ok {
+		return
+	}
+	serveUploadEventSocket(c, userID, jobID)
+}
+
+// UserUploadEventsWebSocket streams the progress of all of the user's upload jobs over a WebSocket
+// @Summary Stream progress of all uploads (WebSocket)
+// @Description Upgrade to a WebSocket that receives every progress change of the user's upload jobs as JSON UploadProgress messages, starting with the current state of every unfinished job.
+// @Tags upload
+// @Success 101 {object} UploadProgress
+// @Router /api/v1/upload/ws [get]
+func UserUploadEventsWebSocket(c *gin.Context) {
+	userID, _, ok := uploadEventsUser(c)
+	if !ok {
+		return
+	}
+	serveUploadEventSocket(c, userID, "")
+}
+
+func serveUploadEventSocket(c *gin.Context, userID uint, jobID string) {
+	conn, err := uploadEventUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied.
+		log.WithField("userID", userID).WithField("error", err.Error()).Warning("Failed to upgrade upload event WebSocket")
+		return
+	}
+	defer conn.Close()
+
+	// Clients only receive; reading handles their control messages and
+	// notices when they go away.
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = streamUploadEvents(ctx, userID, jobID, func(progress UploadProgress) error {
+		conn.SetWriteDeadline(time.Now().Add(uploadEventWriteWait))
+		return conn.WriteJSON(progress)
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(uploadEventWriteWait))
+	})
+	if err != nil && ctx.Err() == nil {
+		log.WithField("userID", userID).WithField("jobID", jobID).WithField("error", err.Error()).Warning("Upload event WebSocket failed")
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(uploadEventWriteWait))
+}
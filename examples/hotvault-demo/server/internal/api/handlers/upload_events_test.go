@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishUploadEvent(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xevents")
+	createTestJob(t, user.ID, "first", "queued", 2*time.Hour)
+	job := createTestJob(t, user.ID, "second", "queued", time.Hour)
+
+	all := subscribeUploadEvents(user.ID, "")
+	defer all.unsubscribe()
+	one := subscribeUploadEvents(user.ID, "second")
+	defer one.unsubscribe()
+	other := subscribeUploadEvents(user.ID, "first")
+	defer other.unsubscribe()
+
+	publishUploadEvent(job)
+
+	for name, subscriber := range map[string]*uploadSubscriber{"user stream": all, "job stream": one} {
+		events, lagged := subscriber.take()
+		if len(events) != 1 || lagged {
+			t.Fatalf("%s got %d events, lagged %v", name, len(events), lagged)
+		}
+		if progress := events[0].progress; progress.JobID != "second" || progress.QueuePosition != 2 {
+			t.Errorf("%s got job %s at queue position %d", name, progress.JobID, progress.QueuePosition)
+		}
+	}
+	if events, _ := other.take(); len(events) != 0 {
+		t.Errorf("stream of another job got %d events", len(events))
+	}
+}
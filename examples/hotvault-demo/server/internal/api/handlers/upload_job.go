@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// uploadJobLease is how long a claimed job stays with its worker
+	// without a heartbeat. Jobs of a crashed server are picked up again
+	// once their lease runs out.
+	uploadJobLease        = 2 * time.Minute
+	uploadJobHeartbeat    = 30 * time.Second
+	uploadJobPollInterval = 5 * time.Second
+	// uploadJobRetention is how long finished jobs stay queryable.
+	uploadJobRetention = 7 * 24 * time.Hour
+)
+
+var terminalUploadStatuses = []string{"complete", "error", "cancelled"}
+
+var (
+	uploadJobSignal    = make(chan struct{}, 1)
+	uploadWorkersOnce  sync.Once
+	uploadProgressLock sync.Mutex
+
+	// runningUploads holds the cancel functions of the jobs this server is
+	// processing.
+	runningUploads     = make(map[string]context.CancelFunc)
+	runningUploadsLock sync.Mutex
+)
+
+func isTerminalUploadStatus(status string) bool {
+	for _, terminal := range terminalUploadStatuses {
+		if status == terminal {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadPayloadDir is the directory holding the payload of a direct upload.
+func uploadPayloadDir(jobID string) string {
+	return filepath.Join(cfg.Uploads.Dir, jobID)
+}
+
+// enqueueUploadJob stores a new job and wakes an idle worker. The job's
+// size, the staged payload or the session it is queued for, is reserved
+// against the user's quota as the job is stored; errQuotaExceeded is
+// returned with the usage if it does not fit. handoff releases the
+// reservation of that session, see reserveQuota.
+func enqueueUploadJob(job *models.UploadJob, handoff func(tx *gorm.DB) error) (*StorageUsage, error) {
+	usage, err := reserveQuota(job.UserID, job.TotalSize, handoff, func(tx *gorm.DB) error {
+		return tx.Create(job).Error
+	})
+	if err != nil {
+		return usage, err
+	}
+	publishUploadEvent(job)
+	select {
+	case uploadJobSignal <- struct{}{}:
+	default:
+	}
+	return usage, nil
+}
+
+// startUploadWorkers starts the workers processing the upload queue.
+func startUploadWorkers() {
+	uploadWorkersOnce.Do(func() {
+		initStageLimiters()
+
+		host, _ := os.Hostname()
+		for i := 0; i < cfg.Uploads.Workers; i++ {
+			go runUploadWorker(fmt.Sprintf("%s-%d-%d", host, os.Getpid(), i))
+		}
+		go pruneUploadJobs()
+		go runAggregator(fmt.Sprintf("%s-%d-aggregator", host, os.Getpid()))
+
+		log.WithField("workers", cfg.Uploads.Workers).
+			WithField("prepareConcurrency", cfg.Uploads.PrepareConcurrency).
+			WithField("transferConcurrency", cfg.Uploads.TransferConcurrency).
+			WithField("addRootsConcurrency", cfg.Uploads.AddRootsConcurrency).
+			WithField("uploadDir", cfg.Uploads.Dir).
+			Info("Started upload workers")
+	})
+}
+
+func runUploadWorker(workerID string) {
+	for {
+		job, err := claimUploadJob(workerID)
+		if err != nil {
+			log.WithField("worker", workerID).WithField("error", err.Error()).Error("Failed to claim upload job")
+			time.Sleep(uploadJobPollInterval)
+			continue
+		}
+		if job == nil {
+			select {
+			case <-uploadJobSignal:
+			case <-time.After(uploadJobPollInterval):
+			}
+			continue
+		}
+		runUploadJob(workerID, job)
+	}
+}
+
+// claimUploadJob leases the oldest unfinished job that no worker holds.
+// Rows locked by a concurrent claim are skipped rather than waited for.
+func claimUploadJob(workerID string) (*models.UploadJob, error) {
+	var job models.UploadJob
+	now := time.Now()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status NOT IN ?", terminalUploadStatuses).
+			Where("status <> ?", uploadStatusAggregating).
+			Where("lease_expires_at IS NULL OR lease_expires_at < ?", now).
+			Order("created_at ASC").
+			First(&job).Error
+		if err != nil {
+			return err
+		}
+
+		leaseExpiresAt := now.Add(uploadJobLease)
+		job.Attempts++
+		job.ClaimedBy = workerID
+		job.LeaseExpiresAt = &leaseExpiresAt
+		return tx.Model(&job).Updates(map[string]interface{}{
+			"attempts":         job.Attempts,
+			"claimed_by":       workerID,
+			"lease_expires_at": leaseExpiresAt,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func runUploadJob(workerID string, job *models.UploadJob) {
+	if job.Attempts > cfg.Uploads.MaxAttempts {
+		log.WithField("jobID", job.ID).
+			WithField("attempts", job.Attempts).
+			Error("Upload job exceeded its attempts, giving up")
+		saveUploadProgress(job.ID, UploadProgress{
+			Status:  "error",
+			Error:   "Upload abandoned",
+			Message: fmt.Sprintf("The upload was interrupted %d times", job.Attempts-1),
+		})
+		finishUploadJob(job.ID)
+		return
+	}
+
+	if job.Attempts > 1 {
+		log.WithField("jobID", job.ID).
+			WithField("stage", job.Stage).
+			WithField("attempt", job.Attempts).
+			Info("Resuming upload job")
+	}
+
+	ctx, end := beginUploadJob(workerID, job)
+	processUpload(ctx, job)
+	end()
+}
+
+// beginUploadJob registers a claimed job as running on this server and
+// keeps its lease. The returned function ends the run: a job stopped by
+// cancellation is marked cancelled, then the job is released.
+func beginUploadJob(workerID string, job *models.UploadJob) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runningUploadsLock.Lock()
+	runningUploads[job.ID] = cancel
+	runningUploadsLock.Unlock()
+
+	if job.CancelRequested {
+		cancel()
+	}
+
+	stop := make(chan struct{})
+	go keepUploadJobLease(job.ID, workerID, cancel, stop)
+
+	return ctx, func() {
+		close(stop)
+
+		runningUploadsLock.Lock()
+		delete(runningUploads, job.ID)
+		runningUploadsLock.Unlock()
+
+		if ctx.Err() != nil {
+			if current, err := loadUploadJob(job.ID); err == nil && !isTerminalUploadStatus(current.Status) {
+				log.WithField("jobID", job.ID).Info("Upload job cancelled")
+				saveUploadProgress(job.ID, UploadProgress{
+					Status:  "cancelled",
+					Message: "Upload cancelled",
+				})
+			}
+		}
+		cancel()
+
+		finishUploadJob(job.ID)
+	}
+}
+
+// keepUploadJobLease extends the lease of a running job until stop is
+// closed, and cancels the job when a cancellation was requested through
+// another server.
+func keepUploadJobLease(jobID, workerID string, cancel context.CancelFunc, stop <-chan struct{}) {
+	ticker := time.NewTicker(uploadJobHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := db.Model(&models.UploadJob{}).
+				Where("id = ? AND claimed_by = ?", jobID, workerID).
+				Update("lease_expires_at", time.Now().Add(uploadJobLease)).Error
+			if err != nil {
+				log.WithField("jobID", jobID).WithField("error", err.Error()).Warning("Failed to extend upload job lease")
+				continue
+			}
+			var job models.UploadJob
+			if err := db.Select("id", "cancel_requested").Where("id = ?", jobID).First(&job).Error; err == nil && job.CancelRequested {
+				cancel()
+			}
+		}
+	}
+}
+
+// cancelUploadJob requests cancellation of a job. A job waiting in the
+// queue is cancelled at once; a running one is stopped by its worker. It
+// returns the job as stored afterwards.
+func cancelUploadJob(job *models.UploadJob) (*models.UploadJob, error) {
+	if err := db.Model(job).Update("cancel_requested", true).Error; err != nil {
+		return nil, err
+	}
+
+	runningUploadsLock.Lock()
+	cancel, running := runningUploads[job.ID]
+	runningUploadsLock.Unlock()
+	if running {
+		cancel()
+	}
+
+	now := time.Now()
+	cancelled := &models.UploadJob{ID: job.ID}
+	result := db.Model(cancelled).Clauses(clause.Returning{}).
+		Where("status NOT IN ?", terminalUploadStatuses).
+		Where("lease_expires_at IS NULL OR lease_expires_at < ?", now).
+		Updates(map[string]interface{}{
+			"status":       "cancelled",
+			"message":      "Upload cancelled",
+			"completed_at": now,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		cleanupUploadPayload(cancelled)
+		publishUploadEvent(cancelled)
+		return cancelled, nil
+	}
+
+	return loadUploadJob(job.ID)
+}
+
+// finishUploadJob releases a job after its worker is done with it. Finished
+// jobs have their payload removed; unfinished ones become claimable again.
+func finishUploadJob(jobID string) {
+	job, err := loadUploadJob(jobID)
+	if err != nil {
+		log.WithField("jobID", jobID).WithField("error", err.Error()).Error("Failed to load upload job")
+		return
+	}
+
+	updates := map[string]interface{}{
+		"claimed_by":       "",
+		"lease_expires_at": nil,
+	}
+	if isTerminalUploadStatus(job.Status) {
+		cleanupUploadPayload(job)
+		updates["completed_at"] = time.Now()
+	} else if job.Status == uploadStatusAggregating {
+		log.WithField("jobID", jobID).Info("Upload job waiting to be aggregated")
+	} else {
+		log.WithField("jobID", jobID).
+			WithField("status", job.Status).
+			Warning("Upload job stopped before finishing, releasing it for retry")
+	}
+
+	if err := db.Model(job).Updates(updates).Error; err != nil {
+		log.WithField("jobID", jobID).WithField("error", err.Error()).Error("Failed to release upload job")
+	}
+}
+
+func cleanupUploadPayload(job *models.UploadJob) {
+	if job.ChunkDir != "" {
+		os.RemoveAll(job.ChunkDir)
+		if job.ChunkedUploadID != "" {
+			if err := db.Delete(&models.ChunkedUpload{}, "id = ?", job.ChunkedUploadID).Error; err != nil {
+				log.WithField("uploadId", job.ChunkedUploadID).WithField("error", err.Error()).Warning("Failed to delete chunked upload session")
+			}
+		}
+	} else {
+		os.RemoveAll(uploadPayloadDir(job.ID))
+	}
+	log.WithField("jobID", job.ID).Info("Cleaned up upload payload")
+}
+
+// pruneUploadJobs deletes finished jobs after uploadJobRetention.
+func pruneUploadJobs() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		result := db.Where("completed_at < ?", time.Now().Add(-uploadJobRetention)).Delete(&models.UploadJob{})
+		if result.Error != nil {
+			log.WithField("error", result.Error.Error()).Error("Failed to prune upload jobs")
+		} else if result.RowsAffected > 0 {
+			log.WithField("jobs", result.RowsAffected).Info("Pruned finished upload jobs")
+		}
+	}
+}
+
+func loadUploadJob(jobID string) (*models.UploadJob, error) {
+	var job models.UploadJob
+	if err := db.Where("id = ?", jobID).First(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// uploadJobProgress is the status of a job as reported to clients.
+func uploadJobProgress(job *models.UploadJob) UploadProgress {
+	return UploadProgress{
+		Status:         job.Status,
+		Progress:       job.Progress,
+		Message:        job.Message,
+		CID:            job.CID,
+		Error:          job.Error,
+		Filename:       job.Filename,
+		TotalSize:      job.TotalSize,
+		JobID:          job.ID,
+		ProofSetID:     job.ProofSetID,
+		BytesProcessed: job.BytesProcessed,
+		Replicas:       job.Replicas,
+	}
+}
+
+// saveUploadProgress replaces the progress of a job. The job's replicas are
+// kept when progress carries none.
+func saveUploadProgress(jobID string, progress UploadProgress) {
+	fields := []string{"Status", "Progress", "Message", "Error", "CID", "ProofSetID", "BytesProcessed"}
+	if progress.Replicas != nil {
+		fields = append(fields, "Replicas")
+	}
+
+	// Webhooks are sent when a job enters its final state, not when a
+	// finished job's progress is saved again.
+	var event string
+	switch progress.Status {
+	case "complete":
+		event = WebhookEventUploadComplete
+	case "error":
+		event = WebhookEventUploadError
+	}
+	if event != "" {
+		result := db.Model(&models.UploadJob{}).
+			Where("id = ? AND status <> ?", jobID, progress.Status).
+			Update("status", progress.Status)
+		if result.Error != nil || result.RowsAffected == 0 {
+			event = ""
+		}
+	}
+
+	// The stored job is returned so its streams get this exact state.
+	job := &models.UploadJob{ID: jobID}
+	err := db.Model(job).Clauses(clause.Returning{}).Select(fields).Updates(&models.UploadJob{
+		Status:         progress.Status,
+		Progress:       progress.Progress,
+		Message:        progress.Message,
+		Error:          progress.Error,
+		CID:            progress.CID,
+		ProofSetID:     progress.ProofSetID,
+		BytesProcessed: progress.BytesProcessed,
+		Replicas:       progress.Replicas,
+	}).Error
+	if err != nil {
+		log.WithField("jobID", jobID).WithField("error", err.Error()).Error("Failed to save upload progress")
+		return
+	}
+	publishUploadEvent(job)
+	if event != "" {
+		emitUploadWebhook(jobID, event)
+	}
+}
+
+// updateUploadProgress applies update to the stored progress of a job.
+// Replica uploads of a job run concurrently, so updates are serialised.
+func updateUploadProgress(jobID string, update func(*UploadProgress)) {
+	uploadProgressLock.Lock()
+	defer uploadProgressLock.Unlock()
+
+	job, err := loadUploadJob(jobID)
+	if err != nil {
+		log.WithField("jobID", jobID).WithField("error", err.Error()).Error("Failed to load upload progress")
+		return
+	}
+	progress := uploadJobProgress(job)
+	update(&progress)
+	saveUploadProgress(jobID, progress)
+}
+
+// setUploadJobStage records that a job has completed stage.
+func setUploadJobStage(job *models.UploadJob, stage string, updates map[string]interface{}) error {
+	if updates == nil {
+		updates = map[string]interface{}{}
+	}
+	updates["stage"] = stage
+	if err := db.Model(job).Updates(updates).Error; err != nil {
+		return err
+	}
+	job.Stage = stage
+	return nil
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hotvault/backend/internal/models"
+)
+
+// createTestJob stores a job created age ago.
+func createTestJob(t *testing.T, userID uint, id, status string, age time.Duration) *models.UploadJob {
+	t.Helper()
+	job := &models.UploadJob{
+		ID:        id,
+		UserID:    userID,
+		Filename:  id + ".bin",
+		TotalSize: 1,
+		Status:    status,
+		CreatedAt: time.Now().Add(-age),
+	}
+	if err := db.Create(job).Error; err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func mustClaim(t *testing.T, workerID string) *models.UploadJob {
+	t.Helper()
+	job, err := claimUploadJob(workerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestClaimUploadJobOrder(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xclaim")
+
+	createTestJob(t, user.ID, "complete", "complete", 5*time.Hour)
+	createTestJob(t, user.ID, "aggregating", uploadStatusAggregating, 4*time.Hour)
+	leased := createTestJob(t, user.ID, "leased", "processing", 3*time.Hour)
+	lease := time.Now().Add(time.Minute)
+	db.Model(leased).Updates(map[string]interface{}{"claimed_by": "other", "lease_expires_at": lease})
+	createTestJob(t, user.ID, "newer", "queued", time.Hour)
+	createTestJob(t, user.ID, "oldest", "queued", 2*time.Hour)
+
+	job := mustClaim(t, "worker-1")
+	if job == nil || job.ID != "oldest" {
+		t.Fatalf("claimed %+v, want the oldest waiting job", job)
+	}
+	if job.Attempts != 1 || job.ClaimedBy != "worker-1" || job.LeaseExpiresAt == nil {
+		t.Errorf("claimed job has attempts %d, worker %q, lease %v", job.Attempts, job.ClaimedBy, job.LeaseExpiresAt)
+	}
+	if until := time.Until(*job.LeaseExpiresAt); until < uploadJobLease-time.Minute || until > uploadJobLease {
+		t.Errorf("lease runs out in %v, want %v", until, uploadJobLease)
+	}
+	stored, _ := loadUploadJob("oldest")
+	if stored.Attempts != 1 || stored.ClaimedBy != "worker-1" || stored.LeaseExpiresAt == nil {
+		t.Errorf("claim was not stored: %+v", stored)
+	}
+
+	if job := mustClaim(t, "worker-2"); job == nil || job.ID != "newer" {
+		t.Fatalf("second claim got %+v, want the newer job", job)
+	}
+	if job := mustClaim(t, "worker-3"); job != nil {
+		t.Errorf("claimed %s; finished, aggregating and leased jobs must be skipped", job.ID)
+	}
+}
+
+func TestClaimUploadJobTakesOverExpiredLease(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xexpired")
+
+	job := createTestJob(t, user.ID, "crashed", "processing", time.Hour)
+	expired := time.Now().Add(-time.Second)
+	db.Model(job).Updates(map[string]interface{}{"attempts": 1, "claimed_by": "dead", "lease_expires_at": expired})
+
+	claimed := mustClaim(t, "worker-1")
+	if claimed == nil || claimed.ID != "crashed" {
+		t.Fatalf("claimed %+v, want the job with the expired lease", claimed)
+	}
+	if claimed.Attempts != 2 || claimed.ClaimedBy != "worker-1" {
+		t.Errorf("attempts %d, worker %q; want 2 and worker-1", claimed.Attempts, claimed.ClaimedBy)
+	}
+}
+
+func TestClaimUploadJobConcurrently(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xconcurrent")
+
+	const jobs = 20
+	for i := 0; i < jobs; i++ {
+		createTestJob(t, user.ID, "job-"+strconv.Itoa(i), "queued", time.Duration(jobs-i)*time.Minute)
+	}
+
+	var mu sync.Mutex
+	claims := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			for {
+				job, err := claimUploadJob(workerID)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				claims[job.ID]++
+				mu.Unlock()
+			}
+		}("worker-" + strconv.Itoa(w))
+	}
+	wg.Wait()
+
+	if len(claims) != jobs {
+		t.Errorf("%d jobs claimed, want %d", len(claims), jobs)
+	}
+	for id, n := range claims {
+		if n != 1 {
+			t.Errorf("job %s claimed %d times", id, n)
+		}
+	}
+}
+
+func TestFinishUploadJob(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xfinish")
+
+	createTestJob(t, user.ID, "interrupted", "processing", 2*time.Hour)
+	mustClaim(t, "worker-1")
+	finishUploadJob("interrupted")
+
+	job, _ := loadUploadJob("interrupted")
+	if job.ClaimedBy != "" || job.LeaseExpiresAt != nil || job.CompletedAt != nil {
+		t.Errorf("unfinished job was not released: %+v", job)
+	}
+	if claimed := mustClaim(t, "worker-2"); claimed == nil || claimed.ID != "interrupted" || claimed.Attempts != 2 {
+		t.Fatalf("released job was not claimable again: %+v", claimed)
+	}
+
+	payload := uploadPayloadDir("interrupted")
+	if err := os.MkdirAll(payload, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(payload, "interrupted.bin"), []byte("x"), 0644)
+	saveUploadProgress("interrupted", UploadProgress{Status: "complete", Progress: 100})
+	finishUploadJob("interrupted")
+
+	job, _ = loadUploadJob("interrupted")
+	if job.ClaimedBy != "" || job.LeaseExpiresAt != nil || job.CompletedAt == nil {
+		t.Errorf("finished job: %+v", job)
+	}
+	if _, err := os.Stat(payload); !os.IsNotExist(err) {
+		t.Errorf("payload of a finished job was kept: %v", err)
+	}
+}
+
+func TestRunUploadJobGivesUpAfterMaxAttempts(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xattempts")
+
+	job := createTestJob(t, user.ID, "flaky", "processing", time.Hour)
+	db.Model(job).Update("attempts", cfg.Uploads.MaxAttempts)
+
+	claimed := mustClaim(t, "worker-1")
+	runUploadJob("worker-1", claimed)
+
+	stored, _ := loadUploadJob("flaky")
+	if stored.Status != "error" || stored.CompletedAt == nil || stored.ClaimedBy != "" {
+		t.Errorf("job over its attempts: status %q, completed %v, claimed by %q", stored.Status, stored.CompletedAt, stored.ClaimedBy)
+	}
+	if job := mustClaim(t, "worker-2"); job != nil {
+		t.Errorf("abandoned job %s was claimed again", job.ID)
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// uploadQueueRetryAfter is the Retry-After sent when the upload queue
+	// is full.
+	uploadQueueRetryAfter = 30 * time.Second
+
+	// maxUploadSize is the largest file accepted by the upload endpoints.
+	maxUploadSize = 10 * 1024 * 1024 * 1024
+)
+
+// stageLimiter bounds how many uploads run a processing stage at once.
+type stageLimiter struct {
+	name  string
+	slots chan struct{}
+}
+
+func newStageLimiter(name string, limit int) *stageLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &stageLimiter{name: name, slots: make(chan struct{}, limit)}
+}
+
+// acquire blocks until a slot is free or ctx is done. onWait is called once
+// if the caller has to wait.
+func (l *stageLimiter) acquire(ctx context.Context, onWait func()) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	log.WithField("stage", l.name).Debug("Waiting for a free upload stage slot")
+	if onWait != nil {
+		onWait()
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *stageLimiter) release() {
+	<-l.slots
+}
+
+var (
+	prepareLimiter  *stageLimiter
+	transferLimiter *stageLimiter
+	addRootsLimiter *stageLimiter
+)
+
+func initStageLimiters() {
+	prepareLimiter = newStageLimiter("prepare", cfg.Uploads.PrepareConcurrency)
+	transferLimiter = newStageLimiter("upload", cfg.Uploads.TransferConcurrency)
+	addRootsLimiter = newStageLimiter("add-roots", cfg.Uploads.AddRootsConcurrency)
+}
+
+// waitingUploadJobs selects unfinished jobs no worker holds. Jobs waiting
+// to be aggregated are not waiting for a worker.
+func waitingUploadJobs() *gorm.DB {
+	return db.Model(&models.UploadJob{}).
+		Where("status NOT IN ?", terminalUploadStatuses).
+		Where("status <> ?", uploadStatusAggregating).
+		Where("lease_expires_at IS NULL OR lease_expires_at < ?", time.Now())
+}
+
+// uploadQueuePosition returns the 1-based position of a job among the jobs
+// waiting for a worker, or 0 if the job is not waiting.
+func uploadQueuePosition(job *models.UploadJob) int {
+	if isTerminalUploadStatus(job.Status) || job.Status == uploadStatusAggregating {
+		return 0
+	}
+	if job.LeaseExpiresAt != nil && job.LeaseExpiresAt.After(time.Now()) {
+		return 0
+	}
+	var ahead int64
+	if err := waitingUploadJobs().Where("created_at < ?", job.CreatedAt).Count(&ahead).Error; err != nil {
+		log.WithField("jobID", job.ID).WithField("error", err.Error()).Warning("Failed to compute upload queue position")
+		return 0
+	}
+	return int(ahead) + 1
+}
+
+// rejectIfUploadQueueFull answers 429 with a Retry-After header when
+// UPLOAD_QUEUE_LIMIT jobs are already waiting. It returns true if the
+// request was rejected.
+func rejectIfUploadQueueFull(c *gin.Context) bool {
+	var waiting int64
+	if err := waitingUploadJobs().Count(&waiting).Error; err != nil {
+		log.WithField("error", err.Error()).Error("Failed to check upload queue length")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to check upload queue",
+		})
+		return true
+	}
+	if int(waiting) < cfg.Uploads.QueueLimit {
+		return false
+	}
+
+	log.WithField("waiting", waiting).
+		WithField("queueLimit", cfg.Uploads.QueueLimit).
+		Warning("Upload queue is full, rejecting upload")
+	c.Header("Retry-After", strconv.Itoa(int(uploadQueueRetryAfter.Seconds())))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":   "Upload queue is full",
+		"message": fmt.Sprintf("%d uploads are waiting to be processed, please retry later", waiting),
+	})
+	return true
+}
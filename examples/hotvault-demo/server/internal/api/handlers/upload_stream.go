@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp/commp"
+)
+
+// contentChecksumHeader carries the optional SHA-256 of a whole upload.
+const contentChecksumHeader = "X-Content-SHA256"
+
+// spooledUpload is an upload body received in a single pass: written to its
+// staging file while its SHA-256 and piece commitment are computed.
+type spooledUpload struct {
+	Path   string
+	Size   int64
+	SHA256 string
+	// Piece is nil for an empty body, which has no piece commitment.
+	Piece *commp.Result
+}
+
+// spoolUploadPayload streams body into the payload directory of a job,
+// hashing it on the way. Anything written to tee also sees the body. The
+// piece commitment is computed here rather than by the upload worker, so
+// the payload is read exactly once.
+func spoolUploadPayload(jobID, filename string, body io.Reader, tee io.Writer) (*spooledUpload, error) {
+	payloadDir := uploadPayloadDir(jobID)
+	if err := os.MkdirAll(payloadDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	payloadPath := filepath.Join(payloadDir, filepath.Base(filename))
+
+	dst, err := os.Create(payloadPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+
+	hasher := sha256.New()
+	calc := commp.New()
+	writers := []io.Writer{dst, hasher, calc}
+	if tee != nil {
+		writers = append(writers, tee)
+	}
+	written, err := io.Copy(io.MultiWriter(writers...), body)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	spooled := &spooledUpload{
+		Path:   payloadPath,
+		Size:   written,
+		SHA256: hex.EncodeToString(hasher.Sum(nil)),
+	}
+	if written > 0 {
+		if spooled.Piece, err = calc.Digest(); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithField("path", payloadPath).
+		WithField("size", formatFileSize(written)).
+		WithField("pieceCID", pieceCIDOf(spooled.Piece)).
+		Info("Upload streamed to staging file")
+	return spooled, nil
+}
+
+func pieceCIDOf(piece *commp.Result) string {
+	if piece == nil {
+		return ""
+	}
+	return piece.CID
+}
+
+// uploadBodyError answers a request whose upload body could not be
+// received.
+func uploadBodyError(c *gin.Context, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "File too large",
+			"message": fmt.Sprintf("Maximum file size is %s", formatFileSize(maxUploadSize)),
+		})
+		return
+	}
+	var pathError *os.PathError
+	if errors.As(err, &pathError) {
+		log.WithField("error", err.Error()).Error("Failed to save uploaded file")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to save uploaded file",
+			"message": err.Error(),
+		})
+		return
+	}
+	log.WithField("error", err.Error()).Error("Failed to receive upload")
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":   "Failed to receive file",
+		"message": err.Error(),
+	})
+}
+
+// enqueueSpooledUpload queues a streamed upload for replication. Its piece
+// is already prepared, so the worker starts at the replication stage. It
+// writes the response and removes the staging file on failure.
+func enqueueSpooledUpload(c *gin.Context, userID uint, provider *models.StorageProvider, jobID, filename string, spooled *spooledUpload) {
+	if spooled.Piece == nil {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "File is empty",
+		})
+		return
+	}
+
+	if expected, ok := parseSHA256(c.GetHeader(contentChecksumHeader)); !ok {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": contentChecksumHeader + " must be a hex-encoded SHA-256 digest",
+		})
+		return
+	} else if expected != "" && expected != spooled.SHA256 {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		log.WithField("filename", filename).
+			WithField("expected", expected).
+			WithField("actual", spooled.SHA256).
+			Warning("Rejected upload with checksum mismatch")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":     "File failed checksum verification",
+			"expected":  expected,
+			"actual":    spooled.SHA256,
+			"retryable": true,
+		})
+		return
+	}
+
+	job := &models.UploadJob{
+		ID:          jobID,
+		UserID:      userID,
+		ProviderID:  &provider.ID,
+		Filename:    filename,
+		TotalSize:   spooled.Size,
+		PayloadPath: spooled.Path,
+		SHA256:      spooled.SHA256,
+		PieceCID:    spooled.Piece.CID,
+		Stage:       models.UploadStagePrepared,
+		Status:      "queued",
+		Message:     "Waiting for an upload worker",
+	}
+	// The quota is reserved for the staged file, whatever size the request
+	// declared.
+	usage, err := enqueueUploadJob(job, nil)
+	if errors.Is(err, errQuotaExceeded) {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		respondQuotaExceeded(c, userID, spooled.Size, usage)
+		return
+	}
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("jobID", jobID).Error("Failed to queue upload job")
+		os.RemoveAll(uploadPayloadDir(jobID))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to queue upload",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Upload started",
+		"jobId":    jobID,
+		"status":   "processing",
+		"pieceCid": spooled.Piece.CID,
+		"sha256":   spooled.SHA256,
+	})
+}
+
+// @Summary Stream a file to PDP service
+// @Description Upload a file sent as the raw request body. The body is read once: it is written to a staging file while its piece commitment is computed, so the returned job starts at replication.
+// @Tags upload
+// @Accept octet-stream
+// @Param filename query string true "File name"
+// @Param provider query string false "Storage provider name or ID"
+// @Param X-Content-SHA256 header string false "Hex-encoded SHA-256 of the file"
+// @Produce json
+// @Success 200 {object} UploadProgress
+// @Failure 422 {object} map[string]interface{} "The file does not match X-Content-SHA256"
+// @Failure 429 {object} map[string]string "Upload queue is full; retry after the Retry-After delay"
+// @Router /api/v1/upload/stream [put]
+func StreamUpload(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	filename := filepath.Base(c.Query("filename"))
+	if c.Query("filename") == "" || filename == "." || filename == "/" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "filename query parameter is required",
+		})
+		return
+	}
+	if c.Request.ContentLength > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":   "File too large",
+			"message": fmt.Sprintf("Maximum file size is %s", formatFileSize(maxUploadSize)),
+		})
+		return
+	}
+	if rejectIfUploadQueueFull(c) {
+		return
+	}
+	if c.Request.ContentLength > 0 && rejectIfOverQuota(c, userID.(uint), c.Request.ContentLength) {
+		return
+	}
+
+	provider, err := selectStorageProvider(userID.(uint), c.Query("provider"))
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("userID", userID).Error("Failed to select storage provider")
+		c.JSON(providerErrorStatus(err), gin.H{
+			"error":   "Failed to select storage provider",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	jobID := uuid.New().String()
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize)
+	spooled, err := spoolUploadPayload(jobID, filename, body, nil)
+	if err != nil {
+		os.RemoveAll(uploadPayloadDir(jobID))
+		uploadBodyError(c, err)
+		return
+	}
+
+	enqueueSpooledUpload(c, userID.(uint), provider, jobID, filename, spooled)
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hotvault/backend/internal/models"
+	"github.com/hotvault/backend/internal/pdp"
+)
+
+// uploadRequest builds an upload form carrying data as the file.
+func uploadRequest(data []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "notes.txt")
+	part.Write(data)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/api/v1/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestUploadFileQuota(t *testing.T) {
+	useTestDB(t)
+	user := createTestUser(t, "0xupload")
+	db.Model(user).Update("quota_bytes", 10)
+
+	// A form whose Content-Length leaves more than the quota once its
+	// overhead is allowed for is refused before it is read.
+	big := uploadRequest(bytes.Repeat([]byte("x"), uploadFormOverhead+20))
+	if w := serveAs(user.ID, UploadFile, big); w.Code != http.StatusForbidden {
+		t.Errorf("form over the quota: %d %s", w.Code, w.Body)
+	}
+
+	// A form within the overhead allowance is checked exactly once received.
+	if w := serveAs(user.ID, UploadFile, uploadRequest([]byte("0123456789a"))); w.Code != http.StatusForbidden {
+		t.Errorf("file over the quota: %d %s", w.Code, w.Body)
+	}
+	w := serveAs(user.ID, UploadFile, uploadRequest([]byte("0123456789")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload within the quota: %d %s", w.Code, w.Body)
+	}
+	job, err := loadUploadJob(decode(t, w)["jobId"].(string))
+	if err != nil || job.TotalSize != 10 {
+		t.Fatalf("queued job: %+v, %v", job, err)
+	}
+
+	// With nothing left, even a form of unknown length is refused.
+	r := uploadRequest([]byte("x"))
+	r.ContentLength = -1
+	if w := serveAs(user.ID, UploadFile, r); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "quota") {
+		t.Errorf("upload with no quota left: %d %s", w.Code, w.Body)
+	}
+}
+
+// An upload runs through preparation, transfer and add-roots against the
+// fake PDP client.
+func TestUploadJobWithFakePDP(t *testing.T) {
+	useTestDB(t)
+	fake := useFakePDP(t)
+	initStageLimiters()
+	user := createTestUser(t, "0x00000000000000000000000000000000000000bb")
+	if err := createProofSetForUser(user, userProvider(t, user)); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(strings.Repeat("hotvault ", 100))
+	w := serveAs(user.ID, UploadFile, uploadRequest(data))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	jobID := decode(t, w)["jobId"].(string)
+
+	job := mustClaim(t, "worker-1")
+	if job == nil || job.ID != jobID {
+		t.Fatalf("claimed %+v, want job %s", job, jobID)
+	}
+	runUploadJob("worker-1", job)
+
+	job, err := loadUploadJob(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != "complete" || job.ProofSetID != "1" || job.CompletedAt == nil {
+		t.Fatalf("job after its run: status %q, error %q, proof set %q", job.Status, job.Error, job.ProofSetID)
+	}
+
+	var piece models.Piece
+	if err := db.Where("user_id = ?", user.ID).First(&piece).Error; err != nil {
+		t.Fatal(err)
+	}
+	if piece.Filename != "notes.txt" || piece.Size != int64(len(data)) || piece.RootID == nil {
+		t.Errorf("stored piece: %+v", piece)
+	}
+	proofSet, err := fake.GetProofSet(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofSet.Roots) != 1 || proofSet.Roots[0].ID != *piece.RootID || proofSet.Roots[0].CID != pdp.ParseRoot(piece.CID).CID {
+		t.Errorf("proof set roots %+v for piece %s", proofSet.Roots, piece.CID)
+	}
+
+	downloaded := filepath.Join(t.TempDir(), "notes.txt")
+	if err := fake.DownloadFile(context.Background(), piece.CID, downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := os.ReadFile(downloaded); !bytes.Equal(stored, data) {
+		t.Errorf("service stored %q", stored)
+	}
+}
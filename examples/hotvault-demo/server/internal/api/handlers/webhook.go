@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultWebhookDeliveryLimit = 50
+	maxWebhookDeliveryLimit     = 200
+)
+
+type CreateWebhookRequest struct {
+	URL string `json:"url" binding:"required"`
+	// Events lists the event types to receive; empty receives all of them.
+	Events      []string `json:"events"`
+	Description string   `json:"description"`
+}
+
+// CreateWebhookResponse is the only response carrying the signing secret.
+type CreateWebhookResponse struct {
+	models.Webhook
+	Secret string `json:"secret"`
+}
+
+type UpdateWebhookRequest struct {
+	URL         *string   `json:"url"`
+	Events      *[]string `json:"events"`
+	Description *string   `json:"description"`
+	Enabled     *bool     `json:"enabled"`
+}
+
+// validateWebhookURL checks that a webhook URL is an absolute http(s) URL
+// that does not name a non-public address. Hostnames are checked again
+// when connecting, once resolved.
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("URL must use http or https")
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL must have a host")
+	}
+	if u.User != nil {
+		return errors.New("URL must not contain credentials")
+	}
+	if cfg.Webhooks.AllowPrivate {
+		return nil
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return errors.New("URL must not target a private address")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !publicIP(addr) {
+		return errors.New("URL must not target a private address")
+	}
+	return nil
+}
+
+func validateWebhookEvents(events []string) error {
+	for _, event := range events {
+		known := false
+		for _, webhookEvent := range webhookEvents {
+			if event == webhookEvent {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q, expected one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+// userWebhook returns the webhook in the :id parameter if it belongs to the
+// authenticated user, replying with an error otherwise.
+func userWebhook(c *gin.Context) (*models.Webhook, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return nil, false
+	}
+
+	var webhook models.Webhook
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&webhook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Webhook not found",
+			})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch webhook",
+		})
+		return nil, false
+	}
+	return &webhook, true
+}
+
+// CreateWebhook registers a webhook for the authenticated user
+// @Summary Create webhook
+// @Description Register an endpoint that is sent upload.complete, upload.error, proofset.ready and root.removed events as signed JSON POST requests. Each request carries an X-HotVault-Signature header "t=<unix time>,v1=<signature>", the signature being the hex HMAC-SHA256 of "<t>.<body>" keyed with the webhook's secret. The secret is only returned in this response.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param request body CreateWebhookRequest true "Webhook"
+// @Success 201 {object} CreateWebhookResponse
+// @Router /api/v1/webhooks [post]
+func CreateWebhook(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	var request CreateWebhookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if err := validateWebhookURL(request.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := validateWebhookEvents(request.Events); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.WithField("error", err.Error()).Error("Failed to generate webhook secret")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create webhook",
+		})
+		return
+	}
+
+	webhook := &models.Webhook{
+		UserID:      userID.(uint),
+		URL:         request.URL,
+		Secret:      "whsec_" + hex.EncodeToString(secret),
+		Events:      request.Events,
+		Description: request.Description,
+		Enabled:     true,
+	}
+	if err := db.Create(webhook).Error; err != nil {
+		log.WithField("error", err.Error()).Error("Failed to create webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create webhook",
+		})
+		return
+	}
+
+	log.WithField("userID", webhook.UserID).WithField("webhookID", webhook.ID).WithField("url", webhook.URL).Info("Created webhook")
+	c.JSON(http.StatusCreated, CreateWebhookResponse{Webhook: *webhook, Secret: webhook.Secret})
+}
+
+// ListWebhooks lists the webhooks of the authenticated user
+// @Summary List webhooks
+// @Tags webhooks
+// @Produce json
+// @Success 200 {array} models.Webhook
+// @Router /api/v1/webhooks [get]
+func ListWebhooks(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User ID not found in token",
+		})
+		return
+	}
+
+	var webhooks []models.Webhook
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&webhooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch webhooks",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// UpdateWebhook changes a webhook
+// @Summary Update webhook
+// @Description Change the URL, events, description or enabled state of a webhook. Omitted fields are kept. Deliveries to a disabled webhook fail without being sent.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param request body UpdateWebhookRequest true "Changes"
+// @Success 200 {object} models.Webhook
+// @Router /api/v1/webhooks/{id} [put]
+func UpdateWebhook(c *gin.Context) {
+	webhook, ok := userWebhook(c)
+	if !ok {
+		return
+	}
+
+	var request UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	if request.URL != nil {
+		if err := validateWebhookURL(*request.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		webhook.URL = *request.URL
+	}
+	if request.Events != nil {
+		if err := validateWebhookEvents(*request.Events); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		webhook.Events = *request.Events
+	}
+	if request.Description != nil {
+		webhook.Description = *request.Description
+	}
+	if request.Enabled != nil {
+		webhook.Enabled = *request.Enabled
+	}
+
+	if err := db.Save(webhook).Error; err != nil {
+		log.WithField("error", err.Error()).WithField("webhookID", webhook.ID).Error("Failed to update webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update webhook",
+		})
+		return
+	}
+
+	log.WithField("userID", webhook.UserID).WithField("webhookID", webhook.ID).Info("Updated webhook")
+	c.JSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhook deletes a webhook and its delivery log
+// @Summary Delete webhook
+// @Tags webhooks
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} map[string]string
+// @Router /api/v1/webhooks/{id} [delete]
+func DeleteWebhook(c *gin.Context) {
+	webhook, ok := userWebhook(c)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(webhook).Error
+	})
+	if err != nil {
+		log.WithField("error", err.Error()).WithField("webhookID", webhook.ID).Error("Failed to delete webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete webhook",
+		})
+		return
+	}
+
+	log.WithField("userID", webhook.UserID).WithField("webhookID", webhook.ID).Info("Deleted webhook")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Webhook deleted",
+	})
+}
+
+// ListWebhookDeliveries lists the deliveries of a webhook, newest first
+// @Summary List webhook deliveries
+// @Description The delivery log of a webhook: every event sent or waiting to be sent, with the attempts made and the outcome of the latest one. Finished deliveries are kept for 30 days.
+// @Tags webhooks
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param status query string false "Only deliveries with this status: pending, succeeded or failed"
+// @Param limit query int false "Maximum number of deliveries (default 50, at most 200)"
+// @Param before query int false "Only deliveries with a lower ID, to page through older ones"
+// @Success 200 {array} models.WebhookDelivery
+// @Router /api/v1/webhooks/{id}/deliveries [get]
+func ListWebhookDeliveries(c *gin.Context) {
+	webhook, ok := userWebhook(c)
+	if !ok {
+		return
+	}
+
+	limit := defaultWebhookDeliveryLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be a positive integer",
+			})
+			return
+		}
+		limit = parsed
+	}
+	if limit > maxWebhookDeliveryLimit {
+		limit = maxWebhookDeliveryLimit
+	}
+
+	query := db.Where("webhook_id = ?", webhook.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if before := c.Query("before"); before != "" {
+		beforeID, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "before must be a delivery ID",
+			})
+			return
+		}
+		query = query.Where("id < ?", beforeID)
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch webhook deliveries",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// ReplayWebhookDelivery sends an event to a webhook again
+// @Summary Replay webhook delivery
+// @Description Queue a new delivery of the event of a finished delivery, with the same payload and event ID, signed with the webhook's current secret.
+// @Tags webhooks
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param deliveryId path int true "Delivery ID"
+// @Success 202 {object} models.WebhookDelivery
+// @Router /api/v1/webhooks/{id}/deliveries/{deliveryId}/replay [post]
+func ReplayWebhookDelivery(c *gin.Context) {
+	webhook, ok := userWebhook(c)
+	if !ok {
+		return
+	}
+
+	var original models.WebhookDelivery
+	if err := db.Where("id = ? AND webhook_id = ?", c.Param("deliveryId"), webhook.ID).First(&original).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Webhook delivery not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch webhook delivery",
+		})
+		return
+	}
+	if original.Status == models.WebhookDeliveryPending {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Webhook delivery is still pending",
+		})
+		return
+	}
+	if !webhook.Enabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Webhook is disabled",
+		})
+		return
+	}
+
+	now := time.Now()
+	replay := &models.WebhookDelivery{
+		WebhookID:     webhook.ID,
+		EventID:       original.EventID,
+		Event:         original.Event,
+		Payload:       original.Payload,
+		Status:        models.WebhookDeliveryPending,
+		NextAttemptAt: &now,
+		ReplayOf:      &original.ID,
+	}
+	if err := db.Create(replay).Error; err != nil {
+		log.WithField("error", err.Error()).WithField("deliveryID", original.ID).Error("Failed to queue webhook replay")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to replay webhook delivery",
+		})
+		return
+	}
+	signalWebhookWorkers()
+
+	log.WithField("webhookID", webhook.ID).
+		WithField("deliveryID", original.ID).
+		WithField("replayID", replay.ID).
+		Info("Queued webhook replay")
+	c.JSON(http.StatusAccepted, replay)
+}
@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hotvault/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Webhook event types.
+const (
+	WebhookEventUploadComplete = "upload.complete"
+	WebhookEventUploadError    = "upload.error"
+	WebhookEventProofSetReady  = "proofset.ready"
+	WebhookEventRootRemoved    = "root.removed"
+)
+
+var webhookEvents = []string{
+	WebhookEventUploadComplete,
+	WebhookEventUploadError,
+	WebhookEventProofSetReady,
+	WebhookEventRootRemoved,
+}
+
+const (
+	webhookPollInterval = 5 * time.Second
+	// webhookLeaseMargin is added to the delivery timeout to lease a
+	// claimed delivery; a delivery whose worker died is retried after it.
+	webhookLeaseMargin = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// webhookResponseLimit bounds the response body kept in delivery logs.
+	webhookResponseLimit = 1024
+	// webhookDeliveryRetention is how long finished deliveries are kept.
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+
+	webhookSignatureHeader = "X-HotVault-Signature"
+)
+
+var (
+	webhookSignal      = make(chan struct{}, 1)
+	webhookWorkersOnce sync.Once
+	webhookClient      *http.Client
+)
+
+// webhookPayload is the body of every webhook request.
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// emitWebhookEvent queues an event for every enabled webhook of a user
+// that subscribes to it.
+func emitWebhookEvent(userID uint, event string, data interface{}) {
+	var webhooks []models.Webhook
+	if err := db.Where("user_id = ? AND enabled = ?", userID, true).Find(&webhooks).Error; err != nil {
+		log.WithField("userID", userID).WithField("event", event).WithField("error", err.Error()).Error("Failed to fetch webhooks")
+		return
+	}
+
+	eventID := uuid.New().String()
+	var payload []byte
+	var deliveries []models.WebhookDelivery
+	now := time.Now()
+	for _, webhook := range webhooks {
+		if !webhookSubscribes(&webhook, event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(webhookPayload{ID: eventID, Type: event, CreatedAt: now.UTC(), Data: data})
+			if err != nil {
+				log.WithField("event", event).WithField("error", err.Error()).Error("Failed to encode webhook event")
+				return
+			}
+		}
+		deliveries = append(deliveries, models.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			EventID:       eventID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        models.WebhookDeliveryPending,
+			NextAttemptAt: &now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+
+	if err := db.Create(&deliveries).Error; err != nil {
+		log.WithField("userID", userID).WithField("event", event).WithField("error", err.Error()).Error("Failed to queue webhook deliveries")
+		return
+	}
+	log.WithField("userID", userID).
+		WithField("event", event).
+		WithField("eventID", eventID).
+		WithField("webhooks", len(deliveries)).
+		Info("Queued webhook event")
+	signalWebhookWorkers()
+}
+
+func webhookSubscribes(webhook *models.Webhook, event string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range webhook.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+func signalWebhookWorkers() {
+	select {
+	case webhookSignal <- struct{}{}:
+	default:
+	}
+}
+
+// emitUploadWebhook sends the final state of an upload job.
+func emitUploadWebhook(jobID, event string) {
+	job, err := loadUploadJob(jobID)
+	if err != nil {
+		log.WithField("jobID", jobID).WithField("error", err.Error()).Error("Failed to load upload job for webhook")
+		return
+	}
+	emitWebhookEvent(job.UserID, event, struct {
+		UploadProgress
+		FileID *uint `json:"fileId,omitempty"`
+	}{uploadJobProgress(job), job.FileID})
+}
+
+// emitRootRemovedWebhook reports that a replica was removed from its proof
+// set.
+func emitRootRemovedWebhook(piece *models.Piece) {
+	data := gin.H{
+		"pieceId":     piece.ID,
+		"fileId":      piece.FileID,
+		"cid":         piece.CID,
+		"filename":    piece.Filename,
+		"serviceName": piece.ServiceName,
+		"serviceUrl":  piece.ServiceURL,
+		"rootId":      piece.RootID,
+	}
+	if piece.ProofSetID != nil {
+		var proofSet models.ProofSet
+		if err := db.Select("id", "proof_set_id").First(&proofSet, *piece.ProofSetID).Error; err == nil {
+			data["proofSetId"] = proofSet.ProofSetID
+		}
+	}
+	emitWebhookEvent(piece.UserID, WebhookEventRootRemoved, data)
+}
+
+// startWebhookWorkers starts the workers delivering webhook events.
+func startWebhookWorkers() {
+	webhookWorkersOnce.Do(func() {
+		webhookClient = newWebhookClient()
+
+		host, _ := os.Hostname()
+		for i := 0; i < cfg.Webhooks.Workers; i++ {
+			go runWebhookWorker(fmt.Sprintf("%s-%d-webhook-%d", host, os.Getpid(), i))
+		}
+		go pruneWebhookDeliveries()
+
+		log.WithField("workers", cfg.Webhooks.Workers).
+			WithField("maxAttempts", cfg.Webhooks.MaxAttempts).
+			Info("Started webhook workers")
+	})
+}
+
+// newWebhookClient returns the client sending webhook requests. Redirects
+// are not followed, and unless AllowPrivate is set, connections to
+// non-public addresses are refused after DNS resolution so a hostname
+// cannot point a webhook at internal services.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if cfg.Webhooks.AllowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if addr, err := netip.ParseAddr(host); err != nil || !publicIP(addr) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// nonPublicPrefixes are the special-purpose ranges of the IANA IPv4 and
+// IPv6 registries whose addresses are not globally reachable, plus the
+// NAT64, Teredo and 6to4 ranges, whose addresses embed an IPv4 address
+// that may not be.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// publicIP reports whether addr is outside every non-public range. An
+// IPv4-mapped IPv6 address is checked as the IPv4 address it carries.
+func publicIP(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func runWebhookWorker(workerID string) {
+	for {
+		delivery, err := claimWebhookDelivery()
+		if err != nil {
+			log.WithField("worker", workerID).WithField("error", err.Error()).Error("Failed to claim webhook delivery")
+			time.Sleep(webhookPollInterval)
+			continue
+		}
+		if delivery == nil {
+			select {
+			case <-webhookSignal:
+			case <-time.After(webhookPollInterval):
+			}
+			continue
+		}
+		deliverWebhook(delivery)
+	}
+}
+
+// claimWebhookDelivery leases the pending delivery that is due first.
+// Rows locked by a concurrent claim are skipped rather than waited for.
+func claimWebhookDelivery() (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	now := time.Now()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", models.WebhookDeliveryPending, now).
+			Order("next_attempt_at ASC").
+			First(&delivery).Error
+		if err != nil {
+			return err
+		}
+
+		lease := now.Add(cfg.Webhooks.Timeout + webhookLeaseMargin)
+		delivery.Attempts++
+		delivery.NextAttemptAt = &lease
+		return tx.Model(&delivery).Updates(map[string]interface{}{
+			"attempts":        delivery.Attempts,
+			"next_attempt_at": lease,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// deliverWebhook makes one attempt at a claimed delivery and records its
+// outcome, scheduling a retry if attempts are left.
+func deliverWebhook(delivery *models.WebhookDelivery) {
+	updates := map[string]interface{}{}
+	// final is set when the delivery must not be retried.
+	final := false
+
+	var webhook models.Webhook
+	err := db.First(&webhook, delivery.WebhookID).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		err = errors.New("webhook was deleted")
+		final = true
+	case err != nil:
+	case !webhook.Enabled:
+		err = errors.New("webhook is disabled")
+		final = true
+	default:
+		var status int
+		var body string
+		status, body, err = sendWebhook(&webhook, delivery)
+		updates["response_status"] = status
+		updates["response_body"] = body
+	}
+
+	entry := log.WithField("deliveryID", delivery.ID).
+		WithField("webhookID", delivery.WebhookID).
+		WithField("event", delivery.Event).
+		WithField("attempt", delivery.Attempts)
+	switch {
+	case err == nil:
+		updates["status"] = models.WebhookDeliverySucceeded
+		updates["error"] = ""
+		updates["delivered_at"] = time.Now()
+		updates["next_attempt_at"] = nil
+		entry.Info("Webhook delivered")
+	case final || delivery.Attempts >= cfg.Webhooks.MaxAttempts:
+		updates["status"] = models.WebhookDeliveryFailed
+		updates["error"] = err.Error()
+		updates["next_attempt_at"] = nil
+		entry.WithField("error", err.Error()).Warning("Webhook delivery failed, giving up")
+	default:
+		retryAt := time.Now().Add(webhookBackoff(delivery.Attempts))
+		updates["error"] = err.Error()
+		updates["next_attempt_at"] = retryAt
+		entry.WithField("error", err.Error()).
+			WithField("retryAt", retryAt).
+			Warning("Webhook delivery failed, retrying")
+	}
+
+	if err := db.Model(delivery).Updates(updates).Error; err != nil {
+		log.WithField("deliveryID", delivery.ID).WithField("error", err.Error()).Error("Failed to record webhook delivery")
+	}
+}
+
+// webhookBackoff is how long to wait after the given failed attempt.
+func webhookBackoff(attempt int) time.Duration {
+	backoff := cfg.Webhooks.Backoff
+	for i := 1; i < attempt && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+// sendWebhook posts a delivery to its webhook. It returns the response
+// status and the start of the response body; non-2xx responses are errors.
+func sendWebhook(webhook *models.Webhook, delivery *models.WebhookDelivery) (int, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Webhooks.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, "", err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "HotVault-Webhooks/1.0")
+	request.Header.Set("X-HotVault-Event", delivery.Event)
+	request.Header.Set("X-HotVault-Event-ID", delivery.EventID)
+	request.Header.Set("X-HotVault-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	request.Header.Set(webhookSignatureHeader, fmt.Sprintf("t=%s,v1=%s", timestamp, signWebhook(webhook.Secret, timestamp, delivery.Payload)))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, webhookResponseLimit))
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, string(body), fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, string(body), nil
+}
+
+// signWebhook returns the signature of a request body sent at timestamp:
+// the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook's
+// secret. Receivers recompute it, and reject old timestamps to stop
+// replayed requests.
+func signWebhook(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pruneWebhookDeliveries deletes finished deliveries after
+// webhookDeliveryRetention.
+func pruneWebhookDeliveries() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		result := db.Where("status <> ? AND created_at < ?", models.WebhookDeliveryPending, time.Now().Add(-webhookDeliveryRetention)).
+			Delete(&models.WebhookDelivery{})
+		if result.Error != nil {
+			log.WithField("error", result.Error.Error()).Error("Failed to prune webhook deliveries")
+		} else if result.RowsAffected > 0 {
+			log.WithField("deliveries", result.RowsAffected).Info("Pruned webhook deliveries")
+		}
+	}
+}
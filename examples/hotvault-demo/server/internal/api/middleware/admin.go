@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth protects operator endpoints with a static token sent in the
+// X-Admin-Token header. The endpoints are disabled when no token is set.
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin API is disabled"})
+			c.Abort()
+			return
+		}
+
+		provided := c.GetHeader("X-Admin-Token")
+		if provided == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Admin token required"})
+			c.Abort()
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -21,13 +21,25 @@ import (
 func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 	handlers.Initialize(db, cfg)
 
-	router.MaxMultipartMemory = 1000 << 20 // 1000 MB
+	// Uploads stream their forms to disk; only upload chunks are parsed as
+	// whole forms, and parts beyond this spill to temporary files.
+	router.MaxMultipartMemory = 32 << 20 // 32 MB
+
+	allowedOrigins := []string{"http://localhost:3000", "https://hotvault-demo-app.yourdomain.com"}
+	handlers.SetWebSocketOrigins(allowedOrigins)
 
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:3000", "https://hotvault-demo-app.yourdomain.com"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowOrigins: allowedOrigins,
+		AllowMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders: []string{
+			"Origin", "Content-Type", "Accept", "Authorization", "X-Admin-Token", "X-Chunk-SHA256", "X-Content-SHA256",
+			"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum",
+		},
+		ExposeHeaders: []string{
+			"Content-Length", "Retry-After", "Location",
+			"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Tus-Checksum-Algorithm",
+			"Upload-Offset", "Upload-Length", "Upload-Metadata",
+		},
 		AllowCredentials: true,
 		MaxAge:           12 * 60 * 60,
 	}))
@@ -39,6 +51,9 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 	v1 := router.Group("/api/v1")
 	{
 		v1.GET("/health", handlers.HealthCheck)
+		v1.OPTIONS("/tus", handlers.TusResumable, handlers.TusOptions)
+		v1.OPTIONS("/tus/", handlers.TusResumable, handlers.TusOptions)
+		v1.OPTIONS("/tus/:id", handlers.TusResumable, handlers.TusOptions)
 
 		auth := v1.Group("/auth")
 		{
@@ -48,12 +63,42 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			auth.POST("/logout", authHandler.Logout)
 		}
 
+		admin := v1.Group("/admin")
+		admin.Use(middleware.AdminAuth(cfg.AdminToken))
+		{
+			admin.GET("/service-secret", handlers.GetServiceSecret)
+			admin.POST("/service-secret/rotate", handlers.RotateServiceSecret)
+			admin.POST("/service-secret/promote", handlers.PromoteServiceSecret)
+
+			providers := admin.Group("/providers")
+			{
+				providers.GET("", handlers.ListStorageProviders)
+				providers.POST("", handlers.CreateStorageProvider)
+				providers.GET("/:id", handlers.GetStorageProvider)
+				providers.PUT("/:id", handlers.UpdateStorageProvider)
+				providers.DELETE("/:id", handlers.DeleteStorageProvider)
+			}
+
+			admin.PUT("/users/:id/provider", handlers.SetUserProvider)
+			admin.PUT("/users/:id/replication", handlers.SetUserReplication)
+			admin.PUT("/users/:id/quota", handlers.SetUserQuota)
+			admin.PUT("/users/:id/encryption", handlers.SetUserEncryption)
+		}
+
 		protected := v1.Group("")
 		protected.Use(middleware.JWTAuth(cfg.JWT.Secret))
 		{
 			protected.POST("/upload", handlers.UploadFile)
+			protected.PUT("/upload/stream", handlers.StreamUpload)
 			protected.GET("/upload/status/:jobId", handlers.GetUploadStatus)
+			protected.GET("/upload/events", handlers.StreamUserUploadEvents)
+			protected.GET("/upload/events/:jobId", handlers.StreamUploadEvents)
+			protected.GET("/upload/ws", handlers.UserUploadEventsWebSocket)
+			protected.GET("/upload/ws/:jobId", handlers.UploadEventsWebSocket)
+			protected.DELETE("/upload/:jobId", handlers.CancelUpload)
 			protected.GET("/download/:cid", handlers.DownloadFile)
+			protected.GET("/providers", handlers.GetAvailableProviders)
+			protected.GET("/usage", handlers.GetUsage)
 
 			chunkedUpload := protected.Group("/chunked-upload")
 			{
@@ -63,6 +108,16 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 				chunkedUpload.GET("/status/:uploadId", handlers.GetChunkedUploadStatus)
 			}
 
+			tus := protected.Group("/tus")
+			tus.Use(handlers.TusResumable)
+			{
+				tus.POST("", handlers.TusCreate)
+				tus.POST("/", handlers.TusCreate)
+				tus.HEAD("/:id", handlers.TusHead)
+				tus.PATCH("/:id", handlers.TusPatch)
+				tus.DELETE("/:id", handlers.TusDelete)
+			}
+
 			pieces := protected.Group("/pieces")
 			{
 				pieces.GET("", handlers.GetUserPieces)
@@ -83,8 +138,35 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 			{
 				roots.POST("/remove", handlers.RemoveRoot)
 			}
+
+			accessKeys := protected.Group("/access-keys")
+			{
+				accessKeys.POST("", handlers.CreateAccessKey)
+				accessKeys.GET("", handlers.ListAccessKeys)
+				accessKeys.DELETE("/:id", handlers.DeleteAccessKey)
+			}
+
+			webhooks := protected.Group("/webhooks")
+			{
+				webhooks.POST("", handlers.CreateWebhook)
+				webhooks.GET("", handlers.ListWebhooks)
+				webhooks.PUT("/:id", handlers.UpdateWebhook)
+				webhooks.DELETE("/:id", handlers.DeleteWebhook)
+				webhooks.GET("/:id/deliveries", handlers.ListWebhookDeliveries)
+				webhooks.POST("/:id/deliveries/:deliveryId/replay", handlers.ReplayWebhookDelivery)
+			}
 		}
 	}
 
+	// S3-compatible gateway, authenticated with access keys instead of JWTs.
+	s3 := router.Group("/s3")
+	s3.Use(handlers.S3Auth)
+	{
+		s3.GET("", handlers.S3ListBuckets)
+		s3.GET("/", handlers.S3ListBuckets)
+		s3.Any("/:bucket", handlers.S3Bucket)
+		s3.Any("/:bucket/*key", handlers.S3Object)
+	}
+
 	router.NoRoute(handlers.NotFound)
 }
@@ -7,10 +7,21 @@ import (
 
 func MigrateDB(db *gorm.DB) error {
 	return db.AutoMigrate(
+		&models.StorageProvider{},
 		&models.User{},
+		&models.UserKey{},
 		&models.Wallet{},
 		&models.Transaction{},
 		&models.ProofSet{},
+		&models.File{},
 		&models.Piece{},
+		&models.Manifest{},
+		&models.UploadJob{},
+		&models.ChunkedUpload{},
+		&models.TusUpload{},
+		&models.AccessKey{},
+		&models.S3MultipartUpload{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
 	)
 }
@@ -0,0 +1,193 @@
+// Package envelope encrypts files with AES-256-GCM under per-file data
+// keys, which are stored wrapped by a key encryption key.
+//
+// Files are encrypted as a stream of chunks so they can be processed
+// without holding them in memory. An encrypted file is a magic header
+// followed by the chunks, each of up to ChunkSize plaintext bytes sealed
+// with GCM. The nonce of a chunk is its counter, with the last byte set on
+// the final chunk, so chunks cannot be reordered, dropped or truncated
+// without failing authentication. Every data key encrypts a single file,
+// which makes counter nonces safe.
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// KeySize is the size of data keys and key encryption keys.
+	KeySize = 32
+	// ChunkSize is the plaintext size of every chunk but the last.
+	ChunkSize = 64 << 10
+
+	magic = "HVE1"
+)
+
+// ErrDecrypt is returned when data fails authentication.
+var ErrDecrypt = errors.New("envelope: message authentication failed")
+
+// NewKey returns a random key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("envelope: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Wrap seals key with kek. aad binds the wrapped key to its use, and must
+// be passed to Unwrap again.
+func Wrap(kek, key, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, aad), nil
+}
+
+// Unwrap opens a key sealed by Wrap.
+func Unwrap(kek, wrapped, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
+
+// chunkNonce returns the nonce of chunk counter.
+func chunkNonce(nonce []byte, counter uint64, last bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// EncryptedSize returns the size of a plaintext of size bytes once
+// encrypted.
+func EncryptedSize(size int64) int64 {
+	chunks := size / ChunkSize
+	if size%ChunkSize != 0 || size == 0 {
+		chunks++
+	}
+	return int64(len(magic)) + size + chunks*16
+}
+
+// Encrypt writes src encrypted with key to dst.
+func Encrypt(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(dst, magic); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, ChunkSize)
+	plain := make([]byte, ChunkSize)
+	sealed := make([]byte, 0, ChunkSize+aead.Overhead())
+	nonce := make([]byte, aead.NonceSize())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(in, plain)
+		last := false
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			last = true
+		case err != nil:
+			return err
+		default:
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(nonce, counter, last), plain[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypt writes src, encrypted by Encrypt with key, decrypted to dst.
+// Nothing is written for a chunk that fails authentication, but chunks
+// before it have been written when ErrDecrypt is returned.
+func Decrypt(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, ChunkSize+aead.Overhead())
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(in, header); err != nil || string(header) != magic {
+		return fmt.Errorf("envelope: not an encrypted file")
+	}
+
+	sealed := make([]byte, ChunkSize+aead.Overhead())
+	plain := make([]byte, 0, ChunkSize)
+	nonce := make([]byte, aead.NonceSize())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(in, sealed)
+		last := false
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			last = true
+		case err != nil:
+			return err
+		default:
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		plain, err = aead.Open(plain[:0], chunkNonce(nonce, counter, last), sealed[:n], nil)
+		if err != nil {
+			return ErrDecrypt
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
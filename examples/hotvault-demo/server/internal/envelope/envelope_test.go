@@ -0,0 +1,135 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, plain, key []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	if err := Encrypt(&sealed, bytes.NewReader(plain), key); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func decrypt(sealed, key []byte) ([]byte, error) {
+	var plain bytes.Buffer
+	err := Decrypt(&plain, bytes.NewReader(sealed), key)
+	return plain.Bytes(), err
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(plain)
+
+		sealed := encrypt(t, plain, key)
+		if int64(len(sealed)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted to %d bytes, EncryptedSize says %d", size, len(sealed), EncryptedSize(int64(size)))
+		}
+		got, err := decrypt(sealed, key)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted data differs", size)
+		}
+	}
+}
+
+// sealedChunks splits an encrypted file into its sealed chunks.
+func sealedChunks(sealed []byte) [][]byte {
+	var chunks [][]byte
+	for rest := sealed[len(magic):]; len(rest) > 0; {
+		n := ChunkSize + 16
+		if n > len(rest) {
+			n = len(rest)
+		}
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	return chunks
+}
+
+func join(chunks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{[]byte(magic)}, chunks...), nil)
+}
+
+func TestTamperingFails(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*ChunkSize)
+	rand.New(rand.NewSource(1)).Read(plain)
+	sealed := encrypt(t, plain, key)
+	chunks := sealedChunks(sealed)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(magic)+ChunkSize/2] ^= 1
+
+	for name, data := range map[string][]byte{
+		"last chunk dropped":   join(chunks[0], chunks[1]),
+		"only header":          []byte(magic),
+		"truncated mid chunk":  sealed[:len(sealed)-100],
+		"chunks reordered":     join(chunks[1], chunks[0], chunks[2]),
+		"middle chunk dropped": join(chunks[0], chunks[2]),
+		"chunk repeated":       join(chunks[0], chunks[0], chunks[1], chunks[2]),
+		"bit flipped":          flipped,
+	} {
+		if _, err := decrypt(data, key); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: err = %v, want ErrDecrypt", name, err)
+		}
+	}
+
+	if _, err := decrypt(sealed, testKey(t)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("wrong key: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := decrypt(append([]byte("HVE0"), sealed[len(magic):]...), key); err == nil {
+		t.Error("file with a bad header decrypted")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	kek, key := testKey(t), testKey(t)
+	aad := []byte("hotvault data key 1")
+	wrapped, err := Wrap(kek, key, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Unwrap(kek, wrapped, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("unwrapped key differs")
+	}
+
+	if _, err := Unwrap(kek, wrapped, []byte("hotvault data key 2")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("other AAD: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := Unwrap(testKey(t), wrapped, aad); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("other key encryption key: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := Unwrap(kek, wrapped[:10], aad); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("truncated: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := Wrap(kek[:16], key, aad); err == nil {
+		t.Error("Wrap accepted a 16-byte key encryption key")
+	}
+}
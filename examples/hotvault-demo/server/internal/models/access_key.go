@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// AccessKey is an S3 access key pair of a user. The secret is kept because
+// SigV4 signatures are verified by recomputing them with it.
+type AccessKey struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          uint       `gorm:"index;not null" json:"userId"`
+	AccessKeyID     string     `gorm:"uniqueIndex;size:32;not null" json:"accessKeyId"`
+	SecretAccessKey string     `gorm:"not null" json:"-"`
+	Description     string     `json:"description"`
+	LastUsedAt      *time.Time `json:"lastUsedAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+)
+
+// ChunkedUpload is an upload session whose file arrives in chunks, kept in
+// ChunkDir until the file is assembled.
+type ChunkedUpload struct {
+	ID             string    `gorm:"primaryKey;size:36" json:"id"`
+	UserID         uint      `gorm:"index;not null" json:"userId"`
+	ProviderID     *uint     `json:"providerId"`
+	Filename       string    `gorm:"not null" json:"filename"`
+	FileType       string    `json:"fileType"`
+	ChunkSize      int64     `json:"chunkSize"`
+	TotalSize      int64     `json:"totalSize"`
+	TotalChunks    int       `json:"totalChunks"`
+	UploadedChunks int       `json:"uploadedChunks"`
+	ChunksReceived []byte    `gorm:"type:bytea" json:"-"`
+	ChunkDir       string    `json:"-"`
+	SHA256         string    `gorm:"size:64" json:"sha256,omitempty"`
+	Status         string    `gorm:"index;not null" json:"status"`
+	JobID          string    `json:"jobId,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `gorm:"index" json:"updatedAt"`
+}
+
+// HasChunk reports whether chunk index has been received.
+func (u *ChunkedUpload) HasChunk(index int) bool {
+	if index < 0 || index/8 >= len(u.ChunksReceived) {
+		return false
+	}
+	return u.ChunksReceived[index/8]&(1<<(index%8)) != 0
+}
+
+// MarkChunk records chunk index as received and returns false if it
+// already was.
+func (u *ChunkedUpload) MarkChunk(index int) bool {
+	if u.HasChunk(index) {
+		return false
+	}
+	if need := index/8 + 1; len(u.ChunksReceived) < need {
+		u.ChunksReceived = append(u.ChunksReceived, make([]byte, need-len(u.ChunksReceived))...)
+	}
+	u.ChunksReceived[index/8] |= 1 << (index % 8)
+	u.UploadedChunks++
+	return true
+}
+
+// MissingChunks returns the indices of the chunks not received yet.
+func (u *ChunkedUpload) MissingChunks() []int {
+	missing := []int{}
+	for i := 0; i < u.TotalChunks; i++ {
+		if !u.HasChunk(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChunkedUploadBitmap(t *testing.T) {
+	upload := &ChunkedUpload{TotalChunks: 10, ChunksReceived: make([]byte, 2)}
+
+	for _, index := range []int{0, 7, 8, 9} {
+		if !upload.MarkChunk(index) {
+			t.Errorf("MarkChunk(%d) = false for a new chunk", index)
+		}
+	}
+	if upload.MarkChunk(7) {
+		t.Error("MarkChunk(7) = true for a chunk already received")
+	}
+	if upload.UploadedChunks != 4 {
+		t.Errorf("UploadedChunks = %d, want 4", upload.UploadedChunks)
+	}
+	for index := -1; index <= 10; index++ {
+		want := index == 0 || index == 7 || index == 8 || index == 9
+		if got := upload.HasChunk(index); got != want {
+			t.Errorf("HasChunk(%d) = %v, want %v", index, got, want)
+		}
+	}
+	if got, want := upload.MissingChunks(), []int{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MissingChunks() = %v, want %v", got, want)
+	}
+}
+
+// MarkChunk grows the bitmap when a session has none or too short a one.
+func TestChunkedUploadBitmapGrows(t *testing.T) {
+	upload := &ChunkedUpload{TotalChunks: 20}
+	if got := upload.MissingChunks(); len(got) != 20 {
+		t.Errorf("MissingChunks() = %v, want all 20 chunks", got)
+	}
+	if !upload.MarkChunk(17) || !upload.HasChunk(17) {
+		t.Fatal("chunk 17 was not recorded")
+	}
+	if len(upload.ChunksReceived) != 3 {
+		t.Errorf("bitmap is %d bytes, want 3", len(upload.ChunksReceived))
+	}
+
+	complete := &ChunkedUpload{TotalChunks: 3}
+	for index := 0; index < 3; index++ {
+		complete.MarkChunk(index)
+	}
+	if got := complete.MissingChunks(); got == nil || len(got) != 0 {
+		t.Errorf("MissingChunks() = %#v, want an empty list", got)
+	}
+}
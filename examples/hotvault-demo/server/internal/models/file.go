@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// File is a logical upload. Each copy stored with a provider is a Piece
+// linked to it.
+type File struct {
+	ID                uint           `gorm:"primaryKey" json:"id"`
+	UserID            uint           `gorm:"index;not null" json:"userId"`
+	Filename          string         `gorm:"not null" json:"filename"`
+	Size              int64          `json:"size"`
+	CID               string         `gorm:"index" json:"cid"`
+	ETag              string         `json:"etag,omitempty"`
+	ReplicationFactor int            `gorm:"not null;default:1" json:"replicationFactor"`
+	Replicas          []Piece        `gorm:"foreignKey:FileID" json:"replicas,omitempty"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	UpdatedAt         time.Time      `json:"updatedAt"`
+	DeletedAt         gorm.DeletedAt `gorm:"index" json:"-"`
+}
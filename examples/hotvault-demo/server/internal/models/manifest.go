@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+// Manifest ties together the segments a large file is split into. Each
+// segment is stored as a Piece of its own with the manifest's ID and its
+// index; Segments lists them in order.
+type Manifest struct {
+	ID          uint              `gorm:"primaryKey" json:"id"`
+	UserID      uint              `gorm:"index;not null" json:"userId"`
+	FileID      uint              `gorm:"uniqueIndex;not null" json:"fileId"`
+	Size        int64             `json:"size"`
+	SegmentSize int64             `json:"segmentSize"`
+	SHA256      string            `gorm:"size:64" json:"sha256"`
+	Segments    []ManifestSegment `gorm:"serializer:json" json:"segments"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// ManifestSegment is one segment of a file.
+type ManifestSegment struct {
+	PieceCID string `json:"pieceCid"`
+	Size     int64  `json:"size"`
+}
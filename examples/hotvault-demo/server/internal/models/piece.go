@@ -6,9 +6,17 @@ import (
 	"gorm.io/gorm"
 )
 
+// Root states of a piece.
+const (
+	RootConfirmed     = "confirmed"
+	RootIDUnconfirmed = "root_id_unconfirmed"
+	RootMissing       = "root_missing"
+)
+
 type Piece struct {
 	ID             uint           `gorm:"primaryKey" json:"id"`
 	UserID         uint           `gorm:"index;not null" json:"userId"`
+	FileID         *uint          `gorm:"index" json:"fileId"`
 	CID            string         `gorm:"not null" json:"cid"`
 	Filename       string         `gorm:"not null" json:"filename"`
 	Size           int64          `json:"size"`
@@ -22,4 +30,19 @@ type Piece struct {
 	UpdatedAt      time.Time      `json:"updatedAt"`
 	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
 	User           User           `gorm:"foreignKey:UserID" json:"user,omitempty"`
+
+	// A file packed into an aggregate keeps its own piece CID in CID.
+	AggregateCID    string `gorm:"index" json:"aggregateCid,omitempty"`
+	AggregateOffset int64  `gorm:"not null;default:0" json:"aggregateOffset,omitempty"`
+	AggregateLength int64  `gorm:"not null;default:0" json:"aggregateLength,omitempty"`
+
+	ManifestID   *uint `gorm:"index" json:"manifestId,omitempty"`
+	SegmentIndex int   `gorm:"not null;default:0" json:"segmentIndex,omitempty"`
+
+	// EncryptionKeyID is the UserKey that wraps WrappedDataKey.
+	EncryptionKeyID *uint  `gorm:"index" json:"encryptionKeyId,omitempty"`
+	WrappedDataKey  []byte `json:"-"`
+
+	RootState     string     `gorm:"index;not null;default:confirmed" json:"rootState"`
+	RootCheckedAt *time.Time `json:"rootCheckedAt,omitempty"`
 }
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// S3MultipartUpload is an S3 multipart upload in progress. Parts are kept
+// in Dir as part_N until the upload is completed or aborted.
+type S3MultipartUpload struct {
+	ID         string    `gorm:"primaryKey;size:36" json:"id"`
+	UserID     uint      `gorm:"index;not null" json:"userId"`
+	ProofSetID uint      `gorm:"index;not null" json:"proofSetId"`
+	Key        string    `gorm:"not null" json:"key"`
+	Dir        string    `json:"-"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `gorm:"index" json:"updatedAt"`
+}
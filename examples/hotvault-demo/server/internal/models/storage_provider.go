@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StorageProvider is a PDP service the server can store pieces with.
+type StorageProvider struct {
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	Name         string         `gorm:"uniqueIndex;not null" json:"name"`
+	ServiceName  string         `gorm:"not null" json:"serviceName"`
+	ServiceURL   string         `gorm:"not null" json:"serviceUrl"`
+	RecordKeeper string         `gorm:"not null" json:"recordKeeper"`
+	Enabled      bool           `gorm:"default:true" json:"enabled"`
+	IsDefault    bool           `gorm:"default:false" json:"isDefault"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+}
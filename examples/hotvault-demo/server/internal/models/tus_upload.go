@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// TusUpload is an upload made with the tus resumable upload protocol. Bytes
+// are appended to the payload until UploadOffset reaches UploadLength, at
+// which point an UploadJob with the same ID is queued.
+type TusUpload struct {
+	ID           string    `gorm:"primaryKey;size:36" json:"id"`
+	UserID       uint      `gorm:"index;not null" json:"userId"`
+	ProviderID   *uint     `json:"providerId"`
+	Filename     string    `gorm:"not null" json:"filename"`
+	FileType     string    `json:"fileType"`
+	Metadata     string    `json:"-"`
+	PayloadPath  string    `json:"-"`
+	UploadLength int64     `gorm:"not null" json:"uploadLength"`
+	UploadOffset int64     `gorm:"not null;default:0" json:"uploadOffset"`
+	Status       string    `gorm:"index;not null" json:"status"`
+	JobID        string    `json:"jobId,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `gorm:"index" json:"updatedAt"`
+}
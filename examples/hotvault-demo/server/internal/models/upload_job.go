@@ -0,0 +1,63 @@
+package models
+
+import (
+	"time"
+)
+
+// Upload job stages, in order. Stage records the last stage a job has
+// completed so a job claimed again after a restart resumes from there.
+const (
+	UploadStageQueued   = "queued"
+	UploadStageReceived = "received"
+	UploadStagePrepared = "prepared"
+	UploadStageStored   = "stored"
+)
+
+// UploadJob is a queued or running upload. Workers claim jobs by taking a
+// lease; a job whose lease has expired is picked up by the next worker.
+type UploadJob struct {
+	ID              string `gorm:"primaryKey;size:36" json:"id"`
+	UserID          uint   `gorm:"index;not null" json:"userId"`
+	ProviderID      *uint  `json:"providerId"`
+	Filename        string `gorm:"not null" json:"filename"`
+	TotalSize       int64  `json:"totalSize"`
+	PayloadPath     string `json:"-"`
+	ChunkDir        string `json:"-"`
+	ChunkCount      int    `json:"-"`
+	ChunkedUploadID string `gorm:"index" json:"chunkedUploadId,omitempty"`
+	SHA256          string `gorm:"size:64" json:"-"`
+	ETag            string `json:"-"`
+	EncryptionKeyID *uint  `json:"-"`
+	WrappedDataKey  []byte `json:"-"`
+
+	Stage          string            `gorm:"not null;default:queued" json:"stage"`
+	Status         string            `gorm:"index;not null" json:"status"`
+	Progress       int               `json:"progress"`
+	Message        string            `json:"message"`
+	Error          string            `json:"error"`
+	CID            string            `json:"cid"`
+	ProofSetID     string            `json:"proofSetId"`
+	BytesProcessed int64             `json:"bytesProcessed"`
+	Replicas       []ReplicaProgress `gorm:"serializer:json" json:"replicas"`
+
+	PieceCID string `gorm:"column:piece_cid" json:"pieceCid"`
+	FileID   *uint  `json:"fileId"`
+
+	Attempts        int        `gorm:"not null;default:0" json:"attempts"`
+	CancelRequested bool       `gorm:"not null;default:false" json:"cancelRequested"`
+	ClaimedBy       string     `json:"-"`
+	LeaseExpiresAt  *time.Time `gorm:"index" json:"-"`
+	CompletedAt     *time.Time `gorm:"index" json:"completedAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+// ReplicaProgress is the state of an upload to one storage provider.
+type ReplicaProgress struct {
+	Provider   string `json:"provider"`
+	Status     string `json:"status"`
+	Message    string `json:"message,omitempty"`
+	ProofSetID string `json:"proofSetId,omitempty"`
+	RootID     string `json:"rootId,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
@@ -8,16 +8,21 @@ import (
 )
 
 type User struct {
-	ID            uint           `gorm:"primaryKey" json:"id"`
-	WalletAddress string         `gorm:"uniqueIndex;not null" json:"walletAddress"`
-	Nonce         string         `gorm:"not null" json:"nonce"`
-	Username      string         `json:"username"`
-	Email         string         `json:"email"`
-	CreatedAt     time.Time      `json:"createdAt"`
-	UpdatedAt     time.Time      `json:"updatedAt"`
-	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
-	Wallets       []Wallet       `gorm:"foreignKey:UserID" json:"wallets,omitempty"`
-	Transactions  []Transaction  `gorm:"foreignKey:UserID" json:"transactions,omitempty"`
+	ID                uint           `gorm:"primaryKey" json:"id"`
+	WalletAddress     string         `gorm:"uniqueIndex;not null" json:"walletAddress"`
+	Nonce             string         `gorm:"not null" json:"nonce"`
+	Username          string         `json:"username"`
+	Email             string         `json:"email"`
+	ProviderID        *uint          `json:"providerId"`
+	ReplicationFactor *int           `json:"replicationFactor"`
+	QuotaBytes        *int64         `json:"quotaBytes"`
+	QuotaPieces       *int64         `json:"quotaPieces"`
+	EncryptUploads    *bool          `json:"encryptUploads"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	UpdatedAt         time.Time      `json:"updatedAt"`
+	DeletedAt         gorm.DeletedAt `gorm:"index" json:"-"`
+	Wallets           []Wallet       `gorm:"foreignKey:UserID" json:"wallets,omitempty"`
+	Transactions      []Transaction  `gorm:"foreignKey:UserID" json:"transactions,omitempty"`
 }
 
 type JWTClaims struct {
@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// UserKey is a key encryption key of a user, wrapped by the server's master
+// key. The data keys of the user's encrypted files are wrapped by it.
+type UserKey struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	UserID     uint      `gorm:"index;not null" json:"userId"`
+	WrappedKey []byte    `gorm:"not null" json:"-"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
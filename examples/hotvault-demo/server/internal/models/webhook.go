@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+)
+
+// Webhook is an endpoint of a user that is sent events as they happen.
+// Events lists the event types it receives, all of them when empty.
+// Deliveries are signed with Secret.
+type Webhook struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"index;not null" json:"userId"`
+	URL         string    `gorm:"not null" json:"url"`
+	Secret      string    `gorm:"not null" json:"-"`
+	Events      []string  `gorm:"serializer:json" json:"events"`
+	Description string    `json:"description"`
+	Enabled     bool      `gorm:"not null;default:true" json:"enabled"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Webhook delivery statuses. A pending delivery is retried at
+// NextAttemptAt until it succeeds or runs out of attempts.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is an event sent to a webhook, with the outcome of its
+// latest attempt. Payload is the exact request body, so receivers can
+// check signatures against it.
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	WebhookID      uint       `gorm:"index;not null" json:"webhookId"`
+	EventID        string     `gorm:"size:36;index;not null" json:"eventId"`
+	Event          string     `gorm:"not null" json:"event"`
+	Payload        string     `gorm:"type:text;not null" json:"payload"`
+	Status         string     `gorm:"index;not null" json:"status"`
+	Attempts       int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  *time.Time `gorm:"index" json:"nextAttemptAt"`
+	ResponseStatus int        `json:"responseStatus,omitempty"`
+	ResponseBody   string     `json:"responseBody,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt"`
+	// ReplayOf is the delivery this one replays.
+	ReplayOf  *uint     `json:"replayOf,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
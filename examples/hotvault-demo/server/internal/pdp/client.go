@@ -0,0 +1,140 @@
+package pdp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Service identifies a PDP service registered with a storage provider.
+type Service struct {
+	Name string
+	URL  string
+}
+
+// PDPClient is the set of PDP service operations used by the upload,
+// download and proof set flows.
+type PDPClient interface {
+	CreateProofSet(ctx context.Context, req CreateProofSetRequest) (string, error)
+	GetProofSetStatus(ctx context.Context, txHash string) (*CreateStatus, error)
+	PreparePiece(ctx context.Context, filePath string) (*PreparedPiece, error)
+	UploadFile(ctx context.Context, filePath string) (*UploadResult, error)
+	AddRoots(ctx context.Context, proofSetID string, roots []Root) error
+	GetProofSet(ctx context.Context, proofSetID string) (*ProofSet, error)
+	RemoveRoots(ctx context.Context, proofSetID string, rootIDs []string) error
+	DownloadFile(ctx context.Context, cid string, outputPath string) error
+}
+
+// Factory returns a client bound to the given service.
+type Factory func(service Service) PDPClient
+
+type CreateProofSetRequest struct {
+	RecordKeeper string
+	ExtraData    string
+}
+
+// CreateStatus is the state of a proof set creation transaction.
+type CreateStatus struct {
+	TxHash    string
+	TxStatus  string
+	TxSuccess bool
+	Created   bool
+	ID        string
+}
+
+const (
+	TxStatusPending   = "pending"
+	TxStatusConfirmed = "confirmed"
+	TxStatusFailed    = "failed"
+)
+
+type PreparedPiece struct {
+	CID        string
+	PaddedSize int64
+}
+
+// UploadResult holds the CIDs reported for an uploaded file. CID is the
+// compound "root:subroot" form accepted by AddRoots.
+type UploadResult struct {
+	CID        string
+	RootCID    string
+	SubrootCID string
+}
+
+type ProofSet struct {
+	ID    string
+	Roots []Root
+}
+
+type Root struct {
+	ID       string
+	CID      string
+	Subroots []string
+}
+
+// ParseRoot splits a compound "root:subroot+subroot" CID into a Root.
+func ParseRoot(compound string) Root {
+	root := Root{CID: compound}
+	if idx := strings.Index(compound, ":"); idx != -1 {
+		root.CID = compound[:idx]
+		for _, sub := range strings.Split(compound[idx+1:], "+") {
+			if sub != "" {
+				root.Subroots = append(root.Subroots, sub)
+			}
+		}
+	}
+	return root
+}
+
+// String returns the compound "root:subroot+subroot" form of the root.
+func (r Root) String() string {
+	if len(r.Subroots) == 0 {
+		return r.CID
+	}
+	return r.CID + ":" + strings.Join(r.Subroots, "+")
+}
+
+// FindRoots returns every root whose CID matches cid, in the order the
+// proof set lists them.
+func (p *ProofSet) FindRoots(cid string) []Root {
+	var roots []Root
+	for _, root := range p.Roots {
+		if root.CID == cid {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// FindRoot returns the root whose CID matches cid.
+func (p *ProofSet) FindRoot(cid string) (Root, bool) {
+	for _, root := range p.Roots {
+		if root.CID == cid {
+			return root, true
+		}
+	}
+	return Root{}, false
+}
+
+// Error is returned by clients when the PDP service rejects an operation.
+// Detail carries the service or tool output useful for diagnosing it.
+type Error struct {
+	Op     string
+	Detail string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := e.Op + " failed"
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	if e.Detail != "" {
+		msg = fmt.Sprintf("%s: %s", msg, strings.TrimSpace(e.Detail))
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
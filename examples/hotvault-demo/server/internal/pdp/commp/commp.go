@@ -0,0 +1,247 @@
+// Package commp computes Filecoin piece commitments (CommP): the payload is
+// fr32 padded and hashed into a binary SHA256-trunc254 merkle tree whose
+// root is encoded as a fil-commitment-unsealed piece CID.
+package commp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	nodeSize = 32
+	quadSize = 127
+
+	// MinPaddedSize is the smallest piece size produced.
+	MinPaddedSize = 128
+
+	maxLayers = 64
+
+	codecFilCommitmentUnsealed = 0xf101
+	hashSHA256Trunc254Padded   = 0x1012
+)
+
+var (
+	zeroComms [maxLayers][]byte
+
+	cidEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+func init() {
+	zeroComms[0] = make([]byte, nodeSize)
+	for i := 1; i < maxLayers; i++ {
+		zeroComms[i] = hashNodes(zeroComms[i-1], zeroComms[i-1])
+	}
+}
+
+// Result describes a computed piece commitment.
+type Result struct {
+	CID         string
+	Digest      []byte
+	PaddedSize  int64
+	PayloadSize int64
+}
+
+// Calc is an io.Writer that accumulates a piece commitment over everything
+// written to it.
+type Calc struct {
+	buf    [quadSize]byte
+	bufLen int
+	size   int64
+	leaves uint64
+	layers [maxLayers][]byte
+	quad   [4 * nodeSize]byte
+}
+
+func New() *Calc {
+	return &Calc{}
+}
+
+func (c *Calc) Write(p []byte) (int, error) {
+	n := len(p)
+	c.size += int64(n)
+
+	if c.bufLen > 0 {
+		copied := copy(c.buf[c.bufLen:], p)
+		c.bufLen += copied
+		p = p[copied:]
+		if c.bufLen < quadSize {
+			return n, nil
+		}
+		c.addQuad(c.buf[:])
+		c.bufLen = 0
+	}
+
+	for len(p) >= quadSize {
+		c.addQuad(p[:quadSize])
+		p = p[quadSize:]
+	}
+	c.bufLen = copy(c.buf[:], p)
+	return n, nil
+}
+
+// Digest zero-pads the payload to the next power-of-two piece size and
+// returns the commitment. The Calc must not be written to afterwards.
+func (c *Calc) Digest() (*Result, error) {
+	if c.size == 0 {
+		return nil, errors.New("cannot compute piece commitment of empty payload")
+	}
+
+	if c.bufLen > 0 {
+		for i := c.bufLen; i < quadSize; i++ {
+			c.buf[i] = 0
+		}
+		c.addQuad(c.buf[:])
+		c.bufLen = 0
+	}
+
+	height := bits.Len64(c.leaves - 1)
+	if c.leaves&(c.leaves-1) == 0 {
+		height = bits.TrailingZeros64(c.leaves)
+	}
+
+	var carry []byte
+	for level := 0; level < height; level++ {
+		switch {
+		case c.layers[level] != nil && carry != nil:
+			carry = hashNodes(c.layers[level], carry)
+		case c.layers[level] != nil:
+			carry = hashNodes(c.layers[level], zeroComms[level])
+		case carry != nil:
+			carry = hashNodes(carry, zeroComms[level])
+		}
+	}
+	root := carry
+	if root == nil {
+		root = c.layers[height]
+	}
+
+	return &Result{
+		CID:         PieceCID(root),
+		Digest:      root,
+		PaddedSize:  int64(nodeSize) << height,
+		PayloadSize: c.size,
+	}, nil
+}
+
+func (c *Calc) addQuad(in []byte) {
+	fr32Pad(in, c.quad[:])
+	for i := 0; i < 4; i++ {
+		leaf := make([]byte, nodeSize)
+		copy(leaf, c.quad[i*nodeSize:(i+1)*nodeSize])
+		c.addLeaf(leaf)
+	}
+}
+
+func (c *Calc) addLeaf(node []byte) {
+	c.leaves++
+	for level := 0; ; level++ {
+		if c.layers[level] == nil {
+			c.layers[level] = node
+			return
+		}
+		node = hashNodes(c.layers[level], node)
+		c.layers[level] = nil
+	}
+}
+
+// fr32Pad spreads 127 input bytes over four 32-byte nodes, leaving the two
+// most significant bits of every node zero.
+func fr32Pad(in []byte, out []byte) {
+	copy(out[:31], in[:31])
+	out[31] = in[31] & 0x3f
+
+	for shift, node := uint(6), 1; node < 4; shift, node = shift-2, node+1 {
+		start := 31*node + node - 1
+		for j := 0; j < nodeSize; j++ {
+			lo := in[start+j] >> shift
+			var hi byte
+			if start+j+1 < quadSize {
+				hi = in[start+j+1] << (8 - shift)
+			}
+			out[node*nodeSize+j] = lo | hi
+		}
+		out[node*nodeSize+31] &= 0x3f
+	}
+}
+
+func hashNodes(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	sum := h.Sum(nil)
+	sum[31] &= 0x3f
+	return sum
+}
+
+// PieceCID encodes a commitment digest as a CIDv1 string
+// (fil-commitment-unsealed, sha2-256-trunc254-padded, base32).
+func PieceCID(digest []byte) string {
+	buf := make([]byte, 0, 8+len(digest))
+	buf = appendUvarint(buf, 1)
+	buf = appendUvarint(buf, codecFilCommitmentUnsealed)
+	buf = appendUvarint(buf, hashSHA256Trunc254Padded)
+	buf = appendUvarint(buf, uint64(len(digest)))
+	buf = append(buf, digest...)
+	return "b" + toLower(cidEncoding.EncodeToString(buf))
+}
+
+// PaddedSize returns the piece size CommP produces for a payload of size
+// bytes.
+func PaddedSize(size int64) int64 {
+	padded := int64(MinPaddedSize)
+	for padded/128*127 < size {
+		padded <<= 1
+	}
+	return padded
+}
+
+// Compute streams r through a Calc. progress, when set, is called with the
+// running byte count after every read.
+func Compute(ctx context.Context, r io.Reader, progress func(done int64)) (*Result, error) {
+	calc := New()
+	buf := make([]byte, 1<<20)
+	var done int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			calc.Write(buf[:n])
+			done += int64(n)
+			if progress != nil {
+				progress(done)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return calc.Digest()
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func toLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
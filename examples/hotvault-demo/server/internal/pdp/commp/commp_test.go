@@ -0,0 +1,151 @@
+package commp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// payload returns n deterministic pseudo-random bytes (xorshift32).
+func payload(n int) []byte {
+	b := make([]byte, n)
+	x := uint32(2463534242)
+	for i := range b {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}
+
+// The expected piece CIDs and sizes were produced by
+// github.com/filecoin-project/go-fil-commp-hashhash v0.2.0, the CommP
+// implementation behind pdptool prepare-piece, for the same payloads.
+var vectors = []struct {
+	name       string
+	data       []byte
+	paddedSize int64
+	cid        string
+}{
+	// A single fr32 quad: four leaves.
+	{"127 bytes", payload(127), 128, "baga6ea4seaqiywpg6cbhyer23xvasiryb7hplsuixxl63rot6sp23tvh4q4ceey"},
+	{"127 zero bytes", make([]byte, 127), 128, "baga6ea4seaqdomn3tgwgrh3g532zopskstnbrd2n3sxfqbze7rxt7vqn7veigmy"},
+	// One byte past a quad: the second quad is zero-filled.
+	{"128 bytes", payload(128), 256, "baga6ea4seaqgpzcqq7ytrkdwzgxavm5tml32ngecyd2vrggwxesow4l4ofmmghq"},
+	{"128 zero bytes", make([]byte, 128), 256, "baga6ea4seaqgiktap34inmaex4wbs6cghlq5i2j2yd2bb2zndn5ep7ralzphkdy"},
+	// Three quads: twelve leaves, padded to sixteen with zero nodes.
+	{"381 bytes", payload(381), 512, "baga6ea4seaqbj2uk3ajg4hm3frulzsze4rdsglhpoksqulwuroc4tg256evbinq"},
+	{"381 zero bytes", make([]byte, 381), 512, "baga6ea4seaqfpirydiugkk7up5v666wkm6n6jlw6lby2wxht5mwaqekerdfykjq"},
+	{"1000 bytes", payload(1000), 1024, "baga6ea4seaqbfnuxo62gq4voixccboyyz56l2je4i2ggyqxuue55swssyvymyja"},
+	{"127 KiB", payload(127 << 10), 128 << 10, "baga6ea4seaqhyehrol47tllf2j4le5oz65hrwvjkhifgbbvhfc5erzfwhzd3uby"},
+	{"3 MiB and 17 bytes", payload(3<<20 + 17), 4 << 20, "baga6ea4seaqdl4ujkej3qraui64dzgfj6r2bsac2dzrfriwugvisy7uhkevfamy"},
+	{"3 MiB and 17 zero bytes", make([]byte, 3<<20+17), 4 << 20, "baga6ea4seaqijqccdoqgqwqbx54vui2eazh6ijf5kku5eq3xwokp6tclivuoqei"},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			calc := New()
+			calc.Write(v.data)
+			result, err := calc.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.CID != v.cid {
+				t.Errorf("CID = %s, want %s", result.CID, v.cid)
+			}
+			if result.PaddedSize != v.paddedSize {
+				t.Errorf("PaddedSize = %d, want %d", result.PaddedSize, v.paddedSize)
+			}
+			if result.PayloadSize != int64(len(v.data)) {
+				t.Errorf("PayloadSize = %d, want %d", result.PayloadSize, len(v.data))
+			}
+			if got := PaddedSize(int64(len(v.data))); got != v.paddedSize {
+				t.Errorf("PaddedSize(%d) = %d, want %d", len(v.data), got, v.paddedSize)
+			}
+			if got := PieceCID(result.Digest); got != v.cid {
+				t.Errorf("PieceCID(Digest) = %s, want %s", got, v.cid)
+			}
+		})
+	}
+}
+
+// Writes of any size must give the same commitment as a single write, as
+// uploads are hashed in whatever chunks the reader returns.
+func TestWriteSplits(t *testing.T) {
+	data := payload(5000)
+	single := New()
+	single.Write(data)
+	expected, err := single.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunk := range []int{1, 7, 126, 127, 128, 1000} {
+		split := New()
+		for rest := data; len(rest) > 0; {
+			n := chunk
+			if n > len(rest) {
+				n = len(rest)
+			}
+			split.Write(rest[:n])
+			rest = rest[n:]
+		}
+		got, _ := split.Digest()
+		if got.CID != expected.CID {
+			t.Errorf("writes of %d bytes: CID = %s, want %s", chunk, got.CID, expected.CID)
+		}
+	}
+}
+
+func TestComputeReportsProgress(t *testing.T) {
+	data := payload(3<<20 + 17)
+	var last int64
+	result, err := Compute(context.Background(), bytes.NewReader(data), func(done int64) {
+		if done <= last {
+			t.Errorf("progress went from %d to %d", last, done)
+		}
+		last = done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != int64(len(data)) {
+		t.Errorf("last progress = %d, want %d", last, len(data))
+	}
+	if want := vectors[8].cid; result.CID != want {
+		t.Errorf("CID = %s, want %s", result.CID, want)
+	}
+}
+
+func TestComputeCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Compute(ctx, bytes.NewReader(payload(1000)), nil); err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestEmptyPayload(t *testing.T) {
+	if _, err := New().Digest(); err == nil {
+		t.Error("Digest of an empty payload succeeded")
+	}
+}
+
+func TestFr32Pad(t *testing.T) {
+	in := bytes.Repeat([]byte{0xff}, quadSize)
+	out := make([]byte, 4*nodeSize)
+	fr32Pad(in, out)
+	for node := 0; node < 4; node++ {
+		for j := 0; j < nodeSize; j++ {
+			want := byte(0xff)
+			if j == nodeSize-1 {
+				want = 0x3f
+			}
+			if got := out[node*nodeSize+j]; got != want {
+				t.Fatalf("node %d byte %d = %#x, want %#x", node, j, got, want)
+			}
+		}
+	}
+}
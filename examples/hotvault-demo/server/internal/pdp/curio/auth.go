@@ -0,0 +1,27 @@
+package curio
+
+import (
+	"crypto/ecdsa"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const tokenLifetime = 24 * time.Hour
+
+// KeySource provides the service key requests are signed with. It is
+// consulted on every request so a rotated key takes effect immediately.
+type KeySource interface {
+	SigningKey() *ecdsa.PrivateKey
+}
+
+// signToken creates the bearer token the PDP service expects on every
+// /pdp request.
+func signToken(serviceName string, key *ecdsa.PrivateKey) (string, error) {
+	claims := jwt.MapClaims{
+		"service_name": serviceName,
+		"exp":          time.Now().Add(tokenLifetime).Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	return token.SignedString(key)
+}
@@ -0,0 +1,386 @@
+package curio
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hotvault/backend/internal/pdp"
+	"github.com/hotvault/backend/internal/pdp/commp"
+	"github.com/hotvault/backend/pkg/logger"
+)
+
+const hashCommP = "sha2-256-trunc254-padded"
+
+// Client implements pdp.PDPClient against the PDP service HTTP API.
+type Client struct {
+	service    pdp.Service
+	keys       KeySource
+	httpClient *http.Client
+	log        logger.Logger
+}
+
+func NewClient(service pdp.Service, keys KeySource) *Client {
+	return &Client{
+		service:    service,
+		keys:       keys,
+		httpClient: &http.Client{},
+		log:        logger.NewLogger(),
+	}
+}
+
+// NewFactory returns a pdp.Factory whose clients sign requests with the
+// key currently provided by keys.
+func NewFactory(keys KeySource) pdp.Factory {
+	return func(service pdp.Service) pdp.PDPClient {
+		return NewClient(service, keys)
+	}
+}
+
+type pieceCheck struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+type pieceRequest struct {
+	Check  pieceCheck `json:"check"`
+	Notify string     `json:"notify,omitempty"`
+}
+
+type createProofSetBody struct {
+	RecordKeeper string `json:"recordKeeper"`
+	ExtraData    string `json:"extraData"`
+}
+
+type createStatusResponse struct {
+	CreateMessageHash string  `json:"createMessageHash"`
+	ProofsetCreated   bool    `json:"proofsetCreated"`
+	Service           string  `json:"service"`
+	TxStatus          string  `json:"txStatus"`
+	OK                *bool   `json:"ok"`
+	ProofSetID        *uint64 `json:"proofSetId,omitempty"`
+}
+
+type subrootEntry struct {
+	SubrootCID string `json:"subrootCid"`
+}
+
+type addRootEntry struct {
+	RootCID  string         `json:"rootCid"`
+	Subroots []subrootEntry `json:"subroots"`
+}
+
+type addRootsBody struct {
+	Roots []addRootEntry `json:"roots"`
+}
+
+type proofSetRootEntry struct {
+	RootID        uint64 `json:"rootId"`
+	RootCID       string `json:"rootCid"`
+	SubrootCID    string `json:"subrootCid"`
+	SubrootOffset int64  `json:"subrootOffset"`
+}
+
+type proofSetResponse struct {
+	ID                 uint64              `json:"id"`
+	NextChallengeEpoch *int64              `json:"nextChallengeEpoch"`
+	Roots              []proofSetRootEntry `json:"roots"`
+}
+
+func (c *Client) endpoint(path string) string {
+	return strings.TrimRight(c.service.URL, "/") + path
+}
+
+// do sends an authenticated request and returns the response when its
+// status is one of the expected codes.
+func (c *Client) do(ctx context.Context, op, method, path string, body io.Reader, contentType string, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint(path), body)
+	if err != nil {
+		return nil, &pdp.Error{Op: op, Err: err}
+	}
+
+	token, err := signToken(c.service.Name, c.keys.SigningKey())
+	if err != nil {
+		return nil, &pdp.Error{Op: op, Err: fmt.Errorf("failed to sign service token: %w", err)}
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	c.log.WithField("method", method).WithField("url", req.URL.String()).Debug("Sending PDP service request")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, &pdp.Error{Op: op, Err: err}
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return nil, &pdp.Error{
+		Op:     op,
+		Detail: string(detail),
+		Err:    fmt.Errorf("unexpected status code %d", resp.StatusCode),
+	}
+}
+
+func (c *Client) doJSON(ctx context.Context, op, method, path string, payload interface{}, expected ...int) (*http.Response, error) {
+	var body io.Reader
+	contentType := ""
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return nil, &pdp.Error{Op: op, Err: err}
+		}
+		body = bytes.NewReader(encoded)
+		contentType = "application/json"
+	}
+	return c.do(ctx, op, method, path, body, contentType, expected...)
+}
+
+func decodeJSON(op string, resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &pdp.Error{Op: op, Err: fmt.Errorf("failed to decode response: %w", err)}
+	}
+	return nil
+}
+
+func (c *Client) CreateProofSet(ctx context.Context, req pdp.CreateProofSetRequest) (string, error) {
+	const op = "create proof set"
+	resp, err := c.doJSON(ctx, op, http.MethodPost, "/pdp/proof-sets", createProofSetBody{
+		RecordKeeper: req.RecordKeeper,
+		ExtraData:    req.ExtraData,
+	}, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	location := resp.Header.Get("Location")
+	const prefix = "/pdp/proof-sets/created/"
+	idx := strings.Index(location, prefix)
+	if idx == -1 {
+		return "", &pdp.Error{Op: op, Detail: location, Err: errors.New("unexpected Location header")}
+	}
+	return location[idx+len(prefix):], nil
+}
+
+func (c *Client) GetProofSetStatus(ctx context.Context, txHash string) (*pdp.CreateStatus, error) {
+	const op = "get proof set status"
+	resp, err := c.doJSON(ctx, op, http.MethodGet, "/pdp/proof-sets/created/"+url.PathEscape(txHash), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var body createStatusResponse
+	if err := decodeJSON(op, resp, &body); err != nil {
+		return nil, err
+	}
+
+	status := &pdp.CreateStatus{
+		TxHash:   txHash,
+		TxStatus: body.TxStatus,
+		Created:  body.ProofsetCreated,
+	}
+	if body.OK != nil {
+		status.TxSuccess = *body.OK
+	}
+	if body.ProofSetID != nil {
+		status.ID = strconv.FormatUint(*body.ProofSetID, 10)
+	}
+	return status, nil
+}
+
+// PreparePiece computes the piece commitment locally.
+func (c *Client) PreparePiece(ctx context.Context, filePath string) (*pdp.PreparedPiece, error) {
+	result, err := computeCommP(ctx, filePath)
+	if err != nil {
+		return nil, &pdp.Error{Op: "prepare piece", Err: err}
+	}
+	return &pdp.PreparedPiece{CID: result.CID, PaddedSize: result.PaddedSize}, nil
+}
+
+func (c *Client) UploadFile(ctx context.Context, filePath string) (*pdp.UploadResult, error) {
+	const op = "upload file"
+	piece, err := computeCommP(ctx, filePath)
+	if err != nil {
+		return nil, &pdp.Error{Op: op, Err: err}
+	}
+	check := pieceCheck{Name: hashCommP, Hash: hex.EncodeToString(piece.Digest), Size: piece.PayloadSize}
+
+	resp, err := c.doJSON(ctx, op, http.MethodPost, "/pdp/piece", pieceRequest{Check: check}, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		c.log.WithField("pieceCID", piece.CID).Info("Piece already present at PDP service, skipping upload")
+	} else {
+		uploadPath := resp.Header.Get("Location")
+		if uploadPath == "" {
+			return nil, &pdp.Error{Op: op, Err: errors.New("service did not return an upload location")}
+		}
+		if err := c.putPiece(ctx, uploadPath, filePath, piece.PayloadSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pdp.UploadResult{CID: piece.CID + ":" + piece.CID, RootCID: piece.CID, SubrootCID: piece.CID}, nil
+}
+
+func (c *Client) putPiece(ctx context.Context, uploadPath, filePath string, size int64) error {
+	const op = "upload file"
+	file, err := os.Open(filePath)
+	if err != nil {
+		return &pdp.Error{Op: op, Err: err}
+	}
+	defer file.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.endpoint(uploadPath), file)
+	if err != nil {
+		return &pdp.Error{Op: op, Err: err}
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &pdp.Error{Op: op, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return &pdp.Error{Op: op, Detail: string(detail), Err: fmt.Errorf("unexpected status code %d", resp.StatusCode)}
+	}
+	return nil
+}
+
+func (c *Client) AddRoots(ctx context.Context, proofSetID string, roots []pdp.Root) error {
+	body := addRootsBody{Roots: make([]addRootEntry, 0, len(roots))}
+	for _, root := range roots {
+		entry := addRootEntry{RootCID: root.CID}
+		subroots := root.Subroots
+		if len(subroots) == 0 {
+			subroots = []string{root.CID}
+		}
+		for _, sub := range subroots {
+			entry.Subroots = append(entry.Subroots, subrootEntry{SubrootCID: sub})
+		}
+		body.Roots = append(body.Roots, entry)
+	}
+
+	resp, err := c.doJSON(ctx, "add roots", http.MethodPost, "/pdp/proof-sets/"+url.PathEscape(proofSetID)+"/roots", body, http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) GetProofSet(ctx context.Context, proofSetID string) (*pdp.ProofSet, error) {
+	const op = "get proof set"
+	resp, err := c.doJSON(ctx, op, http.MethodGet, "/pdp/proof-sets/"+url.PathEscape(proofSetID), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var body proofSetResponse
+	if err := decodeJSON(op, resp, &body); err != nil {
+		return nil, err
+	}
+
+	// The service lists one entry per subroot; group them by root.
+	byID := make(map[uint64]*pdp.Root)
+	ids := make([]uint64, 0)
+	for _, entry := range body.Roots {
+		root, ok := byID[entry.RootID]
+		if !ok {
+			root = &pdp.Root{ID: strconv.FormatUint(entry.RootID, 10), CID: entry.RootCID}
+			byID[entry.RootID] = root
+			ids = append(ids, entry.RootID)
+		}
+		if entry.SubrootCID != "" {
+			root.Subroots = append(root.Subroots, entry.SubrootCID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	proofSet := &pdp.ProofSet{ID: strconv.FormatUint(body.ID, 10)}
+	for _, id := range ids {
+		proofSet.Roots = append(proofSet.Roots, *byID[id])
+	}
+	return proofSet, nil
+}
+
+func (c *Client) RemoveRoots(ctx context.Context, proofSetID string, rootIDs []string) error {
+	for _, rootID := range rootIDs {
+		path := "/pdp/proof-sets/" + url.PathEscape(proofSetID) + "/roots/" + url.PathEscape(rootID)
+		resp, err := c.doJSON(ctx, "remove roots", http.MethodDelete, path, nil, http.StatusNoContent, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (c *Client) DownloadFile(ctx context.Context, cid string, outputPath string) error {
+	const op = "download file"
+	pieceCID := pdp.ParseRoot(cid).CID
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/piece/"+url.PathEscape(pieceCID)), nil)
+	if err != nil {
+		return &pdp.Error{Op: op, Err: err}
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &pdp.Error{Op: op, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return &pdp.Error{Op: op, Detail: string(detail), Err: fmt.Errorf("unexpected status code %d", resp.StatusCode)}
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return &pdp.Error{Op: op, Err: err}
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return &pdp.Error{Op: op, Err: err}
+	}
+	if err := out.Close(); err != nil {
+		return &pdp.Error{Op: op, Err: err}
+	}
+	return nil
+}
+
+func computeCommP(ctx context.Context, path string) (*commp.Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return commp.Compute(ctx, file, nil)
+}
@@ -0,0 +1,309 @@
+package curio
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hotvault/backend/internal/pdp"
+	"github.com/hotvault/backend/internal/pdp/commp"
+)
+
+type staticKey struct{ key *ecdsa.PrivateKey }
+
+func (k staticKey) SigningKey() *ecdsa.PrivateKey { return k.key }
+
+// fakeService is a PDP service that checks the bearer token of every /pdp
+// request and records the requests it served.
+type fakeService struct {
+	t      *testing.T
+	key    *ecdsa.PrivateKey
+	mux    *http.ServeMux
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newFakeService(t *testing.T) *fakeService {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeService{t: t, key: key, mux: http.NewServeMux()}
+	s.server = httptest.NewServer(s)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.mu.Unlock()
+
+	// Piece data is sent to the upload location without a token.
+	if r.Method != http.MethodPut {
+		if err := s.verify(r.Header.Get("Authorization")); err != nil {
+			s.t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// verify checks an ES256 bearer token signed by the service key for the
+// "hotvault" service.
+func (s *fakeService) verify(header string) error {
+	raw, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return errors.New("no bearer token")
+	}
+	token, err := jwt.Parse(raw, func(*jwt.Token) (interface{}, error) {
+		return &s.key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"ES256"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return err
+	}
+	if name := token.Claims.(jwt.MapClaims)["service_name"]; name != "hotvault" {
+		return errors.New("service_name is " + name.(string))
+	}
+	return nil
+}
+
+func (s *fakeService) client() *Client {
+	return NewClient(pdp.Service{Name: "hotvault", URL: s.server.URL + "/"}, staticKey{s.key})
+}
+
+func (s *fakeService) served() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func decodeBody(t *testing.T, r *http.Request, out interface{}) {
+	t.Helper()
+	if r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("%s %s: Content-Type %q", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+	}
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+func TestSignToken(t *testing.T) {
+	s := newFakeService(t)
+	token, err := signToken("hotvault", s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verify("Bearer " + token); err != nil {
+		t.Errorf("token does not verify: %v", err)
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if token, _ = signToken("hotvault", other); s.verify("Bearer "+token) == nil {
+		t.Error("token signed by another key verified")
+	}
+	if token, _ = signToken("other", s.key); s.verify("Bearer "+token) == nil {
+		t.Error("token for another service verified")
+	}
+}
+
+func TestCreateProofSet(t *testing.T) {
+	s := newFakeService(t)
+	s.mux.HandleFunc("POST /pdp/proof-sets", func(w http.ResponseWriter, r *http.Request) {
+		var body createProofSetBody
+		decodeBody(t, r, &body)
+		if body.RecordKeeper != "0xkeeper" || body.ExtraData != "0x01" {
+			t.Errorf("create body: %+v", body)
+		}
+		w.Header().Set("Location", "/pdp/proof-sets/created/0xabc")
+		w.WriteHeader(http.StatusCreated)
+	})
+	s.mux.HandleFunc("GET /pdp/proof-sets/created/0xabc", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"createMessageHash":"0xabc","txStatus":"pending","proofsetCreated":false,"ok":null}`)
+	})
+	s.mux.HandleFunc("GET /pdp/proof-sets/created/0xdef", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"createMessageHash":"0xdef","txStatus":"confirmed","proofsetCreated":true,"ok":true,"proofSetId":7}`)
+	})
+	client := s.client()
+	ctx := context.Background()
+
+	txHash, err := client.CreateProofSet(ctx, pdp.CreateProofSetRequest{RecordKeeper: "0xkeeper", ExtraData: "0x01"})
+	if err != nil || txHash != "0xabc" {
+		t.Fatalf("CreateProofSet = %q, %v", txHash, err)
+	}
+
+	status, err := client.GetProofSetStatus(ctx, txHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (pdp.CreateStatus{TxHash: "0xabc", TxStatus: "pending"}); *status != want {
+		t.Errorf("pending status = %+v, want %+v", *status, want)
+	}
+	status, err = client.GetProofSetStatus(ctx, "0xdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (pdp.CreateStatus{TxHash: "0xdef", TxStatus: "confirmed", TxSuccess: true, Created: true, ID: "7"}); *status != want {
+		t.Errorf("created status = %+v, want %+v", *status, want)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	s := newFakeService(t)
+	data := []byte(strings.Repeat("hotvault piece data ", 20))
+	path := filepath.Join(t.TempDir(), "piece.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	calc := commp.New()
+	calc.Write(data)
+	piece, err := calc.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present := false
+	var stored []byte
+	s.mux.HandleFunc("POST /pdp/piece", func(w http.ResponseWriter, r *http.Request) {
+		var body pieceRequest
+		decodeBody(t, r, &body)
+		if want := (pieceCheck{Name: hashCommP, Hash: hex.EncodeToString(piece.Digest), Size: int64(len(data))}); body.Check != want {
+			t.Errorf("piece check = %+v, want %+v", body.Check, want)
+		}
+		if present {
+			return
+		}
+		w.Header().Set("Location", "/pdp/piece/upload/u1")
+		w.WriteHeader(http.StatusCreated)
+	})
+	s.mux.HandleFunc("PUT /pdp/piece/upload/u1", func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != int64(len(data)) {
+			t.Errorf("PUT Content-Length = %d, want %d", r.ContentLength, len(data))
+		}
+		stored, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client := s.client()
+
+	result, err := client.UploadFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (pdp.UploadResult{CID: piece.CID + ":" + piece.CID, RootCID: piece.CID, SubrootCID: piece.CID}); *result != want {
+		t.Errorf("UploadFile = %+v, want %+v", *result, want)
+	}
+	if string(stored) != string(data) {
+		t.Errorf("service stored %d bytes, want the %d of the file", len(stored), len(data))
+	}
+
+	// A piece the service already has is not sent again.
+	present = true
+	if _, err := client.UploadFile(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"POST /pdp/piece", "PUT /pdp/piece/upload/u1", "POST /pdp/piece"}
+	if got := s.served(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %v, want %v", got, want)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	s := newFakeService(t)
+	s.mux.HandleFunc("POST /pdp/proof-sets/7/roots", func(w http.ResponseWriter, r *http.Request) {
+		var body addRootsBody
+		decodeBody(t, r, &body)
+		want := addRootsBody{Roots: []addRootEntry{
+			{RootCID: "root1", Subroots: []subrootEntry{{SubrootCID: "root1"}}},
+			{RootCID: "root2", Subroots: []subrootEntry{{SubrootCID: "sub1"}, {SubrootCID: "sub2"}}},
+		}}
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("add-roots body = %+v, want %+v", body, want)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	s.mux.HandleFunc("GET /pdp/proof-sets/7", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":7,"nextChallengeEpoch":100,"roots":[
+			{"rootId":2,"rootCid":"root2","subrootCid":"sub1","subrootOffset":0},
+			{"rootId":1,"rootCid":"root1","subrootCid":"root1","subrootOffset":0},
+			{"rootId":2,"rootCid":"root2","subrootCid":"sub2","subrootOffset":128}]}`)
+	})
+	s.mux.HandleFunc("DELETE /pdp/proof-sets/7/roots/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client := s.client()
+	ctx := context.Background()
+
+	if err := client.AddRoots(ctx, "7", []pdp.Root{{CID: "root1"}, {CID: "root2", Subroots: []string{"sub1", "sub2"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	proofSet, err := client.GetProofSet(ctx, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pdp.ProofSet{ID: "7", Roots: []pdp.Root{
+		{ID: "1", CID: "root1", Subroots: []string{"root1"}},
+		{ID: "2", CID: "root2", Subroots: []string{"sub1", "sub2"}},
+	}}
+	if !reflect.DeepEqual(proofSet, want) {
+		t.Errorf("GetProofSet = %+v, want %+v", proofSet, want)
+	}
+
+	if err := client.RemoveRoots(ctx, "7", []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	served := s.served()
+	if got, want := served[len(served)-2:], []string{"DELETE /pdp/proof-sets/7/roots/1", "DELETE /pdp/proof-sets/7/roots/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remove requests = %v, want %v", got, want)
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	s := newFakeService(t)
+	s.mux.HandleFunc("/pdp/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "proof set not found", http.StatusNotFound)
+	})
+	client := s.client()
+	ctx := context.Background()
+
+	checks := map[string]func() error{
+		"get proof set status": func() error { _, err := client.GetProofSetStatus(ctx, "0xabc"); return err },
+		"get proof set":        func() error { _, err := client.GetProofSet(ctx, "7"); return err },
+		"add roots":            func() error { return client.AddRoots(ctx, "7", []pdp.Root{{CID: "root1"}}) },
+		"remove roots":         func() error { return client.RemoveRoots(ctx, "7", []string{"1"}) },
+	}
+	for op, call := range checks {
+		var pdpErr *pdp.Error
+		if err := call(); !errors.As(err, &pdpErr) {
+			t.Errorf("%s: error %v is not a *pdp.Error", op, err)
+		} else if pdpErr.Op != op || pdpErr.Detail != "proof set not found\n" || !strings.Contains(pdpErr.Error(), "unexpected status code 404") {
+			t.Errorf("%s: %q", op, pdpErr)
+		}
+	}
+
+	// A created proof set must be reported at its status location.
+	s.mux.HandleFunc("POST /pdp/proof-sets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/elsewhere")
+		w.WriteHeader(http.StatusCreated)
+	})
+	if _, err := client.CreateProofSet(ctx, pdp.CreateProofSetRequest{}); err == nil || !strings.Contains(err.Error(), "unexpected Location header") {
+		t.Errorf("CreateProofSet with a bad Location: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package pdp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/hotvault/backend/internal/pdp/commp"
+)
+
+// FakeClient is an in-memory PDPClient. Proof sets are created immediately
+// and uploaded files are kept in memory so they can be downloaded again.
+type FakeClient struct {
+	mu         sync.Mutex
+	nextSetID  int
+	nextRootID map[string]int
+	creates    map[string]*CreateStatus
+	proofSets  map[string]*ProofSet
+	pieces     map[string][]byte
+	failures   map[string]error
+}
+
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		nextSetID:  1,
+		nextRootID: make(map[string]int),
+		creates:    make(map[string]*CreateStatus),
+		proofSets:  make(map[string]*ProofSet),
+		pieces:     make(map[string][]byte),
+		failures:   make(map[string]error),
+	}
+}
+
+// Factory returns a Factory that hands out this client for every service.
+func (f *FakeClient) Factory() Factory {
+	return func(Service) PDPClient { return f }
+}
+
+// FailNext makes the next call to op (e.g. "AddRoots") return err.
+func (f *FakeClient) FailNext(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = err
+}
+
+func (f *FakeClient) takeFailure(op string) error {
+	if err, ok := f.failures[op]; ok {
+		delete(f.failures, op)
+		return err
+	}
+	return nil
+}
+
+func (f *FakeClient) CreateProofSet(ctx context.Context, req CreateProofSetRequest) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("CreateProofSet"); err != nil {
+		return "", err
+	}
+
+	id := strconv.Itoa(f.nextSetID)
+	f.nextSetID++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("proofset-%s-%s", id, req.ExtraData)))
+	txHash := "0x" + hex.EncodeToString(sum[:])
+
+	f.proofSets[id] = &ProofSet{ID: id}
+	f.creates[txHash] = &CreateStatus{
+		TxHash:    txHash,
+		TxStatus:  TxStatusConfirmed,
+		TxSuccess: true,
+		Created:   true,
+		ID:        id,
+	}
+	return txHash, nil
+}
+
+func (f *FakeClient) GetProofSetStatus(ctx context.Context, txHash string) (*CreateStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("GetProofSetStatus"); err != nil {
+		return nil, err
+	}
+
+	status, ok := f.creates[txHash]
+	if !ok {
+		return nil, &Error{Op: "get proof set status", Detail: "unknown transaction " + txHash}
+	}
+	copied := *status
+	return &copied, nil
+}
+
+func (f *FakeClient) PreparePiece(ctx context.Context, filePath string) (*PreparedPiece, error) {
+	f.mu.Lock()
+	err := f.takeFailure("PreparePiece")
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, &Error{Op: "prepare piece", Err: err}
+	}
+	piece, err := pieceCommitment(data)
+	if err != nil {
+		return nil, &Error{Op: "prepare piece", Err: err}
+	}
+	return &PreparedPiece{CID: piece.CID, PaddedSize: piece.PaddedSize}, nil
+}
+
+func (f *FakeClient) UploadFile(ctx context.Context, filePath string) (*UploadResult, error) {
+	f.mu.Lock()
+	err := f.takeFailure("UploadFile")
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, &Error{Op: "upload file", Err: err}
+	}
+	piece, err := pieceCommitment(data)
+	if err != nil {
+		return nil, &Error{Op: "upload file", Err: err}
+	}
+	cid := piece.CID
+
+	f.mu.Lock()
+	f.pieces[cid] = data
+	f.mu.Unlock()
+
+	return &UploadResult{CID: cid + ":" + cid, RootCID: cid, SubrootCID: cid}, nil
+}
+
+func (f *FakeClient) AddRoots(ctx context.Context, proofSetID string, roots []Root) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("AddRoots"); err != nil {
+		return err
+	}
+
+	ps, ok := f.proofSets[proofSetID]
+	if !ok {
+		return &Error{Op: "add roots", Detail: "can't add root to non-existing proof set " + proofSetID}
+	}
+	for _, root := range roots {
+		for _, sub := range root.Subroots {
+			if _, ok := f.pieces[sub]; !ok {
+				return &Error{Op: "add roots", Detail: fmt.Sprintf("subroot CID %s not found or does not belong to service", sub)}
+			}
+		}
+	}
+	for _, root := range roots {
+		root.ID = strconv.Itoa(f.nextRootID[proofSetID])
+		f.nextRootID[proofSetID]++
+		ps.Roots = append(ps.Roots, root)
+	}
+	return nil
+}
+
+func (f *FakeClient) GetProofSet(ctx context.Context, proofSetID string) (*ProofSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("GetProofSet"); err != nil {
+		return nil, err
+	}
+
+	ps, ok := f.proofSets[proofSetID]
+	if !ok {
+		return nil, &Error{Op: "get proof set", Detail: "proof set " + proofSetID + " not found"}
+	}
+	copied := &ProofSet{ID: ps.ID, Roots: append([]Root(nil), ps.Roots...)}
+	return copied, nil
+}
+
+func (f *FakeClient) RemoveRoots(ctx context.Context, proofSetID string, rootIDs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure("RemoveRoots"); err != nil {
+		return err
+	}
+
+	ps, ok := f.proofSets[proofSetID]
+	if !ok {
+		return &Error{Op: "remove roots", Detail: "proof set " + proofSetID + " not found"}
+	}
+	remove := make(map[string]bool, len(rootIDs))
+	for _, id := range rootIDs {
+		remove[id] = true
+	}
+	kept := ps.Roots[:0]
+	for _, root := range ps.Roots {
+		if !remove[root.ID] {
+			kept = append(kept, root)
+		}
+	}
+	ps.Roots = kept
+	return nil
+}
+
+func (f *FakeClient) DownloadFile(ctx context.Context, cid string, outputPath string) error {
+	f.mu.Lock()
+	err := f.takeFailure("DownloadFile")
+	data, ok := f.pieces[ParseRoot(cid).CID]
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &Error{Op: "download file", Detail: "piece " + cid + " not found"}
+	}
+	return os.WriteFile(outputPath, data, 0644)
+}
+
+func pieceCommitment(data []byte) (*commp.Result, error) {
+	calc := commp.New()
+	calc.Write(data)
+	return calc.Digest()
+}
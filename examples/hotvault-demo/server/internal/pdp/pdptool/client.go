@@ -0,0 +1,230 @@
+package pdptool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hotvault/backend/internal/pdp"
+	"github.com/hotvault/backend/internal/pdp/pdptool/parser"
+	"github.com/hotvault/backend/pkg/logger"
+)
+
+// ServiceSecretFile is the name pdptool reads the service secret from,
+// relative to its working directory.
+const ServiceSecretFile = "pdpservice.json"
+
+// Client implements pdp.PDPClient by running the pdptool binary. Every
+// command runs in the directory holding the service secret; the process
+// working directory is never changed.
+type Client struct {
+	path       string
+	secretPath string
+	service    pdp.Service
+	log        logger.Logger
+}
+
+// NewClient returns a client running the pdptool binary at path with the
+// service secret at secretPath. pdptool only looks for the secret in its
+// working directory, so secretPath must be named pdpservice.json.
+func NewClient(path, secretPath string, service pdp.Service) (*Client, error) {
+	if secretPath == "" {
+		secretPath = filepath.Join(filepath.Dir(path), ServiceSecretFile)
+	}
+	if filepath.Base(secretPath) != ServiceSecretFile {
+		return nil, fmt.Errorf("pdptool service secret must be named %s, got %s", ServiceSecretFile, secretPath)
+	}
+	return &Client{
+		path:       path,
+		secretPath: secretPath,
+		service:    service,
+		log:        logger.NewLogger(),
+	}, nil
+}
+
+// NewFactory returns a pdp.Factory producing clients for the given binary
+// and service secret.
+func NewFactory(path, secretPath string) (pdp.Factory, error) {
+	if _, err := NewClient(path, secretPath, pdp.Service{}); err != nil {
+		return nil, err
+	}
+	return func(service pdp.Service) pdp.PDPClient {
+		client, _ := NewClient(path, secretPath, service)
+		return client
+	}, nil
+}
+
+func (c *Client) serviceArgs() []string {
+	return []string{"--service-url", c.service.URL, "--service-name", c.service.Name}
+}
+
+func (c *Client) run(ctx context.Context, op string, args ...string) (string, string, error) {
+	if c.path == "" {
+		return "", "", &pdp.Error{Op: op, Err: errors.New("pdptool path not configured")}
+	}
+	if _, err := os.Stat(c.path); os.IsNotExist(err) {
+		return "", "", &pdp.Error{Op: op, Err: fmt.Errorf("pdptool executable not found at %s", c.path)}
+	}
+
+	cmd := exec.CommandContext(ctx, c.path, args...)
+	cmd.Dir = filepath.Dir(c.secretPath)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	c.log.WithField("command", c.path).
+		WithField("dir", cmd.Dir).
+		WithField("args", strings.Join(args, " ")).
+		Info("Executing pdptool " + args[0] + " command")
+
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		c.log.WithField("error", err.Error()).
+			WithField("stderr", stderr.String()).
+			WithField("stdout", stdout.String()).
+			Error("pdptool " + args[0] + " command failed")
+		return stdout.String(), stderr.String(), &pdp.Error{Op: op, Detail: stderr.String(), Err: err}
+	}
+
+	if stderr.Len() > 0 {
+		c.log.WithField("stderr", stderr.String()).Warning("pdptool " + args[0] + " command succeeded but produced output on stderr")
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+func (c *Client) runWithService(ctx context.Context, op string, args ...string) (string, error) {
+	if _, err := os.Stat(c.secretPath); err != nil {
+		return "", &pdp.Error{Op: op, Err: fmt.Errorf("service secret not available at %s: %w", c.secretPath, err)}
+	}
+	stdout, _, err := c.run(ctx, op, args...)
+	return stdout, err
+}
+
+func (c *Client) CreateProofSet(ctx context.Context, req pdp.CreateProofSetRequest) (string, error) {
+	args := append([]string{"create-proof-set"}, c.serviceArgs()...)
+	args = append(args, "--recordkeeper", req.RecordKeeper, "--extra-data", req.ExtraData)
+
+	output, err := c.runWithService(ctx, "create proof set", args...)
+	if err != nil {
+		return "", err
+	}
+
+	txHash, err := parser.CreateProofSet(output)
+	if err != nil {
+		return "", &pdp.Error{Op: "create proof set", Detail: output, Err: err}
+	}
+	return txHash, nil
+}
+
+func (c *Client) GetProofSetStatus(ctx context.Context, txHash string) (*pdp.CreateStatus, error) {
+	args := append([]string{"get-proof-set-create-status"}, c.serviceArgs()...)
+	args = append(args, "--tx-hash", txHash)
+
+	output, err := c.runWithService(ctx, "get proof set status", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := parser.CreateStatus(txHash, output)
+	if err != nil {
+		return nil, &pdp.Error{Op: "get proof set status", Detail: output, Err: err}
+	}
+	return status, nil
+}
+
+func (c *Client) PreparePiece(ctx context.Context, filePath string) (*pdp.PreparedPiece, error) {
+	output, _, err := c.run(ctx, "prepare piece", "prepare-piece", filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	piece, err := parser.PreparePiece(output)
+	if err != nil {
+		return nil, &pdp.Error{Op: "prepare piece", Detail: output, Err: err}
+	}
+	return piece, nil
+}
+
+func (c *Client) UploadFile(ctx context.Context, filePath string) (*pdp.UploadResult, error) {
+	args := append([]string{"upload-file"}, c.serviceArgs()...)
+	args = append(args, filePath)
+
+	output, err := c.runWithService(ctx, "upload file", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := parser.UploadFile(output)
+	if err != nil {
+		return nil, &pdp.Error{Op: "upload file", Detail: output, Err: err}
+	}
+	return result, nil
+}
+
+func (c *Client) AddRoots(ctx context.Context, proofSetID string, roots []pdp.Root) error {
+	args := append([]string{"add-roots"}, c.serviceArgs()...)
+	args = append(args, "--proof-set-id", proofSetID)
+	for _, root := range roots {
+		args = append(args, "--root", root.String())
+	}
+
+	_, err := c.runWithService(ctx, "add roots", args...)
+	return err
+}
+
+func (c *Client) GetProofSet(ctx context.Context, proofSetID string) (*pdp.ProofSet, error) {
+	args := append([]string{"get-proof-set"}, c.serviceArgs()...)
+	args = append(args, proofSetID)
+
+	output, err := c.runWithService(ctx, "get proof set", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	proofSet, err := parser.ProofSet(proofSetID, output)
+	if err != nil {
+		return nil, &pdp.Error{Op: "get proof set", Detail: output, Err: err}
+	}
+	return proofSet, nil
+}
+
+func (c *Client) RemoveRoots(ctx context.Context, proofSetID string, rootIDs []string) error {
+	for _, rootID := range rootIDs {
+		args := append([]string{"remove-roots"}, c.serviceArgs()...)
+		args = append(args, "--proof-set-id", proofSetID, "--root-id", rootID)
+		if _, err := c.runWithService(ctx, "remove roots", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) DownloadFile(ctx context.Context, cid string, outputPath string) error {
+	chunkFile, err := os.CreateTemp("", "pdp-chunks-*.txt")
+	if err != nil {
+		return &pdp.Error{Op: "download file", Err: err}
+	}
+	defer os.Remove(chunkFile.Name())
+
+	_, err = chunkFile.WriteString(pdp.ParseRoot(cid).CID)
+	chunkFile.Close()
+	if err != nil {
+		return &pdp.Error{Op: "download file", Err: err}
+	}
+
+	_, _, err = c.run(ctx, "download file",
+		"download-file",
+		"--service-url", c.service.URL,
+		"--chunk-file", chunkFile.Name(),
+		"--output-file", outputPath,
+	)
+	return err
+}
@@ -0,0 +1,156 @@
+// Package parser turns the human readable output of pdptool commands into
+// pdp types.
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hotvault/backend/internal/pdp"
+)
+
+var (
+	locationRegex   = regexp.MustCompile(`Location: /pdp/proof-sets/created/(0x[a-fA-F0-9]{64})`)
+	proofSetIDRegex = regexp.MustCompile(`ProofSet ID:[ \t]*(\d+)`)
+	createdRegex    = regexp.MustCompile(`Proofset Created:[ \t]*(true|false)`)
+	txStatusRegex   = regexp.MustCompile(`Transaction Status:[ \t]*(confirmed|pending|failed)`)
+	txSuccessRegex  = regexp.MustCompile(`Transaction Successful:[ \t]*(true|false|Pending)`)
+	cidRegex        = regexp.MustCompile(`^(baga[a-zA-Z0-9]+)(?::(baga[a-zA-Z0-9]+))?$`)
+	pieceCIDRegex   = regexp.MustCompile(`(baga[a-zA-Z0-9]+)`)
+	paddedSizeRegex = regexp.MustCompile(`(?i)padded piece size:[ \t]*(\d+)`)
+)
+
+// FormatError reports pdptool output that did not match the expected format.
+type FormatError struct {
+	Command string
+	Reason  string
+	Output  string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("unrecognized %s output: %s", e.Command, e.Reason)
+}
+
+// CreateProofSet extracts the transaction hash from the Location header
+// printed by `pdptool create-proof-set`.
+func CreateProofSet(output string) (string, error) {
+	matches := locationRegex.FindStringSubmatch(output)
+	if len(matches) < 2 {
+		return "", &FormatError{Command: "create-proof-set", Reason: "no Location header with transaction hash", Output: output}
+	}
+	return matches[1], nil
+}
+
+// CreateStatus parses `pdptool get-proof-set-create-status`. The proof set ID
+// is only present once the proof set has been created.
+func CreateStatus(txHash, output string) (*pdp.CreateStatus, error) {
+	status := &pdp.CreateStatus{TxHash: txHash}
+
+	m := txStatusRegex.FindStringSubmatch(output)
+	if len(m) < 2 {
+		return nil, &FormatError{Command: "get-proof-set-create-status", Reason: "no Transaction Status line", Output: output}
+	}
+	status.TxStatus = m[1]
+
+	if m := txSuccessRegex.FindStringSubmatch(output); len(m) > 1 {
+		status.TxSuccess = m[1] == "true"
+	}
+	if m := createdRegex.FindStringSubmatch(output); len(m) > 1 {
+		status.Created = m[1] == "true"
+	}
+	if m := proofSetIDRegex.FindStringSubmatch(output); len(m) > 1 {
+		status.ID = m[1]
+	}
+	if status.Created && status.ID == "" {
+		return nil, &FormatError{Command: "get-proof-set-create-status", Reason: "proof set created but no ProofSet ID line", Output: output}
+	}
+	return status, nil
+}
+
+// PreparePiece parses `pdptool prepare-piece`.
+func PreparePiece(output string) (*pdp.PreparedPiece, error) {
+	m := pieceCIDRegex.FindStringSubmatch(output)
+	if len(m) < 2 {
+		return nil, &FormatError{Command: "prepare-piece", Reason: "no piece CID", Output: output}
+	}
+	piece := &pdp.PreparedPiece{CID: m[1]}
+
+	if m := paddedSizeRegex.FindStringSubmatch(output); len(m) > 1 {
+		size, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, &FormatError{Command: "prepare-piece", Reason: "invalid padded piece size " + m[1], Output: output}
+		}
+		piece.PaddedSize = size
+	}
+	return piece, nil
+}
+
+// UploadFile parses `pdptool upload-file`, which prints the compound
+// root:subroot CID on its last line.
+func UploadFile(output string) (*pdp.UploadResult, error) {
+	lines := strings.Split(output, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		matches := cidRegex.FindStringSubmatch(strings.TrimSpace(lines[i]))
+		if len(matches) > 1 {
+			result := &pdp.UploadResult{CID: matches[0], RootCID: matches[1], SubrootCID: matches[1]}
+			if len(matches) > 2 && matches[2] != "" {
+				result.SubrootCID = matches[2]
+			}
+			return result, nil
+		}
+	}
+
+	if strings.TrimSpace(output) == "" {
+		return nil, &FormatError{Command: "upload-file", Reason: "empty output", Output: output}
+	}
+	return nil, &FormatError{Command: "upload-file", Reason: "no line with a piece CID", Output: output}
+}
+
+// ProofSet parses `pdptool get-proof-set`. Every "Root ID:" line starts a new
+// root; the "Root CID:" and "Subroot CID:" lines that follow belong to it.
+func ProofSet(proofSetID, output string) (*pdp.ProofSet, error) {
+	proofSet := &pdp.ProofSet{ID: proofSetID}
+	recognized := false
+
+	var current *pdp.Root
+	for n, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, "Proof Set ID:") || strings.Contains(line, "ProofSet ID:") || strings.HasPrefix(line, "Roots:") {
+			recognized = true
+			continue
+		}
+		if idx := strings.Index(line, "Root ID:"); idx != -1 {
+			recognized = true
+			value := strings.TrimSpace(line[idx+len("Root ID:"):])
+			if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, &FormatError{Command: "get-proof-set", Reason: fmt.Sprintf("line %d: invalid root ID %q", n+1, value), Output: output}
+			}
+			proofSet.Roots = append(proofSet.Roots, pdp.Root{ID: value})
+			current = &proofSet.Roots[len(proofSet.Roots)-1]
+			continue
+		}
+		if idx := strings.Index(line, "Subroot CID:"); idx != -1 {
+			if current == nil {
+				return nil, &FormatError{Command: "get-proof-set", Reason: fmt.Sprintf("line %d: subroot CID before any root ID", n+1), Output: output}
+			}
+			current.Subroots = append(current.Subroots, strings.TrimSpace(line[idx+len("Subroot CID:"):]))
+		} else if idx := strings.Index(line, "Root CID:"); idx != -1 {
+			if current == nil {
+				return nil, &FormatError{Command: "get-proof-set", Reason: fmt.Sprintf("line %d: root CID before any root ID", n+1), Output: output}
+			}
+			current.CID = strings.TrimSpace(line[idx+len("Root CID:"):])
+		}
+	}
+
+	if !recognized {
+		return nil, &FormatError{Command: "get-proof-set", Reason: "no proof set or root lines", Output: output}
+	}
+	for _, root := range proofSet.Roots {
+		if root.CID == "" {
+			return nil, &FormatError{Command: "get-proof-set", Reason: "root " + root.ID + " has no Root CID line", Output: output}
+		}
+	}
+	return proofSet, nil
+}
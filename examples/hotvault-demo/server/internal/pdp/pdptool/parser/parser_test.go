@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the .golden files from the parser output")
+
+const testTxHash = "0x3f2c1d4e5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d"
+
+// parse runs the parser for the command a sample is named after, the part
+// of its file name before any "_".
+func parse(t *testing.T, command, output string) (interface{}, error) {
+	switch command {
+	case "create-proof-set":
+		return CreateProofSet(output)
+	case "create-status":
+		return CreateStatus(testTxHash, output)
+	case "prepare-piece":
+		return PreparePiece(output)
+	case "upload-file":
+		return UploadFile(output)
+	case "get-proof-set":
+		return ProofSet("42", output)
+	}
+	t.Fatalf("no parser for command %q", command)
+	return nil, nil
+}
+
+// goldenResult is what a .golden file records for a sample: the parsed
+// result, or the reason of the FormatError it is rejected with.
+type goldenResult struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// TestGolden parses every pdptool output sample in testdata and compares
+// the result with the sample's .golden file. Run with -update after
+// changing the parser to rewrite them.
+func TestGolden(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatal("no samples in testdata")
+	}
+
+	for _, sample := range samples {
+		name := strings.TrimSuffix(filepath.Base(sample), ".txt")
+		t.Run(name, func(t *testing.T) {
+			output, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got goldenResult
+			result, err := parse(t, strings.SplitN(name, "_", 2)[0], string(output))
+			if err != nil {
+				var formatErr *FormatError
+				if !errors.As(err, &formatErr) {
+					t.Fatalf("got %T error %v, want *FormatError", err, err)
+				}
+				if formatErr.Output != string(output) {
+					t.Errorf("FormatError does not carry the command output")
+				}
+				got.Error = formatErr.Reason
+			} else {
+				got.Result = result
+			}
+			gotJSON, err := json.MarshalIndent(got, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotJSON = append(gotJSON, '\n')
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, gotJSON, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if string(gotJSON) != string(want) {
+				t.Errorf("parsed %s:\n%s\nwant:\n%s", sample, gotJSON, want)
+			}
+		})
+	}
+}
+
+func TestUploadFileRejectsUnrecognizedOutput(t *testing.T) {
+	for _, output := range []string{
+		"",
+		"Error: failed to upload piece\n",
+		"Uploading file: 100%\nbafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi\n",
+	} {
+		result, err := UploadFile(output)
+		var formatErr *FormatError
+		if !errors.As(err, &formatErr) {
+			t.Errorf("UploadFile(%q) = %+v, %v; want a *FormatError", output, result, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package secret manages the ECDSA key the server uses to authenticate with
+// PDP services. The key is generated or imported once, kept encrypted at
+// rest and can be rotated in two steps so the new public key can be
+// registered with the provider before requests are signed with it.
+package secret
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Key is a service key together with its lifecycle timestamps.
+type Key struct {
+	Private     *ecdsa.PrivateKey
+	CreatedAt   time.Time
+	ActivatedAt *time.Time
+}
+
+// KeyInfo is the public view of a Key.
+type KeyInfo struct {
+	Fingerprint string     `json:"fingerprint"`
+	PublicKey   string     `json:"publicKey"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ActivatedAt *time.Time `json:"activatedAt,omitempty"`
+}
+
+// serviceSecretFile mirrors the pdpservice.json file written by
+// `pdptool create-service-secret`.
+type serviceSecretFile struct {
+	PrivateKey string `json:"private_key"`
+}
+
+func generateKey() (*Key, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate service key: %w", err)
+	}
+	return &Key{Private: private, CreatedAt: time.Now()}, nil
+}
+
+// Info returns the public key and fingerprint of k.
+func (k *Key) Info() KeyInfo {
+	publicPEM, fingerprint := publicKey(k.Private)
+	return KeyInfo{
+		Fingerprint: fingerprint,
+		PublicKey:   publicPEM,
+		CreatedAt:   k.CreatedAt,
+		ActivatedAt: k.ActivatedAt,
+	}
+}
+
+func publicKey(key *ecdsa.PrivateKey) (string, string) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", ""
+	}
+	sum := sha256.Sum256(der)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), hex.EncodeToString(sum[:8])
+}
+
+// MarshalPrivateKey PEM encodes key in SEC1 form, as pdptool does.
+func MarshalPrivateKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParsePrivateKey decodes a PEM encoded ECDSA private key in either PKCS8 or
+// SEC1 form.
+func ParsePrivateKey(pemData []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM private key")
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service secret is not an ECDSA key")
+	}
+	return key, nil
+}
+
+// LoadServiceSecret reads the ECDSA service key from a pdpservice.json file.
+func LoadServiceSecret(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service secret: %w", err)
+	}
+
+	var secret serviceSecretFile
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse service secret: %w", err)
+	}
+	if secret.PrivateKey == "" {
+		return nil, errors.New("service secret does not contain a private_key")
+	}
+	return ParsePrivateKey([]byte(secret.PrivateKey))
+}
+
+// WriteServiceSecret atomically writes key to path in the pdpservice.json
+// format, readable only by the current user.
+func WriteServiceSecret(path string, key *ecdsa.PrivateKey) error {
+	encoded, err := MarshalPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode service secret: %w", err)
+	}
+	data, err := json.Marshal(serviceSecretFile{PrivateKey: encoded})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,168 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	kdfScrypt  = "scrypt"
+	kdfKeyFile = "keyfile"
+
+	sealKeySize = 32
+	saltSize    = 16
+)
+
+// envelope is the on-disk form of the keystore.
+type envelope struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// sealer derives the keystore encryption key from either a passphrase or a
+// local keyfile.
+type sealer struct {
+	passphrase string
+	keyFile    string
+}
+
+func (s sealer) kdf() string {
+	if s.passphrase != "" {
+		return kdfScrypt
+	}
+	return kdfKeyFile
+}
+
+func (s sealer) key(kdf string, salt []byte) ([]byte, error) {
+	switch kdf {
+	case kdfScrypt:
+		if s.passphrase == "" {
+			return nil, errors.New("keystore is passphrase protected but no passphrase is configured")
+		}
+		return scrypt.Key([]byte(s.passphrase), salt, 1<<15, 8, 1, sealKeySize)
+	case kdfKeyFile:
+		return s.loadKeyFile()
+	default:
+		return nil, fmt.Errorf("unsupported keystore kdf %q", kdf)
+	}
+}
+
+// loadKeyFile reads the hex encoded keyfile, creating it on first use.
+func (s sealer) loadKeyFile() ([]byte, error) {
+	if s.keyFile == "" {
+		return nil, errors.New("neither a keystore passphrase nor a keyfile is configured")
+	}
+
+	data, err := os.ReadFile(s.keyFile)
+	if os.IsNotExist(err) {
+		key := make([]byte, sealKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(s.keyFile), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(s.keyFile, []byte(hex.EncodeToString(key)), 0600); err != nil {
+			return nil, fmt.Errorf("failed to create keyfile: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != sealKeySize {
+		return nil, fmt.Errorf("keyfile %s must contain %d hex encoded bytes", s.keyFile, sealKeySize)
+	}
+	return key, nil
+}
+
+func (s sealer) seal(plaintext []byte) (*envelope, error) {
+	env := &envelope{Version: 1, KDF: s.kdf()}
+	if env.KDF == kdfScrypt {
+		env.Salt = make([]byte, saltSize)
+		if _, err := rand.Read(env.Salt); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := s.key(env.KDF, env.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return nil, err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, plaintext, []byte(env.KDF))
+	return env, nil
+}
+
+func (s sealer) open(env *envelope) ([]byte, error) {
+	if env.Version != 1 {
+		return nil, fmt.Errorf("unsupported keystore version %d", env.Version)
+	}
+	key, err := s.key(env.KDF, env.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(env.KDF))
+	if err != nil {
+		return nil, errors.New("failed to decrypt keystore: wrong passphrase or keyfile")
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
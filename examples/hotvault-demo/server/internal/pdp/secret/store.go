@@ -0,0 +1,315 @@
+package secret
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hotvault/backend/pkg/logger"
+)
+
+// ErrNoPendingKey is returned by Promote when Rotate has not been called.
+var ErrNoPendingKey = errors.New("no pending service key to promote")
+
+// Options configures where the keystore lives and how it is protected.
+type Options struct {
+	// StorePath is the encrypted keystore file.
+	StorePath string
+	// Passphrase protects the keystore. When empty KeyFile is used instead.
+	Passphrase string
+	// KeyFile holds a random keystore encryption key and is created on
+	// first use.
+	KeyFile string
+	// ImportPath is a plaintext pdpservice.json imported when the keystore
+	// does not exist yet.
+	ImportPath string
+	// ExportPath, when set, receives a plaintext pdpservice.json with the
+	// active key for tools that can only read it from disk (pdptool).
+	ExportPath string
+}
+
+// Status lists the keys held by the store.
+type Status struct {
+	Active   KeyInfo  `json:"active"`
+	Pending  *KeyInfo `json:"pending,omitempty"`
+	Previous *KeyInfo `json:"previous,omitempty"`
+}
+
+type storedKey struct {
+	PrivateKey  string     `json:"private_key"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+}
+
+type keystore struct {
+	Active   *storedKey `json:"active"`
+	Pending  *storedKey `json:"pending,omitempty"`
+	Previous *storedKey `json:"previous,omitempty"`
+}
+
+// Store holds the active service key and, during a rotation, the pending
+// key that replaces it.
+type Store struct {
+	mu       sync.RWMutex
+	opts     Options
+	sealer   sealer
+	active   *Key
+	pending  *Key
+	previous *Key
+	log      logger.Logger
+}
+
+// Open loads the keystore, importing or generating the service key if it does
+// not exist yet.
+func Open(opts Options) (*Store, error) {
+	if opts.StorePath == "" {
+		return nil, errors.New("service secret store path not configured")
+	}
+
+	s := &Store{
+		opts:   opts,
+		sealer: sealer{passphrase: opts.Passphrase, keyFile: opts.KeyFile},
+		log:    logger.NewLogger(),
+	}
+
+	if _, err := os.Stat(opts.StorePath); err == nil {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		s.log.WithField("path", opts.StorePath).
+			WithField("fingerprint", s.active.Info().Fingerprint).
+			Info("Loaded service secret from keystore")
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to access keystore: %w", err)
+	} else if err := s.initialize(); err != nil {
+		return nil, err
+	}
+
+	if err := s.export(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) initialize() error {
+	var key *Key
+	if s.opts.ImportPath != "" {
+		private, err := LoadServiceSecret(s.opts.ImportPath)
+		switch {
+		case err == nil:
+			key = &Key{Private: private, CreatedAt: time.Now()}
+			s.log.WithField("path", s.opts.ImportPath).Info("Imported existing service secret into keystore")
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+	}
+	if key == nil {
+		generated, err := generateKey()
+		if err != nil {
+			return err
+		}
+		key = generated
+		s.log.Info("Generated new service secret")
+	}
+
+	now := time.Now()
+	key.ActivatedAt = &now
+	s.active = key
+	if err := s.save(); err != nil {
+		return err
+	}
+
+	info := key.Info()
+	s.log.WithField("path", s.opts.StorePath).
+		WithField("fingerprint", info.Fingerprint).
+		Info("Service secret stored; register its public key with the PDP provider")
+	return nil
+}
+
+// SigningKey returns the key requests should currently be signed with.
+func (s *Store) SigningKey() *ecdsa.PrivateKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active.Private
+}
+
+func (s *Store) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := Status{Active: s.active.Info()}
+	if s.pending != nil {
+		info := s.pending.Info()
+		status.Pending = &info
+	}
+	if s.previous != nil {
+		info := s.previous.Info()
+		status.Previous = &info
+	}
+	return status
+}
+
+// Rotate generates a pending key. Requests keep being signed with the active
+// key until Promote is called, so the pending public key can be registered
+// with the provider first. Calling Rotate again replaces the pending key.
+func (s *Store) Rotate() (*KeyInfo, error) {
+	key, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replaced := s.pending
+	s.pending = key
+	if err := s.save(); err != nil {
+		s.pending = replaced
+		return nil, err
+	}
+
+	info := key.Info()
+	s.log.WithField("fingerprint", info.Fingerprint).Info("Generated pending service secret")
+	return &info, nil
+}
+
+// Promote makes the pending key active. The replaced key is kept as the
+// previous key until the next promotion.
+func (s *Store) Promote() (*KeyInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil {
+		return nil, ErrNoPendingKey
+	}
+
+	active, pending, previous := s.active, s.pending, s.previous
+	now := time.Now()
+	s.pending.ActivatedAt = &now
+	s.previous = s.active
+	s.active = s.pending
+	s.pending = nil
+
+	if err := s.save(); err != nil {
+		s.active, s.pending, s.previous = active, pending, previous
+		pending.ActivatedAt = nil
+		return nil, err
+	}
+	if err := s.exportLocked(); err != nil {
+		return nil, err
+	}
+
+	info := s.active.Info()
+	s.log.WithField("fingerprint", info.Fingerprint).
+		WithField("previousFingerprint", s.previous.Info().Fingerprint).
+		Info("Promoted pending service secret")
+	return &info, nil
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.opts.StorePath)
+	if err != nil {
+		return fmt.Errorf("failed to read keystore: %w", err)
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	plaintext, err := s.sealer.open(&env)
+	if err != nil {
+		return err
+	}
+
+	var ks keystore
+	if err := json.Unmarshal(plaintext, &ks); err != nil {
+		return fmt.Errorf("failed to parse keystore contents: %w", err)
+	}
+	if ks.Active == nil {
+		return errors.New("keystore has no active service key")
+	}
+
+	if s.active, err = ks.Active.key(); err != nil {
+		return err
+	}
+	if s.pending, err = ks.Pending.key(); err != nil {
+		return err
+	}
+	if s.previous, err = ks.Previous.key(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// save encrypts the keystore and replaces the file on disk. Callers hold mu.
+func (s *Store) save() error {
+	var ks keystore
+	var err error
+	if ks.Active, err = storeKey(s.active); err != nil {
+		return err
+	}
+	if ks.Pending, err = storeKey(s.pending); err != nil {
+		return err
+	}
+	if ks.Previous, err = storeKey(s.previous); err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(ks)
+	if err != nil {
+		return err
+	}
+	env, err := s.sealer.seal(plaintext)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.opts.StorePath, data); err != nil {
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) export() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.exportLocked()
+}
+
+func (s *Store) exportLocked() error {
+	if s.opts.ExportPath == "" {
+		return nil
+	}
+	if err := WriteServiceSecret(s.opts.ExportPath, s.active.Private); err != nil {
+		return fmt.Errorf("failed to export service secret: %w", err)
+	}
+	return nil
+}
+
+func storeKey(k *Key) (*storedKey, error) {
+	if k == nil {
+		return nil, nil
+	}
+	encoded, err := MarshalPrivateKey(k.Private)
+	if err != nil {
+		return nil, err
+	}
+	return &storedKey{PrivateKey: encoded, CreatedAt: k.CreatedAt, ActivatedAt: k.ActivatedAt}, nil
+}
+
+func (sk *storedKey) key() (*Key, error) {
+	if sk == nil {
+		return nil, nil
+	}
+	private, err := ParsePrivateKey([]byte(sk.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &Key{Private: private, CreatedAt: sk.CreatedAt, ActivatedAt: sk.ActivatedAt}, nil
+}
@@ -0,0 +1,140 @@
+package sigv4
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkSize bounds a single aws-chunked chunk, which is buffered until
+// its signature has been checked.
+const maxChunkSize = 64 << 20
+
+// Body returns the payload of a signed request: the body checked against
+// the signed digest, or decoded from aws-chunked encoding with each chunk
+// signature verified. Reads fail with ErrContentSHA256Mismatch,
+// ErrSignatureMismatch or ErrMalformedChunk when the body doesn't match
+// its signature.
+func (s *Signature) Body(body io.Reader) (io.Reader, error) {
+	switch s.PayloadHash {
+	case UnsignedPayload:
+		return body, nil
+	case StreamingPayload:
+		return &chunkedReader{r: bufio.NewReader(body), sig: s, previous: s.Value}, nil
+	case StreamingUnsignedTrailer:
+		return &chunkedReader{r: bufio.NewReader(body), trailer: true}, nil
+	}
+
+	if len(s.PayloadHash) != sha256.Size*2 {
+		return nil, ErrUnsupportedPayload
+	}
+	if _, err := hex.DecodeString(s.PayloadHash); err != nil {
+		return nil, ErrUnsupportedPayload
+	}
+	return &hashingReader{r: body, hash: sha256.New(), want: strings.ToLower(s.PayloadHash)}, nil
+}
+
+// hashingReader fails at EOF if what it read doesn't hash to want.
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.want {
+		return n, ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body. sig is nil for unsigned
+// chunks.
+type chunkedReader struct {
+	r        *bufio.Reader
+	sig      *Signature
+	previous string
+	trailer  bool
+	chunk    []byte
+	err      error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.chunk, c.err = c.next()
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads the next chunk, returning io.EOF after the final one.
+func (c *chunkedReader) next() ([]byte, error) {
+	header, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	sizeHex, params, _ := strings.Cut(header, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return nil, fmt.Errorf("%w: invalid chunk size", ErrMalformedChunk)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedChunk, err)
+	}
+
+	if c.sig != nil {
+		signature := strings.TrimPrefix(params, "chunk-signature=")
+		expected := c.sig.chunkSignature(c.previous, data)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil, ErrSignatureMismatch
+		}
+		c.previous = signature
+	}
+
+	if size == 0 && c.trailer {
+		// Trailing headers, e.g. x-amz-checksum-*, end with an empty line.
+		for {
+			line, err := c.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if line == "" {
+				return nil, io.EOF
+			}
+		}
+	}
+
+	if line, err := c.readLine(); err != nil || line != "" {
+		return nil, fmt.Errorf("%w: missing chunk terminator", ErrMalformedChunk)
+	}
+	if size == 0 {
+		return nil, io.EOF
+	}
+	return data, nil
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", fmt.Errorf("%w: %v", ErrMalformedChunk, err)
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
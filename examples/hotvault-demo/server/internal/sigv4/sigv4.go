@@ -0,0 +1,326 @@
+// Package sigv4 verifies requests signed with AWS Signature Version 4 the
+// way S3 does: from the Authorization header or a presigned URL, with the
+// payload signed, unsigned or sent in aws-chunked encoding.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Algorithm = "AWS4-HMAC-SHA256"
+
+	// Values of x-amz-content-sha256 besides the hex digest of the body.
+	UnsignedPayload          = "UNSIGNED-PAYLOAD"
+	StreamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	service          = "s3"
+	terminator       = "aws4_request"
+	timeFormat       = "20060102T150405Z"
+	dateFormat       = "20060102"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	ErrMissingAuth           = errors.New("request is not signed")
+	ErrUnsupportedAlgorithm  = errors.New("unsupported signature algorithm")
+	ErrMalformedAuth         = errors.New("malformed authorization")
+	ErrInvalidAccessKey      = errors.New("access key does not exist")
+	ErrSignatureMismatch     = errors.New("signature does not match")
+	ErrRequestTimeSkewed     = errors.New("request time is too far from the server time")
+	ErrRequestExpired        = errors.New("presigned request has expired")
+	ErrUnsupportedPayload    = errors.New("unsupported x-amz-content-sha256")
+	ErrContentSHA256Mismatch = errors.New("body does not match x-amz-content-sha256")
+	ErrMalformedChunk        = errors.New("malformed aws-chunked body")
+)
+
+// SecretLookup returns the secret key of an access key, or
+// ErrInvalidAccessKey if there is no such key.
+type SecretLookup func(accessKeyID string) (string, error)
+
+// Signature is a verified request signature.
+type Signature struct {
+	AccessKeyID string
+	Region      string
+	// PayloadHash is the x-amz-content-sha256 the body must match.
+	PayloadHash string
+	Time        time.Time
+	Value       string
+
+	scope      string
+	signingKey []byte
+}
+
+// Verify checks the signature of r against the secret of its access key.
+func Verify(r *http.Request, lookup SecretLookup, now time.Time) (*Signature, error) {
+	auth := r.Header.Get("Authorization")
+	query := r.URL.Query()
+	switch {
+	case strings.HasPrefix(auth, Algorithm+" "):
+		return verifyHeader(r, auth, lookup, now)
+	case query.Get("X-Amz-Algorithm") == Algorithm:
+		return verifyPresigned(r, query, lookup, now)
+	case auth != "" || query.Get("X-Amz-Algorithm") != "":
+		return nil, ErrUnsupportedAlgorithm
+	default:
+		return nil, ErrMissingAuth
+	}
+}
+
+func verifyHeader(r *http.Request, auth string, lookup SecretLookup, now time.Time) (*Signature, error) {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, Algorithm+" "), ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, ErrMalformedAuth
+		}
+		fields[key] = value
+	}
+	credential, signedHeaders, signature := fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return nil, ErrMalformedAuth
+	}
+
+	requestTime, err := requestTime(r.Header.Get("X-Amz-Date"), r.Header.Get("Date"))
+	if err != nil {
+		return nil, err
+	}
+	if requestTime.Sub(now) > maxClockSkew || now.Sub(requestTime) > maxClockSkew {
+		return nil, ErrRequestTimeSkewed
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, fmt.Errorf("%w: missing x-amz-content-sha256", ErrMalformedAuth)
+	}
+
+	sig, err := newSignature(credential, requestTime, payloadHash, lookup)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := canonicalRequest(r, r.URL.Query(), signedHeaders, payloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return sig.check(canonical, signature)
+}
+
+func verifyPresigned(r *http.Request, query url.Values, lookup SecretLookup, now time.Time) (*Signature, error) {
+	credential := query.Get("X-Amz-Credential")
+	signedHeaders := query.Get("X-Amz-SignedHeaders")
+	signature := query.Get("X-Amz-Signature")
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return nil, ErrMalformedAuth
+	}
+
+	requestTime, err := time.Parse(timeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid X-Amz-Date", ErrMalformedAuth)
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return nil, fmt.Errorf("%w: invalid X-Amz-Expires", ErrMalformedAuth)
+	}
+	if requestTime.Sub(now) > maxClockSkew {
+		return nil, ErrRequestTimeSkewed
+	}
+	if now.After(requestTime.Add(time.Duration(expires) * time.Second)) {
+		return nil, ErrRequestExpired
+	}
+
+	payloadHash := query.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = UnsignedPayload
+	}
+
+	sig, err := newSignature(credential, requestTime, payloadHash, lookup)
+	if err != nil {
+		return nil, err
+	}
+	signedQuery := url.Values{}
+	for key, values := range query {
+		if key != "X-Amz-Signature" {
+			signedQuery[key] = values
+		}
+	}
+	canonical, err := canonicalRequest(r, signedQuery, signedHeaders, payloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return sig.check(canonical, signature)
+}
+
+// newSignature parses a credential scope and derives its signing key.
+func newSignature(credential string, requestTime time.Time, payloadHash string, lookup SecretLookup) (*Signature, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] == "" || parts[3] != service || parts[4] != terminator {
+		return nil, fmt.Errorf("%w: invalid credential scope", ErrMalformedAuth)
+	}
+	if parts[1] != requestTime.Format(dateFormat) {
+		return nil, fmt.Errorf("%w: credential date does not match the request date", ErrMalformedAuth)
+	}
+
+	secret, err := lookup(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key := hmacSHA256([]byte("AWS4"+secret), parts[1])
+	for _, part := range parts[2:] {
+		key = hmacSHA256(key, part)
+	}
+	return &Signature{
+		AccessKeyID: parts[0],
+		Region:      parts[2],
+		PayloadHash: payloadHash,
+		Time:        requestTime,
+		scope:       strings.Join(parts[1:], "/"),
+		signingKey:  key,
+	}, nil
+}
+
+// check compares the signature of a canonical request with the one sent.
+func (s *Signature) check(canonical, signature string) (*Signature, error) {
+	stringToSign := strings.Join([]string{
+		Algorithm,
+		s.Time.Format(timeFormat),
+		s.scope,
+		hashHex([]byte(canonical)),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(s.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrSignatureMismatch
+	}
+	s.Value = signature
+	return s, nil
+}
+
+// chunkSignature returns the signature of an aws-chunked chunk following
+// the chunk signed with previous.
+func (s *Signature) chunkSignature(previous string, data []byte) string {
+	stringToSign := strings.Join([]string{
+		Algorithm + "-PAYLOAD",
+		s.Time.Format(timeFormat),
+		s.scope,
+		previous,
+		emptySHA256,
+		hashHex(data),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(s.signingKey, stringToSign))
+}
+
+func requestTime(amzDate, date string) (time.Time, error) {
+	if amzDate != "" {
+		t, err := time.Parse(timeFormat, amzDate)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: invalid X-Amz-Date", ErrMalformedAuth)
+		}
+		return t, nil
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: missing request date", ErrMalformedAuth)
+	}
+	return t.UTC(), nil
+}
+
+func canonicalRequest(r *http.Request, query url.Values, signedHeaders, payloadHash string) (string, error) {
+	headers := strings.Split(signedHeaders, ";")
+	hasHost := false
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		if name == "" || name != strings.ToLower(name) {
+			return "", fmt.Errorf("%w: invalid SignedHeaders", ErrMalformedAuth)
+		}
+		var values []string
+		switch name {
+		case "host":
+			hasHost = true
+			values = []string{r.Host}
+		case "content-length":
+			values = r.Header.Values(name)
+			if len(values) == 0 && r.ContentLength >= 0 {
+				values = []string{strconv.FormatInt(r.ContentLength, 10)}
+			}
+		case "transfer-encoding":
+			values = r.TransferEncoding
+		default:
+			values = r.Header.Values(name)
+		}
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	if !hasHost {
+		return "", fmt.Errorf("%w: host must be signed", ErrMalformedAuth)
+	}
+
+	path := uriEncode(r.URL.Path, false)
+	if path == "" {
+		path = "/"
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		path,
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), nil
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, and
+// '/' unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}